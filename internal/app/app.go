@@ -0,0 +1,238 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// App carries the state shared by the HTTP handlers. Every handler and
+// middleware is a method on App, so several isolated instances can live in
+// one process.
+type App struct {
+	Config Config
+	Stores
+	// Keys signs and verifies access tokens.
+	Keys *KeyRing
+	// Passwords hashes new passwords.
+	Passwords PasswordHasher
+	// Clock tells the time for logins, tokens and one-time codes. It is
+	// time.Now unless a test fixes it.
+	Clock func() time.Time
+
+	// dummyHash is what the passwords of unknown usernames are checked
+	// against; see checkPassword.
+	dummyHash struct {
+		once sync.Once
+		hash string
+	}
+	closers []io.Closer
+}
+
+// New returns an App that signs tokens with cfg.JWTSecret alone; Open also
+// loads the key files in cfg.JWTKeys. An invalid password hasher setting
+// falls back to the default hasher here and is an error in Open.
+func New(cfg Config, stores Stores) *App {
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = DefaultAccessTokenTTL
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	if cfg.JWTIssuer == "" {
+		cfg.JWTIssuer = DefaultJWTIssuer
+	}
+	if cfg.JWTAudience == "" {
+		cfg.JWTAudience = DefaultJWTAudience
+	}
+	if cfg.TwoFactorIssuer == "" {
+		cfg.TwoFactorIssuer = DefaultTwoFactorIssuer
+	}
+	if cfg.TwoFactorChallengeTTL <= 0 {
+		cfg.TwoFactorChallengeTTL = DefaultTwoFactorChallengeTTL
+	}
+	if cfg.LoginLockout <= 0 {
+		cfg.LoginLockout = DefaultLoginLockout
+	}
+	if cfg.LoginFailureWindow <= 0 {
+		cfg.LoginFailureWindow = DefaultLoginFailureWindow
+	}
+	keys, _ := NewKeyRing([]SigningKey{NewSecretKey(DefaultKeyID, []byte(cfg.JWTSecret))}, DefaultKeyID)
+	passwords, err := NewPasswordHasher(cfg)
+	if err != nil {
+		passwords, _ = NewPasswordHasher(Config{})
+	}
+	return &App{
+		Config:    cfg,
+		Stores:    stores,
+		Keys:      keys,
+		Passwords: passwords,
+		Clock:     time.Now,
+	}
+}
+
+// now is the Clock's time in UTC.
+func (a *App) now() time.Time {
+	return a.Clock().UTC()
+}
+
+// NewInMemory returns an App backed by fresh in-memory stores, picking the
+// todo store that matches cfg.ConcurrencyMode.
+func NewInMemory(cfg Config) *App {
+	return New(cfg, NewMemoryStores(cfg.ConcurrencyMode))
+}
+
+// NewMemoryStores returns fresh in-memory stores that share one change feed.
+// Only in RacyMode is the todo store the unsynchronised RacyTodoStore,
+// whose changes may be recorded out of order.
+func NewMemoryStores(mode string) Stores {
+	changes := NewMemoryChangeLog()
+	users := NewMemoryUserStore()
+	users.changes = changes
+
+	revisions := NewMemoryRevisionStore()
+	users.revisions = revisions
+
+	var todos TodoStore
+	if mode == RacyMode {
+		racy := NewRacyTodoStore()
+		racy.changes = changes
+		racy.revisions = revisions
+		todos = racy
+	} else {
+		safe := NewMemoryTodoStore()
+		safe.changes = changes
+		safe.revisions = revisions
+		todos = safe
+	}
+
+	return Stores{
+		Users:          users,
+		Todos:          todos,
+		Revisions:      revisions,
+		Changes:        changes,
+		Tokens:         NewMemoryTokenStore(),
+		Revocations:    NewMemoryRevocationList(),
+		Attempts:       NewMemoryLoginAttempts(),
+		PersonalTokens: NewMemoryPersonalTokens(),
+		Exporter:       memoryExporter{users, todos, revisions},
+	}
+}
+
+// memoryExporter reads each user's todos from one snapshot of their list.
+// Writes to different users are not ordered, so there is no wider point in
+// time to capture.
+type memoryExporter struct {
+	users     *MemoryUserStore
+	todos     TodoStore
+	revisions *MemoryRevisionStore
+}
+
+func (e memoryExporter) Export() (Dataset, error) {
+	d := newDataset()
+	d.Users, _ = e.users.List()
+	for _, user := range d.Users {
+		todos, err := e.todos.List(user.Username)
+		if err != nil {
+			return Dataset{}, err
+		}
+		if len(todos) > 0 {
+			d.Todos[user.Username] = todos
+		}
+	}
+	e.revisions.forEach(func(username string, revs []Revision) {
+		d.Revisions[username] = revs
+	})
+	return d, nil
+}
+
+// Open returns an App backed by the storage named in cfg.Storage, signing
+// with the keys LoadKeyRing reads from cfg. Call Close when done so durable
+// backends can flush and release their files.
+func Open(cfg Config) (*App, error) {
+	if _, err := NewPasswordHasher(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.TodoCacheBytes > 0 && cfg.Storage != StorageSQLite {
+		return nil, fmt.Errorf("the todo cache needs sqlite storage, not %q", cfg.Storage)
+	}
+	var keys *KeyRing
+	if cfg.JWTSecret != "" || len(cfg.JWTKeys) > 0 {
+		var err error
+		if keys, err = LoadKeyRing(cfg); err != nil {
+			return nil, err
+		}
+	}
+	a, err := openStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		a.Keys = keys
+	}
+	return a, nil
+}
+
+func openStorage(cfg Config) (*App, error) {
+	switch cfg.Storage {
+	case "", StorageMemory:
+		return NewInMemory(cfg), nil
+	case StorageFile:
+		fs, err := OpenFileStore(cfg.DataDir, FileOptions{
+			SnapshotEvery:  cfg.SnapshotEvery,
+			CommitMaxDelay: cfg.CommitMaxDelay,
+			CommitMaxBatch: cfg.CommitMaxBatch,
+		})
+		if err != nil {
+			return nil, err
+		}
+		a := New(cfg, fs.Stores())
+		a.closers = append(a.closers, fs)
+		return a, nil
+	case StorageSQLite:
+		db, err := OpenSQLiteStore(cfg.SQLitePath, cfg.MigrateOnStart)
+		if err != nil {
+			return nil, err
+		}
+		stores := db.Stores()
+		if cfg.TodoCacheBytes > 0 {
+			stores.Todos = NewCachedTodoStore(stores.Todos, int64(cfg.TodoCacheBytes))
+		}
+		a := New(cfg, stores)
+		a.closers = append(a.closers, db)
+		return a, nil
+	case StorageRaft:
+		peers, err := ParseRaftPeers(cfg.RaftPeers)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := OpenRaftStore(RaftConfig{
+			NodeID: cfg.RaftNodeID,
+			Addr:   cfg.RaftAddr,
+			Peers:  peers,
+			Dir:    filepath.Join(cfg.DataDir, "raft"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		a := New(cfg, rs.Stores())
+		a.closers = append(a.closers, rs)
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+}
+
+// Close releases the resources held by the App's storage backends.
+func (a *App) Close() error {
+	var errs []error
+	for _, c := range a.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Backups are JSON lines: a header naming the format and its version, one
+// line per user, todo and revision, and a trailer with the counts. Restore
+// rejects an archive without a matching trailer, so a truncated download is
+// never half loaded.
+const (
+	BackupFormat = "todoapp-backup"
+	// BackupVersion is the archive version this binary writes and the
+	// newest it can read.
+	BackupVersion = 1
+)
+
+// ErrRestoreTargetNotEmpty is returned when restoring into a store that
+// already has users.
+var ErrRestoreTargetNotEmpty = errors.New("restore target already holds users")
+
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// backupLine is one line after the header. Exactly one of User, Todo,
+// Revision and End is set; todos and revisions name their owner.
+type backupLine struct {
+	Username string         `json:"username,omitempty"`
+	User     *User          `json:"user,omitempty"`
+	Todo     *Todo          `json:"todo,omitempty"`
+	Revision *Revision      `json:"revision,omitempty"`
+	End      *BackupSummary `json:"end,omitempty"`
+}
+
+// BackupSummary counts what an archive holds.
+type BackupSummary struct {
+	Users     int `json:"users"`
+	Todos     int `json:"todos"`
+	Revisions int `json:"revisions"`
+}
+
+// WriteBackup writes d to w as an archive created at now. Users come first,
+// then each user's todos and revisions in username order.
+func WriteBackup(w io.Writer, d Dataset, now time.Time) (BackupSummary, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var sum BackupSummary
+
+	if err := enc.Encode(backupHeader{Format: BackupFormat, Version: BackupVersion, CreatedAt: now.UTC()}); err != nil {
+		return sum, err
+	}
+	for _, user := range d.Users {
+		if err := enc.Encode(backupLine{User: &user}); err != nil {
+			return sum, err
+		}
+		sum.Users++
+	}
+	for _, username := range slices.Sorted(maps.Keys(d.Todos)) {
+		for _, todo := range d.Todos[username] {
+			if err := enc.Encode(backupLine{Username: username, Todo: &todo}); err != nil {
+				return sum, err
+			}
+			sum.Todos++
+		}
+	}
+	for _, username := range slices.Sorted(maps.Keys(d.Revisions)) {
+		for _, rev := range d.Revisions[username] {
+			if err := enc.Encode(backupLine{Username: username, Revision: &rev}); err != nil {
+				return sum, err
+			}
+			sum.Revisions++
+		}
+	}
+	if err := enc.Encode(backupLine{End: &sum}); err != nil {
+		return sum, err
+	}
+	return sum, bw.Flush()
+}
+
+// ReadBackup parses an archive written by WriteBackup.
+func ReadBackup(r io.Reader) (Dataset, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return Dataset{}, fmt.Errorf("read backup header: %w", err)
+	}
+	if header.Format != BackupFormat {
+		return Dataset{}, fmt.Errorf("not a %s archive", BackupFormat)
+	}
+	if header.Version < 1 || header.Version > BackupVersion {
+		return Dataset{}, fmt.Errorf("backup version %d is not supported, this binary reads up to %d", header.Version, BackupVersion)
+	}
+
+	d := newDataset()
+	var sum BackupSummary
+	for {
+		var line backupLine
+		if err := dec.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) {
+				return Dataset{}, errors.New("backup is truncated: no end record")
+			}
+			return Dataset{}, fmt.Errorf("read backup: %w", err)
+		}
+		switch {
+		case line.User != nil:
+			d.Users = append(d.Users, *line.User)
+			sum.Users++
+		case line.Todo != nil:
+			d.Todos[line.Username] = append(d.Todos[line.Username], *line.Todo)
+			sum.Todos++
+		case line.Revision != nil:
+			d.Revisions[line.Username] = append(d.Revisions[line.Username], *line.Revision)
+			sum.Revisions++
+		case line.End != nil:
+			if *line.End != sum {
+				return Dataset{}, fmt.Errorf("backup is incomplete: end record counts %+v, read %+v", *line.End, sum)
+			}
+			return d, nil
+		default:
+			return Dataset{}, errors.New("read backup: empty record")
+		}
+	}
+}
+
+// RestoreBackup loads d into stores, which must not hold any users yet.
+// Every todo must belong to a user in d.
+func RestoreBackup(stores Stores, d Dataset) (BackupSummary, error) {
+	var sum BackupSummary
+	existing, err := stores.Users.List()
+	if err != nil {
+		return sum, err
+	}
+	if len(existing) > 0 {
+		return sum, ErrRestoreTargetNotEmpty
+	}
+
+	known := make(map[string]bool, len(d.Users))
+	for _, user := range d.Users {
+		known[user.Username] = true
+	}
+	for username := range d.Todos {
+		if !known[username] {
+			return sum, fmt.Errorf("backup has todos for unknown user %q", username)
+		}
+	}
+
+	for _, user := range d.Users {
+		if err := stores.Users.Create(user); err != nil {
+			return sum, fmt.Errorf("restore user %q: %w", user.Username, err)
+		}
+		sum.Users++
+	}
+	for _, username := range slices.Sorted(maps.Keys(d.Todos)) {
+		for _, todo := range d.Todos[username] {
+			if err := stores.Todos.Create(username, todo); err != nil {
+				return sum, fmt.Errorf("restore todo %s of %q: %w", todo.ID, username, err)
+			}
+			sum.Todos++
+		}
+	}
+	for _, username := range slices.Sorted(maps.Keys(d.Revisions)) {
+		for _, rev := range d.Revisions[username] {
+			if err := stores.Revisions.Append(username, rev); err != nil {
+				return sum, fmt.Errorf("restore revision %d of todo %s: %w", rev.Revision, rev.TodoID, err)
+			}
+			sum.Revisions++
+		}
+	}
+	return sum, nil
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupIsAdminOnlyAndRestoresIntoEveryBackend(t *testing.T) {
+	cfg := Config{JWTSecret: "testsecret_backup", ConcurrencyMode: SafeMode, AdminUsers: []string{"root"}}
+	r := SetupRouter(newTestApp(t, cfg))
+	root := registerAndLogin(t, r, "root", "pass")
+	alice := registerAndLogin(t, r, "alice", "pass")
+
+	var kept, trashed Todo
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "kept"}, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &kept)
+	w = performRequest(r, "POST", "/todos", map[string]string{"title": "trashed"}, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &trashed)
+	title := "kept, edited"
+	performRequest(r, "PUT", "/todos/"+kept.ID, UpdateTodoRequest{Title: &title}, alice)
+	performRequest(r, "DELETE", "/todos/"+trashed.ID, nil, alice)
+
+	if w := performRequest(r, "POST", "/admin/backup", nil, alice); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a non-admin got %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/admin/backup", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token got %d", w.Code)
+	}
+	w = performRequest(r, "POST", "/admin/backup", nil, root)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Backup failed: %d %s", w.Code, w.Body.String())
+	}
+	archive := w.Body.Bytes()
+
+	for _, storage := range []string{StorageMemory, StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			target, err := Open(Config{
+				JWTSecret:       cfg.JWTSecret,
+				ConcurrencyMode: SafeMode,
+				Storage:         storage,
+				DataDir:         dir,
+				SQLitePath:      filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:  true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+
+			d, err := ReadBackup(bytes.NewReader(archive))
+			if err != nil {
+				t.Fatalf("Read backup: %v", err)
+			}
+			sum, err := RestoreBackup(target.Stores, d)
+			if err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			if sum != (BackupSummary{Users: 2, Todos: 2, Revisions: 1}) {
+				t.Fatalf("Unexpected restore summary %+v", sum)
+			}
+
+			// The restored password hash still logs alice in
+			tr := SetupRouter(target)
+			token := login(t, tr, "alice", "pass")
+			var todos []Todo
+			w := performRequest(tr, "GET", "/todos", nil, token)
+			_ = json.Unmarshal(w.Body.Bytes(), &todos)
+			if len(todos) != 1 || todos[0].Title != title || todos[0].Version != 2 {
+				t.Fatalf("Expected the edited todo back, got %s", w.Body.String())
+			}
+			var trash []Todo
+			w = performRequest(tr, "GET", "/trash", nil, token)
+			_ = json.Unmarshal(w.Body.Bytes(), &trash)
+			if len(trash) != 1 || trash[0].ID != trashed.ID {
+				t.Fatalf("Expected the trashed todo back in the trash, got %s", w.Body.String())
+			}
+			w = performRequest(tr, "GET", "/todos/"+kept.ID+"/history", nil, token)
+			if !strings.Contains(w.Body.String(), `"revision":2`) {
+				t.Fatalf("Expected the revision history back, got %s", w.Body.String())
+			}
+
+			if _, err := RestoreBackup(target.Stores, d); err != ErrRestoreTargetNotEmpty {
+				t.Fatalf("Expected ErrRestoreTargetNotEmpty got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadBackupRejectsDamagedArchives(t *testing.T) {
+	d := newDataset()
+	d.Users = []User{{Username: "alice", PasswordHash: "hash"}}
+	d.Todos["alice"] = []Todo{newTestTodo("a"), newTestTodo("b")}
+	var buf bytes.Buffer
+	if _, err := WriteBackup(&buf, d, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	cases := map[string]string{
+		"truncated":     strings.Join(lines[:len(lines)-2], ""),
+		"line dropped":  lines[0] + lines[1] + lines[3] + lines[4],
+		"newer version": strings.Replace(buf.String(), `"version":1`, `"version":99`, 1),
+		"not a backup":  `{"seq":1,"users":[]}`,
+	}
+	for name, archive := range cases {
+		if _, err := ReadBackup(strings.NewReader(archive)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := ReadBackup(&buf); err != nil {
+		t.Fatalf("Intact archive: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// changeNotifier wakes everyone waiting on Changed when a change is
+// recorded.
+type changeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (n *changeNotifier) Changed() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// todoChange describes a create or update of t.
+func todoChange(op, username string, t Todo) Change {
+	return Change{Op: op, Username: username, TodoID: t.ID, Todo: &t}
+}
+
+// todoTombstone describes the permanent removal of a todo.
+func todoTombstone(username, id string) Change {
+	return Change{Op: ChangeDelete, Username: username, TodoID: id}
+}
+
+// subscribeBatch is how many changes Subscribe reads from the feed at once.
+const subscribeBatch = 256
+
+// Subscribe streams every change after since, then keeps streaming new
+// changes as they are recorded, until ctx is cancelled or the feed fails. A
+// non-empty username keeps only that user's changes. The channel is closed
+// when the subscription ends.
+func Subscribe(ctx context.Context, feed ChangeFeed, username string, since uint64) <-chan Change {
+	out := make(chan Change)
+	go func() {
+		defer close(out)
+		for {
+			// Take the wake-up channel before reading so a change recorded
+			// in between is not missed.
+			changed := feed.Changed()
+			batch, err := feed.Since(since, username, subscribeBatch)
+			if err != nil {
+				return
+			}
+			for _, c := range batch {
+				select {
+				case out <- c:
+					since = c.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(batch) == subscribeBatch {
+				continue
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// MemoryChangeLog keeps the change feed in a slice ordered by sequence
+// number.
+type MemoryChangeLog struct {
+	notifier changeNotifier
+
+	mu      sync.RWMutex
+	changes []Change
+	last    uint64
+	floor   uint64 // newest pruned sequence number
+}
+
+func NewMemoryChangeLog() *MemoryChangeLog {
+	return &MemoryChangeLog{}
+}
+
+// record appends c, assigning the next sequence number unless c already has
+// one. A nil log records nothing, which lets stores run without a feed.
+func (l *MemoryChangeLog) record(c Change) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if c.Seq == 0 {
+		c.Seq = l.last + 1
+	}
+	if c.At.IsZero() {
+		c.At = time.Now().UTC()
+	}
+	l.changes = append(l.changes, c)
+	l.last = c.Seq
+	l.mu.Unlock()
+
+	l.notifier.notify()
+}
+
+func (l *MemoryChangeLog) Changed() <-chan struct{} {
+	return l.notifier.Changed()
+}
+
+func (l *MemoryChangeLog) Since(since uint64, username string, limit int) ([]Change, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if since < l.floor {
+		return nil, ErrChangesPruned
+	}
+	i := sort.Search(len(l.changes), func(i int) bool { return l.changes[i].Seq > since })
+	out := []Change{}
+	for ; i < len(l.changes) && len(out) < limit; i++ {
+		if username == "" || l.changes[i].Username == username {
+			out = append(out, l.changes[i])
+		}
+	}
+	return out, nil
+}
+
+func (l *MemoryChangeLog) Floor() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.floor, nil
+}
+
+// Prune removes the oldest changes, up to the first one recorded at or
+// after cutoff.
+func (l *MemoryChangeLog) Prune(cutoff time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.expired(cutoff)
+	if n > 0 {
+		l.floor = l.changes[n-1].Seq
+		l.changes = slices.Clone(l.changes[n:])
+	}
+	return n, nil
+}
+
+// prunable counts the changes Prune(cutoff) would remove, so the log based
+// stores can skip logging a prune that would remove nothing.
+func (l *MemoryChangeLog) prunable(cutoff time.Time) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.expired(cutoff)
+}
+
+// expired counts the changes before the first one recorded at or after
+// cutoff. Callers hold mu.
+func (l *MemoryChangeLog) expired(cutoff time.Time) int {
+	return sort.Search(len(l.changes), func(i int) bool { return !l.changes[i].At.Before(cutoff) })
+}
+
+// purge forgets every change of username, so a user registering the name
+// again does not see the old account's history. Sequence numbers are not
+// reused.
+func (l *MemoryChangeLog) purge(username string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = slices.DeleteFunc(l.changes, func(c Change) bool { return c.Username == username })
+}
+
+// all returns every recorded change.
+func (l *MemoryChangeLog) all() []Change {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Change{}, l.changes...)
+}
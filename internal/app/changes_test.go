@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type changesResponse struct {
+	Changes []Change `json:"changes"`
+	Next    uint64   `json:"next"`
+}
+
+func TestChangesFeedIsOrderedAndScopedToCaller(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_changes", ConcurrencyMode: SafeMode}))
+	alice := registerAndLogin(t, r, "alice", "pass")
+	bob := registerAndLogin(t, r, "bob", "pass")
+
+	var todo Todo
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "a"}, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &todo)
+	performRequest(r, "POST", "/todos", map[string]string{"title": "bob's"}, bob)
+	title := "b"
+	performRequest(r, "PUT", "/todos/"+todo.ID, UpdateTodoRequest{Title: &title}, alice)
+	performRequest(r, "DELETE", "/todos/"+todo.ID, nil, alice)
+	performRequest(r, "DELETE", "/trash/"+todo.ID, nil, alice)
+
+	var resp changesResponse
+	w = performRequest(r, "GET", "/changes?since=0", nil, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /changes failed: %d %s", w.Code, w.Body.String())
+	}
+
+	wantOps := []string{ChangeRegister, ChangeCreate, ChangeUpdate, ChangeUpdate, ChangeDelete}
+	if len(resp.Changes) != len(wantOps) {
+		t.Fatalf("Expected %d changes got %s", len(wantOps), w.Body.String())
+	}
+	for i, c := range resp.Changes {
+		if c.Op != wantOps[i] || c.Username != "alice" {
+			t.Fatalf("Change %d: expected alice %s got %+v", i, wantOps[i], c)
+		}
+		if i > 0 && c.Seq <= resp.Changes[i-1].Seq {
+			t.Fatalf("Sequence numbers not increasing: %+v", resp.Changes)
+		}
+	}
+	if trashed := resp.Changes[3].Todo; trashed == nil || trashed.DeletedAt == nil {
+		t.Fatalf("Expected the trash move to carry the todo, got %+v", resp.Changes[3])
+	}
+	if tomb := resp.Changes[4]; tomb.Todo != nil || tomb.TodoID != todo.ID {
+		t.Fatalf("Expected a tombstone for the purge, got %+v", tomb)
+	}
+	if resp.Next != resp.Changes[4].Seq {
+		t.Fatalf("Expected next %d got %d", resp.Changes[4].Seq, resp.Next)
+	}
+
+	// Resume from the middle, one page at a time
+	since := resp.Changes[1].Seq
+	w = performRequest(r, "GET", "/changes?since="+strconv.FormatUint(since, 10)+"&limit=2", nil, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Changes) != 2 || resp.Changes[0].Op != ChangeUpdate || resp.Next != resp.Changes[1].Seq {
+		t.Fatalf("Unexpected page after %d: %s", since, w.Body.String())
+	}
+	w = performRequest(r, "GET", "/changes?since="+strconv.FormatUint(resp.Next, 10), nil, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Changes) != 1 || resp.Changes[0].Op != ChangeDelete {
+		t.Fatalf("Unexpected last page: %s", w.Body.String())
+	}
+
+	if w := performRequest(r, "GET", "/changes?since=-1", nil, alice); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad since got %d", w.Code)
+	}
+	if w := performRequest(r, "GET", "/changes", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token got %d", w.Code)
+	}
+}
+
+func TestSubscribeStreamsExistingAndNewChanges(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_subscribe", ConcurrencyMode: SafeMode})
+	a.Users.Create(User{Username: "alice", PasswordHash: "hash"})
+	first := newTestTodo("first")
+	a.Todos.Create("alice", first)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	feed := Subscribe(ctx, a.Changes, "alice", 0)
+
+	second := newTestTodo("second")
+	a.Todos.Create("bob", newTestTodo("not alice's"))
+	a.Todos.Create("alice", second)
+
+	var got []Change
+	for len(got) < 3 {
+		select {
+		case c := <-feed:
+			got = append(got, c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for changes, got %+v", got)
+		}
+	}
+	if got[0].Op != ChangeRegister || got[1].TodoID != first.ID || got[2].TodoID != second.ID {
+		t.Fatalf("Unexpected stream %+v", got)
+	}
+
+	cancel()
+	for range feed {
+	}
+}
+
+func TestChangesFeedPrunesOldChanges(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_changes", ConcurrencyMode: SafeMode})
+	r := SetupRouter(a)
+	alice := registerAndLogin(t, r, "alice", "pass")
+	postJSON(t, r, "/todos", Todo{Title: "old"}, alice, http.StatusCreated)
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	postJSON(t, r, "/todos", Todo{Title: "new"}, alice, http.StatusCreated)
+
+	if n, err := a.Changes.Prune(cutoff); err != nil || n != 2 {
+		t.Fatalf("Expected the registration and first create pruned, got %d (err=%v)", n, err)
+	}
+	if n, err := a.Changes.Prune(cutoff); err != nil || n != 0 {
+		t.Fatalf("Expected nothing left to prune, got %d (err=%v)", n, err)
+	}
+
+	// A reader that missed pruned changes must reload, then resume from next
+	w := performRequest(r, "GET", "/changes?since=0", nil, alice)
+	var resp changesResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusGone || resp.Next == 0 {
+		t.Fatalf("Expected 410 with the floor as next, got %d %s", w.Code, w.Body.String())
+	}
+	w = performRequest(r, "GET", "/changes?since="+strconv.FormatUint(resp.Next, 10), nil, alice)
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Changes) != 1 || resp.Changes[0].Todo.Title != "new" {
+		t.Fatalf("Expected the retained change from the floor, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChangesFloorSurvivesRestart(t *testing.T) {
+	for _, storage := range []string{StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{
+				JWTSecret:       "testsecret_changes",
+				ConcurrencyMode: SafeMode,
+				Storage:         storage,
+				DataDir:         dir,
+				SQLitePath:      filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:  true,
+				SnapshotEvery:   2,
+			}
+			a, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.Users.Create(User{Username: "alice", PasswordHash: "hash"})
+			a.Todos.Create("alice", newTestTodo("old"))
+			time.Sleep(10 * time.Millisecond)
+			a.Changes.Prune(time.Now())
+			a.Todos.Create("alice", newTestTodo("new"))
+			floor, _ := a.Changes.Floor()
+			a.Close()
+
+			if a, err = Open(cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if got, err := a.Changes.Floor(); err != nil || got != floor || floor == 0 {
+				t.Fatalf("Expected floor %d kept, got %d (err=%v)", floor, got, err)
+			}
+			if _, err := a.Changes.Since(0, "alice", 10); err != ErrChangesPruned {
+				t.Fatalf("Expected ErrChangesPruned below the floor, got %v", err)
+			}
+			if changes, err := a.Changes.Since(floor, "alice", 10); err != nil || len(changes) != 1 {
+				t.Fatalf("Expected the one retained change, got %+v (err=%v)", changes, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Concurrency modes for the in-memory todo store.
+const (
+	// RacyMode keeps the original unsynchronised store for the race demos.
+	RacyMode = "racy"
+	// SafeMode runs every todo mutation as an atomic per-user transaction.
+	SafeMode = "safe"
+)
+
+// Storage backends selectable through Config.Storage.
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+	StorageSQLite = "sqlite"
+	StorageRaft   = "raft"
+)
+
+// Default lifetimes of the tokens issued at login.
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// DefaultPasswordMinLength is the shortest password LoadConfig allows.
+const DefaultPasswordMinLength = 8
+
+// Defaults of the brute-force protection on /login.
+const (
+	DefaultLoginMaxFailures   = 5
+	DefaultLoginIPMaxFailures = 20
+	DefaultLoginDelay         = time.Second
+	DefaultLoginLockout       = 15 * time.Minute
+	DefaultLoginFailureWindow = 15 * time.Minute
+)
+
+// Defaults of the access token validation policy.
+const (
+	DefaultJWTIssuer   = "todoapp"
+	DefaultJWTAudience = "todoapp"
+	DefaultJWTLeeway   = 5 * time.Second
+)
+
+// Config holds the settings the handlers need at runtime.
+type Config struct {
+	// JWTSecret is the HS256 key with kid DefaultKeyID. JWTKeys adds keys
+	// as kid=path entries naming PEM or secret files (see
+	// ParseSigningKey), and JWTSigningKey picks the kid new tokens are
+	// signed with.
+	JWTSecret     string
+	JWTKeys       []string
+	JWTSigningKey string
+	// JWTIssuer and JWTAudience go into every access token and must match
+	// in every token presented; New fills in the defaults when they are
+	// empty. JWTAlgorithms restricts the accepted signing algorithms,
+	// which are those of the key ring when empty. JWTLeeway is the clock
+	// skew allowed when checking exp, nbf and iat. JWTRequiredClaims are
+	// claims a token must carry besides iss, aud, exp, jti and user.
+	JWTIssuer         string
+	JWTAudience       string
+	JWTAlgorithms     []string
+	JWTLeeway         time.Duration
+	JWTRequiredClaims []string
+	// AccessTokenTTL is how long an access token is accepted, and
+	// RefreshTokenTTL how long each refresh token can be exchanged for a
+	// new pair. New fills in the defaults when they are zero.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// PasswordHash picks the hasher for new passwords: PasswordArgon2id (the
+	// default) or PasswordBcrypt, with the parameters below; zero values
+	// take the Default* constants. Stored hashes made with anything else
+	// are replaced at the user's next login.
+	PasswordHash      string
+	Argon2Memory      int // KiB
+	Argon2Iterations  int
+	Argon2Parallelism int
+	BcryptCost        int
+	// PasswordMinLength is the fewest characters a new password may have,
+	// and PasswordRejectCommon refuses passwords on the embedded list of
+	// common passwords.
+	PasswordMinLength    int
+	PasswordRejectCommon bool
+	// LoginMaxFailures locks an account for LoginLockout after that many
+	// failed logins in a row, and LoginIPMaxFailures does the same for a
+	// client address, whichever accounts it tried. LoginDelay is how long
+	// an account must wait after its first failure, doubling with every
+	// further one up to LoginLockout. Failures more than
+	// LoginFailureWindow apart start the count over. Zero thresholds and
+	// delay turn each protection off; New fills in the default durations
+	// when they are zero.
+	LoginMaxFailures   int
+	LoginIPMaxFailures int
+	LoginDelay         time.Duration
+	LoginLockout       time.Duration
+	LoginFailureWindow time.Duration
+	// TwoFactorIssuer names the service in authenticator apps, and
+	// TwoFactorChallengeTTL is how long a login with a correct password
+	// has to send its second factor. New fills in the defaults when they
+	// are empty.
+	TwoFactorIssuer       string
+	TwoFactorChallengeTTL time.Duration
+	// TrustedProxies are the addresses and CIDR ranges whose
+	// X-Forwarded-For header is believed when telling clients apart. With
+	// none, every client is known by the address it connects from.
+	TrustedProxies []string
+	// ConcurrencyMode is SafeMode (the default) or RacyMode.
+	ConcurrencyMode string
+
+	// Storage picks the backend Open uses: StorageMemory (the default),
+	// StorageFile, StorageSQLite or StorageRaft.
+	Storage string
+	// DataDir is where durable backends keep their files.
+	DataDir string
+	// SnapshotEvery is how many log records the file store writes before it
+	// compacts the log into a snapshot.
+	SnapshotEvery int
+	// CommitMaxDelay and CommitMaxBatch tune the file store's group
+	// commits; see FileOptions.
+	CommitMaxDelay time.Duration
+	CommitMaxBatch int
+	// SQLitePath is the database file used by StorageSQLite.
+	SQLitePath string
+	// MigrateOnStart applies pending SQLite migrations when the store opens.
+	// Without it the server refuses to start on an outdated schema.
+	MigrateOnStart bool
+	// TodoCacheBytes is the memory budget for keeping recently used todo
+	// lists in front of StorageSQLite; 0 reads every request from the
+	// database. The other backends already hold every list in memory, and
+	// Raft followers are written behind any cache's back, so Open refuses
+	// a budget for them.
+	TodoCacheBytes int
+
+	// RaftNodeID, RaftAddr and RaftPeers configure this node of a
+	// StorageRaft cluster. RaftPeers is a comma-separated id=host:port list
+	// of every member; leave it empty for a single-node cluster.
+	RaftNodeID string
+	RaftAddr   string
+	RaftPeers  string
+
+	// AdminUsers may call the /admin endpoints whatever their role.
+	AdminUsers []string
+	// BootstrapAdminUsername names an admin account BootstrapAdmin makes
+	// sure of when the server starts. It is created with
+	// BootstrapAdminPassword if missing, and otherwise made an admin and
+	// enabled again.
+	BootstrapAdminUsername string
+	BootstrapAdminPassword string
+
+	// TrashRetention is how long a deleted todo stays in the trash before
+	// the purger removes it for good.
+	TrashRetention time.Duration
+	// ChangeRetention is how long the change feed keeps a change before the
+	// purger prunes it. Zero keeps every change.
+	ChangeRetention time.Duration
+	// PurgeInterval is how often the purger looks for expired trash.
+	PurgeInterval time.Duration
+}
+
+// LoadConfig reads the configuration from environment variables.
+func LoadConfig() Config {
+	return Config{
+		JWTSecret:              os.Getenv("JWT_SECRET"),
+		JWTKeys:                getListEnv("JWT_KEYS"),
+		JWTSigningKey:          os.Getenv("JWT_SIGNING_KEY"),
+		JWTIssuer:              getEnv("JWT_ISSUER", DefaultJWTIssuer),
+		JWTAudience:            getEnv("JWT_AUDIENCE", DefaultJWTAudience),
+		JWTAlgorithms:          getListEnv("JWT_ALGORITHMS"),
+		JWTLeeway:              getDurationEnv("JWT_LEEWAY", DefaultJWTLeeway),
+		JWTRequiredClaims:      getListEnv("JWT_REQUIRED_CLAIMS"),
+		AccessTokenTTL:         getDurationEnv("ACCESS_TOKEN_TTL", DefaultAccessTokenTTL),
+		RefreshTokenTTL:        getDurationEnv("REFRESH_TOKEN_TTL", DefaultRefreshTokenTTL),
+		PasswordHash:           getEnv("PASSWORD_HASH", PasswordArgon2id),
+		Argon2Memory:           getIntEnv("ARGON2_MEMORY_KIB", DefaultArgon2Memory),
+		Argon2Iterations:       getIntEnv("ARGON2_ITERATIONS", DefaultArgon2Iterations),
+		Argon2Parallelism:      getIntEnv("ARGON2_PARALLELISM", DefaultArgon2Parallelism),
+		BcryptCost:             getIntEnv("BCRYPT_COST", DefaultBcryptCost),
+		PasswordMinLength:      getIntEnv("PASSWORD_MIN_LENGTH", DefaultPasswordMinLength),
+		PasswordRejectCommon:   getBoolEnv("PASSWORD_REJECT_COMMON", true),
+		LoginMaxFailures:       getIntEnv("LOGIN_MAX_FAILURES", DefaultLoginMaxFailures),
+		LoginIPMaxFailures:     getIntEnv("LOGIN_IP_MAX_FAILURES", DefaultLoginIPMaxFailures),
+		LoginDelay:             getDurationEnv("LOGIN_DELAY", DefaultLoginDelay),
+		LoginLockout:           getDurationEnv("LOGIN_LOCKOUT", DefaultLoginLockout),
+		LoginFailureWindow:     getDurationEnv("LOGIN_FAILURE_WINDOW", DefaultLoginFailureWindow),
+		TwoFactorIssuer:        getEnv("TOTP_ISSUER", DefaultTwoFactorIssuer),
+		TwoFactorChallengeTTL:  getDurationEnv("TWO_FACTOR_CHALLENGE_TTL", DefaultTwoFactorChallengeTTL),
+		TrustedProxies:         getListEnv("TRUSTED_PROXIES"),
+		ConcurrencyMode:        getEnv("TODO_CONCURRENCY", SafeMode),
+		Storage:                getEnv("STORAGE", StorageMemory),
+		DataDir:                getEnv("DATA_DIR", "./data"),
+		SnapshotEvery:          getIntEnv("SNAPSHOT_EVERY", 1000),
+		CommitMaxDelay:         getDurationEnv("COMMIT_MAX_DELAY", 0),
+		CommitMaxBatch:         getIntEnv("COMMIT_MAX_BATCH", 0),
+		SQLitePath:             getEnv("SQLITE_PATH", "./data/todoapp.db"),
+		MigrateOnStart:         getBoolEnv("MIGRATE_ON_START", true),
+		TodoCacheBytes:         getIntEnv("TODO_CACHE_BYTES", 0),
+		RaftNodeID:             getEnv("RAFT_NODE_ID", "node1"),
+		RaftAddr:               getEnv("RAFT_ADDR", "127.0.0.1:7000"),
+		RaftPeers:              os.Getenv("RAFT_PEERS"),
+		AdminUsers:             getListEnv("ADMIN_USERS"),
+		BootstrapAdminUsername: os.Getenv("BOOTSTRAP_ADMIN_USERNAME"),
+		BootstrapAdminPassword: os.Getenv("BOOTSTRAP_ADMIN_PASSWORD"),
+		TrashRetention:         getDurationEnv("TRASH_RETENTION", 30*24*time.Hour),
+		ChangeRetention:        getDurationEnv("CHANGE_RETENTION", 30*24*time.Hour),
+		PurgeInterval:          getDurationEnv("PURGE_INTERVAL", time.Hour),
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getListEnv splits a comma-separated variable, dropping empty items.
+func getListEnv(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getIntEnv(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+func getBoolEnv(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
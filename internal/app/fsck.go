@@ -0,0 +1,234 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// Problem kinds reported by Fsck.
+const (
+	// ProblemNilEntry is a hole in a user's todo list.
+	ProblemNilEntry = "nil_entry"
+	// ProblemDuplicateID is a todo ID that appears more than once in one
+	// user's list.
+	ProblemDuplicateID = "duplicate_id"
+	// ProblemSharedID is a todo ID held by more than one user.
+	ProblemSharedID = "shared_id"
+	// ProblemOrphanTodo is a todo whose owner has no user record.
+	ProblemOrphanTodo = "orphan_todo"
+	// ProblemFutureTimestamp is a creation or deletion time ahead of the
+	// check by more than fsckClockSkew.
+	ProblemFutureTimestamp = "future_timestamp"
+)
+
+// fsckClockSkew is how far ahead a timestamp may be before Fsck flags it, so
+// small clock differences between cluster nodes are not reported.
+const fsckClockSkew = time.Minute
+
+// Problem is one broken invariant found by Fsck.
+type Problem struct {
+	Kind     string `json:"kind"`
+	Username string `json:"username"`
+	TodoID   string `json:"todo_id,omitempty"`
+	Detail   string `json:"detail"`
+	// Repaired is set once a repair run has fixed the problem.
+	Repaired bool `json:"repaired"`
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s %s", p.Kind, p.Username)
+	if p.TodoID != "" {
+		s += "/" + p.TodoID
+	}
+	s += ": " + p.Detail
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// FsckReport is the result of a Fsck run.
+type FsckReport struct {
+	Users    int       `json:"users"`
+	Todos    int       `json:"todos"`
+	Problems []Problem `json:"problems"`
+}
+
+// Unrepaired counts the problems still present after the run.
+func (r FsckReport) Unrepaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// rawTodoLister is implemented by todo stores whose lists can hold nil
+// entries and repeated IDs: the racy store, whose unsynchronised writes
+// leave both behind.
+type rawTodoLister interface {
+	rawList(username string) []*Todo
+	compact(username string)
+}
+
+// Fsck walks every user's todos and reports broken invariants as of now.
+// With repair set it also fixes them through the stores, so durable
+// backends log each repair like any other write:
+//   - nil entries and repeated IDs in a list are dropped, keeping the first
+//     todo with each ID;
+//   - a todo ID already held by another user is given a new ID;
+//   - orphaned todos are deleted;
+//   - future timestamps are moved back to now.
+func Fsck(stores Stores, now time.Time, repair bool) (FsckReport, error) {
+	var report FsckReport
+	users, err := stores.Users.List()
+	if err != nil {
+		return report, err
+	}
+	report.Users = len(users)
+	known := make(map[string]bool, len(users))
+	for _, user := range users {
+		known[user.Username] = true
+	}
+
+	// Check registered owners first, so an ID shared with an orphan stays
+	// with the registered user.
+	owners, err := stores.Todos.Owners()
+	if err != nil {
+		return report, err
+	}
+	var ordered []string
+	for _, username := range owners {
+		if known[username] {
+			ordered = append(ordered, username)
+		}
+	}
+	for _, username := range owners {
+		if !known[username] {
+			ordered = append(ordered, username)
+		}
+	}
+
+	holders := make(map[string]string) // todo ID -> first user holding it
+	for _, username := range ordered {
+		todos, err := fsckList(stores.Todos, username, repair, &report)
+		if err != nil {
+			return report, err
+		}
+		for _, t := range todos {
+			if !known[username] {
+				p := Problem{Kind: ProblemOrphanTodo, Username: username, TodoID: t.ID, Detail: "owner has no user record"}
+				if repair {
+					if _, err := stores.Todos.Delete(username, t.ID, nil); err != nil {
+						return report, err
+					}
+					p.Repaired = true
+				}
+				report.Problems = append(report.Problems, p)
+				if p.Repaired {
+					continue // deleted, nothing left to check
+				}
+			}
+			if err := fsckTodo(stores.Todos, username, t, holders, now, repair, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// fsckList reads username's todos, reporting and, when repairing, dropping
+// nil entries and repeated IDs. It returns the first todo with each ID.
+func fsckList(store TodoStore, username string, repair bool, report *FsckReport) ([]Todo, error) {
+	var list []*Todo
+	raw, isRaw := store.(rawTodoLister)
+	if isRaw {
+		list = raw.rawList(username)
+	} else {
+		todos, err := store.List(username)
+		if err != nil {
+			return nil, err
+		}
+		for i := range todos {
+			list = append(list, &todos[i])
+		}
+	}
+
+	var todos []Todo
+	var problems []Problem
+	seen := make(map[string]bool)
+	for i, t := range list {
+		switch {
+		case t == nil:
+			problems = append(problems, Problem{Kind: ProblemNilEntry, Username: username, Detail: fmt.Sprintf("nil entry at position %d", i)})
+		case seen[t.ID]:
+			problems = append(problems, Problem{Kind: ProblemDuplicateID, Username: username, TodoID: t.ID, Detail: fmt.Sprintf("repeated at position %d", i)})
+		default:
+			seen[t.ID] = true
+			todos = append(todos, *t)
+		}
+	}
+	report.Todos += len(todos)
+
+	if repair && isRaw && len(problems) > 0 {
+		raw.compact(username)
+		for i := range problems {
+			problems[i].Repaired = true
+		}
+	}
+	report.Problems = append(report.Problems, problems...)
+	return todos, nil
+}
+
+// fsckTodo checks one of username's todos against holders, the owners of
+// every todo ID seen so far, and its timestamps against now.
+func fsckTodo(store TodoStore, username string, t Todo, holders map[string]string, now time.Time, repair bool, report *FsckReport) error {
+	if holder, ok := holders[t.ID]; !ok {
+		holders[t.ID] = username
+	} else {
+		p := Problem{Kind: ProblemSharedID, Username: username, TodoID: t.ID, Detail: "ID also held by " + holder}
+		if repair {
+			if _, err := store.Delete(username, t.ID, nil); err != nil {
+				return err
+			}
+			t.ID = GenerateID()
+			if err := store.Create(username, t); err != nil {
+				return err
+			}
+			holders[t.ID] = username
+			p.Detail += ", moved to new ID " + t.ID
+			p.Repaired = true
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	limit := now.Add(fsckClockSkew)
+	future := t.CreatedAt.After(limit) || (t.DeletedAt != nil && t.DeletedAt.After(limit))
+	if !future {
+		return nil
+	}
+	p := Problem{Kind: ProblemFutureTimestamp, Username: username, TodoID: t.ID, Detail: fmt.Sprintf("created_at %s", t.CreatedAt.Format(time.RFC3339))}
+	if t.DeletedAt != nil {
+		p.Detail += fmt.Sprintf(", deleted_at %s", t.DeletedAt.Format(time.RFC3339))
+	}
+	if repair {
+		_, err := store.Update(username, t.ID, func(t *Todo) error {
+			if t.CreatedAt.After(limit) {
+				t.CreatedAt = now
+			}
+			if t.DeletedAt != nil && t.DeletedAt.After(limit) {
+				at := now
+				t.DeletedAt = &at
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		p.Repaired = true
+	}
+	report.Problems = append(report.Problems, p)
+	return nil
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func problemKinds(report FsckReport) map[string]int {
+	kinds := make(map[string]int)
+	for _, p := range report.Problems {
+		kinds[p.Kind]++
+	}
+	return kinds
+}
+
+func TestFsckFindsAndRepairsRacyStoreDamage(t *testing.T) {
+	stores := NewMemoryStores(RacyMode)
+	racy := stores.Todos.(*RacyTodoStore)
+	stores.Users.Create(User{Username: "alice", PasswordHash: "hash"})
+
+	// What interleaved creates and deletes leave behind
+	a, b := newTestTodo("a"), newTestTodo("b")
+	racy.todos.Store("alice", []*Todo{&a, nil, &b, &a})
+
+	if err := stores.Users.Create(User{Username: "bob", PasswordHash: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	shared := b
+	shared.Title = "bob's copy"
+	stores.Todos.Create("bob", shared)
+
+	now := time.Now().UTC()
+	late := newTestTodo("from the future")
+	late.CreatedAt = now.Add(24 * time.Hour)
+	stores.Todos.Create("bob", late)
+	stores.Todos.Create("ghost", newTestTodo("nobody's"))
+
+	report, err := Fsck(stores, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{ProblemNilEntry: 1, ProblemDuplicateID: 1, ProblemSharedID: 1, ProblemOrphanTodo: 1, ProblemFutureTimestamp: 1}
+	if got := problemKinds(report); !maps.Equal(got, want) || report.Unrepaired() != 5 {
+		t.Fatalf("Expected %v got %+v", want, report.Problems)
+	}
+	if report.Users != 2 || report.Todos != 5 {
+		t.Fatalf("Expected 2 users and 5 todos checked got %+v", report)
+	}
+
+	report, err = Fsck(stores, now, true)
+	if err != nil || report.Unrepaired() != 0 || len(report.Problems) != 5 {
+		t.Fatalf("Repair failed: %v %+v", err, report.Problems)
+	}
+	if report, _ := Fsck(stores, now, false); len(report.Problems) != 0 {
+		t.Fatalf("Expected a clean store after repair, got %+v", report.Problems)
+	}
+
+	if raw := racy.rawList("alice"); len(raw) != 2 || raw[0].ID != a.ID || raw[1].ID != b.ID {
+		t.Fatalf("Expected alice's list compacted to a and b, got %v", raw)
+	}
+	bobs, _ := stores.Todos.List("bob")
+	if len(bobs) != 2 {
+		t.Fatalf("Expected bob to keep both todos, got %+v", bobs)
+	}
+	for _, todo := range bobs {
+		if todo.ID == b.ID {
+			t.Fatalf("Expected bob's copy of %s to get a new ID", b.ID)
+		}
+		if todo.CreatedAt.After(now) {
+			t.Fatalf("Expected the future timestamp moved back, got %v", todo.CreatedAt)
+		}
+	}
+	if owners, _ := stores.Todos.Owners(); len(owners) != 2 {
+		t.Fatalf("Expected the orphaned todo deleted, owners %v", owners)
+	}
+}
+
+func TestFsckRepairsThroughConfiguredBackend(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_fsck", ConcurrencyMode: SafeMode})
+	a.Users.Create(User{Username: "alice", PasswordHash: "hash"})
+
+	now := time.Now().UTC()
+	kept := newTestTodo("kept")
+	late := newTestTodo("late")
+	deletedAt := now.Add(time.Hour)
+	late.DeletedAt = &deletedAt
+	a.Todos.Create("alice", kept)
+	a.Todos.Create("alice", late)
+	a.Todos.Create("ghost", newTestTodo("orphan"))
+
+	report, err := Fsck(a.Stores, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := problemKinds(report); got[ProblemOrphanTodo] != 1 || got[ProblemFutureTimestamp] != 1 || report.Unrepaired() != 0 {
+		t.Fatalf("Unexpected report %+v", report.Problems)
+	}
+	if report, _ := Fsck(a.Stores, now, false); len(report.Problems) != 0 {
+		t.Fatalf("Expected a clean store after repair, got %+v", report.Problems)
+	}
+	if todo, _ := a.Todos.Get("alice", late.ID); !todo.DeletedAt.Equal(now) {
+		t.Fatalf("Expected deleted_at moved back to now, got %v", todo.DeletedAt)
+	}
+	if todos, _ := a.Todos.List("ghost"); len(todos) != 0 {
+		t.Fatalf("Expected the orphan deleted, got %+v", todos)
+	}
+}
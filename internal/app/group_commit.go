@@ -0,0 +1,130 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// groupCommit makes log records durable in batches. Writers append records
+// to the log and report their sequence number with logged, then call wait.
+// The first waiter to find no sync in progress becomes the leader: it
+// gathers more records for up to maxDelay, or until maxBatch are pending,
+// syncs once for all of them and wakes every writer the sync covered.
+// Records written while a sync is running join the next batch, so batches
+// grow with load even without a delay.
+type groupCommit struct {
+	maxDelay time.Duration
+	maxBatch int // 0 means no limit
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written uint64 // last sequence number written to the log
+	durable uint64 // last sequence number known to be synced
+	syncing bool
+	err     error         // the first failed sync; the log is unusable after it
+	full    chan struct{} // wakes a gathering leader once maxBatch are pending
+}
+
+func newGroupCommit(seq uint64, maxDelay time.Duration, maxBatch int) *groupCommit {
+	g := &groupCommit{
+		maxDelay: maxDelay,
+		maxBatch: maxBatch,
+		written:  seq,
+		durable:  seq,
+		full:     make(chan struct{}, 1),
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// failed returns the error of a failed sync, if any.
+func (g *groupCommit) failed() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// logged records that every record up to seq has been written to the log.
+func (g *groupCommit) logged(seq uint64) {
+	g.mu.Lock()
+	g.written = seq
+	full := g.maxBatch > 0 && g.written-g.durable >= uint64(g.maxBatch)
+	g.mu.Unlock()
+	if full {
+		select {
+		case g.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// synced records that every record up to seq became durable some other way,
+// such as a snapshot.
+func (g *groupCommit) synced(seq uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.durable = max(g.durable, seq)
+	g.cond.Broadcast()
+}
+
+// wait blocks until the record at seq is durable, leading a sync when no
+// other waiter is.
+func (g *groupCommit) wait(seq uint64, sync func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.durable < seq {
+		if g.err != nil {
+			return g.err
+		}
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		g.mu.Unlock()
+		g.gather()
+		g.mu.Lock()
+		target := g.written
+		g.mu.Unlock()
+
+		err := sync()
+
+		g.mu.Lock()
+		g.syncing = false
+		if err != nil {
+			g.err = fmt.Errorf("sync wal: %w", err)
+		} else {
+			g.durable = max(g.durable, target)
+		}
+		g.cond.Broadcast()
+	}
+	return nil
+}
+
+// gather waits up to maxDelay for more records to join the batch.
+func (g *groupCommit) gather() {
+	if g.maxDelay <= 0 {
+		return
+	}
+	// Drop a wake-up left over from a batch that has already been synced.
+	select {
+	case <-g.full:
+	default:
+	}
+	g.mu.Lock()
+	full := g.maxBatch > 0 && g.written-g.durable >= uint64(g.maxBatch)
+	g.mu.Unlock()
+	if full {
+		return
+	}
+
+	timer := time.NewTimer(g.maxDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-g.full:
+	}
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLog stands in for the write-ahead log: records are written under mu
+// and become durable when sync copies the written count.
+type fakeLog struct {
+	mu      sync.Mutex
+	written uint64
+	durable atomic.Uint64
+	syncs   atomic.Int32
+	delay   time.Duration
+}
+
+func (l *fakeLog) append(g *groupCommit) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.written++
+	g.logged(l.written)
+	return l.written
+}
+
+func (l *fakeLog) sync() error {
+	l.mu.Lock()
+	written := l.written
+	l.mu.Unlock()
+	time.Sleep(l.delay)
+	l.durable.Store(written)
+	l.syncs.Add(1)
+	return nil
+}
+
+func TestGroupCommitBatchesConcurrentWriters(t *testing.T) {
+	log := &fakeLog{delay: 5 * time.Millisecond}
+	g := newGroupCommit(0, 0, 0)
+
+	const writers = 64
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq := log.append(g)
+			if err := g.wait(seq, log.sync); err != nil {
+				t.Errorf("wait: %v", err)
+				return
+			}
+			if durable := log.durable.Load(); durable < seq {
+				t.Errorf("Record %d acknowledged with only %d durable", seq, durable)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := log.syncs.Load(); n >= writers {
+		t.Fatalf("Expected concurrent writers to share syncs, got %d syncs for %d writes", n, writers)
+	}
+}
+
+func TestGroupCommitSyncsFullBatchBeforeDelay(t *testing.T) {
+	log := &fakeLog{}
+	g := newGroupCommit(0, time.Hour, 8)
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.wait(log.append(g), log.sync)
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A full batch waited for the maximum delay")
+	}
+	if log.durable.Load() != 8 {
+		t.Fatalf("Expected all 8 records durable got %d", log.durable.Load())
+	}
+}
+
+func TestGroupCommitFailedSyncFailsWaiters(t *testing.T) {
+	g := newGroupCommit(0, 0, 0)
+	g.logged(1)
+	broken := errors.New("disk gone")
+	if err := g.wait(1, func() error { return broken }); !errors.Is(err, broken) {
+		t.Fatalf("Expected the sync error got %v", err)
+	}
+	if err := g.failed(); !errors.Is(err, broken) {
+		t.Fatalf("Expected the failure to stick, got %v", err)
+	}
+}
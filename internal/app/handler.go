@@ -1,16 +1,18 @@
 package app
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Register new user
-func RegisterHandler(c *gin.Context) {
+func (a *App) RegisterHandler(c *gin.Context) {
 	var creds Credentials
 	if err := c.ShouldBindJSON(&creds); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
@@ -22,22 +24,45 @@ func RegisterHandler(c *gin.Context) {
 		return
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if a.rejectWeakPassword(c, creds.Password) {
+		return
+	}
+
+	hashed, err := a.Passwords.Hash(creds.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Encryption error"})
 		return
 	}
 
-	if _, loaded := Users.LoadOrStore(creds.Username, string(hashed)); loaded {
+	err = a.Users.Create(User{Username: creds.Username, PasswordHash: hashed, Role: RoleUser})
+	if errors.Is(err, ErrUserExists) {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
 
 	c.JSON(http.StatusCreated, gin.H{"message": "User created"})
 }
 
+// rejectWeakPassword answers with a 400 if password breaks the password
+// policy and reports whether it did.
+func (a *App) rejectWeakPassword(c *gin.Context, password string) bool {
+	switch err := checkPassword(a.Config, password); {
+	case errors.Is(err, ErrPasswordTooShort):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Password must be at least %d characters", a.Config.PasswordMinLength)})
+	case errors.Is(err, ErrPasswordCommon):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is too common, choose another"})
+	default:
+		return false
+	}
+	return true
+}
+
 // Login existing user
-func LoginHandler(c *gin.Context) {
+func (a *App) LoginHandler(c *gin.Context) {
 	var creds Credentials
 	if err := c.ShouldBindJSON(&creds); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
@@ -51,33 +76,77 @@ func LoginHandler(c *gin.Context) {
 	}
 	// ---------------------------------------------
 
-	hashed, ok := Users.Load(creds.Username)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	now := a.now()
+	attempt, lock, err := a.reserveLogin(creds.Username, c.ClientIP(), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
 		return
 	}
+	if lock != nil {
+		lock.respond(c, now)
+		return
+	}
+	defer attempt.release()
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hashed.(string)), []byte(creds.Password)); err != nil {
+	user, err := a.Users.Get(creds.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	valid, err := a.checkPassword(user, err == nil, creds.Password)
+	if err != nil {
+		log.Printf("login %s: %v", user.Username, err)
+	}
+	if !valid {
+		// Unknown users count as failures too, so locks do not reveal
+		// which accounts exist
+		attempt.fail()
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user": creds.Username,
-		"exp":  time.Now().Add(24 * time.Hour).Unix(),
-	})
-	tokenString, err := token.SignedString(JwtKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+	if accountBlocked(c, user) {
 		return
 	}
+	if a.Passwords.NeedsRehash(user.PasswordHash) {
+		a.rehashPassword(user, creds.Password)
+	}
+	// The failures are only forgotten once the second factor is in too,
+	// or a known password would allow unlimited guesses at the code
+	if user.TOTPSecret != "" {
+		a.respondChallenge(c, user.Username, now)
+		return
+	}
+	attempt.succeed()
+
+	a.respondTokens(c, user, GenerateID(), "", now)
+}
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+// rehashPassword replaces user's stored hash with one made by the current
+// hasher. The login succeeds either way, so failures are only logged; a
+// concurrent password change wins over the rehash.
+func (a *App) rehashPassword(user User, password string) {
+	hashed, err := a.Passwords.Hash(password)
+	if err == nil {
+		_, err = a.Users.Update(user.Username, func(u *User) error {
+			if u.PasswordHash != user.PasswordHash {
+				return errPasswordChanged
+			}
+			u.PasswordHash = hashed
+			return nil
+		})
+	}
+	if err != nil && !errors.Is(err, errPasswordChanged) {
+		log.Printf("rehash password of %s: %v", user.Username, err)
+	}
 }
 
+// errPasswordChanged aborts a rehash whose hash was replaced meanwhile.
+var errPasswordChanged = errors.New("password hash changed")
+
 // Create new Todo
-func CreateTodoHandler(c *gin.Context) {
-	username, _ := c.Get("username")
+func (a *App) CreateTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
 	var req Todo
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
@@ -88,70 +157,51 @@ func CreateTodoHandler(c *gin.Context) {
 		return
 	}
 
-	newTodo := &Todo{
+	newTodo := Todo{
 		ID:        GenerateID(),
 		Title:     req.Title,
 		Completed: false,
-		CreatedAt: time.Now(),
+		CreatedAt: a.now(),
+		Version:   1,
 	}
 
-	curr, ok := Todos.Load(username)
-	if !ok {
-		Todos.Store(username, []*Todo{newTodo})
-		c.JSON(http.StatusCreated, newTodo)
+	if err := a.Todos.Create(username, newTodo); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
 		return
 	}
-
-	slice := curr.([]*Todo)
-	slice = append(slice, newTodo)
-	Todos.Store(username, slice)
+	c.Header("ETag", etag(newTodo))
 	c.JSON(http.StatusCreated, newTodo)
 }
 
 // Get all Todos
-func GetTodosHandler(c *gin.Context) {
-	username, _ := c.Get("username")
-	v, ok := Todos.Load(username)
-	if !ok {
-		c.JSON(http.StatusOK, []Todo{})
+func (a *App) GetTodosHandler(c *gin.Context) {
+	username := c.GetString("username")
+	todos, err := a.Todos.List(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
 		return
 	}
-
-	ptrSlice := v.([]*Todo)
-	out := make([]Todo, 0, len(ptrSlice))
-	for _, p := range ptrSlice {
-		if p != nil {
-			out = append(out, *p)
-		}
-	}
-	c.JSON(http.StatusOK, out)
+	c.JSON(http.StatusOK, filterTodos(todos, false))
 }
 
 // Get single Todo
-func GetTodoHandler(c *gin.Context) {
-	username, _ := c.Get("username")
+func (a *App) GetTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
 	id := c.Param("id")
 
-	v, ok := Todos.Load(username)
-	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+	todo, err := a.getLiveTodo(username, id)
+	if err != nil {
+		respondTodoError(c, err, todo)
 		return
 	}
-	ptrSlice := v.([]*Todo)
 
-	for _, p := range ptrSlice {
-		if p != nil && p.ID == id {
-			c.JSON(http.StatusOK, p)
-			return
-		}
-	}
-
-	c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+	c.Header("ETag", etag(todo))
+	c.JSON(http.StatusOK, todo)
 }
 
-// Update Todo (intentional race)
-func UpdateTodoHandler(c *gin.Context) {
-	username, _ := c.Get("username")
+// Update Todo
+func (a *App) UpdateTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
 	id := c.Param("id")
 
 	var req UpdateTodoRequest
@@ -160,62 +210,329 @@ func UpdateTodoHandler(c *gin.Context) {
 		return
 	}
 
-	v, ok := Todos.Load(username)
-	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+	a.updateTodo(c, username, id, func(t *Todo) {
+		if req.Title != nil {
+			t.Title = *req.Title
+		}
+		if req.Completed != nil {
+			t.Completed = *req.Completed
+		}
+	})
+}
+
+// Get the revisions of a Todo
+func (a *App) GetTodoHistoryHandler(c *gin.Context) {
+	username := c.GetString("username")
+	id := c.Param("id")
+
+	if _, err := a.getLiveTodo(username, id); err != nil {
+		respondTodoError(c, err, Todo{})
+		return
+	}
+	revs, err := a.Revisions.List(username, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, revs)
+}
+
+// Revert a Todo: undo the changes one revision made by restoring the old
+// value of every field it changed. The revert is itself a new revision.
+func (a *App) RevertTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
+	id := c.Param("id")
+
+	number, err := strconv.ParseInt(c.Param("revision"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+	rev, err := a.Revisions.Get(username, id, number)
+	if errors.Is(err, ErrRevisionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
 		return
 	}
-	ptrSlice := v.([]*Todo)
 
-	var found *Todo
-	for _, p := range ptrSlice {
-		if p != nil && p.ID == id {
-			found = p
-			break
+	a.updateTodo(c, username, id, func(t *Todo) {
+		for _, change := range rev.Changes {
+			switch change.Field {
+			case "title":
+				if title, ok := change.Old.(string); ok {
+					t.Title = title
+				}
+			case "completed":
+				if completed, ok := change.Old.(bool); ok {
+					t.Completed = completed
+				}
+			}
 		}
+	})
+}
+
+// errUnchanged aborts an update that would not change any field.
+var errUnchanged = errors.New("todo unchanged")
+
+// updateTodo applies edit to the todo under the request's If-Match
+// precondition, stores it together with the resulting revision and writes
+// the response. An edit that changes nothing writes nothing: the version,
+// and so every client's ETag, stays as it was.
+func (a *App) updateTodo(c *gin.Context, username, id string, edit func(*Todo)) {
+	ifMatch := c.GetHeader("If-Match")
+	updated, err := a.Todos.Revise(username, id, func(t *Todo) (Revision, error) {
+		if t.Trashed() {
+			return Revision{}, ErrTodoNotFound
+		}
+		if !etagMatches(ifMatch, *t) {
+			return Revision{}, ErrVersionMismatch
+		}
+		before := *t
+		edit(t)
+		changes := diffTodo(before, *t)
+		if len(changes) == 0 {
+			return Revision{}, errUnchanged
+		}
+		t.Version++
+		return Revision{
+			TodoID:   id,
+			Revision: t.Version,
+			Author:   username,
+			At:       a.now(),
+			Changes:  changes,
+		}, nil
+	})
+	if errors.Is(err, errUnchanged) {
+		c.Header("ETag", etag(updated))
+		c.JSON(http.StatusOK, updated)
+		return
+	}
+	if err != nil {
+		respondTodoError(c, err, updated)
+		return
 	}
 
-	if found == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+	c.Header("ETag", etag(updated))
+	c.JSON(http.StatusOK, updated)
+}
+
+// diffTodo lists the user-editable fields that differ between two versions.
+func diffTodo(before, after Todo) []FieldChange {
+	changes := []FieldChange{}
+	if before.Title != after.Title {
+		changes = append(changes, FieldChange{Field: "title", Old: before.Title, New: after.Title})
+	}
+	if before.Completed != after.Completed {
+		changes = append(changes, FieldChange{Field: "completed", Old: before.Completed, New: after.Completed})
+	}
+	return changes
+}
+
+// Delete Todo: move it to the trash, where it stays restorable until the
+// purger removes it.
+func (a *App) DeleteTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
+	id := c.Param("id")
+
+	ifMatch := c.GetHeader("If-Match")
+	current, err := a.Todos.Update(username, id, func(t *Todo) error {
+		if t.Trashed() {
+			return ErrTodoNotFound
+		}
+		if !etagMatches(ifMatch, *t) {
+			return ErrVersionMismatch
+		}
+		now := a.now()
+		t.DeletedAt = &now
+		t.Version++
+		return nil
+	})
+	if err != nil {
+		respondTodoError(c, err, current)
 		return
 	}
 
-	if req.Title != nil {
-		found.Title = *req.Title // race
+	c.JSON(http.StatusOK, gin.H{"message": "Todo deleted"})
+}
+
+// Get the todos in the trash
+func (a *App) GetTrashHandler(c *gin.Context) {
+	username := c.GetString("username")
+	todos, err := a.Todos.List(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
 	}
-	if req.Completed != nil {
-		found.Completed = *req.Completed // race
+	c.JSON(http.StatusOK, filterTodos(todos, true))
+}
+
+// Restore a Todo from the trash
+func (a *App) RestoreTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
+	id := c.Param("id")
+
+	restored, err := a.Todos.Update(username, id, func(t *Todo) error {
+		if !t.Trashed() {
+			return ErrTodoNotFound
+		}
+		t.DeletedAt = nil
+		t.Version++
+		return nil
+	})
+	if err != nil {
+		respondTodoError(c, err, restored)
+		return
 	}
 
-	c.JSON(http.StatusOK, found)
+	c.Header("ETag", etag(restored))
+	c.JSON(http.StatusOK, restored)
 }
 
-// Delete Todo
-func DeleteTodoHandler(c *gin.Context) {
-	username, _ := c.Get("username")
+// Permanently delete a Todo from the trash
+func (a *App) PurgeTodoHandler(c *gin.Context) {
+	username := c.GetString("username")
 	id := c.Param("id")
 
-	v, ok := Todos.Load(username)
-	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+	current, err := a.Todos.Delete(username, id, func(t Todo) error {
+		if !t.Trashed() {
+			return ErrTodoNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		respondTodoError(c, err, current)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Todo permanently deleted"})
+}
+
+// getLiveTodo returns a todo that is not in the trash; trashed todos are
+// reported as ErrTodoNotFound.
+func (a *App) getLiveTodo(username, id string) (Todo, error) {
+	todo, err := a.Todos.Get(username, id)
+	if err == nil && todo.Trashed() {
+		return Todo{}, ErrTodoNotFound
+	}
+	return todo, err
+}
+
+// filterTodos keeps the todos whose trashed state matches trashed.
+func filterTodos(todos []Todo, trashed bool) []Todo {
+	out := make([]Todo, 0, len(todos))
+	for _, t := range todos {
+		if t.Trashed() == trashed {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Limits for GET /changes.
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// Get the caller's changes after a sequence number
+func (a *App) GetChangesHandler(c *gin.Context) {
+	username := c.GetString("username")
+
+	since, err := strconv.ParseUint(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since"})
 		return
 	}
-	ptrSlice := v.([]*Todo)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultChangesLimit)))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	limit = min(limit, maxChangesLimit)
 
-	idx := -1
-	for i, p := range ptrSlice {
-		if p != nil && p.ID == id {
-			idx = i
-			break
+	changes, err := a.Changes.Since(since, username, limit)
+	if errors.Is(err, ErrChangesPruned) {
+		// The client must reload its todos, then carry on from the floor
+		if floor, err := a.Changes.Floor(); err == nil {
+			c.JSON(http.StatusGone, gin.H{"error": "Changes since " + strconv.FormatUint(since, 10) + " are no longer retained", "next": floor})
+			return
 		}
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	// next is the since value that continues from here.
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes, "next": next})
+}
 
-	if idx == -1 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+// Stream a backup of every user and todo
+func (a *App) BackupHandler(c *gin.Context) {
+	d, err := a.Exporter.Export()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
 		return
 	}
 
-	newSlice := append(ptrSlice[:idx], ptrSlice[idx+1:]...)
-	Todos.Store(username, newSlice)
-	c.JSON(http.StatusOK, gin.H{"message": "Todo deleted"})
+	now := a.now()
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="todoapp-backup-`+now.Format("20060102T150405Z")+`.jsonl"`)
+	c.Status(http.StatusOK)
+	// Too late for an error status; the missing end record marks the
+	// archive as incomplete.
+	if _, err := WriteBackup(c.Writer, d, now); err != nil {
+		c.Error(err)
+	}
+}
+
+// CacheStatsHandler reports the todo cache's hit rate, evictions and size.
+func (a *App) CacheStatsHandler(c *gin.Context) {
+	cache, ok := a.Todos.(*CachedTodoStore)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Todo cache is disabled"})
+		return
+	}
+	c.JSON(http.StatusOK, cache.Stats())
+}
+
+// respondTodoError maps store errors to responses. A failed If-Match gets
+// 412 with the current todo so the client can merge and retry.
+func respondTodoError(c *gin.Context, err error, current Todo) {
+	switch {
+	case errors.Is(err, ErrTodoNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Todo not found"})
+	case errors.Is(err, ErrVersionMismatch):
+		c.Header("ETag", etag(current))
+		c.JSON(http.StatusPreconditionFailed, current)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+	}
+}
+
+// etag renders a todo's version as a strong entity tag.
+func etag(t Todo) string {
+	return `"` + strconv.FormatInt(t.Version, 10) + `"`
+}
+
+// etagMatches reports whether an If-Match header allows writing t. An empty
+// header means the request is unconditional.
+func etagMatches(ifMatch string, t Todo) bool {
+	if ifMatch == "" {
+		return true
+	}
+	current := etag(t)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == current {
+			return true
+		}
+	}
+	return false
 }
@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
-	"sync"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,13 +16,42 @@ import (
 func init() {
 	// Set the testing mode for gin
 	gin.SetMode(gin.TestMode)
+}
+
+// testArgon2Memory is the Argon2id memory cost, in KiB, of test apps.
+const testArgon2Memory = 1024
+
+// newTestApp returns an App with fresh stores and, as serve would, the
+// bootstrap admin in place. The backend comes from the
+// STORAGE environment variable, so `STORAGE=sqlite go test ./...` runs the
+// handler tests against SQLite.
+func newTestApp(t *testing.T, cfg Config) *App {
+	t.Helper()
+	cfg.Storage = getEnv("STORAGE", StorageMemory)
+	cfg.DataDir = t.TempDir()
+	cfg.SQLitePath = filepath.Join(cfg.DataDir, "todoapp.db")
+	cfg.MigrateOnStart = true
+	cfg.RaftNodeID, cfg.RaftAddr = "node1", "127.0.0.1:0"
+	if cfg.PasswordHash == "" && cfg.Argon2Memory == 0 {
+		cfg.Argon2Memory, cfg.Argon2Iterations = testArgon2Memory, 1 // cheap hashes keep tests fast
+	}
 
-	testSecret := "testsecret_standard"
-	os.Setenv("JWT_SECRET", testSecret)
-	Init(testSecret)
+	a, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open %s store: %v", cfg.Storage, err)
+	}
+	t.Cleanup(func() { a.Close() })
+	if err := a.BootstrapAdmin(); err != nil {
+		t.Fatalf("Bootstrap admin: %v", err)
+	}
+	return a
 }
 
 func performRequest(r *gin.Engine, method, path string, body interface{}, token string) *httptest.ResponseRecorder {
+	return performRequestWithHeaders(r, method, path, body, token, nil)
+}
+
+func performRequestWithHeaders(r *gin.Engine, method, path string, body interface{}, token string, headers map[string]string) *httptest.ResponseRecorder {
 	var buf bytes.Buffer
 	if body != nil {
 		_ = json.NewEncoder(&buf).Encode(body)
@@ -32,16 +61,16 @@ func performRequest(r *gin.Engine, method, path string, body interface{}, token
 	if token != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 	return w
 }
 
 func TestFullCRUDFlow(t *testing.T) {
-	Users = sync.Map{}
-	Todos = sync.Map{}
-
-	r := SetupRouter()
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_standard"}))
 
 	regBody := Credentials{Username: "alice", Password: "pass"}
 	w := performRequest(r, "POST", "/register", regBody, "")
@@ -107,3 +136,210 @@ func TestFullCRUDFlow(t *testing.T) {
 		t.Fatalf("Expected 0 todos got %d", len(list))
 	}
 }
+
+func TestAppInstancesAreIsolated(t *testing.T) {
+	r1 := SetupRouter(newTestApp(t, Config{JWTSecret: "secret_one"}))
+	r2 := SetupRouter(newTestApp(t, Config{JWTSecret: "secret_two"}))
+
+	creds := Credentials{Username: "alice", Password: "pass"}
+	if w := performRequest(r1, "POST", "/register", creds, ""); w.Code != http.StatusCreated {
+		t.Fatalf("Register on first app failed: %d body=%s", w.Code, w.Body.String())
+	}
+	if w := performRequest(r2, "POST", "/register", creds, ""); w.Code != http.StatusCreated {
+		t.Fatalf("Register on second app failed: %d body=%s", w.Code, w.Body.String())
+	}
+
+	w := performRequest(r1, "POST", "/login", creds, "")
+	var loginResp map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &loginResp)
+	token := loginResp["token"]
+
+	w = performRequest(r1, "POST", "/todos", map[string]string{"title": "only in one"}, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create todo failed: %d body=%s", w.Code, w.Body.String())
+	}
+
+	// A token signed with the first app's secret is rejected by the second
+	w = performRequest(r2, "GET", "/todos", nil, token)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 from second app got %d", w.Code)
+	}
+
+	w = performRequest(r2, "POST", "/login", creds, "")
+	_ = json.Unmarshal(w.Body.Bytes(), &loginResp)
+	w = performRequest(r2, "GET", "/todos", nil, loginResp["token"])
+	var list []Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 0 {
+		t.Fatalf("Expected second app to have 0 todos got %d", len(list))
+	}
+}
+
+// registerAndLogin creates a user on r and returns a token for them
+func registerAndLogin(t testing.TB, r *gin.Engine, username, password string) string {
+	t.Helper()
+	creds := Credentials{Username: username, Password: password}
+	if w := performRequest(r, "POST", "/register", creds, ""); w.Code != http.StatusCreated {
+		t.Fatalf("Register failed: %d body=%s", w.Code, w.Body.String())
+	}
+	return login(t, r, username, password)
+}
+
+func login(t testing.TB, r *gin.Engine, username, password string) string {
+	t.Helper()
+	w := performRequest(r, "POST", "/login", Credentials{Username: username, Password: password}, "")
+	var loginResp map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &loginResp)
+	if loginResp["token"] == "" {
+		t.Fatalf("Login failed: %d body=%s", w.Code, w.Body.String())
+	}
+	return loginResp["token"]
+}
+
+func TestIfMatchPreconditions(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_etag", ConcurrencyMode: SafeMode}))
+	token := registerAndLogin(t, r, "alice", "pass")
+
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "v1"}, token)
+	var created Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Version != 1 || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected version 1 and ETag \"1\", got %d and %s", created.Version, w.Header().Get("ETag"))
+	}
+
+	w = performRequest(r, "GET", "/todos/"+created.ID, nil, token)
+	if w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected GET ETag \"1\" got %s", w.Header().Get("ETag"))
+	}
+
+	title := "v2"
+	w = performRequestWithHeaders(r, "PUT", "/todos/"+created.ID, UpdateTodoRequest{Title: &title}, token, map[string]string{"If-Match": `"1"`})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Conditional update failed: %d ETag=%s body=%s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+
+	// A second writer still holding version 1 must not overwrite version 2
+	stale := "stale"
+	w = performRequestWithHeaders(r, "PUT", "/todos/"+created.ID, UpdateTodoRequest{Title: &stale}, token, map[string]string{"If-Match": `"1"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for stale update got %d", w.Code)
+	}
+	var current Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &current)
+	if current.Title != "v2" || current.Version != 2 || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected current representation v2, got %+v ETag=%s", current, w.Header().Get("ETag"))
+	}
+
+	w = performRequestWithHeaders(r, "DELETE", "/todos/"+created.ID, nil, token, map[string]string{"If-Match": `"1"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for stale delete got %d", w.Code)
+	}
+
+	w = performRequestWithHeaders(r, "DELETE", "/todos/"+created.ID, nil, token, map[string]string{"If-Match": `"7", "2"`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Conditional delete failed: %d body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestTodoHistoryAndRevert(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_history", ConcurrencyMode: SafeMode}))
+	token := registerAndLogin(t, r, "alice", "pass")
+
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "draft"}, token)
+	var created Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+	title, done := "final", true
+	performRequest(r, "PUT", "/todos/"+created.ID, UpdateTodoRequest{Title: &title}, token)
+	performRequest(r, "PUT", "/todos/"+created.ID, UpdateTodoRequest{Completed: &done}, token)
+
+	w = performRequest(r, "GET", "/todos/"+created.ID+"/history", nil, token)
+	var history []Revision
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	if w.Code != http.StatusOK || len(history) != 2 {
+		t.Fatalf("Expected two revisions got %d: %s", w.Code, w.Body.String())
+	}
+	first := history[0]
+	if first.Revision != 2 || first.Author != "alice" || len(first.Changes) != 1 ||
+		first.Changes[0].Field != "title" || first.Changes[0].Old != "draft" || first.Changes[0].New != "final" {
+		t.Fatalf("Unexpected first revision %+v", first)
+	}
+	if history[1].Revision != 3 || history[1].Changes[0].Field != "completed" {
+		t.Fatalf("Unexpected second revision %+v", history[1])
+	}
+
+	// An update that changes nothing keeps the version and records nothing.
+	w = performRequestWithHeaders(r, "PUT", "/todos/"+created.ID, UpdateTodoRequest{Title: &title, Completed: &done}, token, map[string]string{"If-Match": `"3"`})
+	var unchanged Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &unchanged)
+	if w.Code != http.StatusOK || unchanged.Version != 3 || w.Header().Get("ETag") != `"3"` {
+		t.Fatalf("Expected the todo returned unchanged, got %d %s", w.Code, w.Body.String())
+	}
+	w = performRequest(r, "GET", "/todos/"+created.ID+"/history", nil, token)
+	if _ = json.Unmarshal(w.Body.Bytes(), &history); len(history) != 2 {
+		t.Fatalf("Expected no revision for an unchanged todo, got %s", w.Body.String())
+	}
+
+	// Undo the title edit; the later completion stays.
+	w = performRequestWithHeaders(r, "POST", "/todos/"+created.ID+"/revert/2", nil, token, map[string]string{"If-Match": `"3"`})
+	var reverted Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &reverted)
+	if w.Code != http.StatusOK || reverted.Title != "draft" || !reverted.Completed || reverted.Version != 4 {
+		t.Fatalf("Revert failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w = performRequest(r, "GET", "/todos/"+created.ID+"/history", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history) != 3 || history[2].Changes[0].Old != "final" || history[2].Changes[0].New != "draft" {
+		t.Fatalf("Expected the revert to be recorded, got %s", w.Body.String())
+	}
+
+	if w := performRequestWithHeaders(r, "POST", "/todos/"+created.ID+"/revert/2", nil, token, map[string]string{"If-Match": `"3"`}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for stale revert got %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/todos/"+created.ID+"/revert/9", nil, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown revision got %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/todos/"+created.ID+"/revert/abc", nil, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for malformed revision got %d", w.Code)
+	}
+
+	// Another user sees neither the todo nor its history.
+	bob := registerAndLogin(t, r, "bob", "pass")
+	if w := performRequest(r, "GET", "/todos/"+created.ID+"/history", nil, bob); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for another user's history got %d", w.Code)
+	}
+}
+
+func TestTodoTimestampsFollowTheClock(t *testing.T) {
+	clock := &testClock{time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+	a := newTestApp(t, Config{JWTSecret: "testsecret_clock", ConcurrencyMode: SafeMode})
+	a.Clock = clock.Now
+	r := SetupRouter(a)
+	token := registerAndLogin(t, r, "alice", "pass")
+
+	created := postJSON(t, r, "/todos", Todo{Title: "draft"}, token, http.StatusCreated)
+	id := created["id"].(string)
+	if created["created_at"] != "2026-10-16T12:00:00Z" {
+		t.Fatalf("Expected the clock's creation time, got %v", created["created_at"])
+	}
+
+	clock.Advance(time.Minute)
+	title := "final"
+	performRequest(r, "PUT", "/todos/"+id, UpdateTodoRequest{Title: &title}, token)
+	var history []Revision
+	w := performRequest(r, "GET", "/todos/"+id+"/history", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history) != 1 || !history[0].At.Equal(clock.Now()) {
+		t.Fatalf("Expected the revision at the clock's time, got %s", w.Body.String())
+	}
+
+	clock.Advance(time.Minute)
+	performRequest(r, "DELETE", "/todos/"+id, nil, token)
+	var trash []Todo
+	w = performRequest(r, "GET", "/trash", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &trash)
+	if len(trash) != 1 || trash[0].DeletedAt == nil || !trash[0].DeletedAt.Equal(clock.Now()) {
+		t.Fatalf("Expected the deletion at the clock's time, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultKeyID is the kid of the HS256 key made from Config.JWTSecret.
+const DefaultKeyID = "default"
+
+// minRSABits is the smallest RSA key a KeyRing accepts.
+const minRSABits = 2048
+
+// Errors returned by KeyRing.Keyfunc.
+var (
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrKeyAlgorithm = errors.New("algorithm does not match the signing key")
+)
+
+// SigningKey is one key of a KeyRing. Secret keys sign and verify HS256
+// with the same bytes. RSA keys sign RS256 and Ed25519 keys EdDSA with
+// Private and verify with Public; a key without Private only verifies.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private any // []byte, *rsa.PrivateKey or ed25519.PrivateKey
+	Public  any // []byte, *rsa.PublicKey or ed25519.PublicKey
+}
+
+// NewSecretKey returns an HS256 key.
+func NewSecretKey(id string, secret []byte) SigningKey {
+	return SigningKey{ID: id, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+}
+
+// ParseSigningKey reads a key from the contents of a key file. PEM encoded
+// RSA and Ed25519 private keys (PKCS #8, or PKCS #1 for RSA) sign and
+// verify, PEM public keys only verify, and anything else is taken as an
+// HS256 secret with surrounding whitespace trimmed.
+func ParseSigningKey(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return SigningKey{}, fmt.Errorf("key %s: empty secret", id)
+		}
+		return NewSecretKey(id, secret), nil
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("key %s: unsupported PEM block %q", id, block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("key %s: %w", id, err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return newRSAKey(id, k, &k.PublicKey)
+	case *rsa.PublicKey:
+		return newRSAKey(id, nil, k)
+	case ed25519.PrivateKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, Private: k, Public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, Public: k}, nil
+	}
+	return SigningKey{}, fmt.Errorf("key %s: unsupported key type %T", id, key)
+}
+
+func newRSAKey(id string, private *rsa.PrivateKey, public *rsa.PublicKey) (SigningKey, error) {
+	if public.N.BitLen() < minRSABits {
+		return SigningKey{}, fmt.Errorf("key %s: RSA keys need at least %d bits", id, minRSABits)
+	}
+	key := SigningKey{ID: id, Method: jwt.SigningMethodRS256, Public: public}
+	if private != nil {
+		key.Private = private
+	}
+	return key, nil
+}
+
+// KeyRing holds the keys access tokens are verified with, selected by the
+// token's kid header, and the current key new tokens are signed with.
+// Rotating means adding a key everywhere, then making it current, then
+// dropping the old key once the tokens it signed have expired.
+type KeyRing struct {
+	keys    map[string]SigningKey
+	current SigningKey
+}
+
+// NewKeyRing returns a ring of keys that signs with the key named current.
+func NewKeyRing(keys []SigningKey, current string) (*KeyRing, error) {
+	r := &KeyRing{keys: make(map[string]SigningKey, len(keys))}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("signing key without an ID")
+		}
+		if _, ok := r.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key %s", key.ID)
+		}
+		r.keys[key.ID] = key
+	}
+	key, ok := r.keys[current]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", current)
+	}
+	if key.Private == nil {
+		return nil, fmt.Errorf("signing key %s has no private key", current)
+	}
+	r.current = key
+	return r, nil
+}
+
+// LoadKeyRing builds the ring described by cfg: the JWTSecret key under
+// DefaultKeyID, if set, and every key file in JWTKeys. The current key is
+// JWTSigningKey, or else the JWTSecret key, or else the first key file, so
+// adding a key never changes which one signs. JWTAlgorithms, when set, must
+// accept the current key's algorithm.
+func LoadKeyRing(cfg Config) (*KeyRing, error) {
+	var keys []SigningKey
+	if cfg.JWTSecret != "" {
+		keys = append(keys, NewSecretKey(DefaultKeyID, []byte(cfg.JWTSecret)))
+	}
+	for _, entry := range cfg.JWTKeys {
+		id, path, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT key %q, want kid=path", entry)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseSigningKey(id, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no JWT signing keys configured")
+	}
+
+	current := cfg.JWTSigningKey
+	if current == "" {
+		current = keys[0].ID
+	}
+	r, err := NewKeyRing(keys, current)
+	if err != nil {
+		return nil, err
+	}
+	for _, alg := range cfg.JWTAlgorithms {
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unknown JWT algorithm %q", alg)
+		}
+	}
+	if alg := r.current.Method.Alg(); len(cfg.JWTAlgorithms) > 0 && !slices.Contains(cfg.JWTAlgorithms, alg) {
+		return nil, fmt.Errorf("JWT algorithms exclude %s, which signing key %s uses", alg, r.current.ID)
+	}
+	return r, nil
+}
+
+// Sign returns claims as a token signed with the current key.
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.current.Method, claims)
+	token.Header["kid"] = r.current.ID
+	return token.SignedString(r.current.Private)
+}
+
+// Keyfunc returns the key that verifies token. Tokens without a kid were
+// issued before key rotation and are checked against the DefaultKeyID
+// key. The token's algorithm must be the one its key is for, so a public
+// key can never be used as an HMAC secret.
+func (r *KeyRing) Keyfunc(token *jwt.Token) (any, error) {
+	kid := DefaultKeyID
+	if v, ok := token.Header["kid"]; ok {
+		if kid, ok = v.(string); !ok {
+			return nil, fmt.Errorf("%w: kid is not a string", ErrUnknownKey)
+		}
+	}
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("%w: key %s does not sign %s", ErrKeyAlgorithm, kid, token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// Algorithms returns the algorithms of the ring's keys, sorted.
+func (r *KeyRing) Algorithms() []string {
+	var algs []string
+	for _, key := range r.keys {
+		if alg := key.Method.Alg(); !slices.Contains(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the body of the JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the ring's asymmetric public keys ordered by kid. Secret
+// keys are never published.
+func (r *KeyRing) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range r.keys {
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// JWKSHandler publishes the public keys other services verify access
+// tokens with.
+func (a *App) JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, a.Keys.JWKS())
+}
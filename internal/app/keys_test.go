@@ -0,0 +1,225 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newRSAKeyFile(t *testing.T, dir, name string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	return writePEM(t, dir, name, "PRIVATE KEY", der), key
+}
+
+func newEd25519KeyFile(t *testing.T, dir, name string) (string, ed25519.PrivateKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	return writePEM(t, dir, name, "PRIVATE KEY", der), key
+}
+
+func tokenHeader(t *testing.T, token string) map[string]any {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Header
+}
+
+func TestKeyRotationKeepsSessionsAlive(t *testing.T) {
+	dir := t.TempDir()
+	rsaPath, _ := newRSAKeyFile(t, dir, "rsa.pem")
+	edPath, _ := newEd25519KeyFile(t, dir, "ed.pem")
+	cfg := Config{JWTSecret: "testsecret_keys", ConcurrencyMode: SafeMode}
+	a := newTestApp(t, cfg)
+	r := SetupRouter(a)
+
+	registerAndLogin(t, r, "alice", "pass")
+	old := loginPair(t, r, "alice", "pass")
+	if h := tokenHeader(t, old.Token); h["kid"] != DefaultKeyID || h["alg"] != "HS256" {
+		t.Fatalf("Expected the secret key to sign by default, got %v", h)
+	}
+
+	// Add the new keys everywhere first; signing does not move yet
+	cfg.JWTKeys = []string{"rsa-1=" + rsaPath, "ed-1=" + edPath}
+	keys, err := LoadKeyRing(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Keys = keys
+	if h := tokenHeader(t, loginPair(t, r, "alice", "pass").Token); h["kid"] != DefaultKeyID {
+		t.Fatalf("Expected adding keys to leave signing alone, got %v", h)
+	}
+
+	for _, kid := range []string{"rsa-1", "ed-1"} {
+		cfg.JWTSigningKey = kid
+		if a.Keys, err = LoadKeyRing(cfg); err != nil {
+			t.Fatal(err)
+		}
+		next, w := refresh(r, old.RefreshToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Refresh failed: %d body=%s", w.Code, w.Body.String())
+		}
+		if h := tokenHeader(t, next.Token); h["kid"] != kid {
+			t.Fatalf("Expected tokens signed with %s, got %v", kid, h)
+		}
+		for _, token := range []string{old.Token, next.Token} {
+			if w := performRequest(r, "GET", "/todos", nil, token); w.Code != http.StatusOK {
+				t.Fatalf("Expected tokens of every key in the ring accepted, got %d", w.Code)
+			}
+		}
+		old = next
+	}
+
+	// Dropping a key retires the tokens it signed, and only those
+	edOnly := old.Token
+	cfg.JWTSecret, cfg.JWTKeys = "", []string{"ed-1=" + edPath}
+	if a.Keys, err = LoadKeyRing(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if w := performRequest(r, "GET", "/todos", nil, edOnly); w.Code != http.StatusOK {
+		t.Fatalf("Expected the remaining key's token accepted, got %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/login", Credentials{Username: "alice", Password: "pass"}, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected login to work without the secret, got %d", w.Code)
+	}
+}
+
+func TestKeyfuncRejectsForeignTokens(t *testing.T) {
+	dir := t.TempDir()
+	rsaPath, _ := newRSAKeyFile(t, dir, "rsa.pem")
+	keys, err := LoadKeyRing(Config{JWTSecret: "testsecret_keys", JWTKeys: []string{"rsa-1=" + rsaPath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"user": "alice", "jti": "x", "exp": time.Now().Add(time.Minute).Unix()}
+
+	// The RSA public key used as an HMAC secret
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	confused.Header["kid"] = "rsa-1"
+	pub, _ := x509.MarshalPKIXPublicKey(keys.keys["rsa-1"].Public)
+	confusedString, _ := confused.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	unknown.Header["kid"] = "gone"
+	unknownString, _ := unknown.SignedString([]byte("testsecret_keys"))
+
+	legacyString, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("testsecret_keys"))
+
+	for name, token := range map[string]string{"algorithm mismatch": confusedString, "unknown kid": unknownString} {
+		if _, err := jwt.Parse(token, keys.Keyfunc); err == nil {
+			t.Fatalf("%s: expected the token rejected", name)
+		}
+	}
+	if _, err := jwt.Parse(legacyString, keys.Keyfunc); err != nil {
+		t.Fatalf("Expected a token without kid checked against the default key, got %v", err)
+	}
+}
+
+func TestJWKSPublishesPublicKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaPath, rsaKey := newRSAKeyFile(t, dir, "rsa.pem")
+	edPath, _ := newEd25519KeyFile(t, dir, "ed.pem")
+	a := newTestApp(t, Config{JWTSecret: "testsecret_keys", ConcurrencyMode: SafeMode})
+	keys, err := LoadKeyRing(Config{
+		JWTSecret:     "testsecret_keys",
+		JWTKeys:       []string{"rsa-1=" + rsaPath, "ed-1=" + edPath},
+		JWTSigningKey: "ed-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Keys = keys
+	r := SetupRouter(a)
+
+	w := performRequest(r, "GET", "/.well-known/jwks.json", nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), base64.RawURLEncoding.EncodeToString([]byte("testsecret_keys"))) {
+		t.Fatal("The HMAC secret was published")
+	}
+	var set JWKSet
+	json.Unmarshal(w.Body.Bytes(), &set)
+	if len(set.Keys) != 2 || set.Keys[0].Kid != "ed-1" || set.Keys[1].Kid != "rsa-1" {
+		t.Fatalf("Expected the two public keys, got %+v", set.Keys)
+	}
+	if n := set.Keys[1].N; n != base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()) || set.Keys[1].E != "AQAB" {
+		t.Fatalf("Unexpected RSA key %+v", set.Keys[1])
+	}
+
+	// Another service verifies a token with nothing but the published key
+	registerAndLogin(t, r, "alice", "pass")
+	token := loginPair(t, r, "alice", "pass").Token
+	x, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].X)
+	parsed, err := jwt.Parse(token, func(*jwt.Token) (any, error) { return ed25519.PublicKey(x), nil },
+		jwt.WithValidMethods([]string{set.Keys[0].Alg}))
+	if err != nil || !parsed.Valid {
+		t.Fatalf("Expected the token verified with the JWK, got %v", err)
+	}
+}
+
+func TestLoadKeyRingErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, rsaKey := newRSAKeyFile(t, dir, "rsa.pem")
+	pub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	pubPath := writePEM(t, dir, "rsa.pub", "PUBLIC KEY", pub)
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	smallPath := writePEM(t, dir, "small.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(small))
+	certPath := writePEM(t, dir, "cert.pem", "CERTIFICATE", []byte("x"))
+	secretPath := filepath.Join(dir, "secret")
+	os.WriteFile(secretPath, []byte("another-secret\n"), 0o600)
+
+	for name, cfg := range map[string]Config{
+		"nothing":           {},
+		"bad entry":         {JWTSecret: "s", JWTKeys: []string{"rsa.pem"}},
+		"missing file":      {JWTSecret: "s", JWTKeys: []string{"k=" + filepath.Join(dir, "none")}},
+		"duplicate kid":     {JWTSecret: "s", JWTKeys: []string{DefaultKeyID + "=" + secretPath}},
+		"unknown signer":    {JWTSecret: "s", JWTSigningKey: "other"},
+		"public key signer": {JWTSecret: "s", JWTKeys: []string{"pub=" + pubPath}, JWTSigningKey: "pub"},
+		"short RSA key":     {JWTSecret: "s", JWTKeys: []string{"small=" + smallPath}},
+		"unsupported PEM":   {JWTSecret: "s", JWTKeys: []string{"cert=" + certPath}},
+	} {
+		if _, err := LoadKeyRing(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	keys, err := LoadKeyRing(Config{JWTKeys: []string{"s=" + secretPath, "pub=" + pubPath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keys.current; key.ID != "s" || string(key.Private.([]byte)) != "another-secret" {
+		t.Fatalf("Expected the trimmed secret file to sign, got %+v", key)
+	}
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Codes sent with the 429 responses of a refused login.
+const (
+	CodeAccountLocked  = "account_locked"
+	CodeAddressLocked  = "address_locked"
+	CodeLoginThrottled = "login_throttled"
+)
+
+// maxDelayDoublings bounds the progressive delay's exponent so the shift
+// cannot overflow before LoginLockout caps it.
+const maxDelayDoublings = 30
+
+// accountKey and addressKey name the failed login counters of an account
+// and of a client address.
+func accountKey(username string) string { return "user:" + username }
+func addressKey(ip string) string       { return "ip:" + ip }
+
+// loginLock is why a login is refused before its password is checked.
+type loginLock struct {
+	code    string
+	message string
+	until   time.Time
+}
+
+// respond sends the 429 for l, with Retry-After in whole seconds.
+func (l loginLock) respond(c *gin.Context, now time.Time) {
+	retry := int64((l.until.Sub(now) + time.Second - 1) / time.Second)
+	if retry < 1 {
+		retry = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(retry, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": l.message, "code": l.code})
+}
+
+// errLoginLocked aborts reserving a login against a locked counter.
+var errLoginLocked = errors.New("login locked")
+
+// loginAttempt is a login counted as a failure against its account and
+// client address before its credentials are checked. Checking them is
+// slow, so counting only once they turn out wrong would let a burst of
+// concurrent guesses all get past the lock before any of them counted.
+// Handlers defer release, which gives the reservations back unless fail
+// kept them or succeed settled them.
+type loginAttempt struct {
+	a        *App
+	username string
+	taken    []reservation
+}
+
+// reservation is the record under key before and after a loginAttempt
+// counted against it.
+type reservation struct {
+	key           string
+	before, after LoginAttempts
+}
+
+// reserveLogin counts a login by username from ip at now, unless either is
+// locked, in which case nothing is counted and the lock is returned.
+// Unknown usernames are counted like real ones, so a lock says nothing
+// about whether an account exists. The address goes first, so a locked
+// address adds nothing to the accounts it guesses at.
+func (a *App) reserveLogin(username, ip string, now time.Time) (*loginAttempt, *loginLock, error) {
+	l := &loginAttempt{a: a, username: username}
+	if a.Config.LoginIPMaxFailures > 0 {
+		r, err := l.reserve(addressKey(ip), a.Config.LoginIPMaxFailures, 0, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r != nil {
+			return nil, &loginLock{CodeAddressLocked, "Too many failed logins from this address", r.LockedUntil}, nil
+		}
+	}
+	if a.Config.LoginMaxFailures > 0 || a.Config.LoginDelay > 0 {
+		r, err := l.reserve(accountKey(username), a.Config.LoginMaxFailures, a.Config.LoginDelay, now)
+		if err != nil || r != nil {
+			l.release()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if r != nil {
+			if a.Config.LoginMaxFailures > 0 && r.Failures >= a.Config.LoginMaxFailures {
+				return nil, &loginLock{CodeAccountLocked, "Account locked after too many failed logins", r.LockedUntil}, nil
+			}
+			return nil, &loginLock{CodeLoginThrottled, "Too many failed logins, retry later", r.LockedUntil}, nil
+		}
+	}
+	return l, nil, nil
+}
+
+// reserve counts a failure under key in one update of the store. If the
+// key is locked at now it counts nothing and returns the locked record.
+func (l *loginAttempt) reserve(key string, threshold int, delay time.Duration, now time.Time) (*LoginAttempts, error) {
+	var before LoginAttempts
+	after, err := l.a.Attempts.Update(key, func(r *LoginAttempts) error {
+		before = *r
+		if now.Before(r.LockedUntil) {
+			return errLoginLocked
+		}
+		l.a.countFailure(r, threshold, delay, now)
+		return nil
+	})
+	if errors.Is(err, errLoginLocked) {
+		return &before, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.taken = append(l.taken, reservation{key, before, after})
+	return nil, nil
+}
+
+// fail keeps the login counted: its credentials were wrong.
+func (l *loginAttempt) fail() {
+	l.taken = nil
+}
+
+// succeed forgets the account's failures and gives back the rest of the
+// reservation. The client address keeps the failures it had, or a valid
+// account would let one address guess at every other account.
+func (l *loginAttempt) succeed() {
+	for _, r := range l.taken {
+		if r.key == accountKey(l.username) {
+			l.a.clearLoginFailures(l.username)
+		} else {
+			l.giveBack(r)
+		}
+	}
+	l.taken = nil
+}
+
+// release gives back whatever the login still holds, so a login refused
+// for anything but wrong credentials is not counted against anyone.
+func (l *loginAttempt) release() {
+	for i := len(l.taken) - 1; i >= 0; i-- {
+		l.giveBack(l.taken[i])
+	}
+	l.taken = nil
+}
+
+// giveBack undoes r. If nothing has counted against the key since, the
+// record returns to what it was, lock included; otherwise only the
+// failure is taken off, and the later failures' lock stands. The login
+// goes ahead either way, so failures are only logged.
+func (l *loginAttempt) giveBack(r reservation) {
+	_, err := l.a.Attempts.Update(r.key, func(a *LoginAttempts) error {
+		if a.Failures == r.after.Failures && a.LastFailure.Equal(r.after.LastFailure) {
+			*a = r.before
+		} else if a.Failures > 0 {
+			a.Failures--
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("give back login attempt %s: %v", r.key, err)
+	}
+}
+
+// countFailure adds a failure to r. Reaching threshold locks the key for
+// LoginLockout; below it, delay doubles with every failure. A count that
+// reached the threshold starts over once the lock has run out.
+func (a *App) countFailure(r *LoginAttempts, threshold int, delay time.Duration, now time.Time) {
+	if now.Sub(r.LastFailure) > a.Config.LoginFailureWindow || (threshold > 0 && r.Failures >= threshold) {
+		r.Failures = 0
+	}
+	r.Failures++
+	r.LastFailure = now
+	switch {
+	case threshold > 0 && r.Failures >= threshold:
+		r.LockedUntil = now.Add(a.Config.LoginLockout)
+	case delay > 0:
+		r.LockedUntil = now.Add(progressiveDelay(delay, r.Failures, a.Config.LoginLockout))
+	}
+	r.ExpiresAt = now.Add(a.Config.LoginFailureWindow)
+	if r.LockedUntil.After(r.ExpiresAt) {
+		r.ExpiresAt = r.LockedUntil
+	}
+}
+
+// progressiveDelay is delay doubled for every failure after the first, at
+// most limit.
+func progressiveDelay(delay time.Duration, failures int, limit time.Duration) time.Duration {
+	d := delay << min(failures-1, maxDelayDoublings)
+	if d <= 0 || d > limit {
+		return limit
+	}
+	return d
+}
+
+// clearLoginFailures forgets the failures of username. The login or reset
+// that called it succeeds either way, so failures are only logged.
+func (a *App) clearLoginFailures(username string) {
+	if err := a.Attempts.Delete(accountKey(username)); err != nil {
+		log.Printf("clear login failures of %s: %v", username, err)
+	}
+}
+
+// UnlockUserHandler lifts a lockout or delay on an account and clears its
+// failed login count.
+func (a *App) UnlockUserHandler(c *gin.Context) {
+	username := c.Param("username")
+	if _, err := a.Users.Get(username); errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	if err := a.Attempts.Delete(accountKey(username)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked"})
+}
+
+// checkTrustedProxies rejects entries of Config.TrustedProxies that are
+// neither an IP address nor a CIDR range.
+func checkTrustedProxies(proxies []string) error {
+	for _, p := range proxies {
+		if _, err := netip.ParsePrefix(p); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(p); err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// attemptLogin posts credentials from the test client, adding headers.
+func attemptLogin(r *gin.Engine, username, password string, headers map[string]string) *httptest.ResponseRecorder {
+	return performRequestWithHeaders(r, "POST", "/login", Credentials{Username: username, Password: password}, "", headers)
+}
+
+// lockedFor checks that w refused a login with code and returns its
+// Retry-After.
+func lockedFor(t *testing.T, w *httptest.ResponseRecorder, code string) string {
+	t.Helper()
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusTooManyRequests || body["code"] != code {
+		t.Fatalf("Expected 429 %s, got %d body=%s", code, w.Code, w.Body.String())
+	}
+	return w.Header().Get("Retry-After")
+}
+
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{
+		JWTSecret:        "testsecret_lockout",
+		ConcurrencyMode:  SafeMode,
+		AdminUsers:       []string{"root"},
+		LoginMaxFailures: 3,
+		LoginLockout:     time.Hour,
+	}))
+	root := registerAndLogin(t, r, "root", "pass")
+	bob := registerAndLogin(t, r, "bob", "pass")
+	performRequest(r, "POST", "/register", Credentials{Username: "alice", Password: "pass"}, "")
+
+	for i := 0; i < 3; i++ {
+		if w := attemptLogin(r, "alice", "wrong", nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected 401 got %d", i+1, w.Code)
+		}
+	}
+	if retry := lockedFor(t, attemptLogin(r, "alice", "pass", nil), CodeAccountLocked); retry != "3600" {
+		t.Fatalf("Expected Retry-After 3600, got %q", retry)
+	}
+	login(t, r, "bob", "pass")
+
+	// Accounts that do not exist lock the same way
+	for i := 0; i < 3; i++ {
+		attemptLogin(r, "mallory", "guess", nil)
+	}
+	lockedFor(t, attemptLogin(r, "mallory", "guess", nil), CodeAccountLocked)
+
+	if w := performRequest(r, "POST", "/admin/users/alice/unlock", nil, bob); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected non-admins refused, got %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/admin/users/nobody/unlock", nil, root); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown user, got %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/admin/users/alice/unlock", nil, root); w.Code != http.StatusOK {
+		t.Fatalf("Expected unlock to succeed, got %d body=%s", w.Code, w.Body.String())
+	}
+	login(t, r, "alice", "pass")
+
+	// A successful login starts the count over
+	attemptLogin(r, "alice", "wrong", nil)
+	attemptLogin(r, "alice", "wrong", nil)
+	login(t, r, "alice", "pass")
+	attemptLogin(r, "alice", "wrong", nil)
+	login(t, r, "alice", "pass")
+}
+
+func TestLoginProgressiveDelay(t *testing.T) {
+	a := newTestApp(t, Config{
+		JWTSecret:        "testsecret_lockout",
+		ConcurrencyMode:  SafeMode,
+		LoginMaxFailures: 4,
+		LoginDelay:       time.Minute,
+		LoginLockout:     time.Hour,
+	})
+	r := SetupRouter(a)
+	registerAndLogin(t, r, "alice", "pass")
+
+	// Let each delay run out by moving the lock into the past
+	expire := func() {
+		a.Attempts.Update(accountKey("alice"), func(r *LoginAttempts) error {
+			r.LockedUntil = time.Now().Add(-time.Second)
+			return nil
+		})
+	}
+	for i, want := range []string{"60", "120", "240"} {
+		attemptLogin(r, "alice", "wrong", nil)
+		if retry := lockedFor(t, attemptLogin(r, "alice", "pass", nil), CodeLoginThrottled); retry != want {
+			t.Fatalf("Failure %d: expected Retry-After %s, got %s", i+1, want, retry)
+		}
+		expire()
+	}
+	attemptLogin(r, "alice", "wrong", nil)
+	lockedFor(t, attemptLogin(r, "alice", "pass", nil), CodeAccountLocked)
+
+	if d := progressiveDelay(time.Second, 200, time.Hour); d != time.Hour {
+		t.Fatalf("Expected the delay capped at the lockout, got %v", d)
+	}
+}
+
+func TestLoginAddressLockout(t *testing.T) {
+	cfg := Config{
+		JWTSecret:          "testsecret_lockout",
+		ConcurrencyMode:    SafeMode,
+		LoginIPMaxFailures: 3,
+		LoginLockout:       time.Hour,
+	}
+	r := SetupRouter(newTestApp(t, cfg))
+	registerAndLogin(t, r, "alice", "pass")
+
+	// One address guessing at several accounts; a successful login does
+	// not reset the address
+	attemptLogin(r, "bob", "guess", nil)
+	attemptLogin(r, "carol", "guess", nil)
+	login(t, r, "alice", "pass")
+	attemptLogin(r, "dave", "guess", nil)
+	spoofed := map[string]string{"X-Forwarded-For": "198.51.100.7"}
+	lockedFor(t, attemptLogin(r, "alice", "pass", spoofed), CodeAddressLocked)
+
+	// Behind a trusted proxy clients are told apart by X-Forwarded-For
+	cfg.TrustedProxies = []string{"192.0.2.0/24"}
+	r = SetupRouter(newTestApp(t, cfg))
+	registerAndLogin(t, r, "alice", "pass")
+	for i := 0; i < 3; i++ {
+		attemptLogin(r, "bob", "guess", spoofed)
+	}
+	lockedFor(t, attemptLogin(r, "alice", "pass", spoofed), CodeAddressLocked)
+	if w := attemptLogin(r, "alice", "pass", map[string]string{"X-Forwarded-For": "198.51.100.8"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected other clients unaffected, got %d", w.Code)
+	}
+
+	cfg.TrustedProxies = []string{"proxy.internal"}
+	if _, err := Open(cfg); err == nil {
+		t.Fatal("Expected an invalid trusted proxy rejected")
+	}
+}
+
+// TestLoginLockoutHoldsUnderConcurrentGuesses fires a burst of wrong
+// passwords at once: no more of them may be checked than the limits allow.
+func TestLoginLockoutHoldsUnderConcurrentGuesses(t *testing.T) {
+	for _, cfg := range []Config{
+		{LoginMaxFailures: 3},
+		{LoginIPMaxFailures: 3},
+	} {
+		cfg.JWTSecret = "testsecret_lockout"
+		cfg.ConcurrencyMode = SafeMode
+		cfg.LoginLockout = time.Hour
+		r := SetupRouter(newTestApp(t, cfg))
+		performRequest(r, "POST", "/register", Credentials{Username: "alice", Password: "pass"}, "")
+
+		const guesses = 20
+		var checked atomic.Int32
+		var wg sync.WaitGroup
+		wg.Add(guesses)
+		for i := 0; i < guesses; i++ {
+			go func() {
+				defer wg.Done()
+				switch w := attemptLogin(r, "alice", "wrong", nil); w.Code {
+				case http.StatusUnauthorized:
+					checked.Add(1)
+				case http.StatusTooManyRequests:
+				default:
+					t.Errorf("Unexpected %d body=%s", w.Code, w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+		if n := checked.Load(); n != 3 {
+			t.Fatalf("%+v: expected 3 guesses checked, got %d", cfg, n)
+		}
+	}
+}
+
+// TestLoginGivesBackItsAttempt checks that logins refused for anything but
+// wrong credentials do not count towards a lock.
+func TestLoginGivesBackItsAttempt(t *testing.T) {
+	a := newTestApp(t, Config{
+		JWTSecret:          "testsecret_lockout",
+		ConcurrencyMode:    SafeMode,
+		AdminUsers:         []string{"root"},
+		LoginMaxFailures:   2,
+		LoginIPMaxFailures: 2,
+		LoginLockout:       time.Hour,
+	})
+	r := SetupRouter(a)
+	root := registerAndLogin(t, r, "root", "pass")
+	performRequest(r, "POST", "/register", Credentials{Username: "alice", Password: "pass"}, "")
+	if w := performRequest(r, "POST", "/admin/users/alice/disable", nil, root); w.Code != http.StatusOK {
+		t.Fatalf("Disable failed: %d body=%s", w.Code, w.Body.String())
+	}
+
+	attemptLogin(r, "alice", "wrong", nil)
+	for i := 0; i < 3; i++ {
+		if w := attemptLogin(r, "alice", "pass", nil); w.Code != http.StatusForbidden {
+			t.Fatalf("Attempt %d: expected the disabled account refused, got %d", i+1, w.Code)
+		}
+	}
+	for _, key := range []string{accountKey("alice"), addressKey("192.0.2.1")} {
+		if r, _ := a.Attempts.Get(key); r.Failures != 1 || !r.LockedUntil.IsZero() {
+			t.Fatalf("Expected %s to hold the one wrong password, got %+v", key, r)
+		}
+	}
+
+	// Unknown usernames are checked against a hash all the same
+	attemptLogin(r, "mallory", "guess", nil)
+	if a.dummyHash.hash == "" {
+		t.Fatal("Expected an unknown username checked against the dummy hash")
+	}
+}
+
+func TestLoginAttemptsSurviveRestart(t *testing.T) {
+	for _, storage := range []string{StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{
+				JWTSecret:        "testsecret_lockout",
+				ConcurrencyMode:  SafeMode,
+				Storage:          storage,
+				DataDir:          dir,
+				SQLitePath:       filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:   true,
+				LoginMaxFailures: 2,
+				LoginLockout:     time.Hour,
+			}
+			a, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := SetupRouter(a)
+			performRequest(r, "POST", "/register", Credentials{Username: "alice", Password: "pass"}, "")
+			attemptLogin(r, "alice", "wrong", nil)
+			attemptLogin(r, "alice", "wrong", nil)
+			a.Close()
+
+			if a, err = Open(cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			lockedFor(t, attemptLogin(SetupRouter(a), "alice", "pass", nil), CodeAccountLocked)
+			// Records outlive neither the lock nor the failure window
+			if n, err := a.Attempts.Prune(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+				t.Fatalf("Expected the record pruned, got %d (err=%v)", n, err)
+			}
+		})
+	}
+}
@@ -1,42 +1,280 @@
 package app
 
 import (
+	"errors"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// Codes in the "code" field of a 401 from AuthMiddleware, one per reason a
+// request is turned away.
+const (
+	CodeMissingAuthorization  = "missing_authorization"
+	CodeInvalidScheme         = "invalid_authorization_scheme"
+	CodeMalformedToken        = "malformed_token"
+	CodeUnsupportedAlgorithm  = "unsupported_algorithm"
+	CodeAlgorithmMismatch     = "algorithm_mismatch"
+	CodeUnknownKey            = "unknown_key"
+	CodeInvalidSignature      = "invalid_signature"
+	CodeTokenExpired          = "token_expired"
+	CodeTokenNotYetValid      = "token_not_yet_valid"
+	CodeInvalidIssuer         = "invalid_issuer"
+	CodeInvalidAudience       = "invalid_audience"
+	CodeMissingClaim          = "missing_claim"
+	CodeTokenRevoked          = "token_revoked"
+	CodeUnknownToken          = "unknown_token"
+	CodeUnknownUser           = "unknown_user"
+	CodeAccountDisabled       = "account_disabled"
+	CodePasswordResetRequired = "password_reset_required"
+)
+
+// errUnsupportedAlgorithm rejects tokens signed with an algorithm the
+// policy does not accept.
+var errUnsupportedAlgorithm = errors.New("signing algorithm not accepted")
+
+// tokenRejection is why AuthMiddleware turned a request away.
+type tokenRejection struct {
+	code  string
+	claim string // the missing claim, for CodeMissingClaim
+}
+
+func (r *tokenRejection) body() gin.H {
+	message := "Invalid token"
+	switch r.code {
+	case CodeMissingAuthorization:
+		message = "Authorization header required"
+	case CodeTokenRevoked:
+		message = "Token revoked"
+	case CodeAccountDisabled:
+		message = "Account disabled"
+	case CodePasswordResetRequired:
+		message = "Password reset required"
+	}
+	body := gin.H{"error": message, "code": r.code}
+	if r.claim != "" {
+		body["claim"] = r.claim
+	}
+	return body
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>"
+// header. The scheme is case-insensitive, as in RFC 6750, but must be
+// followed by exactly one space and a token without whitespace.
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" || strings.ContainsAny(token, " \t\r\n") {
+		return "", false
+	}
+	return token, true
+}
+
+// accessTokenKey returns the key that verifies token, after checking its
+// algorithm is one the policy accepts: Config.JWTAlgorithms, or else those
+// of the key ring.
+func (a *App) accessTokenKey(token *jwt.Token) (any, error) {
+	allowed := a.Config.JWTAlgorithms
+	if len(allowed) == 0 {
+		allowed = a.Keys.Algorithms()
+	}
+	if !slices.Contains(allowed, token.Method.Alg()) {
+		return nil, errUnsupportedAlgorithm
+	}
+	return a.Keys.Keyfunc(token)
+}
+
+// verifyAccessToken checks an Authorization header against the token
+// policy and returns the token's claims.
+func (a *App) verifyAccessToken(header string) (jwt.MapClaims, *tokenRejection) {
+	if header == "" {
+		return nil, &tokenRejection{code: CodeMissingAuthorization}
+	}
+	tokenString, ok := bearerToken(header)
+	if !ok {
+		return nil, &tokenRejection{code: CodeInvalidScheme}
+	}
+
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithLeeway(a.Config.JWTLeeway), jwt.WithIssuedAt(), jwt.WithTimeFunc(a.Clock))
+	if _, err := parser.ParseWithClaims(tokenString, claims, a.accessTokenKey); err != nil {
+		return nil, &tokenRejection{code: tokenErrorCode(err)}
+	}
+
+	required := append([]string{"iss", "aud", "exp", "jti", "user"}, a.Config.JWTRequiredClaims...)
+	for _, name := range required {
+		if v, ok := claims[name]; !ok || v == nil || v == "" {
+			return nil, &tokenRejection{code: CodeMissingClaim, claim: name}
+		}
+	}
+	if iss, err := claims.GetIssuer(); err != nil || iss != a.Config.JWTIssuer {
+		return nil, &tokenRejection{code: CodeInvalidIssuer}
+	}
+	if aud, err := claims.GetAudience(); err != nil || !slices.Contains(aud, a.Config.JWTAudience) {
+		return nil, &tokenRejection{code: CodeInvalidAudience}
+	}
+	for _, name := range []string{"jti", "user", "sid", "scope"} {
+		if _, ok := claims[name].(string); !ok && claims[name] != nil {
+			return nil, &tokenRejection{code: CodeMalformedToken}
+		}
+	}
+	return claims, nil
+}
+
+// tokenErrorCode maps an error from parsing a token to its rejection code.
+func tokenErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errUnsupportedAlgorithm):
+		return CodeUnsupportedAlgorithm
+	case errors.Is(err, ErrKeyAlgorithm):
+		return CodeAlgorithmMismatch
+	case errors.Is(err, ErrUnknownKey):
+		return CodeUnknownKey
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		// The alg header names no algorithm the library knows
+		return CodeUnsupportedAlgorithm
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return CodeInvalidSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return CodeTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return CodeTokenNotYetValid
+	}
+	return CodeMalformedToken
+}
+
+// AuthMiddleware lets through requests with a valid access token and sets
+// username, scopes, jti, sid and token_expires_at, the last moment the
+// token is accepted, on the context. A personal access token sets
+// username, scopes and personal_token, its ID, instead. Either way the
+// token's user must still exist and be enabled, and is set as user.
+// Rejections are 401s whose code says why; RequireScope then checks the
+// scopes.
+func (a *App) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+		header := c.GetHeader("Authorization")
+		if token, ok := bearerToken(header); ok && strings.HasPrefix(token, PersonalTokenPrefix) {
+			pat, rejection, err := a.verifyPersonalToken(token)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+				c.Abort()
+				return
+			}
+			if rejection != nil {
+				c.JSON(http.StatusUnauthorized, rejection.body())
+				c.Abort()
+				return
+			}
+			if !a.requireActiveUser(c, pat.Username) {
+				return
+			}
+			a.touchPersonalToken(pat)
+			c.Set("username", pat.Username)
+			c.Set("personal_token", pat.ID)
+			c.Set("scopes", pat.Scopes)
+			c.Next()
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return JwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		claims, rejection := a.verifyAccessToken(header)
+		if rejection != nil {
+			c.JSON(http.StatusUnauthorized, rejection.body())
 			c.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		// The account comes first: disabling it also revokes its sessions,
+		// and the code should say why
+		user, _ := claims["user"].(string)
+		if !a.requireActiveUser(c, user) {
+			return
+		}
+		jti, _ := claims["jti"].(string)
+		sid, _ := claims["sid"].(string)
+		revoked, err := a.tokenRevoked(jti, sid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusUnauthorized, (&tokenRejection{code: CodeTokenRevoked}).body())
 			c.Abort()
 			return
 		}
 
-		user, _ := claims["user"].(string)
+		scopes, _ := scopeClaim(claims)
 		c.Set("username", user)
+		c.Set("scopes", scopes)
+		c.Set("jti", jti)
+		c.Set("sid", sid)
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			c.Set("token_expires_at", exp.Time.Add(a.Config.JWTLeeway))
+		}
+		c.Next()
+	}
+}
+
+// requireActiveUser looks up the user a token was issued to and stores it
+// in c as "user". Tokens of deleted and disabled users, and of users who
+// must reset their password, are turned away at once: it answers the
+// request and returns false.
+func (a *App) requireActiveUser(c *gin.Context, username string) bool {
+	user, err := a.Users.Get(username)
+	var rejection *tokenRejection
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		rejection = &tokenRejection{code: CodeUnknownUser}
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		c.Abort()
+		return false
+	case user.Disabled:
+		rejection = &tokenRejection{code: CodeAccountDisabled}
+	case user.PasswordResetRequired:
+		rejection = &tokenRejection{code: CodePasswordResetRequired}
+	}
+	if rejection != nil {
+		c.JSON(http.StatusUnauthorized, rejection.body())
+		c.Abort()
+		return false
+	}
+	c.Set("user", user)
+	return true
+}
+
+// currentUser returns the user AuthMiddleware stored in c.
+func currentUser(c *gin.Context) User {
+	user, _ := c.Get("user")
+	u, _ := user.(User)
+	return u
+}
+
+// accountBlocked refuses a login or a refresh for a disabled account, or
+// one that must reset its password first, and reports whether it did.
+func accountBlocked(c *gin.Context, user User) bool {
+	switch {
+	case user.Disabled:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled", "code": CodeAccountDisabled})
+	case user.PasswordResetRequired:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password reset required", "code": CodePasswordResetRequired})
+	default:
+		return false
+	}
+	return true
+}
+
+// AdminMiddleware lets through only admins, as of this request. It must
+// run after AuthMiddleware.
+func (a *App) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.isAdmin(currentUser(c)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const policySecret = "testsecret_policy"
+
+// policyClaims returns the claims of a token the default policy accepts.
+func policyClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":  DefaultJWTIssuer,
+		"aud":  DefaultJWTAudience,
+		"user": "alice",
+		"jti":  GenerateID(),
+		"iat":  now.Unix(),
+		"exp":  now.Add(time.Minute).Unix(),
+	}
+}
+
+func signPolicyToken(t *testing.T, method jwt.SigningMethod, claims jwt.MapClaims, key any) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func rejectionCode(t *testing.T, w *httptest.ResponseRecorder) (string, string) {
+	t.Helper()
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 got %d body=%s", w.Code, w.Body.String())
+	}
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body["code"], body["claim"]
+}
+
+func TestAuthMiddlewareRejectionCodes(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: policySecret, ConcurrencyMode: SafeMode}))
+	registerAndLogin(t, r, "alice", "pass") // the user of policyClaims
+	valid := signPolicyToken(t, jwt.SigningMethodHS256, policyClaims(), []byte(policySecret))
+
+	with := func(change func(jwt.MapClaims)) string {
+		claims := policyClaims()
+		change(claims)
+		return signPolicyToken(t, jwt.SigningMethodHS256, claims, []byte(policySecret))
+	}
+	withKid := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, policyClaims())
+		token.Header["kid"] = kid
+		s, _ := token.SignedString([]byte(policySecret))
+		return s
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		code   string
+		claim  string
+	}{
+		{"no header", "", CodeMissingAuthorization, ""},
+		{"no scheme", valid, CodeInvalidScheme, ""},
+		{"basic scheme", "Basic " + valid, CodeInvalidScheme, ""},
+		{"glued scheme", "Bearer" + valid, CodeInvalidScheme, ""},
+		{"two spaces", "Bearer  " + valid, CodeInvalidScheme, ""},
+		{"trailing data", "Bearer " + valid + " extra", CodeInvalidScheme, ""},
+		{"empty token", "Bearer ", CodeInvalidScheme, ""},
+		{"garbage", "Bearer not.a.jwt", CodeMalformedToken, ""},
+		{"alg none", "Bearer " + signPolicyToken(t, jwt.SigningMethodNone, policyClaims(), jwt.UnsafeAllowNoneSignatureType), CodeUnsupportedAlgorithm, ""},
+		{"HS512", "Bearer " + signPolicyToken(t, jwt.SigningMethodHS512, policyClaims(), []byte(policySecret)), CodeUnsupportedAlgorithm, ""},
+		{"unknown kid", "Bearer " + withKid("retired"), CodeUnknownKey, ""},
+		{"wrong secret", "Bearer " + signPolicyToken(t, jwt.SigningMethodHS256, policyClaims(), []byte("other")), CodeInvalidSignature, ""},
+		{"expired", "Bearer " + with(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }), CodeTokenExpired, ""},
+		{"not before", "Bearer " + with(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Minute).Unix() }), CodeTokenNotYetValid, ""},
+		{"issued in the future", "Bearer " + with(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Minute).Unix() }), CodeTokenNotYetValid, ""},
+		{"wrong issuer", "Bearer " + with(func(c jwt.MapClaims) { c["iss"] = "elsewhere" }), CodeInvalidIssuer, ""},
+		{"wrong audience", "Bearer " + with(func(c jwt.MapClaims) { c["aud"] = []string{"billing"} }), CodeInvalidAudience, ""},
+		{"no issuer", "Bearer " + with(func(c jwt.MapClaims) { delete(c, "iss") }), CodeMissingClaim, "iss"},
+		{"no expiry", "Bearer " + with(func(c jwt.MapClaims) { delete(c, "exp") }), CodeMissingClaim, "exp"},
+		{"no jti", "Bearer " + with(func(c jwt.MapClaims) { delete(c, "jti") }), CodeMissingClaim, "jti"},
+		{"empty user", "Bearer " + with(func(c jwt.MapClaims) { c["user"] = "" }), CodeMissingClaim, "user"},
+		{"numeric user", "Bearer " + with(func(c jwt.MapClaims) { c["user"] = 7 }), CodeMalformedToken, ""},
+		{"unknown user", "Bearer " + with(func(c jwt.MapClaims) { c["user"] = "mallory" }), CodeUnknownUser, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := performRequestWithHeaders(r, "GET", "/todos", nil, "", map[string]string{"Authorization": tc.header})
+			if code, claim := rejectionCode(t, w); code != tc.code || claim != tc.claim {
+				t.Fatalf("Expected %s %q got %s %q", tc.code, tc.claim, code, claim)
+			}
+		})
+	}
+
+	for _, header := range []string{"Bearer " + valid, "bearer " + valid} {
+		if w := performRequestWithHeaders(r, "GET", "/todos", nil, "", map[string]string{"Authorization": header}); w.Code != http.StatusOK {
+			t.Fatalf("Expected %q accepted, got %d body=%s", header[:7], w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAuthMiddlewarePolicyConfig(t *testing.T) {
+	a := newTestApp(t, Config{
+		JWTSecret:         policySecret,
+		ConcurrencyMode:   SafeMode,
+		JWTIssuer:         "https://auth.example.com",
+		JWTAudience:       "todo-api",
+		JWTLeeway:         time.Minute,
+		JWTRequiredClaims: []string{"sid"},
+	})
+	r := SetupRouter(a)
+
+	// Tokens the server issues satisfy its own policy
+	token := registerAndLogin(t, r, "alice", "pass")
+	if w := performRequest(r, "GET", "/todos", nil, token); w.Code != http.StatusOK {
+		t.Fatalf("Expected the issued token accepted, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	claims := policyClaims()
+	claims["iss"], claims["aud"], claims["sid"] = "https://auth.example.com", []string{"other", "todo-api"}, "s"
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix() // within the leeway
+	if w := performRequest(r, "GET", "/todos", nil, signPolicyToken(t, jwt.SigningMethodHS256, claims, []byte(policySecret))); w.Code != http.StatusOK {
+		t.Fatalf("Expected a slightly expired token accepted, got %d body=%s", w.Code, w.Body.String())
+	}
+	delete(claims, "sid")
+	if code, claim := rejectionCode(t, performRequest(r, "GET", "/todos", nil, signPolicyToken(t, jwt.SigningMethodHS256, claims, []byte(policySecret)))); code != CodeMissingClaim || claim != "sid" {
+		t.Fatalf("Expected the configured claim required, got %s %q", code, claim)
+	}
+
+	// The policy can accept fewer algorithms than the ring has keys for
+	a.Config.JWTAlgorithms = []string{"RS256"}
+	if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, token)); code != CodeUnsupportedAlgorithm {
+		t.Fatalf("Expected HS256 refused, got %s", code)
+	}
+	if _, err := LoadKeyRing(Config{JWTSecret: policySecret, JWTAlgorithms: []string{"RS256"}}); err == nil {
+		t.Fatal("Expected a policy that refuses the signing key rejected at startup")
+	}
+}
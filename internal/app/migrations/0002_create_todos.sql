@@ -0,0 +1,14 @@
+-- seq keeps todos in creation order; handlers list them in that order.
+CREATE TABLE todos (
+    seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+    username   TEXT    NOT NULL,
+    id         TEXT    NOT NULL,
+    title      TEXT    NOT NULL,
+    completed  INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT    NOT NULL,
+    version    INTEGER NOT NULL DEFAULT 1
+);
+
+-- Single-todo lookups and per-user listing, replacing the slice scans.
+CREATE UNIQUE INDEX todos_by_user_id ON todos (username, id);
+CREATE INDEX todos_by_user_seq ON todos (username, seq);
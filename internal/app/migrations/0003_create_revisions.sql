@@ -0,0 +1,11 @@
+-- Edit history of each todo. Rows are only ever inserted; changes holds the
+-- JSON-encoded []FieldChange.
+CREATE TABLE revisions (
+    username TEXT    NOT NULL,
+    todo_id  TEXT    NOT NULL,
+    revision INTEGER NOT NULL,
+    author   TEXT    NOT NULL,
+    at       TEXT    NOT NULL,
+    changes  TEXT    NOT NULL,
+    PRIMARY KEY (username, todo_id, revision)
+);
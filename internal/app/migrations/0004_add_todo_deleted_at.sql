@@ -0,0 +1,3 @@
+-- Deleted todos stay in the table with deleted_at set until the trash
+-- purger removes them.
+ALTER TABLE todos ADD COLUMN deleted_at TEXT;
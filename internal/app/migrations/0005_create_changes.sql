@@ -0,0 +1,13 @@
+-- The change feed: one row per user registration and todo mutation, written
+-- in the same transaction as the change. Deletes are tombstones with a NULL
+-- todo.
+CREATE TABLE changes (
+    seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+    op       TEXT    NOT NULL,
+    username TEXT    NOT NULL,
+    todo_id  TEXT    NOT NULL DEFAULT '',
+    todo     TEXT,
+    at       TEXT    NOT NULL
+);
+
+CREATE INDEX changes_by_user_seq ON changes (username, seq);
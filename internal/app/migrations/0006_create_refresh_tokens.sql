@@ -0,0 +1,14 @@
+-- Refresh tokens issued at login, keyed by the SHA-256 of the token. used_at
+-- is set when a token is exchanged; every token rotated from one login
+-- shares its family. Revoking a session looks its tokens up by family,
+-- and logging a user out everywhere looks theirs up by username.
+CREATE TABLE refresh_tokens (
+    hash       TEXT PRIMARY KEY,
+    family     TEXT NOT NULL,
+    username   TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    used_at    TEXT
+);
+
+CREATE INDEX refresh_tokens_by_family ON refresh_tokens (family);
+CREATE INDEX refresh_tokens_by_user ON refresh_tokens (username);
@@ -0,0 +1,7 @@
+-- Access tokens and sessions revoked before their expiry. id is a token's
+-- jti or a session ID; rows are pruned once expires_at has passed.
+CREATE TABLE revocations (
+    id         TEXT PRIMARY KEY,
+    username   TEXT NOT NULL,
+    expires_at TEXT NOT NULL
+);
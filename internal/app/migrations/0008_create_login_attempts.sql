@@ -0,0 +1,9 @@
+-- Failed login counters per account (user:<name>) and client address
+-- (ip:<address>). Rows are pruned once expires_at has passed.
+CREATE TABLE login_attempts (
+    key          TEXT PRIMARY KEY,
+    failures     INTEGER NOT NULL,
+    last_failure TEXT NOT NULL,
+    locked_until TEXT NOT NULL,
+    expires_at   TEXT NOT NULL
+);
@@ -0,0 +1,7 @@
+-- TOTP two-factor authentication. totp_secret is set once an authenticator
+-- is confirmed and totp_pending while one is being set up; recovery_codes
+-- holds the space-separated hashes of the unused recovery codes.
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_pending TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '';
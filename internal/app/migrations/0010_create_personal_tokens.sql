@@ -0,0 +1,14 @@
+-- Personal access tokens, keyed by the SHA-256 of the token. scopes is
+-- space-separated; expires_at is NULL for tokens that never expire.
+CREATE TABLE personal_tokens (
+    hash         TEXT PRIMARY KEY,
+    id           TEXT NOT NULL UNIQUE,
+    username     TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    scopes       TEXT NOT NULL,
+    created_at   TEXT NOT NULL,
+    expires_at   TEXT,
+    last_used_at TEXT
+);
+
+CREATE INDEX personal_tokens_by_username ON personal_tokens (username);
@@ -0,0 +1,6 @@
+-- User roles and account state. role is 'user' or 'admin'; a disabled
+-- account cannot log in, and password_reset_required is set while the
+-- account holds a temporary password an admin reset it to.
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN password_reset_required INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- The change feed's floor: the sequence number of the newest change pruned
+-- for outliving CHANGE_RETENTION. Reads that start below it are refused,
+-- since they would silently miss the pruned changes. Always one row.
+CREATE TABLE changes_floor (
+    seq INTEGER NOT NULL
+);
+
+INSERT INTO changes_floor (seq) VALUES (0);
@@ -7,6 +7,134 @@ type Todo struct {
 	Title     string    `json:"title"`
 	Completed bool      `json:"completed"`
 	CreatedAt time.Time `json:"created_at"`
+	// Version starts at 1 and increases by one on every update.
+	Version int64 `json:"version"`
+	// DeletedAt is set while the todo is in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Trashed reports whether t has been moved to the trash.
+func (t Todo) Trashed() bool {
+	return t.DeletedAt != nil
+}
+
+// Revision records one successful update of a todo. Revision numbers are the
+// version the update produced, so a todo's first revision is 2.
+type Revision struct {
+	TodoID   string        `json:"todo_id"`
+	Revision int64         `json:"revision"`
+	Author   string        `json:"author"`
+	At       time.Time     `json:"at"`
+	Changes  []FieldChange `json:"changes"`
+}
+
+// FieldChange is one field an update changed, with its value before and
+// after.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+// Change kinds recorded in the change feed.
+const (
+	ChangeRegister = "register"
+	ChangeCreate   = "create"
+	ChangeUpdate   = "update"
+	ChangeDelete   = "delete"
+)
+
+// Change is one entry of the change feed. Seq is global and strictly
+// increasing. Create and update changes carry the todo as written; a delete
+// is a tombstone with only TodoID set.
+type Change struct {
+	Seq      uint64    `json:"seq"`
+	Op       string    `json:"op"`
+	Username string    `json:"username"`
+	TodoID   string    `json:"todo_id,omitempty"`
+	Todo     *Todo     `json:"todo,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	// TOTPSecret is the base32 secret of a confirmed authenticator, which
+	// turns on two-factor login, and TOTPPending one set up but not yet
+	// confirmed. TOTPLastStep is the time step of the last code accepted,
+	// so no code works twice.
+	TOTPSecret   string `json:"totp_secret,omitempty"`
+	TOTPPending  string `json:"totp_pending,omitempty"`
+	TOTPLastStep int64  `json:"totp_last_step,omitempty"`
+	// RecoveryCodes holds the SHA-256 hashes of the unused recovery codes,
+	// space-separated so that User stays comparable.
+	RecoveryCodes string `json:"recovery_codes,omitempty"`
+	// Role is RoleUser or RoleAdmin; users stored before roles have none
+	// and count as RoleUser.
+	Role string `json:"role,omitempty"`
+	// Disabled accounts cannot log in, and their tokens stop working.
+	Disabled bool `json:"disabled,omitempty"`
+	// PasswordResetRequired is set when an admin resets the password: the
+	// temporary one only lets the user choose a new one.
+	PasswordResetRequired bool `json:"password_reset_required,omitempty"`
+}
+
+// User roles. Admins may call the /admin endpoints.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// IsAdmin reports whether u has RoleAdmin.
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// RefreshToken is the stored record of an opaque refresh token. Only the
+// token's SHA-256 is kept, as Hash. Every token rotated from one login shares
+// that login's Family, so a replayed token can revoke them all.
+type RefreshToken struct {
+	Hash      string    `json:"hash"`
+	Family    string    `json:"family"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// UsedAt is set once the token has been exchanged for a new one.
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// Revocation rejects access tokens until they would have expired anyway.
+// ID is either one token's jti or a session ID, the sid claim shared by
+// every access token issued from one login.
+type Revocation struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PersonalAccessToken is the stored record of a long-lived token a user
+// created for scripts and integrations. Like refresh tokens only the
+// token's SHA-256 is kept, as Hash; ID names the token in the API.
+type PersonalAccessToken struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is nil for a token that never expires.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// LoginAttempts counts the recent failed logins for one account or client
+// address; Key is "user:<username>" or "ip:<address>". A login is refused
+// until LockedUntil, and the record can be dropped after ExpiresAt.
+type LoginAttempts struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
 
 type Credentials struct {
@@ -14,6 +142,43 @@ type Credentials struct {
 	Password string `json:"password"`
 }
 
+// TwoFactorCodeRequest confirms a new authenticator with one of its codes.
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// TwoFactorLoginRequest completes a login with the challenge token from
+// /login and a TOTP or recovery code.
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// CreatePersonalTokenRequest creates a personal access token. A nil
+// ExpiresAt makes a token that never expires.
+type CreatePersonalTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PasswordResetRequest replaces the temporary password an admin reset an
+// account to with one the user chooses.
+type PasswordResetRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+// SetRoleRequest changes a user's role.
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type UpdateTodoRequest struct {
 	Title     *string `json:"title,omitempty"`
 	Completed *bool   `json:"completed,omitempty"`
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms selectable through Config.PasswordHash.
+const (
+	PasswordArgon2id = "argon2id"
+	PasswordBcrypt   = "bcrypt"
+)
+
+// Default hashing parameters. The Argon2id ones follow the second
+// recommended option of RFC 9106.
+const (
+	DefaultArgon2Memory      = 64 * 1024 // KiB
+	DefaultArgon2Iterations  = 3
+	DefaultArgon2Parallelism = 4
+	DefaultBcryptCost        = 12
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// ErrUnknownHash is returned for stored hashes in a format no hasher reads.
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// PasswordHasher turns passwords into self-describing PHC strings.
+type PasswordHasher interface {
+	// Hash returns a hash of password made with the hasher's parameters.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches encoded, whatever
+	// parameters encoded was made with.
+	Verify(encoded, password string) (bool, error)
+	// NeedsRehash reports whether encoded was made by another algorithm or
+	// with other parameters than Hash would use now.
+	NeedsRehash(encoded string) bool
+}
+
+// NewPasswordHasher returns the hasher named in cfg.PasswordHash with the
+// parameters in cfg, falling back to the defaults for zero values.
+func NewPasswordHasher(cfg Config) (PasswordHasher, error) {
+	switch cfg.PasswordHash {
+	case "", PasswordArgon2id:
+		h := Argon2idHasher{
+			Memory:      uint32(cfg.Argon2Memory),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		}
+		if h.Memory == 0 {
+			h.Memory = DefaultArgon2Memory
+		}
+		if h.Iterations == 0 {
+			h.Iterations = DefaultArgon2Iterations
+		}
+		if h.Parallelism == 0 {
+			h.Parallelism = DefaultArgon2Parallelism
+		}
+		return h, nil
+	case PasswordBcrypt:
+		h := BcryptHasher{Cost: cfg.BcryptCost}
+		if h.Cost == 0 {
+			h.Cost = DefaultBcryptCost
+		}
+		if h.Cost < bcrypt.MinCost || h.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost %d out of range", h.Cost)
+		}
+		return h, nil
+	}
+	return nil, fmt.Errorf("unknown password hash %q", cfg.PasswordHash)
+}
+
+// VerifyPassword checks password against a hash made by any supported
+// hasher.
+func VerifyPassword(encoded, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2idHasher{}.Verify(encoded, password)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return BcryptHasher{}.Verify(encoded, password)
+	}
+	return false, ErrUnknownHash
+}
+
+// checkPassword reports whether password is user's. A user that was not
+// found is checked against a throwaway hash made by a.Passwords, so an
+// unknown username takes as long to refuse as a wrong password and the
+// response time does not tell which accounts exist.
+func (a *App) checkPassword(user User, found bool, password string) (bool, error) {
+	if !found {
+		a.dummyHash.once.Do(func() {
+			a.dummyHash.hash, _ = a.Passwords.Hash(GenerateID())
+		})
+		VerifyPassword(a.dummyHash.hash, password)
+		return false, nil
+	}
+	return VerifyPassword(user.PasswordHash, password)
+}
+
+// Argon2idHasher hashes with Argon2id into
+// $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<key>.
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	got := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, key, err := parseArgon2id(encoded)
+	return err != nil || params != h || len(key) != argon2KeyLen
+}
+
+// parseArgon2id splits an Argon2id PHC string into its parts.
+func parseArgon2id(encoded string) (params Argon2idHasher, salt, key []byte, err error) {
+	fail := fmt.Errorf("%w: malformed argon2id hash", ErrUnknownHash)
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, nil, nil, fail
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fail
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fail
+	}
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, fail
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(salt) == 0 {
+		return params, nil, nil, fail
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, fail
+	}
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes with bcrypt, whose $2b$<cost>$... strings predate
+// and are accepted by the PHC format.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hashed), err
+}
+
+func (h BcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Password policy errors, worded for the client.
+var (
+	ErrPasswordTooShort = errors.New("password too short")
+	ErrPasswordCommon   = errors.New("password is too common")
+)
+
+// commonPasswordsList is a list of the most frequent passwords in public
+// breach corpora, one per line.
+//
+//go:embed common_passwords.txt
+var commonPasswordsList string
+
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	set := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordsList))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = true
+		}
+	}
+	return set
+})
+
+// checkPassword applies the password policy in cfg to a new password.
+// Length counts characters, not bytes, and the common password list is
+// matched case-insensitively.
+func checkPassword(cfg Config, password string) error {
+	if utf8.RuneCountInString(password) < cfg.PasswordMinLength {
+		return ErrPasswordTooShort
+	}
+	if cfg.PasswordRejectCommon && commonPasswords()[strings.ToLower(password)] {
+		return ErrPasswordCommon
+	}
+	return nil
+}
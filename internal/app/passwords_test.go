@@ -0,0 +1,148 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	argon := Argon2idHasher{Memory: testArgon2Memory, Iterations: 1, Parallelism: 2}
+	for name, tc := range map[string]struct {
+		hasher PasswordHasher
+		format *regexp.Regexp
+		other  PasswordHasher // same algorithm, other parameters
+	}{
+		"argon2id": {argon, regexp.MustCompile(`^\$argon2id\$v=19\$m=1024,t=1,p=2\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`), Argon2idHasher{Memory: testArgon2Memory, Iterations: 2, Parallelism: 2}},
+		"bcrypt":   {BcryptHasher{Cost: 4}, regexp.MustCompile(`^\$2a\$04\$`), BcryptHasher{Cost: 5}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := tc.hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.format.MatchString(encoded) {
+				t.Fatalf("Unexpected hash format %s", encoded)
+			}
+			if again, _ := tc.hasher.Hash("correct horse"); again == encoded {
+				t.Fatal("Expected a fresh salt per hash")
+			}
+			if ok, err := VerifyPassword(encoded, "correct horse"); !ok || err != nil {
+				t.Fatalf("Expected the password verified, got %v %v", ok, err)
+			}
+			if ok, err := VerifyPassword(encoded, "correct horsE"); ok || err != nil {
+				t.Fatalf("Expected a wrong password refused without error, got %v %v", ok, err)
+			}
+			// Verification reads the parameters from the hash
+			if ok, _ := tc.other.Verify(encoded, "correct horse"); !ok {
+				t.Fatal("Expected a hasher with other parameters to verify the hash")
+			}
+			if tc.hasher.NeedsRehash(encoded) || !tc.other.NeedsRehash(encoded) {
+				t.Fatal("Expected only a change of parameters to call for a rehash")
+			}
+		})
+	}
+
+	bcryptHash, _ := BcryptHasher{Cost: 4}.Hash("pw")
+	argonHash, _ := argon.Hash("pw")
+	if !argon.NeedsRehash(bcryptHash) || !(BcryptHasher{Cost: 4}).NeedsRehash(argonHash) {
+		t.Fatal("Expected a change of algorithm to call for a rehash")
+	}
+	for _, encoded := range []string{"", "plaintext", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1024,t=1,p=1$!!$a2V5"} {
+		if ok, err := VerifyPassword(encoded, "pw"); ok || !errors.Is(err, ErrUnknownHash) {
+			t.Fatalf("%q: expected an unknown hash, got %v %v", encoded, ok, err)
+		}
+	}
+
+	if _, err := NewPasswordHasher(Config{PasswordHash: "md5"}); err == nil {
+		t.Fatal("Expected an unknown hasher rejected")
+	}
+	if _, err := NewPasswordHasher(Config{PasswordHash: PasswordBcrypt, BcryptCost: 99}); err == nil {
+		t.Fatal("Expected an out of range bcrypt cost rejected")
+	}
+	if h, _ := NewPasswordHasher(Config{}); h != (Argon2idHasher{DefaultArgon2Memory, DefaultArgon2Iterations, DefaultArgon2Parallelism}) {
+		t.Fatalf("Expected the default Argon2id parameters, got %+v", h)
+	}
+}
+
+func TestLoginRehashesOutdatedHashes(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_passwords", ConcurrencyMode: SafeMode, PasswordHash: PasswordBcrypt, BcryptCost: 4})
+	r := SetupRouter(a)
+	registerAndLogin(t, r, "alice", "pass")
+	before, _ := a.Users.Get("alice")
+	if !strings.HasPrefix(before.PasswordHash, "$2a$04$") {
+		t.Fatalf("Expected a bcrypt hash, got %s", before.PasswordHash)
+	}
+
+	a.Passwords = Argon2idHasher{Memory: testArgon2Memory, Iterations: 1, Parallelism: 1}
+	if w := performRequest(r, "POST", "/login", Credentials{Username: "alice", Password: "wrong"}, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password refused, got %d", w.Code)
+	}
+	if user, _ := a.Users.Get("alice"); user != before {
+		t.Fatal("Expected a failed login to leave the hash alone")
+	}
+
+	login(t, r, "alice", "pass")
+	after, _ := a.Users.Get("alice")
+	if !strings.HasPrefix(after.PasswordHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("Expected the hash upgraded to Argon2id, got %s", after.PasswordHash)
+	}
+	login(t, r, "alice", "pass")
+	if again, _ := a.Users.Get("alice"); again != after {
+		t.Fatal("Expected a current hash to be kept")
+	}
+}
+
+func TestRegisterPasswordPolicy(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{
+		JWTSecret:            "testsecret_passwords",
+		PasswordMinLength:    8,
+		PasswordRejectCommon: true,
+	}))
+
+	for password, want := range map[string]string{
+		"short":       "Password must be at least 8 characters",
+		"pässwör":     "Password must be at least 8 characters", // 7 characters in 9 bytes
+		"Password123": "Password is too common, choose another",
+		"qwertyuiop":  "Password is too common, choose another",
+	} {
+		w := performRequest(r, "POST", "/register", Credentials{Username: "alice", Password: password}, "")
+		if w.Code != http.StatusBadRequest || !bodyHasError(w, want) {
+			t.Fatalf("%q: expected %q, got %d body=%s", password, want, w.Code, w.Body.String())
+		}
+	}
+	for i, password := range []string{"pässwört", "correct horse battery staple"} {
+		w := performRequest(r, "POST", "/register", Credentials{Username: "user" + string(rune('a'+i)), Password: password}, "")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%q: expected the password accepted, got %d body=%s", password, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUserUpdateSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFileStore(dir, FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Users().Create(User{Username: "alice", PasswordHash: "old"})
+	if _, err := fs.Users().Update("bob", func(*User) error { return nil }); err != ErrUserNotFound {
+		t.Fatalf("Expected an unknown user, got %v", err)
+	}
+	abort := errors.New("abort")
+	if _, err := fs.Users().Update("alice", func(u *User) error { u.PasswordHash = "lost"; return abort }); err != abort {
+		t.Fatalf("Expected fn's error, got %v", err)
+	}
+	fs.Users().Update("alice", func(u *User) error { u.PasswordHash = "new"; return nil })
+	fs.Close()
+
+	if fs, err = OpenFileStore(dir, FileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if user, _ := fs.Users().Get("alice"); user.PasswordHash != "new" {
+		t.Fatalf("Expected the update replayed, got %+v", user)
+	}
+}
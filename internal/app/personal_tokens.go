@@ -0,0 +1,188 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PersonalTokenPrefix starts every personal access token, which tells them
+// apart from JWTs and makes leaked ones easy to scan for.
+const PersonalTokenPrefix = "todo_pat_"
+
+const (
+	// personalTokenBytes is the amount of randomness in a personal access
+	// token.
+	personalTokenBytes = 32
+	// maxPersonalTokenName bounds a token's name, in bytes.
+	maxPersonalTokenName = 100
+	// personalTokenTouchInterval is how stale LastUsedAt may get before a
+	// request updates it, so busy tokens do not write on every request.
+	personalTokenTouchInterval = time.Minute
+)
+
+// newPersonalToken returns a random personal access token.
+func newPersonalToken() string {
+	b := make([]byte, personalTokenBytes)
+	rand.Read(b)
+	return PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// personalTokenView is how the API shows a token: never its hash or owner.
+func personalTokenView(t PersonalAccessToken) gin.H {
+	view := gin.H{
+		"id":         t.ID,
+		"name":       t.Name,
+		"scopes":     t.Scopes,
+		"created_at": t.CreatedAt.Format(time.RFC3339),
+	}
+	if t.ExpiresAt != nil {
+		view["expires_at"] = t.ExpiresAt.Format(time.RFC3339)
+	}
+	if t.LastUsedAt != nil {
+		view["last_used_at"] = t.LastUsedAt.Format(time.RFC3339)
+	}
+	return view
+}
+
+// verifyPersonalToken looks token up and checks it has not expired.
+func (a *App) verifyPersonalToken(token string) (PersonalAccessToken, *tokenRejection, error) {
+	t, err := a.PersonalTokens.Get(hashToken(token))
+	if errors.Is(err, ErrPersonalTokenNotFound) {
+		return PersonalAccessToken{}, &tokenRejection{code: CodeUnknownToken}, nil
+	}
+	if err != nil {
+		return PersonalAccessToken{}, nil, err
+	}
+	if t.ExpiresAt != nil && a.now().After(*t.ExpiresAt) {
+		return PersonalAccessToken{}, &tokenRejection{code: CodeTokenExpired}, nil
+	}
+	return t, nil, nil
+}
+
+// touchPersonalToken records that t was used now, at most once every
+// personalTokenTouchInterval. The request goes ahead either way, so
+// failures are only logged.
+func (a *App) touchPersonalToken(t PersonalAccessToken) {
+	now := a.now()
+	if t.LastUsedAt != nil && now.Sub(*t.LastUsedAt) < personalTokenTouchInterval {
+		return
+	}
+	if err := a.PersonalTokens.Touch(t.Hash, now); err != nil {
+		log.Printf("record use of personal token %s: %v", t.ID, err)
+	}
+}
+
+// SessionMiddleware lets through only requests authenticated by the access
+// token of a login, so a personal access token can neither manage tokens
+// nor change the account's sign-in settings, whatever its scopes. It must
+// run after AuthMiddleware.
+func (a *App) SessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("personal_token") != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed with a personal access token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CreatePersonalTokenHandler creates a personal access token for the
+// caller, with scopes the caller holds. The token itself is in this
+// response only; afterwards just its hash is kept.
+func (a *App) CreatePersonalTokenHandler(c *gin.Context) {
+	var req CreatePersonalTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token name required"})
+		return
+	}
+	if len(req.Name) > maxPersonalTokenName {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token name too long"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope required"})
+		return
+	}
+	scopes, unknown, ok := normalizeScopes(req.Scopes)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + unknown})
+		return
+	}
+	username := c.GetString("username")
+	for _, scope := range scopes {
+		if !slices.Contains(a.scopesFor(currentUser(c)), scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot grant scope " + scope})
+			return
+		}
+	}
+	now := a.now()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	secret := newPersonalToken()
+	token := PersonalAccessToken{
+		ID:        GenerateID(),
+		Hash:      hashToken(secret),
+		Username:  username,
+		Name:      req.Name,
+		Scopes:    scopes,
+		CreatedAt: now.Truncate(time.Second),
+	}
+	if req.ExpiresAt != nil {
+		expiresAt := req.ExpiresAt.UTC()
+		token.ExpiresAt = &expiresAt
+	}
+	if err := a.PersonalTokens.Create(token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	view := personalTokenView(token)
+	view["token"] = secret
+	c.JSON(http.StatusCreated, view)
+}
+
+// ListPersonalTokensHandler lists the caller's personal access tokens,
+// oldest first, with when each was last used.
+func (a *App) ListPersonalTokensHandler(c *gin.Context) {
+	tokens, err := a.PersonalTokens.List(c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	views := make([]gin.H, 0, len(tokens))
+	for _, t := range tokens {
+		views = append(views, personalTokenView(t))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// DeletePersonalTokenHandler revokes one of the caller's personal access
+// tokens. It stops working at once.
+func (a *App) DeletePersonalTokenHandler(c *gin.Context) {
+	err := a.PersonalTokens.Delete(c.GetString("username"), c.Param("id"))
+	switch {
+	case errors.Is(err, ErrPersonalTokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
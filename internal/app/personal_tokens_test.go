@@ -0,0 +1,126 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersonalAccessTokens(t *testing.T) {
+	clock := &testClock{time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+	a := newTestApp(t, Config{JWTSecret: "testsecret_pat", ConcurrencyMode: SafeMode, AdminUsers: []string{"alice"}})
+	a.Clock = clock.Now
+	r := SetupRouter(a)
+	session := registerAndLogin(t, r, "alice", "pass")
+	bob := registerAndLogin(t, r, "bob", "pass")
+
+	for _, req := range []CreatePersonalTokenRequest{
+		{Scopes: []string{ScopeTodosRead}},
+		{Name: "ci", Scopes: nil},
+		{Name: "ci", Scopes: []string{"todos:delete"}},
+		{Name: strings.Repeat("x", maxPersonalTokenName+1), Scopes: []string{ScopeTodosRead}},
+		{Name: "ci", Scopes: []string{ScopeTodosRead}, ExpiresAt: &clock.t},
+	} {
+		postJSON(t, r, "/me/tokens", req, session, http.StatusBadRequest)
+	}
+
+	expiresAt := clock.t.Add(time.Hour)
+	created := postJSON(t, r, "/me/tokens", CreatePersonalTokenRequest{
+		Name:      " ci ",
+		Scopes:    []string{ScopeTodosWrite, ScopeTodosRead, ScopeTodosWrite},
+		ExpiresAt: &expiresAt,
+	}, session, http.StatusCreated)
+	pat := created["token"].(string)
+	if !strings.HasPrefix(pat, PersonalTokenPrefix) || created["name"] != "ci" || created["expires_at"] != "2026-10-16T13:00:00Z" {
+		t.Fatalf("Unexpected token %v", created)
+	}
+	if scopes := created["scopes"].([]any); len(scopes) != 2 || scopes[0] != ScopeTodosRead {
+		t.Fatalf("Expected scopes deduplicated in order, got %v", scopes)
+	}
+	clock.Advance(time.Second)
+	forever := postJSON(t, r, "/me/tokens", CreatePersonalTokenRequest{Name: "dashboard", Scopes: []string{ScopeTodosRead}}, session, http.StatusCreated)
+
+	// The token works like a login, but cannot manage tokens or sessions
+	if w := performRequest(r, "POST", "/todos", Todo{Title: "From CI"}, pat); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the token accepted, got %d body=%s", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/me/tokens", "/logout", "/admin/backup"} {
+		if w := performRequest(r, "POST", path, nil, pat); w.Code != http.StatusForbidden {
+			t.Fatalf("POST %s: expected 403 got %d", path, w.Code)
+		}
+	}
+
+	w := performRequest(r, "GET", "/me/tokens", nil, session)
+	var listed []map[string]any
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if w.Code != http.StatusOK || len(listed) != 2 || listed[0]["last_used_at"] != "2026-10-16T12:00:01Z" || listed[1]["last_used_at"] != nil {
+		t.Fatalf("Expected both tokens with the use of the first, got %d %s", w.Code, w.Body.String())
+	}
+	if listed[0]["token"] != nil || listed[0]["hash"] != nil {
+		t.Fatalf("Expected the secret left out of the list, got %v", listed[0])
+	}
+	if w := performRequest(r, "GET", "/me/tokens", nil, bob); !strings.Contains(w.Body.String(), "[]") {
+		t.Fatalf("Expected other users to see none, got %s", w.Body.String())
+	}
+
+	clock.Advance(2 * time.Hour)
+	if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, pat)); code != CodeTokenExpired {
+		t.Fatalf("Expected the token expired, got %s", code)
+	}
+	if n, err := a.PersonalTokens.Prune(clock.Now()); err != nil || n != 1 {
+		t.Fatalf("Expected the expired token pruned, got %d (err=%v)", n, err)
+	}
+
+	session, bob = login(t, r, "alice", "pass"), login(t, r, "bob", "pass")
+	id := forever["id"].(string)
+	if w := performRequest(r, "DELETE", "/me/tokens/"+id, nil, bob); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected another user's token not found, got %d", w.Code)
+	}
+	if w := performRequest(r, "DELETE", "/me/tokens/"+id, nil, session); w.Code != http.StatusOK {
+		t.Fatalf("Expected the token deleted, got %d", w.Code)
+	}
+	if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, forever["token"].(string))); code != CodeUnknownToken {
+		t.Fatalf("Expected a deleted token refused, got %s", code)
+	}
+}
+
+func TestPersonalTokensSurviveRestart(t *testing.T) {
+	for _, storage := range []string{StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{
+				JWTSecret:       "testsecret_pat",
+				ConcurrencyMode: SafeMode,
+				Storage:         storage,
+				DataDir:         dir,
+				SQLitePath:      filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:  true,
+			}
+			a, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := SetupRouter(a)
+			session := registerAndLogin(t, r, "alice", "pass")
+			created := postJSON(t, r, "/me/tokens", CreatePersonalTokenRequest{Name: "ci", Scopes: []string{ScopeTodosRead}}, session, http.StatusCreated)
+			pat := created["token"].(string)
+			performRequest(r, "GET", "/todos", nil, pat)
+			a.Close()
+
+			if a, err = Open(cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if w := performRequest(SetupRouter(a), "GET", "/todos", nil, pat); w.Code != http.StatusOK {
+				t.Fatalf("Expected the token accepted after a restart, got %d", w.Code)
+			}
+			tokens, err := a.PersonalTokens.List("alice")
+			if err != nil || len(tokens) != 1 || tokens[0].LastUsedAt == nil || tokens[0].Scopes[0] != ScopeTodosRead {
+				t.Fatalf("Expected the token and its use kept, got %+v (err=%v)", tokens, err)
+			}
+		})
+	}
+}
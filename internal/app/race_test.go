@@ -3,7 +3,6 @@ package app
 import (
 	"encoding/json"
 	"net/http"
-	"os"
 	"sync"
 	"testing"
 	"time"
@@ -11,7 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// The helper functions performRequest and Init are accessible from handlers_test.go
+// The helper functions performRequest and newTestApp are accessible from handlers_test.go
 // because they are in the same package (app).
 
 // setupRaceRouter is not strictly needed since SetupRouter already exists,
@@ -21,17 +20,10 @@ import (
 // TestConcurrentUpdateRace is the key test to showcase the data race.
 // It will only fail/warn when run with the Go race detector flag (-race).
 func TestConcurrentUpdateRace(t *testing.T) {
-	// Reset global maps
-	Users = sync.Map{}
-	Todos = sync.Map{}
-
-	// Ensure the secret is initialized for JWT operations
-	testSecret := "testsecret_race"
-	os.Setenv("JWT_SECRET", testSecret)
-	Init(testSecret)
+	// Fresh stores for this test
 	gin.SetMode(gin.TestMode)
 
-	r := SetupRouter()
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_race", ConcurrencyMode: RacyMode}))
 
 	// --- Setup user & todo ---
 	// Using the helper from handlers_test.go
@@ -77,3 +69,183 @@ func TestConcurrentUpdateRace(t *testing.T) {
 	_ = json.Unmarshal(w.Body.Bytes(), &final)
 	t.Logf("Final todo title: %s", final.Title)
 }
+
+// newSafeRaceRouter registers and logs in a user on an app running in
+// SafeMode and returns the router with that user's token.
+func newSafeRaceRouter(t *testing.T, username string) (*gin.Engine, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_safe", ConcurrencyMode: SafeMode}))
+	performRequest(r, "POST", "/register", Credentials{username, "pass"}, "")
+	w := performRequest(r, "POST", "/login", Credentials{username, "pass"}, "")
+	var loginResp map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &loginResp)
+	if loginResp["token"] == "" {
+		t.Fatalf("Login failed: %s", w.Body.String())
+	}
+	return r, loginResp["token"]
+}
+
+// TestConcurrentCreateSafe checks that no create is lost when many requests
+// append to the same user's list at once. Run with -race for the full check.
+func TestConcurrentCreateSafe(t *testing.T) {
+	r, token := newSafeRaceRouter(t, "creator")
+
+	const workers = 8
+	const perWorker = 50
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				w := performRequest(r, "POST", "/todos", map[string]string{"title": "task"}, token)
+				if w.Code != http.StatusCreated {
+					t.Errorf("Create failed: %d body=%s", w.Code, w.Body.String())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := performRequest(r, "GET", "/todos", nil, token)
+	var list []Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != workers*perWorker {
+		t.Fatalf("Expected %d todos got %d (lost creates)", workers*perWorker, len(list))
+	}
+}
+
+// TestConcurrentUpdateSafe runs the same two competing writers as
+// TestConcurrentUpdateRace, but each writer sets title and completed
+// together. Every response and the final state must be one writer's
+// complete version, never a mix of both.
+func TestConcurrentUpdateSafe(t *testing.T) {
+	r, token := newSafeRaceRouter(t, "racer")
+
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "base task"}, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create failed: %s", w.Body.String())
+	}
+	var created Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+	const loops = 500
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	updateFunc := func(title string, completed bool) {
+		defer wg.Done()
+		for i := 0; i < loops; i++ {
+			body := UpdateTodoRequest{Title: &title, Completed: &completed}
+			w := performRequest(r, "PUT", "/todos/"+created.ID, body, token)
+			var got Todo
+			_ = json.Unmarshal(w.Body.Bytes(), &got)
+			if !consistentVersion(got) {
+				t.Errorf("Torn write in response: title=%q completed=%v", got.Title, got.Completed)
+				return
+			}
+		}
+	}
+
+	go updateFunc("VERSION A", true)
+	go updateFunc("VERSION B", false)
+	wg.Wait()
+
+	w = performRequest(r, "GET", "/todos/"+created.ID, nil, token)
+	var final Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &final)
+	if !consistentVersion(final) {
+		t.Fatalf("Torn final state: title=%q completed=%v", final.Title, final.Completed)
+	}
+}
+
+// TestConcurrentUpdatesKeepHistory checks that competing edits leave one
+// revision per version, each picking up where the one before it left off.
+func TestConcurrentUpdatesKeepHistory(t *testing.T) {
+	r, token := newSafeRaceRouter(t, "historian")
+
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "base task"}, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create failed: %s", w.Body.String())
+	}
+	var created Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+	const loops = 50
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	updateFunc := func(title string) {
+		defer wg.Done()
+		for i := 0; i < loops; i++ {
+			body := UpdateTodoRequest{Title: &title}
+			if w := performRequest(r, "PUT", "/todos/"+created.ID, body, token); w.Code != http.StatusOK {
+				t.Errorf("Update failed: %d body=%s", w.Code, w.Body.String())
+				return
+			}
+		}
+	}
+	go updateFunc("VERSION A")
+	go updateFunc("VERSION B")
+	wg.Wait()
+
+	w = performRequest(r, "GET", "/todos/"+created.ID, nil, token)
+	var final Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &final)
+	w = performRequest(r, "GET", "/todos/"+created.ID+"/history", nil, token)
+	var history []Revision
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	if int64(len(history)) != final.Version-1 {
+		t.Fatalf("Expected %d revisions for version %d, got %d", final.Version-1, final.Version, len(history))
+	}
+	title := "base task"
+	for i, rev := range history {
+		if rev.Revision != int64(i)+2 || rev.Changes[0].Old != title {
+			t.Fatalf("Revision %d does not follow the one before it: %+v", i, rev)
+		}
+		title = rev.Changes[0].New.(string)
+	}
+	if title != final.Title {
+		t.Fatalf("History ends at %q but the todo is %q", title, final.Title)
+	}
+}
+
+// TestConcurrentCreateDeleteSafe interleaves creates and deletes on one
+// user's list and checks the surviving todos exactly.
+func TestConcurrentCreateDeleteSafe(t *testing.T) {
+	r, token := newSafeRaceRouter(t, "juggler")
+
+	const workers = 4
+	const perWorker = 40
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				w := performRequest(r, "POST", "/todos", map[string]string{"title": "task"}, token)
+				var created Todo
+				_ = json.Unmarshal(w.Body.Bytes(), &created)
+				if j%2 == 0 {
+					continue
+				}
+				if w := performRequest(r, "DELETE", "/todos/"+created.ID, nil, token); w.Code != http.StatusOK {
+					t.Errorf("Delete failed: %d body=%s", w.Code, w.Body.String())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := performRequest(r, "GET", "/todos", nil, token)
+	var list []Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != workers*perWorker/2 {
+		t.Fatalf("Expected %d todos got %d", workers*perWorker/2, len(list))
+	}
+}
+
+func consistentVersion(t Todo) bool {
+	return (t.Title == "VERSION A" && t.Completed) || (t.Title == "VERSION B" && !t.Completed)
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// The first byte of every connection to a cluster node says what it
+// carries, so Raft traffic and forwarded writes share one port.
+const (
+	muxRaft    byte = 1
+	muxForward byte = 2
+)
+
+// raftMux is the raft.StreamLayer of a node. Raft connections are handed to
+// the transport through Accept; forward connections go to onForward.
+type raftMux struct {
+	ln        net.Listener
+	conns     chan net.Conn
+	onForward func(net.Conn)
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newRaftMux(ln net.Listener, onForward func(net.Conn)) *raftMux {
+	m := &raftMux{
+		ln:        ln,
+		conns:     make(chan net.Conn),
+		onForward: onForward,
+		closed:    make(chan struct{}),
+	}
+	go m.serve()
+	return m
+}
+
+func (m *raftMux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			m.Close()
+			return
+		}
+		go m.route(conn)
+	}
+}
+
+func (m *raftMux) route(conn net.Conn) {
+	kind := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, kind); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch kind[0] {
+	case muxRaft:
+		select {
+		case m.conns <- conn:
+		case <-m.closed:
+			conn.Close()
+		}
+	case muxForward:
+		m.onForward(conn)
+	default:
+		conn.Close()
+	}
+}
+
+func (m *raftMux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.closed:
+		return nil, errors.New("raft mux closed")
+	}
+}
+
+func (m *raftMux) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.ln.Close()
+	})
+	return nil
+}
+
+func (m *raftMux) Addr() net.Addr {
+	return m.ln.Addr()
+}
+
+func (m *raftMux) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialMux(string(address), muxRaft, timeout)
+}
+
+func dialMux(address string, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// forwardResponse answers one forwarded log record.
+type forwardResponse struct {
+	// Index is the log index the record was applied at.
+	Index uint64 `json:"index"`
+	// Err is the error code of the record's result, see forwardErrors.
+	Err string `json:"err,omitempty"`
+	// NotLeader asks the follower to find the leader again and retry.
+	NotLeader bool `json:"not_leader,omitempty"`
+}
+
+// forwardErrors are the results that survive a round trip to the leader.
+var forwardErrors = map[string]error{
+	"user_exists":              ErrUserExists,
+	"user_not_found":           ErrUserNotFound,
+	"todo_not_found":           ErrTodoNotFound,
+	"stale_write":              errStaleWrite,
+	"token_not_found":          ErrTokenNotFound,
+	"token_reused":             ErrTokenReused,
+	"personal_token_not_found": ErrPersonalTokenNotFound,
+}
+
+func encodeForwardError(err error) string {
+	if err == nil {
+		return ""
+	}
+	for code, sentinel := range forwardErrors {
+		if errors.Is(err, sentinel) {
+			return code
+		}
+	}
+	return err.Error()
+}
+
+func decodeForwardError(code string) error {
+	if code == "" {
+		return nil
+	}
+	if err, ok := forwardErrors[code]; ok {
+		return err
+	}
+	return errors.New(code)
+}
+
+// forward sends a record to the leader at address and returns its result.
+func forward(address string, data []byte, timeout time.Duration) (forwardResponse, error) {
+	conn, err := dialMux(address, muxForward, timeout)
+	if err != nil {
+		return forwardResponse{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(json.RawMessage(data)); err != nil {
+		return forwardResponse{}, fmt.Errorf("forward to leader: %w", err)
+	}
+	var resp forwardResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return forwardResponse{}, fmt.Errorf("forward to leader: %w", err)
+	}
+	return resp, nil
+}
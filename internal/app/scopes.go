@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes a token can carry. Every route behind AuthMiddleware declares the
+// one it needs with RequireScope.
+const (
+	ScopeTodosRead  = "todos:read"
+	ScopeTodosWrite = "todos:write"
+	ScopeAdmin      = "admin"
+)
+
+// CodeInsufficientScope is the code of a 403 from RequireScope.
+const CodeInsufficientScope = "insufficient_scope"
+
+// allScopes lists every scope in the order responses show them.
+var allScopes = []string{ScopeTodosRead, ScopeTodosWrite, ScopeAdmin}
+
+// userScopes are the scopes of every user. Access tokens issued before
+// tokens carried scopes, which have no scope claim, get these.
+var userScopes = []string{ScopeTodosRead, ScopeTodosWrite}
+
+// isAdmin reports whether user may call the /admin endpoints: admins, and
+// the users listed in Config.AdminUsers whatever their role.
+func (a *App) isAdmin(user User) bool {
+	return user.IsAdmin() || slices.Contains(a.Config.AdminUsers, user.Username)
+}
+
+// scopesFor returns the scopes user holds: those of every user, and
+// ScopeAdmin for admins.
+func (a *App) scopesFor(user User) []string {
+	if a.isAdmin(user) {
+		return allScopes
+	}
+	return userScopes
+}
+
+// normalizeScopes checks scopes against the known ones and returns them
+// without duplicates, in canonical order. The unknown scope is returned
+// alongside ok == false.
+func normalizeScopes(scopes []string) ([]string, string, bool) {
+	for _, scope := range scopes {
+		if !slices.Contains(allScopes, scope) {
+			return nil, scope, false
+		}
+	}
+	var normalized []string
+	for _, scope := range allScopes {
+		if slices.Contains(scopes, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, "", true
+}
+
+// scopeClaim reads the space-separated scope claim of an access token, as
+// in RFC 8693. A token without one has userScopes.
+func scopeClaim(claims map[string]any) ([]string, bool) {
+	v, ok := claims["scope"]
+	if !ok {
+		return userScopes, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	return strings.Fields(s), true
+}
+
+// RequireScope lets through only requests whose token carries scope, and
+// answers the rest with a 403 naming it. It must run after AuthMiddleware.
+func (a *App) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, _ := c.Get("scopes")
+		if granted, _ := scopes.([]string); !slices.Contains(granted, scope) {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Missing scope " + scope,
+				"code":  CodeInsufficientScope,
+				"scope": scope,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
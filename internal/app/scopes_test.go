@@ -0,0 +1,85 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// missingScope checks that w refused a request for lack of a scope and
+// returns the scope it named.
+func missingScope(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusForbidden || body["code"] != CodeInsufficientScope {
+		t.Fatalf("Expected 403 %s, got %d body=%s", CodeInsufficientScope, w.Code, w.Body.String())
+	}
+	if header := w.Header().Get("WWW-Authenticate"); header != `Bearer error="insufficient_scope", scope="`+body["scope"]+`"` {
+		t.Fatalf("Unexpected WWW-Authenticate %q", header)
+	}
+	return body["scope"]
+}
+
+func TestRequireScope(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: policySecret, ConcurrencyMode: SafeMode, AdminUsers: []string{"root"}}))
+	session := registerAndLogin(t, r, "alice", "pass")
+	root := registerAndLogin(t, r, "root", "pass")
+
+	pat := func(token string, scopes ...string) string {
+		return postJSON(t, r, "/me/tokens", CreatePersonalTokenRequest{Name: "t", Scopes: scopes}, token, http.StatusCreated)["token"].(string)
+	}
+	reader, writer := pat(session, ScopeTodosRead), pat(session, ScopeTodosWrite)
+
+	if w := performRequest(r, "GET", "/todos", nil, reader); w.Code != http.StatusOK {
+		t.Fatalf("Expected a read token to list todos, got %d", w.Code)
+	}
+	for _, req := range []struct{ method, path string }{
+		{"POST", "/todos"}, {"PUT", "/todos/x"}, {"DELETE", "/todos/x"}, {"POST", "/todos/x/revert/2"},
+		{"POST", "/trash/x/restore"}, {"DELETE", "/trash/x"},
+	} {
+		if scope := missingScope(t, performRequest(r, req.method, req.path, Todo{Title: "x"}, reader)); scope != ScopeTodosWrite {
+			t.Fatalf("%s %s: expected %s missing, got %s", req.method, req.path, ScopeTodosWrite, scope)
+		}
+	}
+	for _, path := range []string{"/todos", "/todos/x", "/todos/x/history", "/trash", "/changes"} {
+		if scope := missingScope(t, performRequest(r, "GET", path, nil, writer)); scope != ScopeTodosRead {
+			t.Fatalf("GET %s: expected %s missing, got %s", path, ScopeTodosRead, scope)
+		}
+	}
+
+	// Logins carry every scope of their user; only admins can grant admin
+	if w := performRequest(r, "POST", "/todos", Todo{Title: "x"}, session); w.Code != http.StatusCreated {
+		t.Fatalf("Expected a login to write, got %d", w.Code)
+	}
+	postJSON(t, r, "/me/tokens", CreatePersonalTokenRequest{Name: "t", Scopes: []string{ScopeAdmin}}, session, http.StatusForbidden)
+	if w := performRequest(r, "GET", "/admin/cache", nil, pat(root, ScopeAdmin)); w.Code == http.StatusForbidden {
+		t.Fatalf("Expected an admin token let through, got %d", w.Code)
+	}
+	if scope := missingScope(t, performRequest(r, "GET", "/admin/cache", nil, pat(root, ScopeTodosRead))); scope != ScopeAdmin {
+		t.Fatalf("Expected %s missing, got %s", ScopeAdmin, scope)
+	}
+
+	// Access tokens from before scopes have those of every user
+	legacy := policyClaims()
+	legacy["user"] = "root"
+	token := signPolicyToken(t, jwt.SigningMethodHS256, legacy, []byte(policySecret))
+	if w := performRequest(r, "GET", "/todos", nil, token); w.Code != http.StatusOK {
+		t.Fatalf("Expected a token without scopes to read, got %d", w.Code)
+	}
+	missingScope(t, performRequest(r, "GET", "/admin/cache", nil, token))
+
+	narrowed := policyClaims()
+	narrowed["scope"] = ScopeTodosRead
+	token = signPolicyToken(t, jwt.SigningMethodHS256, narrowed, []byte(policySecret))
+	missingScope(t, performRequest(r, "POST", "/todos", Todo{Title: "x"}, token))
+
+	narrowed["scope"] = []string{ScopeTodosRead}
+	token = signPolicyToken(t, jwt.SigningMethodHS256, narrowed, []byte(policySecret))
+	if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, token)); code != CodeMalformedToken {
+		t.Fatalf("Expected a scope claim that is not a string refused, got %s", code)
+	}
+}
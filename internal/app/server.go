@@ -1,21 +1,83 @@
 package app
 
-import "github.com/gin-gonic/gin"
+import (
+	"log"
 
-func SetupRouter() *gin.Engine {
+	"github.com/gin-gonic/gin"
+)
+
+func SetupRouter(a *App) *gin.Engine {
 	r := gin.Default()
+	// Login throttling goes by client address, which X-Forwarded-For must
+	// not be able to fake. Open has already rejected invalid entries.
+	if err := r.SetTrustedProxies(a.Config.TrustedProxies); err != nil {
+		log.Printf("trusted proxies: %v", err)
+	}
+
+	r.POST("/register", a.RegisterHandler)
+	r.POST("/login", a.LoginHandler)
+	r.POST("/login/2fa", a.LoginTwoFactorHandler)
+	r.POST("/password/reset", a.PasswordResetHandler)
+	r.POST("/token/refresh", a.RefreshHandler)
+	r.GET("/.well-known/jwks.json", a.JWKSHandler)
+
+	logout := r.Group("/logout")
+	logout.Use(a.AuthMiddleware(), a.SessionMiddleware())
+	{
+		logout.POST("", a.LogoutHandler)
+		logout.POST("/all", a.LogoutAllHandler)
+	}
+
+	me := r.Group("/me")
+	me.Use(a.AuthMiddleware(), a.SessionMiddleware())
+	{
+		me.POST("/2fa/setup", a.TwoFactorSetupHandler)
+		me.POST("/2fa/verify", a.TwoFactorVerifyHandler)
+		me.GET("/tokens", a.ListPersonalTokensHandler)
+		me.POST("/tokens", a.CreatePersonalTokenHandler)
+		me.DELETE("/tokens/:id", a.DeletePersonalTokenHandler)
+	}
 
-	r.POST("/register", RegisterHandler)
-	r.POST("/login", LoginHandler)
+	read, write := a.RequireScope(ScopeTodosRead), a.RequireScope(ScopeTodosWrite)
 
 	protected := r.Group("/todos")
-	protected.Use(AuthMiddleware())
+	protected.Use(a.AuthMiddleware())
+	{
+		protected.GET("", read, a.GetTodosHandler)
+		protected.POST("", write, a.CreateTodoHandler)
+		protected.GET("/:id", read, a.GetTodoHandler)
+		protected.PUT("/:id", write, a.UpdateTodoHandler)
+		protected.DELETE("/:id", write, a.DeleteTodoHandler)
+		protected.GET("/:id/history", read, a.GetTodoHistoryHandler)
+		protected.POST("/:id/revert/:revision", write, a.RevertTodoHandler)
+	}
+
+	trash := r.Group("/trash")
+	trash.Use(a.AuthMiddleware())
+	{
+		trash.GET("", read, a.GetTrashHandler)
+		trash.POST("/:id/restore", write, a.RestoreTodoHandler)
+		trash.DELETE("/:id", write, a.PurgeTodoHandler)
+	}
+
+	changes := r.Group("/changes")
+	changes.Use(a.AuthMiddleware())
+	{
+		changes.GET("", read, a.GetChangesHandler)
+	}
+
+	admin := r.Group("/admin")
+	admin.Use(a.AuthMiddleware(), a.AdminMiddleware(), a.RequireScope(ScopeAdmin))
 	{
-		protected.GET("", GetTodosHandler)
-		protected.POST("", CreateTodoHandler)
-		protected.GET("/:id", GetTodoHandler)
-		protected.PUT("/:id", UpdateTodoHandler)
-		protected.DELETE("/:id", DeleteTodoHandler)
+		admin.POST("/backup", a.BackupHandler)
+		admin.GET("/cache", a.CacheStatsHandler)
+		admin.GET("/users", a.ListUsersHandler)
+		admin.PUT("/users/:username/role", a.SetUserRoleHandler)
+		admin.POST("/users/:username/disable", a.DisableUserHandler)
+		admin.POST("/users/:username/enable", a.EnableUserHandler)
+		admin.POST("/users/:username/reset-password", a.ResetUserPasswordHandler)
+		admin.POST("/users/:username/unlock", a.UnlockUserHandler)
+		admin.DELETE("/users/:username", a.DeleteUserHandler)
 	}
 
 	return r
@@ -2,18 +2,203 @@ package app
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
-	"sync"
+	"time"
 )
 
 var (
-	Users  sync.Map // username -> hashed password
-	Todos  sync.Map // username -> []*Todo
-	JwtKey []byte   // global JWT secret
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+	ErrTodoNotFound = errors.New("todo not found")
+	// ErrRevisionNotFound is returned when a todo has no revision with the
+	// requested number.
+	ErrRevisionNotFound = errors.New("revision not found")
+	// ErrVersionMismatch is returned by precondition checks when the caller
+	// wrote against a stale version of a todo.
+	ErrVersionMismatch = errors.New("version mismatch")
+	// ErrTokenNotFound is returned for refresh tokens that were never
+	// issued, have been revoked or were pruned after expiring.
+	ErrTokenNotFound = errors.New("refresh token not found")
+	// ErrTokenReused is returned when a refresh token that was already
+	// exchanged is presented again.
+	ErrTokenReused = errors.New("refresh token already used")
+	// ErrPersonalTokenNotFound is returned for personal access tokens that
+	// were never created, have been deleted or were pruned after expiring.
+	ErrPersonalTokenNotFound = errors.New("personal access token not found")
+	// ErrChangesPruned is returned for change feed reads that start below
+	// the feed's floor, where changes the reader has not seen were pruned.
+	ErrChangesPruned = errors.New("changes no longer retained")
 )
 
-func Init(secret string) {
-	JwtKey = []byte(secret)
+// UserStore holds registered users keyed by username.
+type UserStore interface {
+	// Create stores a new user and returns ErrUserExists if the name is taken.
+	Create(user User) error
+	// Get returns ErrUserNotFound for unknown usernames.
+	Get(username string) (User, error)
+	// List returns every user ordered by username.
+	List() ([]User, error)
+	// Update applies fn to a copy of the user and stores the result. An
+	// error from fn aborts the update and is returned unchanged.
+	Update(username string, fn func(*User) error) (User, error)
+	// Delete removes the user with their revisions and change feed entries,
+	// so the name can be registered again without inheriting any history,
+	// and returns ErrUserNotFound for unknown usernames. The user's todos
+	// and tokens are left to the caller.
+	Delete(username string) error
+}
+
+// TodoStore holds each user's todos. Methods that address a single todo
+// return ErrTodoNotFound when the user has no todo with that ID.
+type TodoStore interface {
+	List(username string) ([]Todo, error)
+	Get(username, id string) (Todo, error)
+	Create(username string, todo Todo) error
+	// Update applies fn to the stored todo and returns the result. If fn
+	// returns an error nothing is written and the current todo is returned
+	// alongside that error.
+	Update(username, id string, fn func(*Todo) error) (Todo, error)
+	// Revise is Update for an edit that belongs in the todo's history: fn
+	// also returns the revision describing the edit, and the store writes
+	// it with the updated todo, so neither is kept without the other and
+	// a todo's revisions are appended in version order.
+	Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error)
+	// Delete removes the todo and returns it. A non-nil check runs against
+	// the current todo first; if it fails nothing is removed and the current
+	// todo is returned alongside the check's error.
+	Delete(username, id string, check func(Todo) error) (Todo, error)
+	// Owners returns every username that holds todos, in order, whether or
+	// not a user with that name exists.
+	Owners() ([]string, error)
+}
+
+// RevisionStore keeps the edit history of each user's todos. Revisions are
+// never changed once appended.
+type RevisionStore interface {
+	Append(username string, rev Revision) error
+	// List returns a todo's revisions ordered by revision number.
+	List(username, todoID string) ([]Revision, error)
+	// Get returns ErrRevisionNotFound for unknown revision numbers.
+	Get(username, todoID string, revision int64) (Revision, error)
+}
+
+// ChangeFeed is the ordered log of every user registration and todo
+// mutation. Backends record each change atomically with the write it
+// describes, so a user's changes appear in the order they were applied.
+type ChangeFeed interface {
+	// Since returns up to limit changes with a sequence number greater than
+	// since, oldest first. A non-empty username keeps only that user's
+	// changes. It returns ErrChangesPruned if since is below Floor.
+	Since(since uint64, username string, limit int) ([]Change, error)
+	// Changed returns a channel that is closed when the next change is
+	// recorded.
+	Changed() <-chan struct{}
+	// Floor returns the sequence number of the newest pruned change, or 0
+	// if none has been pruned.
+	Floor() (uint64, error)
+	// Prune removes the changes recorded before cutoff and returns how
+	// many it removed.
+	Prune(cutoff time.Time) (int, error)
+}
+
+// TokenStore keeps the refresh tokens issued at login, keyed by their hash.
+// Tokens are session state, not user data, so backups leave them out.
+type TokenStore interface {
+	Create(token RefreshToken) error
+	// Get returns ErrTokenNotFound for unknown hashes.
+	Get(hash string) (RefreshToken, error)
+	// List returns every token issued to username, used ones included.
+	List(username string) ([]RefreshToken, error)
+	// Use marks the token exchanged at the given time and returns it. A
+	// token that was already exchanged is left as it is and returned
+	// alongside ErrTokenReused.
+	Use(hash string, at time.Time) (RefreshToken, error)
+	// RevokeFamily deletes every token of a family.
+	RevokeFamily(family string) error
+	// Prune deletes every token that expired before now and returns how
+	// many it deleted.
+	Prune(now time.Time) (int, error)
+}
+
+// RevocationStore is the list of access tokens and sessions revoked before
+// their expiry.
+type RevocationStore interface {
+	// Revoke adds r to the list. Revoking a token twice keeps the later
+	// expiry.
+	Revoke(r Revocation) error
+	IsRevoked(id string) (bool, error)
+	// Prune deletes every revocation that expired before now and returns
+	// how many it deleted.
+	Prune(now time.Time) (int, error)
+}
+
+// PersonalTokenStore keeps personal access tokens, keyed by their hash.
+// They are credentials rather than user data, so backups leave them out.
+type PersonalTokenStore interface {
+	Create(token PersonalAccessToken) error
+	// Get returns ErrPersonalTokenNotFound for unknown hashes.
+	Get(hash string) (PersonalAccessToken, error)
+	// List returns username's tokens, oldest first.
+	List(username string) ([]PersonalAccessToken, error)
+	// Touch records that the token with hash was used at the given time. It
+	// never moves LastUsedAt back, and touching an unknown token is a
+	// no-op.
+	Touch(hash string, at time.Time) error
+	// Delete removes username's token with id, returning
+	// ErrPersonalTokenNotFound if there is none.
+	Delete(username, id string) error
+	// Prune deletes every token that expired before now and returns how
+	// many it deleted.
+	Prune(now time.Time) (int, error)
+}
+
+// LoginAttemptStore keeps the failed login counters behind brute-force
+// protection. Like tokens they are session state and stay out of backups.
+type LoginAttemptStore interface {
+	// Get returns the counters for key, or a zero record with only Key set.
+	Get(key string) (LoginAttempts, error)
+	// Update applies fn to the counters for key, starting from the zero
+	// record when there are none, and stores the result atomically.
+	Update(key string, fn func(*LoginAttempts) error) (LoginAttempts, error)
+	// Delete clears the counters for key.
+	Delete(key string) error
+	// Prune deletes every record that expired before now and returns how
+	// many it deleted.
+	Prune(now time.Time) (int, error)
+}
+
+// Dataset is every user with their todos and revisions: what a backup
+// holds.
+type Dataset struct {
+	Users     []User                `json:"users"`
+	Todos     map[string][]Todo     `json:"todos"`
+	Revisions map[string][]Revision `json:"revisions,omitempty"`
+}
+
+func newDataset() Dataset {
+	return Dataset{Todos: make(map[string][]Todo), Revisions: make(map[string][]Revision)}
+}
+
+// Exporter reads a backend's whole dataset for a backup.
+type Exporter interface {
+	// Export returns the dataset as of a single point in time, so no write
+	// is half included. The in-memory stores have no global lock and only
+	// guarantee this per user.
+	Export() (Dataset, error)
+}
+
+// Stores groups the stores an App reads and writes.
+type Stores struct {
+	Users          UserStore
+	Todos          TodoStore
+	Revisions      RevisionStore
+	Changes        ChangeFeed
+	Tokens         TokenStore
+	Revocations    RevocationStore
+	Attempts       LoginAttemptStore
+	PersonalTokens PersonalTokenStore
+	Exporter       Exporter
 }
 
 func GenerateID() string {
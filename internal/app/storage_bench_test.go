@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Benchmarks comparing the original slice store (RacyTodoStore, which scans
+// a user's []*Todo for every lookup) with the indexed MemoryTodoStore. Run
+// with:
+//
+//	go test -run '^$' -bench TodoStore ./internal/app/
+//
+// All benchmarks are single-goroutine, so the racy store is safe to use.
+
+var benchSizes = []int{10, 1_000, 100_000}
+
+var benchStores = []struct {
+	name string
+	new  func() TodoStore
+}{
+	{"slice", func() TodoStore { return NewRacyTodoStore() }},
+	{"indexed", func() TodoStore { return NewMemoryTodoStore() }},
+}
+
+// seedBenchStore fills a store with n todos for one user and returns their IDs.
+func seedBenchStore(b *testing.B, store TodoStore, n int) []string {
+	b.Helper()
+	ids := make([]string, n)
+	for i := range ids {
+		todo := newTestTodo(fmt.Sprintf("todo %d", i))
+		ids[i] = todo.ID
+		if err := store.Create("bench", todo); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return ids
+}
+
+// runTodoStoreBench runs op for every store and size combination.
+func runTodoStoreBench(b *testing.B, op func(b *testing.B, store TodoStore, ids []string)) {
+	for _, size := range benchSizes {
+		for _, s := range benchStores {
+			b.Run(fmt.Sprintf("%s/%d", s.name, size), func(b *testing.B) {
+				store := s.new()
+				ids := seedBenchStore(b, store, size)
+				b.ResetTimer()
+				op(b, store, ids)
+			})
+		}
+	}
+}
+
+func BenchmarkTodoStoreGet(b *testing.B) {
+	runTodoStoreBench(b, func(b *testing.B, store TodoStore, ids []string) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Get("bench", ids[i%len(ids)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkTodoStoreUpdate(b *testing.B) {
+	runTodoStoreBench(b, func(b *testing.B, store TodoStore, ids []string) {
+		for i := 0; i < b.N; i++ {
+			_, err := store.Update("bench", ids[i%len(ids)], func(t *Todo) error {
+				t.Completed = !t.Completed
+				t.Version++
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkTodoStoreDelete deletes a todo and recreates it, so the list
+// keeps its size for the whole run.
+func BenchmarkTodoStoreDelete(b *testing.B) {
+	runTodoStoreBench(b, func(b *testing.B, store TodoStore, ids []string) {
+		for i := 0; i < b.N; i++ {
+			idx := i % len(ids)
+			deleted, err := store.Delete("bench", ids[idx], nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := store.Create("bench", deleted); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkTodoStoreList(b *testing.B) {
+	runTodoStoreBench(b, func(b *testing.B, store TodoStore, ids []string) {
+		for i := 0; i < b.N; i++ {
+			if todos, _ := store.List("bench"); len(todos) != len(ids) {
+				b.Fatalf("expected %d todos got %d", len(ids), len(todos))
+			}
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package app
+
+import (
+	"container/list"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Rough per-item memory costs used to keep a CachedTodoStore within its
+// budget. Only the relative sizes matter.
+const (
+	cachedUserOverhead = 128
+	cachedTodoOverhead = 96
+)
+
+// CachedTodoStore keeps the todo lists of recently active users in memory in
+// front of a backing TodoStore, so dormant accounts cost nothing until they
+// are used again. A user's list is loaded on its first read and the least
+// recently used lists are evicted once their estimated size exceeds the
+// budget. Writes go through to the backing store before the cached copy is
+// updated, so the backing store never lags behind and an evicted list has no
+// unsaved state. That is how the cache writes back its dirty state: it
+// never holds any. Deferring writes to eviction would acknowledge edits a
+// crash could still lose, and would split a todo from the revision and
+// change feed entry its backing store writes with it. The cache assumes it
+// is the only writer to the backing store.
+type CachedTodoStore struct {
+	backing TodoStore
+	budget  int64
+
+	mu    sync.Mutex // guards lru, users and size
+	lru   *list.List // of *cachedTodos, most recently used first
+	users map[string]*list.Element
+	size  int64
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// cachedTodos is one user's cache entry. Every operation on the user holds
+// mu while it talks to the backing store, so a load never races a write.
+type cachedTodos struct {
+	username string
+
+	mu      sync.RWMutex
+	loaded  bool
+	evicted bool
+	todos   []Todo
+	size    int64 // last size reported to the store, guarded by the store's mu
+}
+
+// drop forgets the cached list after a failed write, which may or may not
+// have reached the backing store, so the next read reloads it.
+func (e *cachedTodos) drop() {
+	e.loaded, e.todos = false, nil
+}
+
+// dropOnFailure drops e unless err says the write was turned down and
+// changed nothing: the todo was missing, the version was stale or err is
+// refused, the error the caller's callback returned. Any other error is a
+// storage failure that may or may not have landed.
+func (e *cachedTodos) dropOnFailure(err, refused error) {
+	if errors.Is(err, ErrTodoNotFound) || errors.Is(err, ErrVersionMismatch) || (refused != nil && errors.Is(err, refused)) {
+		return
+	}
+	e.drop()
+}
+
+// CacheStats is a snapshot of a CachedTodoStore's counters.
+type CacheStats struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions uint64  `json:"evictions"`
+	Users     int     `json:"users"`
+	Bytes     int64   `json:"bytes"`
+	Budget    int64   `json:"budget_bytes"`
+}
+
+// NewCachedTodoStore caches backing's lists within budget bytes.
+func NewCachedTodoStore(backing TodoStore, budget int64) *CachedTodoStore {
+	return &CachedTodoStore{
+		backing: backing,
+		budget:  budget,
+		lru:     list.New(),
+		users:   make(map[string]*list.Element),
+	}
+}
+
+// Stats returns the cache's counters.
+func (s *CachedTodoStore) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:      s.hits.Load(),
+		Misses:    s.misses.Load(),
+		Evictions: s.evictions.Load(),
+		Budget:    s.budget,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	s.mu.Lock()
+	stats.Users, stats.Bytes = len(s.users), s.size
+	s.mu.Unlock()
+	return stats
+}
+
+// Backing returns the store s caches. Scans over every user, such as the
+// trash purger's, read it directly so they neither load dormant lists nor
+// push out the ones in use; their writes still go through s.
+func (s *CachedTodoStore) Backing() TodoStore {
+	return s.backing
+}
+
+// entry returns username's entry, creating it if needed, and marks it most
+// recently used.
+func (s *CachedTodoStore) entry(username string) *cachedTodos {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.users[username]; ok {
+		s.lru.MoveToFront(el)
+		return el.Value.(*cachedTodos)
+	}
+	e := &cachedTodos{username: username}
+	s.users[username] = s.lru.PushFront(e)
+	return e
+}
+
+// read runs fn with username's loaded list, loading it first on a miss.
+func (s *CachedTodoStore) read(username string, fn func(todos []Todo)) error {
+	for {
+		e := s.entry(username)
+		e.mu.RLock()
+		if e.evicted {
+			e.mu.RUnlock()
+			continue
+		}
+		if e.loaded {
+			s.hits.Add(1)
+			fn(e.todos)
+			e.mu.RUnlock()
+			return nil
+		}
+		e.mu.RUnlock()
+
+		e.mu.Lock()
+		if e.evicted {
+			e.mu.Unlock()
+			continue
+		}
+		if !e.loaded {
+			s.misses.Add(1)
+			todos, err := s.backing.List(username)
+			if err != nil {
+				e.mu.Unlock()
+				return err
+			}
+			e.todos, e.loaded = todos, true
+		} else {
+			s.hits.Add(1)
+		}
+		fn(e.todos)
+		e.mu.Unlock()
+		s.resize(e)
+		return nil
+	}
+}
+
+// write runs fn with username's entry locked. fn writes to the backing store
+// and then updates the cached copy if there is one; a user whose list is not
+// loaded is not loaded just to be written to.
+func (s *CachedTodoStore) write(username string, fn func(e *cachedTodos)) {
+	for {
+		e := s.entry(username)
+		e.mu.Lock()
+		if e.evicted {
+			e.mu.Unlock()
+			continue
+		}
+		fn(e)
+		e.mu.Unlock()
+		s.resize(e)
+		return
+	}
+}
+
+// resize updates the store's size for e and evicts cold entries while the
+// cache is over budget.
+func (s *CachedTodoStore) resize(e *cachedTodos) {
+	e.mu.RLock()
+	size := int64(cachedUserOverhead + len(e.username))
+	for _, t := range e.todos {
+		size += cachedTodoOverhead + int64(len(t.ID)+len(t.Title))
+	}
+	e.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[e.username]; !ok || s.users[e.username].Value != e {
+		return // evicted meanwhile
+	}
+	s.size += size - e.size
+	e.size = size
+
+	// Entries in use are skipped; they are cold again soon enough.
+	for el := s.lru.Back(); el != nil && s.size > s.budget; {
+		prev := el.Prev()
+		victim := el.Value.(*cachedTodos)
+		if victim != e && victim.mu.TryLock() {
+			victim.evicted = true
+			victim.todos = nil
+			victim.mu.Unlock()
+			s.lru.Remove(el)
+			delete(s.users, victim.username)
+			s.size -= victim.size
+			s.evictions.Add(1)
+		}
+		el = prev
+	}
+}
+
+func (s *CachedTodoStore) List(username string) ([]Todo, error) {
+	var out []Todo
+	err := s.read(username, func(todos []Todo) {
+		out = append(make([]Todo, 0, len(todos)), todos...)
+	})
+	return out, err
+}
+
+func (s *CachedTodoStore) Get(username, id string) (Todo, error) {
+	var out Todo
+	found := false
+	err := s.read(username, func(todos []Todo) {
+		if i := findTodo(todos, id); i >= 0 {
+			out, found = todos[i], true
+		}
+	})
+	if err == nil && !found {
+		err = ErrTodoNotFound
+	}
+	return out, err
+}
+
+func (s *CachedTodoStore) Create(username string, todo Todo) error {
+	var err error
+	s.write(username, func(e *cachedTodos) {
+		if err = s.backing.Create(username, todo); err != nil {
+			e.dropOnFailure(err, nil)
+		} else if e.loaded {
+			e.todos = append(e.todos, todo)
+		}
+	})
+	return err
+}
+
+func (s *CachedTodoStore) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	var updated Todo
+	var err, refused error
+	guarded := func(t *Todo) error {
+		refused = fn(t)
+		return refused
+	}
+	s.write(username, func(e *cachedTodos) {
+		if updated, err = s.backing.Update(username, id, guarded); err != nil {
+			e.dropOnFailure(err, refused)
+		} else if i := findTodo(e.todos, id); i >= 0 {
+			e.todos[i] = updated
+		}
+	})
+	return updated, err
+}
+
+func (s *CachedTodoStore) Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error) {
+	var updated Todo
+	var err, refused error
+	guarded := func(t *Todo) (Revision, error) {
+		var rev Revision
+		rev, refused = fn(t)
+		return rev, refused
+	}
+	s.write(username, func(e *cachedTodos) {
+		if updated, err = s.backing.Revise(username, id, guarded); err != nil {
+			e.dropOnFailure(err, refused)
+		} else if i := findTodo(e.todos, id); i >= 0 {
+			e.todos[i] = updated
+		}
+	})
+	return updated, err
+}
+
+func (s *CachedTodoStore) Delete(username, id string, check func(Todo) error) (Todo, error) {
+	var deleted Todo
+	var err, refused error
+	guarded := check
+	if check != nil {
+		guarded = func(t Todo) error {
+			refused = check(t)
+			return refused
+		}
+	}
+	s.write(username, func(e *cachedTodos) {
+		if deleted, err = s.backing.Delete(username, id, guarded); err != nil {
+			e.dropOnFailure(err, refused)
+		} else if i := findTodo(e.todos, id); i >= 0 {
+			e.todos = slices.Delete(e.todos, i, i+1)
+		}
+	})
+	return deleted, err
+}
+
+func (s *CachedTodoStore) Owners() ([]string, error) {
+	return s.backing.Owners()
+}
+
+func findTodo(todos []Todo, id string) int {
+	for i, t := range todos {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
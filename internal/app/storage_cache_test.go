@@ -0,0 +1,274 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTodoStore counts the lists read from the store it wraps.
+type countingTodoStore struct {
+	TodoStore
+	lists atomic.Int32
+}
+
+func (s *countingTodoStore) List(username string) ([]Todo, error) {
+	s.lists.Add(1)
+	return s.TodoStore.List(username)
+}
+
+func TestCachedTodoStoreLoadsLazilyAndEvictsColdUsers(t *testing.T) {
+	backing := &countingTodoStore{TodoStore: NewMemoryTodoStore()}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		for i := 0; i < 3; i++ {
+			backing.Create(username, newTestTodo(fmt.Sprintf("%s %d", username, i)))
+		}
+	}
+	// Room for about two users' lists
+	cache := NewCachedTodoStore(backing, 2*(cachedUserOverhead+3*(cachedTodoOverhead+64)))
+
+	if stats := cache.Stats(); stats.Users != 0 || backing.lists.Load() != 0 {
+		t.Fatalf("Expected nothing loaded before first access, got %+v", stats)
+	}
+	cache.List("alice")
+	cache.List("alice")
+	cache.List("bob")
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Evictions != 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// carol pushes out alice, the least recently used
+	cache.List("carol")
+	stats := cache.Stats()
+	if stats.Evictions != 1 || stats.Users != 2 || stats.Bytes > stats.Budget {
+		t.Fatalf("Expected alice evicted within budget, got %+v", stats)
+	}
+	cache.List("bob")
+	if backing.lists.Load() != 3 {
+		t.Fatalf("Expected bob still cached, got %d backing reads", backing.lists.Load())
+	}
+	cache.List("alice")
+	if backing.lists.Load() != 4 {
+		t.Fatalf("Expected alice reloaded, got %d backing reads", backing.lists.Load())
+	}
+	if stats := cache.Stats(); stats.HitRate != 2.0/6 {
+		t.Fatalf("Expected hit rate 2/6 got %v", stats.HitRate)
+	}
+}
+
+func TestCachedTodoStoreWritesThrough(t *testing.T) {
+	backing := NewMemoryTodoStore()
+	cache := NewCachedTodoStore(backing, 1<<20)
+
+	kept, gone := newTestTodo("kept"), newTestTodo("gone")
+	cache.Create("alice", kept)
+	cache.List("alice")
+	cache.Create("alice", gone)
+	cache.Update("alice", kept.ID, func(t *Todo) error {
+		t.Title = "renamed"
+		return nil
+	})
+	cache.Delete("alice", gone.ID, nil)
+	if _, err := cache.Update("alice", kept.ID, func(*Todo) error { return ErrVersionMismatch }); err != ErrVersionMismatch {
+		t.Fatalf("Expected the precondition error got %v", err)
+	}
+
+	cached, _ := cache.List("alice")
+	stored, _ := backing.List("alice")
+	if len(cached) != 1 || cached[0].Title != "renamed" || !slices.Equal(cached, stored) {
+		t.Fatalf("Cache and backing store disagree: %+v vs %+v", cached, stored)
+	}
+	if _, err := cache.Get("alice", gone.ID); err != ErrTodoNotFound {
+		t.Fatalf("Expected the deleted todo gone, got %v", err)
+	}
+}
+
+// failingTodoStore fails every update with a storage error while failing
+// is set.
+type failingTodoStore struct {
+	countingTodoStore
+	failing bool
+}
+
+func (s *failingTodoStore) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	if s.failing {
+		return Todo{}, fmt.Errorf("disk on fire")
+	}
+	return s.countingTodoStore.Update(username, id, fn)
+}
+
+func TestCachedTodoStoreKeepsListsOnRefusedWrites(t *testing.T) {
+	backing := &failingTodoStore{countingTodoStore: countingTodoStore{TodoStore: NewMemoryTodoStore()}}
+	cache := NewCachedTodoStore(backing, 1<<20)
+	todo := newTestTodo("a")
+	cache.Create("alice", todo)
+	cache.List("alice")
+
+	errNope := fmt.Errorf("nope")
+	refusals := map[string]func() error{
+		"version mismatch": func() error {
+			_, err := cache.Update("alice", todo.ID, func(*Todo) error { return ErrVersionMismatch })
+			return err
+		},
+		"missing todo": func() error {
+			_, err := cache.Update("alice", "missing", func(*Todo) error { return nil })
+			return err
+		},
+		"update callback": func() error {
+			_, err := cache.Update("alice", todo.ID, func(*Todo) error { return errNope })
+			return err
+		},
+		"delete check": func() error {
+			_, err := cache.Delete("alice", todo.ID, func(Todo) error { return errNope })
+			return err
+		},
+	}
+	for name, refuse := range refusals {
+		if err := refuse(); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		cache.List("alice")
+		if n := backing.lists.Load(); n != 1 {
+			t.Fatalf("%s: expected the list kept loaded, got %d backing reads", name, n)
+		}
+	}
+
+	// A storage failure may have landed, so the list is read again
+	backing.failing = true
+	if _, err := cache.Update("alice", todo.ID, func(*Todo) error { return nil }); err == nil {
+		t.Fatal("Expected the storage error")
+	}
+	cache.List("alice")
+	if n := backing.lists.Load(); n != 2 {
+		t.Fatalf("Expected the list reloaded after a storage failure, got %d backing reads", n)
+	}
+}
+
+// TestCachedTodoStoreStressSafe mixes reads and writes over more users than
+// fit in the cache, so loads and evictions race the writes. Run it with
+// -race.
+func TestPurgeTrashReadsPastTheCache(t *testing.T) {
+	stores := NewMemoryStores(SafeMode)
+	backing := &countingTodoStore{TodoStore: stores.Todos}
+	cache := NewCachedTodoStore(backing, 1<<20)
+	stores.Todos = cache
+	a := New(Config{JWTSecret: "testsecret_cache", TrashRetention: time.Hour}, stores)
+
+	deletedAt := time.Now().Add(-2 * time.Hour)
+	for _, username := range []string{"alice", "bob"} {
+		stores.Users.Create(User{Username: username, PasswordHash: "hash-" + username})
+		trashed := newTestTodo("trashed")
+		trashed.DeletedAt = &deletedAt
+		backing.Create(username, newTestTodo("kept"))
+		backing.Create(username, trashed)
+	}
+	cache.List("alice")
+
+	if n, err := a.PurgeTrash(time.Now()); err != nil || n != 2 {
+		t.Fatalf("Expected both trashed todos purged, got %d (err=%v)", n, err)
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Hits != 0 {
+		t.Fatalf("Expected the purge to leave the cache unread, got %+v", stats)
+	}
+	if list, _ := cache.List("alice"); len(list) != 1 || list[0].Title != "kept" {
+		t.Fatalf("Expected alice's cached list to drop the purged todo, got %+v", list)
+	}
+}
+
+func TestCachedTodoStoreStressSafe(t *testing.T) {
+	const (
+		users   = 20
+		workers = 4 // per user
+		writes  = 20
+	)
+	backing := NewMemoryTodoStore()
+	cache := NewCachedTodoStore(backing, 3*(cachedUserOverhead+workers*writes*(cachedTodoOverhead+40)))
+
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		username := fmt.Sprintf("user%d", u)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < writes; i++ {
+					todo := newTestTodo(fmt.Sprintf("%d-%d", w, i))
+					if err := cache.Create(username, todo); err != nil {
+						t.Errorf("Create: %v", err)
+						return
+					}
+					if _, err := cache.Get(username, todo.ID); err != nil {
+						t.Errorf("Get after create: %v", err)
+						return
+					}
+					if i%2 == 0 {
+						cache.Delete(username, todo.ID, nil)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if cache.Stats().Evictions == 0 {
+		t.Fatal("Expected the budget to force evictions")
+	}
+	for u := 0; u < users; u++ {
+		username := fmt.Sprintf("user%d", u)
+		cached, _ := cache.List(username)
+		stored, _ := backing.List(username)
+		if len(stored) != workers*writes/2 || !slices.Equal(cached, stored) {
+			t.Fatalf("%s: cache has %d todos, backing store %d", username, len(cached), len(stored))
+		}
+	}
+}
+
+func TestCacheStatsEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(Config{
+		JWTSecret:      "testsecret_cache",
+		Storage:        StorageSQLite,
+		SQLitePath:     filepath.Join(dir, "todoapp.db"),
+		MigrateOnStart: true,
+		TodoCacheBytes: 1 << 20,
+		AdminUsers:     []string{"root"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	r := SetupRouter(a)
+	token := registerAndLogin(t, r, "root", "pass")
+
+	performRequest(r, "POST", "/todos", map[string]string{"title": "one"}, token)
+	performRequest(r, "GET", "/todos", nil, token)
+	performRequest(r, "GET", "/todos", nil, token)
+
+	w := performRequest(r, "GET", "/admin/cache", nil, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d body=%s", w.Code, w.Body.String())
+	}
+	var stats CacheStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats.Misses != 1 || stats.Hits != 1 || stats.Users != 1 || stats.Budget != 1<<20 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	for _, storage := range []string{StorageMemory, StorageFile, StorageRaft} {
+		if _, err := Open(Config{JWTSecret: "testsecret_cache", Storage: storage, DataDir: dir, TodoCacheBytes: 1 << 20}); err == nil {
+			t.Fatalf("Expected a cache in front of %s storage refused", storage)
+		}
+	}
+
+	plain := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_cache", AdminUsers: []string{"root"}}))
+	token = registerAndLogin(t, plain, "root", "pass")
+	if w := performRequest(plain, "GET", "/admin/cache", nil, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without a cache got %d", w.Code)
+	}
+}
@@ -0,0 +1,747 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// Operations recorded in the write-ahead log.
+const (
+	opRegister   = "register"
+	opUserUpdate = "user_update"
+	opUserDelete = "user_delete"
+	opCreate     = "create"
+	opUpdate     = "update"
+	opDelete     = "delete"
+	opRevision   = "revision"
+
+	opTokenCreate = "token_create"
+	opTokenUse    = "token_use"
+	opTokenRevoke = "token_revoke"
+	opTokenPrune  = "token_prune"
+
+	opRevoke      = "revoke"
+	opRevokePrune = "revoke_prune"
+
+	opAttempts       = "login_attempts"
+	opAttemptsDelete = "login_attempts_delete"
+	opAttemptsPrune  = "login_attempts_prune"
+
+	opPersonalTokenCreate = "personal_token_create"
+	opPersonalTokenTouch  = "personal_token_touch"
+	opPersonalTokenDelete = "personal_token_delete"
+	opPersonalTokenPrune  = "personal_token_prune"
+
+	opChangesPrune = "changes_prune"
+)
+
+// walRecord is one line of the write-ahead log. Update records carry the
+// whole todo after the change, and the revision of an edit, so replaying a
+// log never has to re-run handler logic. The record's Seq doubles as the change feed sequence
+// number.
+type walRecord struct {
+	Seq      uint64    `json:"seq"`
+	Op       string    `json:"op"`
+	At       time.Time `json:"at"`
+	Username string    `json:"username"`
+	User     *User     `json:"user,omitempty"`
+	Todo     *Todo     `json:"todo,omitempty"`
+	TodoID   string    `json:"todo_id,omitempty"`
+	Revision *Revision `json:"revision,omitempty"`
+	// Token is the refresh token a token record is about. Use records carry
+	// its hash and UsedAt, revoke records its family, and prune records the
+	// cutoff as ExpiresAt.
+	Token *RefreshToken `json:"token,omitempty"`
+	// Revocation is the revocation a revoke record adds, or the cutoff as
+	// ExpiresAt of a revoke prune record.
+	Revocation *Revocation `json:"revocation,omitempty"`
+	// Attempts is the record a login attempts update stores, the key of a
+	// delete, or the cutoff as ExpiresAt of a prune.
+	Attempts *LoginAttempts `json:"login_attempts,omitempty"`
+	// PersonalToken is the personal access token a create record stores.
+	// Touch records carry its hash and LastUsedAt, delete records its ID,
+	// and prune records the cutoff as ExpiresAt.
+	PersonalToken *PersonalAccessToken `json:"personal_token,omitempty"`
+	// Change carries the cutoff of a change feed prune record as At.
+	Change *Change `json:"change,omitempty"`
+	// RequestID identifies a Raft proposal across its retries, so the FSM
+	// applies it once however often it reaches the log. The file store
+	// leaves it empty.
+	RequestID string `json:"request_id,omitempty"`
+	// Expect makes an update or delete conditional on the stored todo still
+	// being this version, and ExpectUser and ExpectAttempts do the same for
+	// user and login attempts updates. The file store checks preconditions
+	// before logging and leaves them empty; the Raft store relies on them.
+	Expect         *Todo          `json:"expect,omitempty"`
+	ExpectUser     *User          `json:"expect_user,omitempty"`
+	ExpectAttempts *LoginAttempts `json:"expect_login_attempts,omitempty"`
+}
+
+// fileSnapshot is the compacted state up to and including record Seq.
+type fileSnapshot struct {
+	Seq uint64 `json:"seq"`
+	Dataset
+	Changes        []Change              `json:"changes,omitempty"`
+	ChangesFloor   uint64                `json:"changes_floor,omitempty"`
+	Tokens         []RefreshToken        `json:"tokens,omitempty"`
+	Revocations    []Revocation          `json:"revocations,omitempty"`
+	LoginAttempts  []LoginAttempts       `json:"login_attempts,omitempty"`
+	PersonalTokens []PersonalAccessToken `json:"personal_tokens,omitempty"`
+}
+
+// FileStore is a durable user and todo store. Every write is appended to a
+// JSON-lines write-ahead log and applied in memory, and returns once the log
+// is fsynced; reads are served from memory. Concurrent writes share fsyncs
+// through group commit. The store keeps two copies of its state: writers
+// check their preconditions against the logged one, which has every record
+// in the log, and readers see the published one, which gets a record only
+// once its group commit is durable, so nothing is visible that a crash
+// could still take back. Every SnapshotEvery records the state is written
+// to a snapshot and the log is truncated. On open the snapshot is loaded and the
+// log replayed on top of it, dropping a torn final record left by a crash
+// mid-write.
+type FileStore struct {
+	mu            sync.Mutex // serialises writes so log order matches apply order
+	dir           string
+	wal           *os.File
+	closed        bool
+	seq           uint64
+	sinceSnapshot int
+	snapshotEvery int
+	commits       *groupCommit
+	logged        *memoryState // every logged record, guarded by mu
+
+	pubMu       sync.Mutex  // serialises publishing so apply order matches log order
+	unpublished []walRecord // logged but not yet applied to memoryState
+
+	*memoryState // published: records known to be durable
+}
+
+// FileOptions tunes a FileStore.
+type FileOptions struct {
+	// SnapshotEvery is how many records are logged between snapshots. Zero
+	// or less disables automatic compaction.
+	SnapshotEvery int
+	// CommitMaxDelay is how long a group commit waits for more writes to
+	// join it before syncing. Zero syncs as soon as the previous sync is
+	// done, batching only the writes that arrived meanwhile.
+	CommitMaxDelay time.Duration
+	// CommitMaxBatch syncs a group commit early once it holds this many
+	// records; zero means no limit. One syncs every write on its own before
+	// the next is logged.
+	CommitMaxBatch int
+}
+
+// OpenFileStore opens or creates a store in dir.
+func OpenFileStore(dir string, opts FileOptions) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+
+	s := &FileStore{
+		dir:           dir,
+		snapshotEvery: opts.SnapshotEvery,
+		memoryState:   newMemoryState(),
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+	if err := s.replay(wal); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	// Everything on disk is durable, so both copies start out equal.
+	s.logged = newMemoryState()
+	s.logged.restore(s.export(s.seq))
+	s.wal = wal
+	s.commits = newGroupCommit(s.seq, opts.CommitMaxDelay, opts.CommitMaxBatch)
+	return s, nil
+}
+
+// Users returns the UserStore view of s.
+func (s *FileStore) Users() UserStore { return fileUsers{s} }
+
+// Todos returns the TodoStore view of s.
+func (s *FileStore) Todos() TodoStore { return fileTodos{s} }
+
+// Revisions returns the RevisionStore view of s.
+func (s *FileStore) Revisions() RevisionStore { return fileRevisions{s} }
+
+// Changes returns the change feed of s.
+func (s *FileStore) Changes() ChangeFeed { return fileChanges{s} }
+
+// Tokens returns the TokenStore view of s.
+func (s *FileStore) Tokens() TokenStore { return fileTokens{s} }
+
+// Revocations returns the RevocationStore view of s.
+func (s *FileStore) Revocations() RevocationStore { return fileRevocations{s} }
+
+// Attempts returns the LoginAttemptStore view of s.
+func (s *FileStore) Attempts() LoginAttemptStore { return fileAttempts{s} }
+
+// PersonalTokens returns the PersonalTokenStore view of s.
+func (s *FileStore) PersonalTokens() PersonalTokenStore { return filePersonalTokens{s} }
+
+// Stores returns every store view of s.
+func (s *FileStore) Stores() Stores {
+	return Stores{Users: s.Users(), Todos: s.Todos(), Revisions: s.Revisions(), Changes: s.Changes(), Tokens: s.Tokens(), Revocations: s.Revocations(), Attempts: s.Attempts(), PersonalTokens: s.PersonalTokens(), Exporter: s}
+}
+
+// Export returns the dataset as of the last published record.
+func (s *FileStore) Export() (Dataset, error) {
+	s.pubMu.Lock()
+	defer s.pubMu.Unlock()
+	return s.dataset(), nil
+}
+
+// Close syncs the last batch and releases the log. It does not snapshot, so
+// the next open replays the log exactly as after a crash.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	// Waits out a sync in progress, which never needs s.mu.
+	err := s.commits.wait(s.seq, s.wal.Sync)
+	if err == nil {
+		s.publish(s.seq)
+	}
+	return errors.Join(err, s.wal.Close())
+}
+
+// Snapshot compacts the log into a new snapshot.
+func (s *FileStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+func (s *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var snap fileSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	s.restore(snap)
+	s.seq = snap.Seq
+	return nil
+}
+
+// replay applies every log record newer than the snapshot. A final record
+// that is incomplete or undecodable is a write that was never acknowledged,
+// so it is cut off; damage anywhere else is reported as corruption.
+func (s *FileStore) replay(wal *os.File) error {
+	r := bufio.NewReader(wal)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return truncateWal(wal, offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read wal: %w", err)
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, peekErr := r.Peek(1); errors.Is(peekErr, io.EOF) {
+				return truncateWal(wal, offset)
+			}
+			return fmt.Errorf("wal corrupted at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+
+		if rec.Seq <= s.seq {
+			// Already part of the snapshot; the log was not truncated
+			// before the last shutdown.
+			continue
+		}
+		s.apply(rec) // validated before it was logged
+		s.seq = rec.Seq
+		s.sinceSnapshot++
+	}
+}
+
+func truncateWal(wal *os.File, offset int64) error {
+	if err := wal.Truncate(offset); err != nil {
+		return fmt.Errorf("truncate torn wal record: %w", err)
+	}
+	return wal.Sync()
+}
+
+// write runs prepare under s.mu and logs the record it returns, then waits
+// for the record's group commit and publishes it. A prepare error aborts the
+// write. Writers validate against s.logged inside prepare, so they see every
+// logged record whether or not it is durable yet.
+func (s *FileStore) write(prepare func() (walRecord, error)) error {
+	s.mu.Lock()
+	rec, err := prepare()
+	if err == nil {
+		err = s.commit(&rec)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.commits.wait(rec.Seq, s.wal.Sync); err != nil {
+		return err
+	}
+	s.publish(rec.Seq)
+	return nil
+}
+
+// publish applies every unpublished record up to seq to the state readers
+// see, in log order. Callers have waited for seq to be durable; the records
+// before it are then durable too.
+func (s *FileStore) publish(seq uint64) {
+	s.pubMu.Lock()
+	defer s.pubMu.Unlock()
+	n := 0
+	for ; n < len(s.unpublished) && s.unpublished[n].Seq <= seq; n++ {
+		s.apply(s.unpublished[n]) // validated before it was logged
+	}
+	s.unpublished = slices.Delete(s.unpublished, 0, n)
+}
+
+// commit logs rec and applies it to s.logged. With a batch limit of one the
+// record is synced before s.mu is released; otherwise the caller waits for
+// its group commit. Callers hold s.mu.
+func (s *FileStore) commit(rec *walRecord) error {
+	if s.closed {
+		return errors.New("file store is closed")
+	}
+	if err := s.commits.failed(); err != nil {
+		return err
+	}
+
+	rec.Seq = s.seq + 1
+	rec.At = time.Now().UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.wal.Write(line); err != nil {
+		return fmt.Errorf("append wal: %w", err)
+	}
+	s.commits.logged(rec.Seq)
+	if s.commits.maxBatch == 1 {
+		if err := s.commits.wait(rec.Seq, s.wal.Sync); err != nil {
+			return err
+		}
+	}
+
+	s.logged.apply(*rec) // validated by the caller, so it cannot fail
+	s.pubMu.Lock()
+	s.unpublished = append(s.unpublished, *rec)
+	s.pubMu.Unlock()
+	s.seq = rec.Seq
+	s.sinceSnapshot++
+	if s.snapshotEvery > 0 && s.sinceSnapshot >= s.snapshotEvery {
+		// The record is already durable, so a failed compaction only
+		// means a longer replay next time.
+		if err := s.snapshot(); err != nil {
+			log.Printf("file store: snapshot failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// snapshot writes the current state to a temporary file, renames it over the
+// old snapshot and then truncates the log. A crash between the rename and
+// the truncate is harmless: replay skips records the snapshot already has.
+// Callers hold s.mu.
+func (s *FileStore) snapshot() error {
+	snap := s.logged.export(s.seq)
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(snap); err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(s.dir, snapshotFileName), buf.Bytes()); err != nil {
+		return err
+	}
+
+	if s.wal != nil {
+		if err := truncateWal(s.wal, 0); err != nil {
+			return err
+		}
+		// Everything logged so far is in the snapshot.
+		s.commits.synced(s.seq)
+	}
+	s.sinceSnapshot = 0
+	return nil
+}
+
+// writeFileSync atomically replaces path with data.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+type fileUsers struct{ s *FileStore }
+
+func (u fileUsers) Create(user User) error {
+	return u.s.write(func() (walRecord, error) {
+		if _, err := u.s.logged.users.Get(user.Username); err == nil {
+			return walRecord{}, ErrUserExists
+		}
+		return walRecord{Op: opRegister, Username: user.Username, User: &user}, nil
+	})
+}
+
+func (u fileUsers) Get(username string) (User, error) {
+	return u.s.users.Get(username)
+}
+
+func (u fileUsers) List() ([]User, error) {
+	return u.s.users.List()
+}
+
+func (u fileUsers) Update(username string, fn func(*User) error) (User, error) {
+	var current, updated User
+	err := u.s.write(func() (walRecord, error) {
+		var err error
+		if current, err = u.s.logged.users.Get(username); err != nil {
+			return walRecord{}, err
+		}
+		updated = current
+		if err := fn(&updated); err != nil {
+			return walRecord{}, err
+		}
+		return walRecord{Op: opUserUpdate, Username: username, User: &updated}, nil
+	})
+	if err != nil {
+		return current, err
+	}
+	return updated, nil
+}
+
+func (u fileUsers) Delete(username string) error {
+	return u.s.write(func() (walRecord, error) {
+		if _, err := u.s.logged.users.Get(username); err != nil {
+			return walRecord{}, err
+		}
+		return walRecord{Op: opUserDelete, Username: username}, nil
+	})
+}
+
+type fileTodos struct{ s *FileStore }
+
+func (t fileTodos) List(username string) ([]Todo, error) {
+	return t.s.todos.List(username)
+}
+
+func (t fileTodos) Get(username, id string) (Todo, error) {
+	return t.s.todos.Get(username, id)
+}
+
+func (t fileTodos) Create(username string, todo Todo) error {
+	return t.s.write(func() (walRecord, error) {
+		return walRecord{Op: opCreate, Username: username, Todo: &todo}, nil
+	})
+}
+
+func (t fileTodos) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	return t.update(username, id, func(t *Todo) (*Revision, error) {
+		return nil, fn(t)
+	})
+}
+
+func (t fileTodos) Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error) {
+	return t.update(username, id, func(t *Todo) (*Revision, error) {
+		rev, err := fn(t)
+		return &rev, err
+	})
+}
+
+// update logs the todo fn produces and, if fn returns one, its revision
+// in a single record.
+func (t fileTodos) update(username, id string, fn func(*Todo) (*Revision, error)) (Todo, error) {
+	var current, updated Todo
+	err := t.s.write(func() (walRecord, error) {
+		var err error
+		if current, err = t.s.logged.todos.Get(username, id); err != nil {
+			return walRecord{}, err
+		}
+		updated = current
+		rev, err := fn(&updated)
+		if err != nil {
+			return walRecord{}, err
+		}
+		return walRecord{Op: opUpdate, Username: username, Todo: &updated, Revision: rev}, nil
+	})
+	if err != nil {
+		return current, err
+	}
+	return updated, nil
+}
+
+func (t fileTodos) Delete(username, id string, check func(Todo) error) (Todo, error) {
+	var current Todo
+	err := t.s.write(func() (walRecord, error) {
+		var err error
+		if current, err = t.s.logged.todos.Get(username, id); err != nil {
+			return walRecord{}, err
+		}
+		if check != nil {
+			if err := check(current); err != nil {
+				return walRecord{}, err
+			}
+		}
+		return walRecord{Op: opDelete, Username: username, TodoID: id}, nil
+	})
+	return current, err
+}
+
+func (t fileTodos) Owners() ([]string, error) {
+	return t.s.todos.Owners()
+}
+
+type fileRevisions struct{ s *FileStore }
+
+func (r fileRevisions) Append(username string, rev Revision) error {
+	return r.s.write(func() (walRecord, error) {
+		return walRecord{Op: opRevision, Username: username, Revision: &rev}, nil
+	})
+}
+
+func (r fileRevisions) List(username, todoID string) ([]Revision, error) {
+	return r.s.revisions.List(username, todoID)
+}
+
+func (r fileRevisions) Get(username, todoID string, revision int64) (Revision, error) {
+	return r.s.revisions.Get(username, todoID, revision)
+}
+
+type fileChanges struct{ s *FileStore }
+
+func (c fileChanges) Since(since uint64, username string, limit int) ([]Change, error) {
+	return c.s.changes.Since(since, username, limit)
+}
+
+func (c fileChanges) Changed() <-chan struct{} {
+	return c.s.changes.Changed()
+}
+
+func (c fileChanges) Floor() (uint64, error) {
+	return c.s.changes.Floor()
+}
+
+func (c fileChanges) Prune(cutoff time.Time) (int, error) {
+	n := c.s.changes.prunable(cutoff)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, c.s.write(func() (walRecord, error) {
+		return walRecord{Op: opChangesPrune, Change: &Change{At: cutoff}}, nil
+	})
+}
+
+type fileTokens struct{ s *FileStore }
+
+func (t fileTokens) Create(token RefreshToken) error {
+	return t.s.write(func() (walRecord, error) {
+		return walRecord{Op: opTokenCreate, Username: token.Username, Token: &token}, nil
+	})
+}
+
+func (t fileTokens) Get(hash string) (RefreshToken, error) {
+	return t.s.tokens.Get(hash)
+}
+
+func (t fileTokens) List(username string) ([]RefreshToken, error) {
+	return t.s.tokens.List(username)
+}
+
+func (t fileTokens) Use(hash string, at time.Time) (RefreshToken, error) {
+	var token RefreshToken
+	err := t.s.write(func() (walRecord, error) {
+		var err error
+		if token, err = t.s.logged.tokens.Get(hash); err != nil {
+			return walRecord{}, err
+		}
+		if token.UsedAt != nil {
+			return walRecord{}, ErrTokenReused
+		}
+		token.UsedAt = &at
+		return walRecord{Op: opTokenUse, Username: token.Username, Token: &RefreshToken{Hash: hash, UsedAt: &at}}, nil
+	})
+	return token, err
+}
+
+func (t fileTokens) RevokeFamily(family string) error {
+	return t.s.write(func() (walRecord, error) {
+		return walRecord{Op: opTokenRevoke, Token: &RefreshToken{Family: family}}, nil
+	})
+}
+
+func (t fileTokens) Prune(now time.Time) (int, error) {
+	n := expiredTokens(t.s.tokens, now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, t.s.write(func() (walRecord, error) {
+		return walRecord{Op: opTokenPrune, Token: &RefreshToken{ExpiresAt: now}}, nil
+	})
+}
+
+type fileRevocations struct{ s *FileStore }
+
+func (r fileRevocations) Revoke(rev Revocation) error {
+	return r.s.write(func() (walRecord, error) {
+		return walRecord{Op: opRevoke, Username: rev.Username, Revocation: &rev}, nil
+	})
+}
+
+func (r fileRevocations) IsRevoked(id string) (bool, error) {
+	return r.s.revocations.IsRevoked(id)
+}
+
+func (r fileRevocations) Prune(now time.Time) (int, error) {
+	n := r.s.revocations.expired(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.s.write(func() (walRecord, error) {
+		return walRecord{Op: opRevokePrune, Revocation: &Revocation{ExpiresAt: now}}, nil
+	})
+}
+
+type fileAttempts struct{ s *FileStore }
+
+func (a fileAttempts) Get(key string) (LoginAttempts, error) {
+	return a.s.attempts.Get(key)
+}
+
+func (a fileAttempts) Update(key string, fn func(*LoginAttempts) error) (LoginAttempts, error) {
+	var current, updated LoginAttempts
+	err := a.s.write(func() (walRecord, error) {
+		current, _ = a.s.logged.attempts.Get(key)
+		updated = current
+		if err := fn(&updated); err != nil {
+			return walRecord{}, err
+		}
+		updated.Key = key
+		return walRecord{Op: opAttempts, Attempts: &updated}, nil
+	})
+	if err != nil {
+		return current, err
+	}
+	return updated, nil
+}
+
+func (a fileAttempts) Delete(key string) error {
+	return a.s.write(func() (walRecord, error) {
+		return walRecord{Op: opAttemptsDelete, Attempts: &LoginAttempts{Key: key}}, nil
+	})
+}
+
+func (a fileAttempts) Prune(now time.Time) (int, error) {
+	n := a.s.attempts.expired(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, a.s.write(func() (walRecord, error) {
+		return walRecord{Op: opAttemptsPrune, Attempts: &LoginAttempts{ExpiresAt: now}}, nil
+	})
+}
+
+type filePersonalTokens struct{ s *FileStore }
+
+func (p filePersonalTokens) Create(token PersonalAccessToken) error {
+	return p.s.write(func() (walRecord, error) {
+		return walRecord{Op: opPersonalTokenCreate, Username: token.Username, PersonalToken: &token}, nil
+	})
+}
+
+func (p filePersonalTokens) Get(hash string) (PersonalAccessToken, error) {
+	return p.s.personal.Get(hash)
+}
+
+func (p filePersonalTokens) List(username string) ([]PersonalAccessToken, error) {
+	return p.s.personal.List(username)
+}
+
+func (p filePersonalTokens) Touch(hash string, at time.Time) error {
+	return p.s.write(func() (walRecord, error) {
+		return walRecord{Op: opPersonalTokenTouch, PersonalToken: &PersonalAccessToken{Hash: hash, LastUsedAt: &at}}, nil
+	})
+}
+
+func (p filePersonalTokens) Delete(username, id string) error {
+	return p.s.write(func() (walRecord, error) {
+		tokens, _ := p.s.logged.personal.List(username)
+		if !slices.ContainsFunc(tokens, func(t PersonalAccessToken) bool { return t.ID == id }) {
+			return walRecord{}, ErrPersonalTokenNotFound
+		}
+		return walRecord{Op: opPersonalTokenDelete, Username: username, PersonalToken: &PersonalAccessToken{ID: id}}, nil
+	})
+}
+
+func (p filePersonalTokens) Prune(now time.Time) (int, error) {
+	n := p.s.personal.expired(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, p.s.write(func() (walRecord, error) {
+		return walRecord{Op: opPersonalTokenPrune, PersonalToken: &PersonalAccessToken{ExpiresAt: &now}}, nil
+	})
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Benchmarks comparing group commit with an fsync per write, measured as
+// POST /todos requests per second against the file store. Run with:
+//
+//	go test -run '^$' -bench FileStoreCreate ./internal/app/
+
+var benchClients = []int{1, 16, 256}
+
+var benchCommitModes = []struct {
+	name string
+	opts FileOptions
+}{
+	{"fsync-per-write", FileOptions{CommitMaxBatch: 1}},
+	{"group-commit", FileOptions{}},
+	{"group-commit-1ms", FileOptions{CommitMaxDelay: time.Millisecond, CommitMaxBatch: 256}},
+}
+
+func BenchmarkFileStoreCreateTodo(b *testing.B) {
+	// Keep request logging out of the measurement
+	defer func(w io.Writer) { gin.DefaultWriter = w }(gin.DefaultWriter)
+	gin.DefaultWriter = io.Discard
+
+	for _, mode := range benchCommitModes {
+		for _, clients := range benchClients {
+			b.Run(fmt.Sprintf("%s/clients=%d", mode.name, clients), func(b *testing.B) {
+				fs, err := OpenFileStore(b.TempDir(), mode.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer fs.Close()
+				r := SetupRouter(New(Config{JWTSecret: "benchsecret", ConcurrencyMode: SafeMode}, fs.Stores()))
+				token := registerAndLogin(b, r, "bench", "pass")
+				body := map[string]string{"title": "bench"}
+
+				var next atomic.Int64
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for c := 0; c < clients; c++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for next.Add(1) <= int64(b.N) {
+							if w := performRequest(r, "POST", "/todos", body, token); w.Code != http.StatusCreated {
+								b.Errorf("POST /todos: %d", w.Code)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+			})
+		}
+	}
+}
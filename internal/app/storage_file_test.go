@@ -0,0 +1,313 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestFileStore(t *testing.T, dir string, snapshotEvery int) *FileStore {
+	t.Helper()
+	fs, err := OpenFileStore(dir, FileOptions{SnapshotEvery: snapshotEvery})
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	return fs
+}
+
+func newTestTodo(title string) Todo {
+	return Todo{ID: GenerateID(), Title: title, CreatedAt: time.Now().UTC(), Version: 1}
+}
+
+// fillFileStore registers alice and bob, creates three todos for alice,
+// revises one and deletes another.
+func fillFileStore(t *testing.T, fs *FileStore) (kept, updated Todo) {
+	t.Helper()
+	users, todos := fs.Users(), fs.Todos()
+
+	for _, name := range []string{"alice", "bob"} {
+		if err := users.Create(User{Username: name, PasswordHash: "hash-" + name}); err != nil {
+			t.Fatalf("Create user %s: %v", name, err)
+		}
+	}
+	kept, updated, deleted := newTestTodo("kept"), newTestTodo("to update"), newTestTodo("to delete")
+	for _, todo := range []Todo{kept, updated, deleted} {
+		if err := todos.Create("alice", todo); err != nil {
+			t.Fatalf("Create todo: %v", err)
+		}
+	}
+	updated, err := todos.Revise("alice", updated.ID, func(t *Todo) (Revision, error) {
+		t.Title = "updated"
+		t.Completed = true
+		t.Version++
+		return Revision{TodoID: t.ID, Revision: t.Version, Author: "alice", At: time.Now().UTC(),
+			Changes: []FieldChange{{Field: "title", Old: "to update", New: "updated"}}}, nil
+	})
+	if err != nil {
+		t.Fatalf("Revise: %v", err)
+	}
+	if _, err := todos.Delete("alice", deleted.ID, nil); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	return kept, updated
+}
+
+func assertFilledState(t *testing.T, fs *FileStore, kept, updated Todo) {
+	t.Helper()
+	if _, err := fs.Users().Get("bob"); err != nil {
+		t.Fatalf("Expected bob to survive reopen: %v", err)
+	}
+	if err := fs.Users().Create(User{Username: "alice"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Expected ErrUserExists for alice, got %v", err)
+	}
+
+	list, _ := fs.Todos().List("alice")
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 todos after reopen got %d: %+v", len(list), list)
+	}
+	if list[0].ID != kept.ID || list[1].ID != updated.ID {
+		t.Fatalf("Todo order not preserved: %+v", list)
+	}
+	if list[1].Title != "updated" || !list[1].Completed || list[1].Version != 2 {
+		t.Fatalf("Update not replayed: %+v", list[1])
+	}
+
+	rev, err := fs.Revisions().Get("alice", updated.ID, 2)
+	if err != nil || rev.Author != "alice" || len(rev.Changes) != 1 || rev.Changes[0].New != "updated" {
+		t.Fatalf("Revision not replayed: %+v (err=%v)", rev, err)
+	}
+
+	// Two registrations, three creates, an update and a delete
+	changes, _ := fs.Changes().Since(0, "", 100)
+	if len(changes) != 7 || changes[0].Op != ChangeRegister || changes[6].Op != ChangeDelete || changes[6].Todo != nil {
+		t.Fatalf("Change feed not replayed: %+v", changes)
+	}
+}
+
+func TestFileStoreReplaysLogOnReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir, 0)
+	kept, updated := fillFileStore(t, fs)
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fs = openTestFileStore(t, dir, 0)
+	defer fs.Close()
+	assertFilledState(t, fs, kept, updated)
+}
+
+// TestFileStoreHidesWritesUntilDurable holds a group commit open and checks
+// that readers see nothing of it until it is synced, while writers in the
+// same batch already build on each other.
+func TestFileStoreHidesWritesUntilDurable(t *testing.T) {
+	fs, err := OpenFileStore(t.TempDir(), FileOptions{CommitMaxDelay: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	defer fs.Close()
+	todos := fs.Todos()
+
+	todo := newTestTodo("pending")
+	created, updated := make(chan error, 1), make(chan error, 1)
+	go func() { created <- todos.Create("alice", todo) }()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		_, err := todos.Update("alice", todo.ID, func(t *Todo) error {
+			t.Title = "pending too"
+			return nil
+		})
+		updated <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := todos.Get("alice", todo.ID); !errors.Is(err, ErrTodoNotFound) {
+		t.Fatalf("Expected the todo hidden before its commit is durable, got %v", err)
+	}
+	if changes, _ := fs.Changes().Since(0, "", 10); len(changes) != 0 {
+		t.Fatalf("Expected no changes published yet, got %+v", changes)
+	}
+	if err := <-created; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := <-updated; err != nil {
+		t.Fatalf("Expected the update to see the logged create, got %v", err)
+	}
+	if got, err := todos.Get("alice", todo.ID); err != nil || got.Title != "pending too" {
+		t.Fatalf("Expected both writes visible once durable, got %+v (err=%v)", got, err)
+	}
+}
+
+func TestFileStoreCompactsIntoSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir, 3)
+	kept, updated := fillFileStore(t, fs) // 7 records: two snapshots, one record left
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Fatalf("Expected a snapshot file: %v", err)
+	}
+	if n := countLines(t, filepath.Join(dir, walFileName)); n != 1 {
+		t.Fatalf("Expected 1 record left in the log after compaction got %d", n)
+	}
+
+	fs = openTestFileStore(t, dir, 3)
+	defer fs.Close()
+	assertFilledState(t, fs, kept, updated)
+}
+
+func TestFileStoreDropsTornFinalRecord(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir, 0)
+	kept, updated := fillFileStore(t, fs)
+	fs.Close()
+
+	// Simulate a crash halfway through appending a record
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteString(`{"seq":9,"op":"create","username":"alice","todo":{"id":"torn","ti`)
+	wal.Close()
+
+	fs = openTestFileStore(t, dir, 0)
+	assertFilledState(t, fs, kept, updated)
+
+	// The store must keep working after cutting the torn tail off
+	extra := newTestTodo("after crash")
+	if err := fs.Todos().Create("bob", extra); err != nil {
+		t.Fatalf("Create after recovery: %v", err)
+	}
+	fs.Close()
+
+	fs = openTestFileStore(t, dir, 0)
+	defer fs.Close()
+	if _, err := fs.Todos().Get("bob", extra.ID); err != nil {
+		t.Fatalf("Write after recovery was lost: %v", err)
+	}
+}
+
+func TestFileStoreRejectsCorruptionBeforeTheTail(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir, 0)
+	fillFileStore(t, fs)
+	fs.Close()
+
+	path := filepath.Join(dir, walFileName)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append([]byte("garbage\n"), data...), 0o644)
+
+	if _, err := OpenFileStore(dir, FileOptions{}); err == nil {
+		t.Fatal("Expected an error for a corrupted record in the middle of the log")
+	}
+}
+
+func TestFileStoreSkipsRecordsAlreadyInSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir, 0)
+	kept, updated := fillFileStore(t, fs)
+
+	// Crash after the snapshot rename but before the log was truncated
+	walPath := filepath.Join(dir, walFileName)
+	before, _ := os.ReadFile(walPath)
+	if err := fs.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	fs.Close()
+	os.WriteFile(walPath, before, 0o644)
+
+	fs = openTestFileStore(t, dir, 0)
+	defer fs.Close()
+	assertFilledState(t, fs, kept, updated)
+}
+
+// TestFileStoreSurvivesKill runs a writer in a child process, kills it
+// mid-stream and checks that every write it acknowledged is still there.
+func TestFileStoreSurvivesKill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns a child process")
+	}
+	dir := t.TempDir()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileStoreCrashWriter$")
+	cmd.Env = append(os.Environ(), "FILESTORE_CRASH_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var acked []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && len(acked) < 200 {
+		var id string
+		if _, err := fmt.Sscanf(scanner.Text(), "ACK %s", &id); err == nil {
+			acked = append(acked, id)
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if len(acked) < 200 {
+		t.Fatalf("Writer only acknowledged %d writes before exiting", len(acked))
+	}
+
+	fs := openTestFileStore(t, dir, 50)
+	defer fs.Close()
+	for _, id := range acked {
+		if _, err := fs.Todos().Get("crasher", id); err != nil {
+			t.Fatalf("Acknowledged todo %s lost after kill: %v", id, err)
+		}
+	}
+}
+
+// TestFileStoreCrashWriter is the child process for TestFileStoreSurvivesKill.
+// Its writers run concurrently so acknowledgements come from group commits.
+func TestFileStoreCrashWriter(t *testing.T) {
+	dir := os.Getenv("FILESTORE_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only runs as a child of TestFileStoreSurvivesKill")
+	}
+
+	fs, err := OpenFileStore(dir, FileOptions{SnapshotEvery: 50, CommitMaxDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		go func() {
+			for {
+				todo := newTestTodo("crash test")
+				if err := fs.Todos().Create("crasher", todo); err != nil {
+					t.Errorf("Create: %v", err)
+					return
+				}
+				fmt.Printf("ACK %s\n", todo.ID)
+			}
+		}()
+	}
+	select {}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
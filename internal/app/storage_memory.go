@@ -0,0 +1,926 @@
+package app
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+// MemoryUserStore keeps users in a sync.Map (username -> User).
+type MemoryUserStore struct {
+	users     sync.Map
+	changes   *MemoryChangeLog     // optional
+	revisions *MemoryRevisionStore // optional
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{}
+}
+
+func (s *MemoryUserStore) Create(user User) error {
+	if _, loaded := s.users.LoadOrStore(user.Username, user); loaded {
+		return ErrUserExists
+	}
+	s.changes.record(Change{Op: ChangeRegister, Username: user.Username})
+	return nil
+}
+
+func (s *MemoryUserStore) Get(username string) (User, error) {
+	v, ok := s.users.Load(username)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return v.(User), nil
+}
+
+func (s *MemoryUserStore) Update(username string, fn func(*User) error) (User, error) {
+	for {
+		v, ok := s.users.Load(username)
+		if !ok {
+			return User{}, ErrUserNotFound
+		}
+		current := v.(User)
+		updated := current
+		if err := fn(&updated); err != nil {
+			return current, err
+		}
+		if s.users.CompareAndSwap(username, current, updated) {
+			return updated, nil
+		}
+	}
+}
+
+func (s *MemoryUserStore) Delete(username string) error {
+	if _, ok := s.users.LoadAndDelete(username); !ok {
+		return ErrUserNotFound
+	}
+	s.changes.purge(username)
+	s.revisions.purge(username)
+	return nil
+}
+
+func (s *MemoryUserStore) List() ([]User, error) {
+	var users []User
+	s.users.Range(func(_, v any) bool {
+		users = append(users, v.(User))
+		return true
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// RacyTodoStore keeps each user's todos as a []*Todo in a sync.Map.
+// Reads and writes are not synchronised per user: updates mutate the shared
+// *Todo in place and create/delete do a non-atomic Load-modify-Store of the
+// slice. This is the behaviour the race demos rely on (RacyMode); use
+// MemoryTodoStore for anything else.
+type RacyTodoStore struct {
+	todos     sync.Map             // username -> []*Todo
+	changes   *MemoryChangeLog     // optional
+	revisions *MemoryRevisionStore // optional
+}
+
+func NewRacyTodoStore() *RacyTodoStore {
+	return &RacyTodoStore{}
+}
+
+func (s *RacyTodoStore) List(username string) ([]Todo, error) {
+	v, ok := s.todos.Load(username)
+	if !ok {
+		return []Todo{}, nil
+	}
+
+	ptrSlice := v.([]*Todo)
+	out := make([]Todo, 0, len(ptrSlice))
+	for _, p := range ptrSlice {
+		if p != nil {
+			out = append(out, *p)
+		}
+	}
+	return out, nil
+}
+
+func (s *RacyTodoStore) Get(username, id string) (Todo, error) {
+	p := s.find(username, id)
+	if p == nil {
+		return Todo{}, ErrTodoNotFound
+	}
+	return *p, nil
+}
+
+func (s *RacyTodoStore) Create(username string, todo Todo) error {
+	newTodo := &todo
+
+	curr, ok := s.todos.Load(username)
+	if !ok {
+		s.todos.Store(username, []*Todo{newTodo})
+	} else {
+		slice := curr.([]*Todo)
+		slice = append(slice, newTodo)
+		s.todos.Store(username, slice)
+	}
+	s.changes.record(todoChange(ChangeCreate, username, todo))
+	return nil
+}
+
+func (s *RacyTodoStore) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	found := s.find(username, id)
+	if found == nil {
+		return Todo{}, ErrTodoNotFound
+	}
+
+	err := fn(found) // race
+	if err == nil {
+		s.changes.record(todoChange(ChangeUpdate, username, *found))
+	}
+	return *found, err
+}
+
+func (s *RacyTodoStore) Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error) {
+	var rev Revision
+	updated, err := s.Update(username, id, func(t *Todo) (err error) {
+		rev, err = fn(t)
+		return err
+	})
+	if err == nil && s.revisions != nil {
+		s.revisions.Append(username, rev) // race: not atomic with the update
+	}
+	return updated, err
+}
+
+func (s *RacyTodoStore) Delete(username, id string, check func(Todo) error) (Todo, error) {
+	v, ok := s.todos.Load(username)
+	if !ok {
+		return Todo{}, ErrTodoNotFound
+	}
+	ptrSlice := v.([]*Todo)
+
+	idx := -1
+	for i, p := range ptrSlice {
+		if p != nil && p.ID == id {
+			idx = i
+			break
+		}
+	}
+
+	if idx == -1 {
+		return Todo{}, ErrTodoNotFound
+	}
+
+	deleted := *ptrSlice[idx]
+	if check != nil {
+		if err := check(deleted); err != nil {
+			return deleted, err
+		}
+	}
+
+	newSlice := append(ptrSlice[:idx], ptrSlice[idx+1:]...)
+	s.todos.Store(username, newSlice)
+	s.changes.record(todoTombstone(username, id))
+	return deleted, nil
+}
+
+func (s *RacyTodoStore) Owners() ([]string, error) {
+	var owners []string
+	s.todos.Range(func(k, v any) bool {
+		if len(v.([]*Todo)) > 0 {
+			owners = append(owners, k.(string))
+		}
+		return true
+	})
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// rawList returns username's list as stored, nil entries and repeated IDs
+// included.
+func (s *RacyTodoStore) rawList(username string) []*Todo {
+	v, ok := s.todos.Load(username)
+	if !ok {
+		return nil
+	}
+	return append([]*Todo(nil), v.([]*Todo)...)
+}
+
+// compact drops nil entries and every todo whose ID already appeared
+// earlier in username's list.
+func (s *RacyTodoStore) compact(username string) {
+	v, ok := s.todos.Load(username)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	var kept []*Todo
+	for _, p := range v.([]*Todo) {
+		if p != nil && !seen[p.ID] {
+			seen[p.ID] = true
+			kept = append(kept, p)
+		}
+	}
+	s.todos.Store(username, kept)
+}
+
+func (s *RacyTodoStore) find(username, id string) *Todo {
+	v, ok := s.todos.Load(username)
+	if !ok {
+		return nil
+	}
+
+	for _, p := range v.([]*Todo) {
+		if p != nil && p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// MemoryTodoStore is the safe in-memory store. Users are spread across a
+// fixed number of shards, each guarding its own username -> list map, so
+// looking up or adding users in one shard never contends with another.
+// Each user's todos are indexed twice: by ID for single-todo lookups and by
+// creation position for listing. Both indexes are immutable radix trees
+// published together as one snapshot, so readers never take the user's lock
+// and never see a half-applied write. Writers for the same user are
+// serialised by that user's mutex; writers for different users never block
+// each other. Each write builds a new snapshot in O(log n) by sharing
+// unchanged nodes with the previous one.
+type MemoryTodoStore struct {
+	shards    []todoShard
+	changes   *MemoryChangeLog     // optional, written under the user's lock
+	revisions *MemoryRevisionStore // optional, written under the user's lock
+}
+
+type todoShard struct {
+	mu    sync.RWMutex
+	lists map[string]*todoList
+}
+
+type todoList struct {
+	mu       sync.Mutex // serialises writers
+	snapshot atomic.Pointer[todoSnapshot]
+	nextPos  uint64 // position of the next created todo, guarded by mu
+}
+
+// todoSnapshot is one immutable version of a user's todos.
+type todoSnapshot struct {
+	byID  *iradix.Tree // id -> position (uint64)
+	byPos *iradix.Tree // big-endian position -> Todo
+}
+
+var emptyTodoSnapshot = &todoSnapshot{byID: iradix.New(), byPos: iradix.New()}
+
+// DefaultTodoShards is the shard count used by NewMemoryTodoStore.
+const DefaultTodoShards = 64
+
+func NewMemoryTodoStore() *MemoryTodoStore {
+	return NewShardedTodoStore(DefaultTodoShards)
+}
+
+// NewShardedTodoStore returns a MemoryTodoStore that spreads users across n
+// shards (at least one).
+func NewShardedTodoStore(n int) *MemoryTodoStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &MemoryTodoStore{shards: make([]todoShard, n)}
+	for i := range s.shards {
+		s.shards[i].lists = make(map[string]*todoList)
+	}
+	return s
+}
+
+func (s *MemoryTodoStore) shard(username string) *todoShard {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return &s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// list returns username's list, creating it when create is set.
+func (sh *todoShard) list(username string, create bool) *todoList {
+	sh.mu.RLock()
+	l := sh.lists[username]
+	sh.mu.RUnlock()
+	if l != nil || !create {
+		return l
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if l = sh.lists[username]; l == nil {
+		l = &todoList{}
+		sh.lists[username] = l
+	}
+	return l
+}
+
+func posKey(pos uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, pos)
+}
+
+// load returns the latest snapshot for username without locking.
+func (s *MemoryTodoStore) load(username string) *todoSnapshot {
+	l := s.shard(username).list(username, false)
+	if l == nil {
+		return emptyTodoSnapshot
+	}
+	if snap := l.snapshot.Load(); snap != nil {
+		return snap
+	}
+	return emptyTodoSnapshot
+}
+
+// lock returns username's list with its writer mutex held, and the snapshot
+// the write should build on.
+func (s *MemoryTodoStore) lock(username string) (*todoList, *todoSnapshot) {
+	l := s.shard(username).list(username, true)
+	l.mu.Lock()
+	snap := l.snapshot.Load()
+	if snap == nil {
+		snap = emptyTodoSnapshot
+	}
+	return l, snap
+}
+
+func (snap *todoSnapshot) list() []Todo {
+	out := make([]Todo, 0, snap.byPos.Len())
+	snap.byPos.Root().Walk(func(_ []byte, v interface{}) bool {
+		out = append(out, v.(Todo))
+		return false
+	})
+	return out
+}
+
+func (snap *todoSnapshot) get(id string) (Todo, uint64, bool) {
+	pos, ok := snap.byID.Get([]byte(id))
+	if !ok {
+		return Todo{}, 0, false
+	}
+	v, _ := snap.byPos.Get(posKey(pos.(uint64)))
+	return v.(Todo), pos.(uint64), true
+}
+
+func (s *MemoryTodoStore) List(username string) ([]Todo, error) {
+	return s.load(username).list(), nil
+}
+
+func (s *MemoryTodoStore) Get(username, id string) (Todo, error) {
+	t, _, ok := s.load(username).get(id)
+	if !ok {
+		return Todo{}, ErrTodoNotFound
+	}
+	return t, nil
+}
+
+func (s *MemoryTodoStore) Create(username string, todo Todo) error {
+	l, snap := s.lock(username)
+	defer l.mu.Unlock()
+
+	pos := l.nextPos
+	l.nextPos++
+	byID, _, _ := snap.byID.Insert([]byte(todo.ID), pos)
+	byPos, _, _ := snap.byPos.Insert(posKey(pos), todo)
+	l.snapshot.Store(&todoSnapshot{byID: byID, byPos: byPos})
+	s.changes.record(todoChange(ChangeCreate, username, todo))
+	return nil
+}
+
+func (s *MemoryTodoStore) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	return s.update(username, id, func(t *Todo) (*Revision, error) {
+		return nil, fn(t)
+	})
+}
+
+func (s *MemoryTodoStore) Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error) {
+	return s.update(username, id, func(t *Todo) (*Revision, error) {
+		rev, err := fn(t)
+		return &rev, err
+	})
+}
+
+// update applies fn and, if it returns a revision, appends that under the
+// same lock.
+func (s *MemoryTodoStore) update(username, id string, fn func(*Todo) (*Revision, error)) (Todo, error) {
+	l, snap := s.lock(username)
+	defer l.mu.Unlock()
+
+	current, pos, ok := snap.get(id)
+	if !ok {
+		return Todo{}, ErrTodoNotFound
+	}
+
+	updated := current
+	rev, err := fn(&updated)
+	if err != nil {
+		return current, err
+	}
+	byPos, _, _ := snap.byPos.Insert(posKey(pos), updated)
+	l.snapshot.Store(&todoSnapshot{byID: snap.byID, byPos: byPos})
+	if rev != nil && s.revisions != nil {
+		s.revisions.Append(username, *rev)
+	}
+	s.changes.record(todoChange(ChangeUpdate, username, updated))
+	return updated, nil
+}
+
+func (s *MemoryTodoStore) Delete(username, id string, check func(Todo) error) (Todo, error) {
+	l, snap := s.lock(username)
+	defer l.mu.Unlock()
+
+	current, pos, ok := snap.get(id)
+	if !ok {
+		return Todo{}, ErrTodoNotFound
+	}
+	if check != nil {
+		if err := check(current); err != nil {
+			return current, err
+		}
+	}
+
+	byID, _, _ := snap.byID.Delete([]byte(id))
+	byPos, _, _ := snap.byPos.Delete(posKey(pos))
+	l.snapshot.Store(&todoSnapshot{byID: byID, byPos: byPos})
+	s.changes.record(todoTombstone(username, id))
+	return current, nil
+}
+
+func (s *MemoryTodoStore) Owners() ([]string, error) {
+	var owners []string
+	s.forEach(func(username string, todos []Todo) {
+		if len(todos) > 0 {
+			owners = append(owners, username)
+		}
+	})
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// forEach calls fn with every user's todos, including users whose list is
+// empty.
+func (s *MemoryTodoStore) forEach(fn func(username string, todos []Todo)) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		usernames := make([]string, 0, len(sh.lists))
+		for username := range sh.lists {
+			usernames = append(usernames, username)
+		}
+		sh.mu.RUnlock()
+
+		for _, username := range usernames {
+			fn(username, s.load(username).list())
+		}
+	}
+}
+
+// MemoryRevisionStore keeps every todo's revisions in a slice ordered by
+// revision number.
+type MemoryRevisionStore struct {
+	mu        sync.RWMutex
+	revisions map[string]map[string][]Revision // username -> todo ID -> revisions
+}
+
+func NewMemoryRevisionStore() *MemoryRevisionStore {
+	return &MemoryRevisionStore{revisions: make(map[string]map[string][]Revision)}
+}
+
+func (s *MemoryRevisionStore) Append(username string, rev Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	todos := s.revisions[username]
+	if todos == nil {
+		todos = make(map[string][]Revision)
+		s.revisions[username] = todos
+	}
+	// Concurrent updates may append out of order; keep the slice sorted.
+	revs := todos[rev.TodoID]
+	i := sort.Search(len(revs), func(i int) bool { return revs[i].Revision > rev.Revision })
+	revs = append(revs, Revision{})
+	copy(revs[i+1:], revs[i:])
+	revs[i] = rev
+	todos[rev.TodoID] = revs
+	return nil
+}
+
+func (s *MemoryRevisionStore) List(username, todoID string) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Revision{}, s.revisions[username][todoID]...), nil
+}
+
+func (s *MemoryRevisionStore) Get(username, todoID string, revision int64) (Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revs := s.revisions[username][todoID]
+	i := sort.Search(len(revs), func(i int) bool { return revs[i].Revision >= revision })
+	if i == len(revs) || revs[i].Revision != revision {
+		return Revision{}, ErrRevisionNotFound
+	}
+	return revs[i], nil
+}
+
+// purge forgets every revision of username. A nil store holds nothing.
+func (s *MemoryRevisionStore) purge(username string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.revisions, username)
+}
+
+// forEach calls fn with every user's revisions, grouped per todo in no
+// particular order.
+func (s *MemoryRevisionStore) forEach(fn func(username string, revs []Revision)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for username, todos := range s.revisions {
+		var revs []Revision
+		for _, todoRevs := range todos {
+			revs = append(revs, todoRevs...)
+		}
+		fn(username, revs)
+	}
+}
+
+// MemoryTokenStore keeps refresh tokens in a map guarded by one mutex.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken // hash -> token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]RefreshToken)}
+}
+
+// Create stores token. Creating a token that already exists is a no-op, so
+// a replayed log can create it again.
+func (s *MemoryTokenStore) Create(token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[token.Hash]; !ok {
+		s.tokens[token.Hash] = token
+	}
+	return nil
+}
+
+// Get returns the token with hash, used or not.
+func (s *MemoryTokenStore) Get(hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hash]
+	if !ok {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *MemoryTokenStore) List(username string) ([]RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []RefreshToken
+	for _, token := range s.tokens {
+		if token.Username == username {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Hash < tokens[j].Hash })
+	return tokens, nil
+}
+
+func (s *MemoryTokenStore) Use(hash string, at time.Time) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hash]
+	if !ok {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	if token.UsedAt != nil {
+		return token, ErrTokenReused
+	}
+	token.UsedAt = &at
+	s.tokens[hash] = token
+	return token, nil
+}
+
+func (s *MemoryTokenStore) RevokeFamily(family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.tokens {
+		if token.Family == family {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryTokenStore) Prune(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for hash, token := range s.tokens {
+		if token.ExpiresAt.Before(now) {
+			delete(s.tokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expiredTokens counts the tokens in s that expired before now, so the log
+// based stores can skip logging a prune that would delete nothing.
+func expiredTokens(s *MemoryTokenStore, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, token := range s.tokens {
+		if token.ExpiresAt.Before(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// list returns every token ordered by hash.
+func (s *MemoryTokenStore) list() []RefreshToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]RefreshToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Hash < tokens[j].Hash })
+	return tokens
+}
+
+// MemoryRevocationList keeps revocations in a map guarded by one mutex.
+type MemoryRevocationList struct {
+	mu      sync.RWMutex
+	revoked map[string]Revocation // jti or session ID -> revocation
+}
+
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{revoked: make(map[string]Revocation)}
+}
+
+func (s *MemoryRevocationList) Revoke(r Revocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.revoked[r.ID]; !ok || existing.ExpiresAt.Before(r.ExpiresAt) {
+		s.revoked[r.ID] = r
+	}
+	return nil
+}
+
+func (s *MemoryRevocationList) IsRevoked(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.revoked[id]
+	return ok, nil
+}
+
+func (s *MemoryRevocationList) Prune(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, r := range s.revoked {
+		if r.ExpiresAt.Before(now) {
+			delete(s.revoked, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expired counts the revocations that expired before now.
+func (s *MemoryRevocationList) expired(now time.Time) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, r := range s.revoked {
+		if r.ExpiresAt.Before(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// list returns every revocation ordered by ID.
+func (s *MemoryRevocationList) list() []Revocation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	revoked := make([]Revocation, 0, len(s.revoked))
+	for _, r := range s.revoked {
+		revoked = append(revoked, r)
+	}
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].ID < revoked[j].ID })
+	return revoked
+}
+
+// MemoryLoginAttempts keeps failed login counters in a map guarded by one
+// mutex.
+type MemoryLoginAttempts struct {
+	mu       sync.RWMutex
+	attempts map[string]LoginAttempts
+}
+
+func NewMemoryLoginAttempts() *MemoryLoginAttempts {
+	return &MemoryLoginAttempts{attempts: make(map[string]LoginAttempts)}
+}
+
+func (s *MemoryLoginAttempts) Get(key string) (LoginAttempts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if a, ok := s.attempts[key]; ok {
+		return a, nil
+	}
+	return LoginAttempts{Key: key}, nil
+}
+
+func (s *MemoryLoginAttempts) Update(key string, fn func(*LoginAttempts) error) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.attempts[key]
+	if !ok {
+		current = LoginAttempts{Key: key}
+	}
+	updated := current
+	if err := fn(&updated); err != nil {
+		return current, err
+	}
+	updated.Key = key
+	s.attempts[key] = updated
+	return updated, nil
+}
+
+func (s *MemoryLoginAttempts) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLoginAttempts) Prune(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, a := range s.attempts {
+		if a.ExpiresAt.Before(now) {
+			delete(s.attempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expired counts the records that expired before now.
+func (s *MemoryLoginAttempts) expired(now time.Time) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, a := range s.attempts {
+		if a.ExpiresAt.Before(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// list returns every record ordered by key.
+func (s *MemoryLoginAttempts) list() []LoginAttempts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	attempts := make([]LoginAttempts, 0, len(s.attempts))
+	for _, a := range s.attempts {
+		attempts = append(attempts, a)
+	}
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].Key < attempts[j].Key })
+	return attempts
+}
+
+// MemoryPersonalTokens keeps personal access tokens in a map guarded by one
+// mutex.
+type MemoryPersonalTokens struct {
+	mu     sync.RWMutex
+	tokens map[string]PersonalAccessToken // hash -> token
+}
+
+func NewMemoryPersonalTokens() *MemoryPersonalTokens {
+	return &MemoryPersonalTokens{tokens: make(map[string]PersonalAccessToken)}
+}
+
+// Create stores token. Creating a token that already exists is a no-op, so
+// a replayed log can create it again.
+func (s *MemoryPersonalTokens) Create(token PersonalAccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[token.Hash]; !ok {
+		token.Scopes = slices.Clone(token.Scopes)
+		s.tokens[token.Hash] = token
+	}
+	return nil
+}
+
+func (s *MemoryPersonalTokens) Get(hash string) (PersonalAccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, ok := s.tokens[hash]
+	if !ok {
+		return PersonalAccessToken{}, ErrPersonalTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *MemoryPersonalTokens) List(username string) ([]PersonalAccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tokens []PersonalAccessToken
+	for _, token := range s.tokens {
+		if token.Username == username {
+			tokens = append(tokens, token)
+		}
+	}
+	sortPersonalTokens(tokens)
+	return tokens, nil
+}
+
+func (s *MemoryPersonalTokens) Touch(hash string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hash]
+	if !ok || (token.LastUsedAt != nil && !at.After(*token.LastUsedAt)) {
+		return nil
+	}
+	token.LastUsedAt = &at
+	s.tokens[hash] = token
+	return nil
+}
+
+func (s *MemoryPersonalTokens) Delete(username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.tokens {
+		if token.Username == username && token.ID == id {
+			delete(s.tokens, hash)
+			return nil
+		}
+	}
+	return ErrPersonalTokenNotFound
+}
+
+func (s *MemoryPersonalTokens) Prune(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for hash, token := range s.tokens {
+		if token.ExpiresAt != nil && token.ExpiresAt.Before(now) {
+			delete(s.tokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expired counts the tokens that expired before now, so the log based
+// stores can skip logging a prune that would delete nothing.
+func (s *MemoryPersonalTokens) expired(now time.Time) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, token := range s.tokens {
+		if token.ExpiresAt != nil && token.ExpiresAt.Before(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// list returns every token, oldest first.
+func (s *MemoryPersonalTokens) list() []PersonalAccessToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]PersonalAccessToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sortPersonalTokens(tokens)
+	return tokens
+}
+
+// sortPersonalTokens orders tokens by creation, then ID.
+func sortPersonalTokens(tokens []PersonalAccessToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestShardedStoreStressSafe hammers the sharded store from hundreds of
+// goroutines spread over many users. A small shard count makes users share
+// shards, so both the shard maps and the per-user locks are contended. Run it
+// with -race.
+func TestShardedStoreStressSafe(t *testing.T) {
+	const (
+		users         = 50
+		workers       = 8 // per user
+		increments    = 25
+		createsPerRun = 10
+	)
+	store := NewShardedTodoStore(4)
+
+	counters := make([]string, users)
+	for u := range counters {
+		counter := newTestTodo("0")
+		counters[u] = counter.ID
+		if err := store.Create(fmt.Sprintf("user%d", u), counter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		username := fmt.Sprintf("user%d", u)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; i++ {
+					_, err := store.Update(username, counters[u], func(todo *Todo) error {
+						n, _ := strconv.Atoi(todo.Title)
+						todo.Title = strconv.Itoa(n + 1)
+						todo.Version++
+						return nil
+					})
+					if err != nil {
+						t.Errorf("Update: %v", err)
+						return
+					}
+				}
+
+				// Create a batch and delete every other todo in it.
+				for i := 0; i < createsPerRun; i++ {
+					todo := newTestTodo("temp")
+					if err := store.Create(username, todo); err != nil {
+						t.Errorf("Create: %v", err)
+						return
+					}
+					if i%2 == 0 {
+						if _, err := store.Delete(username, todo.ID, nil); err != nil {
+							t.Errorf("Delete: %v", err)
+							return
+						}
+					}
+				}
+				store.List(username)
+			}()
+		}
+	}
+	wg.Wait()
+
+	for u := 0; u < users; u++ {
+		username := fmt.Sprintf("user%d", u)
+		counter, err := store.Get(username, counters[u])
+		if err != nil {
+			t.Fatalf("Get counter for %s: %v", username, err)
+		}
+		if want := strconv.Itoa(workers * increments); counter.Title != want || counter.Version != int64(workers*increments+1) {
+			t.Fatalf("%s: expected counter %s at version %d got %s at version %d",
+				username, want, workers*increments+1, counter.Title, counter.Version)
+		}
+
+		list, _ := store.List(username)
+		if want := 1 + workers*createsPerRun/2; len(list) != want {
+			t.Fatalf("%s: expected %d todos got %d", username, want, len(list))
+		}
+	}
+}
@@ -0,0 +1,733 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// RaftPeer is one member of a cluster.
+type RaftPeer struct {
+	ID   string
+	Addr string
+}
+
+// ParseRaftPeers parses a comma-separated list of id=host:port members.
+func ParseRaftPeers(s string) ([]RaftPeer, error) {
+	var peers []RaftPeer
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(part, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, want id=host:port", part)
+		}
+		peers = append(peers, RaftPeer{ID: id, Addr: addr})
+	}
+	return peers, nil
+}
+
+// RaftConfig configures one node of a RaftStore cluster.
+type RaftConfig struct {
+	NodeID string
+	// Addr is where the node listens for Raft traffic and forwarded writes,
+	// and the address other members dial.
+	Addr string
+	// Peers lists every member, this node included. Every node of a new
+	// cluster must be started with the same list. An empty list starts a
+	// single-node cluster.
+	Peers []RaftPeer
+	// Dir holds the Raft log and snapshots.
+	Dir string
+	// Listener, if set, is used instead of listening on Addr.
+	Listener net.Listener
+	// HeartbeatTimeout and ElectionTimeout override the Raft defaults (one
+	// second each) when positive.
+	HeartbeatTimeout time.Duration
+	ElectionTimeout  time.Duration
+	// ApplyTimeout bounds how long a write waits for a leader and for the
+	// cluster to commit it. Zero means ten seconds; it must stay below
+	// requestRetention.
+	ApplyTimeout time.Duration
+}
+
+// requestRetention is how long the FSM remembers an applied request ID.
+// Retries stop after ApplyTimeout, so a longer window catches every repeat,
+// with room for clock skew between the nodes stamping records.
+const requestRetention = 10 * time.Minute
+
+// RaftStore is a user and todo store replicated across a cluster with Raft.
+// Every write is a walRecord appended to the Raft log; each node applies the
+// committed log to its own memoryState and serves reads from it. Writes on a
+// follower are forwarded to the leader, and the follower waits until it has
+// applied the write before returning, so a client reads its own writes on
+// any node.
+//
+// Updates and deletes cannot ship their callbacks to the leader, so they
+// run optimistically: the callback runs against the local copy and the
+// record carries that copy as Expect. If another write got there first the
+// leader rejects the record and the operation re-reads and retries.
+//
+// A proposal that timed out or lost its leader may still have committed, so
+// every record carries a request ID and is proposed again unchanged. The FSM
+// remembers the IDs it applied in the last requestRetention and answers a
+// repeat with the first result instead of applying it twice.
+type RaftStore struct {
+	raft     *raft.Raft
+	fsm      *raftFSM
+	mux      *raftMux
+	trans    *raft.NetworkTransport
+	logs     *raftboltdb.BoltStore
+	timeout  time.Duration
+	notifier changeNotifier
+}
+
+// OpenRaftStore starts a cluster node. A node with no Raft state yet
+// bootstraps the cluster from cfg.Peers.
+func OpenRaftStore(cfg RaftConfig) (*RaftStore, error) {
+	timeout := cfg.ApplyTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	if timeout >= requestRetention {
+		return nil, fmt.Errorf("raft apply timeout %s must be below %s", timeout, requestRetention)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create raft dir: %w", err)
+	}
+
+	ln := cfg.Listener
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", cfg.Addr); err != nil {
+			return nil, fmt.Errorf("listen on %s: %w", cfg.Addr, err)
+		}
+	}
+
+	s := &RaftStore{timeout: timeout}
+	s.fsm = &raftFSM{store: s, requests: make(map[string]appliedRequest)}
+	s.fsm.state.Store(newMemoryState())
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: os.Stderr})
+	s.mux = newRaftMux(ln, s.serveForward)
+	s.trans = raft.NewNetworkTransportWithLogger(s.mux, 3, 10*time.Second, logger)
+
+	var err error
+	s.logs, err = raftboltdb.New(raftboltdb.Options{Path: filepath.Join(cfg.Dir, "raft.db")})
+	if err != nil {
+		s.trans.Close()
+		return nil, fmt.Errorf("open raft log: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(cfg.Dir, 2, logger)
+	if err != nil {
+		s.closeFiles()
+		return nil, fmt.Errorf("open raft snapshots: %w", err)
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cfg.NodeID)
+	rc.Logger = logger
+	if cfg.HeartbeatTimeout > 0 {
+		rc.HeartbeatTimeout = cfg.HeartbeatTimeout
+		rc.LeaderLeaseTimeout = min(rc.LeaderLeaseTimeout, cfg.HeartbeatTimeout)
+	}
+	if cfg.ElectionTimeout > 0 {
+		rc.ElectionTimeout = cfg.ElectionTimeout
+	}
+
+	hasState, err := raft.HasExistingState(s.logs, s.logs, snaps)
+	if err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	if !hasState {
+		servers := []raft.Server{{ID: rc.LocalID, Address: s.trans.LocalAddr()}}
+		if len(cfg.Peers) > 0 {
+			servers = servers[:0]
+			for _, p := range cfg.Peers {
+				servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Addr)})
+			}
+		}
+		err := raft.BootstrapCluster(rc, s.logs, s.logs, snaps, s.trans, raft.Configuration{Servers: servers})
+		if err != nil {
+			s.closeFiles()
+			return nil, fmt.Errorf("bootstrap raft cluster: %w", err)
+		}
+	}
+
+	s.raft, err = raft.NewRaft(rc, s.fsm, s.logs, s.logs, snaps, s.trans)
+	if err != nil {
+		s.closeFiles()
+		return nil, fmt.Errorf("start raft: %w", err)
+	}
+	return s, nil
+}
+
+// Users returns the UserStore view of s.
+func (s *RaftStore) Users() UserStore { return raftUsers{s} }
+
+// Todos returns the TodoStore view of s.
+func (s *RaftStore) Todos() TodoStore { return raftTodos{s} }
+
+// Revisions returns the RevisionStore view of s.
+func (s *RaftStore) Revisions() RevisionStore { return raftRevisions{s} }
+
+// Changes returns the change feed of s. Sequence numbers are Raft log
+// indexes, so they are the same on every node.
+func (s *RaftStore) Changes() ChangeFeed { return raftChanges{s} }
+
+// Tokens returns the TokenStore view of s.
+func (s *RaftStore) Tokens() TokenStore { return raftTokens{s} }
+
+// Revocations returns the RevocationStore view of s.
+func (s *RaftStore) Revocations() RevocationStore { return raftRevocations{s} }
+
+// Attempts returns the LoginAttemptStore view of s.
+func (s *RaftStore) Attempts() LoginAttemptStore { return raftAttempts{s} }
+
+// PersonalTokens returns the PersonalTokenStore view of s.
+func (s *RaftStore) PersonalTokens() PersonalTokenStore { return raftPersonalTokens{s} }
+
+// Stores returns every store view of s.
+func (s *RaftStore) Stores() Stores {
+	return Stores{Users: s.Users(), Todos: s.Todos(), Revisions: s.Revisions(), Changes: s.Changes(), Tokens: s.Tokens(), Revocations: s.Revocations(), Attempts: s.Attempts(), PersonalTokens: s.PersonalTokens(), Exporter: s}
+}
+
+// Export returns the dataset as of the last record this node applied.
+func (s *RaftStore) Export() (Dataset, error) {
+	s.fsm.mu.Lock()
+	defer s.fsm.mu.Unlock()
+	return s.state().dataset(), nil
+}
+
+// IsLeader reports whether this node currently leads the cluster.
+func (s *RaftStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// Leader returns the ID of the current leader, or "" while there is none.
+func (s *RaftStore) Leader() string {
+	_, id := s.raft.LeaderWithID()
+	return string(id)
+}
+
+// Close leaves the cluster running without this node.
+func (s *RaftStore) Close() error {
+	err := s.raft.Shutdown().Error()
+	return errors.Join(err, s.closeFiles())
+}
+
+func (s *RaftStore) closeFiles() error {
+	err := s.trans.Close()
+	if s.logs != nil {
+		err = errors.Join(err, s.logs.Close())
+	}
+	return err
+}
+
+func (s *RaftStore) state() *memoryState {
+	return s.fsm.state.Load()
+}
+
+// propose commits rec through the leader and returns the result of applying
+// it. It retries while the cluster has no reachable leader, up to the apply
+// timeout, and returns once this node has applied the record too. Every
+// attempt sends the same request ID, so one that committed before its
+// answer was lost is not applied again.
+func (s *RaftStore) propose(rec walRecord) error {
+	rec.At = time.Now().UTC()
+	rec.RequestID = GenerateID()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	for {
+		var resp forwardResponse
+		if s.IsLeader() {
+			resp = s.applyLocal(data)
+		} else if addr, _ := s.raft.LeaderWithID(); addr != "" {
+			resp, err = forward(string(addr), data, time.Until(deadline))
+			if err != nil {
+				resp.NotLeader = true
+			}
+		} else {
+			resp.NotLeader = true
+		}
+
+		if !resp.NotLeader {
+			if err := s.waitApplied(resp.Index, deadline); err != nil {
+				return err
+			}
+			return decodeForwardError(resp.Err)
+		}
+		if time.Now().After(deadline) {
+			return errors.New("raft: no leader available")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// applyLocal appends data to the log on the leader.
+func (s *RaftStore) applyLocal(data []byte) forwardResponse {
+	f := s.raft.Apply(data, s.timeout)
+	if err := f.Error(); err != nil {
+		// Not the leader any more, or leadership was lost before the
+		// record committed.
+		return forwardResponse{NotLeader: true}
+	}
+	resp := forwardResponse{Index: f.Index()}
+	if err, ok := f.Response().(error); ok {
+		resp.Err = encodeForwardError(err)
+	}
+	return resp
+}
+
+// waitApplied blocks until this node's FSM has applied the log up to index.
+// raft.AppliedIndex is not enough: it moves as soon as entries are handed to
+// the FSM, before they are applied.
+func (s *RaftStore) waitApplied(index uint64, deadline time.Time) error {
+	for s.fsm.applied.Load() < index {
+		if time.Now().After(deadline) {
+			return errors.New("raft: timed out waiting for the write to replicate")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	return nil
+}
+
+// serveForward applies one record forwarded by a follower.
+func (s *RaftStore) serveForward(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	var data json.RawMessage
+	if err := json.NewDecoder(conn).Decode(&data); err != nil {
+		return
+	}
+	resp := forwardResponse{NotLeader: true}
+	if s.IsLeader() {
+		resp = s.applyLocal(data)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// raftFSM applies committed records to the node's memoryState.
+type raftFSM struct {
+	store   *RaftStore
+	mu      sync.Mutex // held while applying, so exports see whole records
+	state   atomic.Pointer[memoryState]
+	applied atomic.Uint64 // index of the last record applied to state
+
+	// requests holds the request IDs applied in the last requestRetention
+	// and requestLog the same in apply order, oldest first, for expiry.
+	// Both are guarded by mu.
+	requests   map[string]appliedRequest
+	requestLog []appliedRequest
+}
+
+// appliedRequest is the result of applying one proposal, kept to answer its
+// retries.
+type appliedRequest struct {
+	ID  string    `json:"id"`
+	At  time.Time `json:"at"`
+	Err string    `json:"err,omitempty"` // see encodeForwardError
+}
+
+// raftSnapshotState is what a Raft snapshot holds: the state, and the
+// requests recently applied so a node restored from it still recognises
+// their retries.
+type raftSnapshotState struct {
+	fileSnapshot
+	Requests []appliedRequest `json:"requests,omitempty"`
+}
+
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	var rec walRecord
+	if err := json.Unmarshal(l.Data, &rec); err != nil {
+		return err
+	}
+	rec.Seq = l.Index
+	f.mu.Lock()
+	var err error
+	if done, ok := f.requests[rec.RequestID]; ok {
+		err = decodeForwardError(done.Err)
+	} else {
+		err = f.state.Load().apply(rec)
+		f.remember(rec, err)
+	}
+	f.applied.Store(l.Index)
+	f.mu.Unlock()
+	f.store.notifier.notify()
+	return err
+}
+
+// remember records the result of applying rec and forgets the requests
+// applied more than requestRetention before it. Expiry goes by the records'
+// own times, so every node forgets the same requests. Callers hold mu.
+func (f *raftFSM) remember(rec walRecord, err error) {
+	if rec.RequestID == "" {
+		return
+	}
+	done := appliedRequest{ID: rec.RequestID, At: rec.At, Err: encodeForwardError(err)}
+	f.requests[done.ID] = done
+	f.requestLog = append(f.requestLog, done)
+
+	cutoff := rec.At.Add(-requestRetention)
+	expired := 0
+	for expired < len(f.requestLog) && f.requestLog[expired].At.Before(cutoff) {
+		delete(f.requests, f.requestLog[expired].ID)
+		expired++
+	}
+	if expired > 0 {
+		f.requestLog = slices.Clone(f.requestLog[expired:])
+	}
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	// Snapshot runs on the same goroutine as Apply, so applied matches state.
+	snap := raftSnapshotState{
+		fileSnapshot: f.state.Load().export(f.applied.Load()),
+		Requests:     f.requestLog,
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	return raftSnapshot(data), nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap raftSnapshotState
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return fmt.Errorf("decode raft snapshot: %w", err)
+	}
+	state := newMemoryState()
+	state.restore(snap.fileSnapshot)
+	requests := make(map[string]appliedRequest, len(snap.Requests))
+	for _, done := range snap.Requests {
+		requests[done.ID] = done
+	}
+	f.mu.Lock()
+	f.state.Store(state)
+	f.applied.Store(snap.Seq)
+	f.requests, f.requestLog = requests, snap.Requests
+	f.mu.Unlock()
+	f.store.notifier.notify()
+	return nil
+}
+
+type raftSnapshot []byte
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+type raftUsers struct{ s *RaftStore }
+
+func (u raftUsers) Create(user User) error {
+	return u.s.propose(walRecord{Op: opRegister, Username: user.Username, User: &user})
+}
+
+func (u raftUsers) Get(username string) (User, error) {
+	return u.s.state().users.Get(username)
+}
+
+func (u raftUsers) List() ([]User, error) {
+	return u.s.state().users.List()
+}
+
+func (u raftUsers) Update(username string, fn func(*User) error) (User, error) {
+	for {
+		current, err := u.s.state().users.Get(username)
+		if err != nil {
+			return User{}, err
+		}
+		updated := current
+		if err := fn(&updated); err != nil {
+			return current, err
+		}
+
+		err = u.s.propose(walRecord{Op: opUserUpdate, Username: username, User: &updated, ExpectUser: &current})
+		if errors.Is(err, errStaleWrite) {
+			continue
+		}
+		if err != nil {
+			return current, err
+		}
+		return updated, nil
+	}
+}
+
+func (u raftUsers) Delete(username string) error {
+	return u.s.propose(walRecord{Op: opUserDelete, Username: username})
+}
+
+type raftTodos struct{ s *RaftStore }
+
+func (t raftTodos) List(username string) ([]Todo, error) {
+	return t.s.state().todos.List(username)
+}
+
+func (t raftTodos) Get(username, id string) (Todo, error) {
+	return t.s.state().todos.Get(username, id)
+}
+
+func (t raftTodos) Create(username string, todo Todo) error {
+	return t.s.propose(walRecord{Op: opCreate, Username: username, Todo: &todo})
+}
+
+func (t raftTodos) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	return t.update(username, id, func(t *Todo) (*Revision, error) {
+		return nil, fn(t)
+	})
+}
+
+func (t raftTodos) Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error) {
+	return t.update(username, id, func(t *Todo) (*Revision, error) {
+		rev, err := fn(t)
+		return &rev, err
+	})
+}
+
+// update proposes the todo fn produces and, if fn returns one, its
+// revision in a single record.
+func (t raftTodos) update(username, id string, fn func(*Todo) (*Revision, error)) (Todo, error) {
+	for {
+		current, err := t.s.state().todos.Get(username, id)
+		if err != nil {
+			return Todo{}, err
+		}
+		updated := current
+		rev, err := fn(&updated)
+		if err != nil {
+			return current, err
+		}
+
+		err = t.s.propose(walRecord{Op: opUpdate, Username: username, Todo: &updated, Revision: rev, Expect: &current})
+		if errors.Is(err, errStaleWrite) {
+			continue // propose waited for the conflicting write, so re-read
+		}
+		if err != nil {
+			return current, err
+		}
+		return updated, nil
+	}
+}
+
+func (t raftTodos) Delete(username, id string, check func(Todo) error) (Todo, error) {
+	for {
+		current, err := t.s.state().todos.Get(username, id)
+		if err != nil {
+			return Todo{}, err
+		}
+		if check != nil {
+			if err := check(current); err != nil {
+				return current, err
+			}
+		}
+
+		err = t.s.propose(walRecord{Op: opDelete, Username: username, TodoID: id, Expect: &current})
+		if errors.Is(err, errStaleWrite) {
+			continue
+		}
+		return current, err
+	}
+}
+
+func (t raftTodos) Owners() ([]string, error) {
+	return t.s.state().todos.Owners()
+}
+
+type raftRevisions struct{ s *RaftStore }
+
+func (r raftRevisions) Append(username string, rev Revision) error {
+	return r.s.propose(walRecord{Op: opRevision, Username: username, Revision: &rev})
+}
+
+func (r raftRevisions) List(username, todoID string) ([]Revision, error) {
+	return r.s.state().revisions.List(username, todoID)
+}
+
+func (r raftRevisions) Get(username, todoID string, revision int64) (Revision, error) {
+	return r.s.state().revisions.Get(username, todoID, revision)
+}
+
+type raftChanges struct{ s *RaftStore }
+
+func (c raftChanges) Since(since uint64, username string, limit int) ([]Change, error) {
+	return c.s.state().changes.Since(since, username, limit)
+}
+
+func (c raftChanges) Changed() <-chan struct{} {
+	return c.s.notifier.Changed()
+}
+
+func (c raftChanges) Floor() (uint64, error) {
+	return c.s.state().changes.Floor()
+}
+
+func (c raftChanges) Prune(cutoff time.Time) (int, error) {
+	n := c.s.state().changes.prunable(cutoff)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, c.s.propose(walRecord{Op: opChangesPrune, Change: &Change{At: cutoff}})
+}
+
+type raftTokens struct{ s *RaftStore }
+
+func (t raftTokens) Create(token RefreshToken) error {
+	return t.s.propose(walRecord{Op: opTokenCreate, Username: token.Username, Token: &token})
+}
+
+func (t raftTokens) Get(hash string) (RefreshToken, error) {
+	return t.s.state().tokens.Get(hash)
+}
+
+func (t raftTokens) List(username string) ([]RefreshToken, error) {
+	return t.s.state().tokens.List(username)
+}
+
+// Use is checked when the record is applied, so of two nodes exchanging the
+// same token at once only one succeeds.
+func (t raftTokens) Use(hash string, at time.Time) (RefreshToken, error) {
+	err := t.s.propose(walRecord{Op: opTokenUse, Token: &RefreshToken{Hash: hash, UsedAt: &at}})
+	if errors.Is(err, ErrTokenReused) || err == nil {
+		token, getErr := t.s.state().tokens.Get(hash)
+		if getErr != nil {
+			// Revoked since the record was applied
+			return RefreshToken{}, getErr
+		}
+		return token, err
+	}
+	return RefreshToken{}, err
+}
+
+func (t raftTokens) RevokeFamily(family string) error {
+	return t.s.propose(walRecord{Op: opTokenRevoke, Token: &RefreshToken{Family: family}})
+}
+
+func (t raftTokens) Prune(now time.Time) (int, error) {
+	n := expiredTokens(t.s.state().tokens, now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, t.s.propose(walRecord{Op: opTokenPrune, Token: &RefreshToken{ExpiresAt: now}})
+}
+
+type raftRevocations struct{ s *RaftStore }
+
+func (r raftRevocations) Revoke(rev Revocation) error {
+	return r.s.propose(walRecord{Op: opRevoke, Username: rev.Username, Revocation: &rev})
+}
+
+// IsRevoked reads this node's copy. Revoke returns once the local node has
+// applied the revocation, so a follower that revoked a token rejects it
+// right away; other followers catch up within replication lag.
+func (r raftRevocations) IsRevoked(id string) (bool, error) {
+	return r.s.state().revocations.IsRevoked(id)
+}
+
+func (r raftRevocations) Prune(now time.Time) (int, error) {
+	n := r.s.state().revocations.expired(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.s.propose(walRecord{Op: opRevokePrune, Revocation: &Revocation{ExpiresAt: now}})
+}
+
+type raftAttempts struct{ s *RaftStore }
+
+func (a raftAttempts) Get(key string) (LoginAttempts, error) {
+	return a.s.state().attempts.Get(key)
+}
+
+// Update retries until its record applies on top of the counters it read,
+// so concurrent failures on different nodes are all counted.
+func (a raftAttempts) Update(key string, fn func(*LoginAttempts) error) (LoginAttempts, error) {
+	for {
+		current, _ := a.s.state().attempts.Get(key)
+		updated := current
+		if err := fn(&updated); err != nil {
+			return current, err
+		}
+		updated.Key = key
+
+		err := a.s.propose(walRecord{Op: opAttempts, Attempts: &updated, ExpectAttempts: &current})
+		if errors.Is(err, errStaleWrite) {
+			continue
+		}
+		if err != nil {
+			return current, err
+		}
+		return updated, nil
+	}
+}
+
+func (a raftAttempts) Delete(key string) error {
+	return a.s.propose(walRecord{Op: opAttemptsDelete, Attempts: &LoginAttempts{Key: key}})
+}
+
+func (a raftAttempts) Prune(now time.Time) (int, error) {
+	n := a.s.state().attempts.expired(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, a.s.propose(walRecord{Op: opAttemptsPrune, Attempts: &LoginAttempts{ExpiresAt: now}})
+}
+
+type raftPersonalTokens struct{ s *RaftStore }
+
+func (p raftPersonalTokens) Create(token PersonalAccessToken) error {
+	return p.s.propose(walRecord{Op: opPersonalTokenCreate, Username: token.Username, PersonalToken: &token})
+}
+
+func (p raftPersonalTokens) Get(hash string) (PersonalAccessToken, error) {
+	return p.s.state().personal.Get(hash)
+}
+
+func (p raftPersonalTokens) List(username string) ([]PersonalAccessToken, error) {
+	return p.s.state().personal.List(username)
+}
+
+func (p raftPersonalTokens) Touch(hash string, at time.Time) error {
+	return p.s.propose(walRecord{Op: opPersonalTokenTouch, PersonalToken: &PersonalAccessToken{Hash: hash, LastUsedAt: &at}})
+}
+
+// Delete is checked when the record is applied, so deleting a token twice
+// at once fails on one of the nodes.
+func (p raftPersonalTokens) Delete(username, id string) error {
+	return p.s.propose(walRecord{Op: opPersonalTokenDelete, Username: username, PersonalToken: &PersonalAccessToken{ID: id}})
+}
+
+func (p raftPersonalTokens) Prune(now time.Time) (int, error) {
+	n := p.s.state().personal.expired(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, p.s.propose(walRecord{Op: opPersonalTokenPrune, PersonalToken: &PersonalAccessToken{ExpiresAt: &now}})
+}
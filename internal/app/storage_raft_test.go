@@ -0,0 +1,380 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startRaftCluster starts n nodes on loopback and waits for a leader.
+func startRaftCluster(t *testing.T, n int) []*RaftStore {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	peers := make([]RaftPeer, n)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = ln
+		peers[i] = RaftPeer{ID: fmt.Sprintf("node%d", i+1), Addr: ln.Addr().String()}
+	}
+
+	nodes := make([]*RaftStore, n)
+	for i := range nodes {
+		node, err := OpenRaftStore(RaftConfig{
+			NodeID:           peers[i].ID,
+			Addr:             peers[i].Addr,
+			Peers:            peers,
+			Dir:              t.TempDir(),
+			Listener:         listeners[i],
+			HeartbeatTimeout: 200 * time.Millisecond,
+			ElectionTimeout:  200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Start %s: %v", peers[i].ID, err)
+		}
+		nodes[i] = node
+		t.Cleanup(func() { node.Close() })
+	}
+	waitForLeader(t, nodes)
+	return nodes
+}
+
+// waitForLeader returns the index of the node all running nodes agree leads.
+func waitForLeader(t *testing.T, nodes []*RaftStore) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, node := range nodes {
+			if node != nil && node.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return -1
+}
+
+// waitForTodos waits until node holds exactly the todos in ids for user.
+func waitForTodos(t *testing.T, node *RaftStore, username string, ids []string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		list, _ := node.Todos().List(username)
+		have := make(map[string]bool, len(list))
+		for _, todo := range list {
+			have[todo.ID] = true
+		}
+		missing := 0
+		for _, id := range ids {
+			if !have[id] {
+				missing++
+			}
+		}
+		if missing == 0 && len(list) == len(ids) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d acknowledged todos missing, %d todos stored", missing, len(ids), len(list))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func followerOf(nodes []*RaftStore, leader int) *RaftStore {
+	return nodes[(leader+1)%len(nodes)]
+}
+
+func TestRaftClusterForwardsFollowerWrites(t *testing.T) {
+	nodes := startRaftCluster(t, 3)
+	follower := followerOf(nodes, waitForLeader(t, nodes))
+
+	if err := follower.Users().Create(User{Username: "alice", PasswordHash: "hash"}); err != nil {
+		t.Fatalf("Register through follower: %v", err)
+	}
+	if err := follower.Users().Create(User{Username: "alice", PasswordHash: "other"}); err != ErrUserExists {
+		t.Fatalf("Expected ErrUserExists through follower, got %v", err)
+	}
+
+	todo := newTestTodo("replicated")
+	if err := follower.Todos().Create("alice", todo); err != nil {
+		t.Fatalf("Create through follower: %v", err)
+	}
+	// The follower waits for its own copy before acknowledging
+	if _, err := follower.Todos().Get("alice", todo.ID); err != nil {
+		t.Fatalf("Expected to read our own write on the follower: %v", err)
+	}
+	for _, node := range nodes {
+		waitForTodos(t, node, "alice", []string{todo.ID})
+	}
+
+	if _, err := follower.Todos().Update("alice", "missing", func(t *Todo) error { return nil }); err != ErrTodoNotFound {
+		t.Fatalf("Expected ErrTodoNotFound got %v", err)
+	}
+	if _, err := follower.Todos().Delete("alice", todo.ID, nil); err != nil {
+		t.Fatalf("Delete through follower: %v", err)
+	}
+	for _, node := range nodes {
+		waitForTodos(t, node, "alice", nil)
+	}
+}
+
+// Appends made concurrently through every node must all survive, which only
+// holds if conflicting optimistic updates are retried against fresh state.
+func TestRaftClusterConcurrentUpdatesKeepEveryChange(t *testing.T) {
+	nodes := startRaftCluster(t, 3)
+	todo := newTestTodo("")
+	if err := nodes[0].Todos().Create("alice", todo); err != nil {
+		t.Fatal(err)
+	}
+	// Followers serve reads from their own copy, so let it arrive first
+	for _, node := range nodes {
+		waitForTodos(t, node, "alice", []string{todo.ID})
+	}
+
+	const appends = 15
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mark := string(rune('a' + i))
+			for j := 0; j < appends; j++ {
+				_, err := node.Todos().Update("alice", todo.ID, func(t *Todo) error {
+					t.Title += mark
+					t.Version++
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Update through node %d: %v", i, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Read on the leader, which has applied every acknowledged write
+	final, _ := nodes[waitForLeader(t, nodes)].Todos().Get("alice", todo.ID)
+	for i := range nodes {
+		mark := string(rune('a' + i))
+		if n := strings.Count(final.Title, mark); n != appends {
+			t.Fatalf("Expected %d %q appends got %d in %q", appends, mark, n, final.Title)
+		}
+	}
+	if final.Version != 1+3*appends {
+		t.Fatalf("Expected version %d got %d", 1+3*appends, final.Version)
+	}
+}
+
+func TestRaftClusterLeaderFailoverKeepsAcknowledgedTodos(t *testing.T) {
+	nodes := startRaftCluster(t, 3)
+
+	var mu sync.Mutex
+	var acked []string
+	write := func(node *RaftStore, title string) {
+		todo := newTestTodo(title)
+		if err := node.Todos().Create("alice", todo); err == nil {
+			mu.Lock()
+			acked = append(acked, todo.ID)
+			mu.Unlock()
+		}
+	}
+
+	for i := 0; i < 30; i++ {
+		write(nodes[i%3], fmt.Sprintf("before %d", i))
+	}
+
+	// Keep writing through the followers while the leader goes away
+	leader := waitForLeader(t, nodes)
+	var survivors []*RaftStore
+	for i, node := range nodes {
+		if i != leader {
+			survivors = append(survivors, node)
+		}
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, node := range survivors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					write(node, fmt.Sprintf("during %d", i))
+				}
+			}
+		}()
+	}
+	if err := nodes[leader].Close(); err != nil {
+		t.Fatalf("Stop leader: %v", err)
+	}
+	nodes[leader] = nil
+
+	newLeader := waitForLeader(t, nodes)
+	if newLeader == leader {
+		t.Fatal("Expected a different leader after failover")
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		write(survivors[i%2], fmt.Sprintf("after %d", i))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acked) < 40 {
+		t.Fatalf("Expected writes to be acknowledged around the failover, got %d", len(acked))
+	}
+	for _, node := range survivors {
+		waitForTodos(t, node, "alice", acked)
+	}
+}
+
+// A proposal whose answer was lost is proposed again with the same request
+// ID; the second copy must answer like the first without applying again.
+func TestRaftRetriedProposalsApplyOnce(t *testing.T) {
+	node := startRaftCluster(t, 1)[0]
+	todo := newTestTodo("once")
+	if err := node.Todos().Create("alice", todo); err != nil {
+		t.Fatal(err)
+	}
+	updated := todo
+	updated.Title, updated.Version = "twice?", todo.Version+1
+	records := []walRecord{
+		{Op: opUpdate, Username: "alice", Todo: &updated, Expect: &todo},
+		{Op: opRevision, Username: "alice", Revision: &Revision{TodoID: todo.ID, Revision: updated.Version}},
+	}
+	for _, rec := range records {
+		rec.At, rec.RequestID = time.Now().UTC(), GenerateID()
+		data, _ := json.Marshal(rec)
+		for attempt := 0; attempt < 2; attempt++ {
+			if resp := node.applyLocal(data); resp.NotLeader || resp.Err != "" {
+				t.Fatalf("%s attempt %d: unexpected answer %+v", rec.Op, attempt, resp)
+			}
+		}
+	}
+	if got, _ := node.Todos().Get("alice", todo.ID); got.Version != updated.Version {
+		t.Fatalf("Expected version %d got %d", updated.Version, got.Version)
+	}
+	if revs, _ := node.Revisions().List("alice", todo.ID); len(revs) != 1 {
+		t.Fatalf("Expected one revision got %d", len(revs))
+	}
+
+	// A node restored from a snapshot still knows the requests
+	snap, err := node.fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &raftFSM{store: node}
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(snap.(raftSnapshot)))); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.requests) != len(node.fsm.requests) || len(restored.requests) < len(records) {
+		t.Fatalf("Expected %d requests restored got %d", len(node.fsm.requests), len(restored.requests))
+	}
+}
+
+// Writes retried across a failover must each land once: every acknowledged
+// update bumps the version by one and every revision is stored once.
+func TestRaftClusterLeaderFailoverAppliesEachWriteOnce(t *testing.T) {
+	nodes := startRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	var survivors []*RaftStore
+	for i, node := range nodes {
+		if i != leader {
+			survivors = append(survivors, node)
+		}
+	}
+	todos := make([]Todo, len(survivors))
+	for i := range todos {
+		todos[i] = newTestTodo(fmt.Sprintf("counter %d", i))
+		if err := nodes[leader].Todos().Create("alice", todos[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := []string{todos[0].ID, todos[1].ID}
+	for _, node := range survivors {
+		waitForTodos(t, node, "alice", ids)
+	}
+
+	// Each survivor bumps its own todo and records a revision per update
+	type tally struct{ updated, updateFailed, appended, appendFailed int }
+	tallies := make([]tally, len(survivors))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, node := range survivors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				updated, err := node.Todos().Update("alice", todos[i].ID, func(t *Todo) error {
+					t.Version++
+					return nil
+				})
+				if err != nil {
+					tallies[i].updateFailed++
+					continue
+				}
+				tallies[i].updated++
+				rev := Revision{TodoID: updated.ID, Revision: updated.Version, Author: "alice"}
+				if err := node.Revisions().Append("alice", rev); err != nil {
+					tallies[i].appendFailed++
+				} else {
+					tallies[i].appended++
+				}
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := nodes[leader].Close(); err != nil {
+		t.Fatalf("Stop leader: %v", err)
+	}
+	nodes[leader] = nil
+	if waitForLeader(t, nodes) == leader {
+		t.Fatal("Expected a different leader after failover")
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// Read on the new leader, which has applied every acknowledged write
+	node := nodes[waitForLeader(t, nodes)]
+	for i, todo := range todos {
+		n := tallies[i]
+		if n.updated == 0 {
+			t.Fatalf("Todo %d: expected updates acknowledged around the failover", i)
+		}
+		got, _ := node.Todos().Get("alice", todo.ID)
+		if bumps := got.Version - todo.Version; bumps < int64(n.updated) || bumps > int64(n.updated+n.updateFailed) {
+			t.Fatalf("Todo %d: %d updates acknowledged, %d failed, but version moved by %d", i, n.updated, n.updateFailed, bumps)
+		}
+		revs, _ := node.Revisions().List("alice", todo.ID)
+		if len(revs) < n.appended || len(revs) > n.appended+n.appendFailed {
+			t.Fatalf("Todo %d: %d revisions appended, %d failed, but %d stored", i, n.appended, n.appendFailed, len(revs))
+		}
+		for j := 1; j < len(revs); j++ {
+			if revs[j].Revision == revs[j-1].Revision {
+				t.Fatalf("Todo %d: revision %d stored twice", i, revs[j].Revision)
+			}
+		}
+	}
+}
@@ -0,0 +1,954 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go driver, keeps the binary CGO-free
+)
+
+// SQLiteStore is a user and todo store backed by an embedded SQLite
+// database. Every todo mutation runs in an immediate transaction, so
+// read-modify-write updates are atomic across processes as well as
+// goroutines.
+type SQLiteStore struct {
+	db      *sql.DB
+	changes *sqliteChanges
+}
+
+// OpenSQLiteDB opens the database at path without touching its schema.
+func OpenSQLiteDB(path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create database dir: %w", err)
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenSQLiteStore opens the database at path. With migrate set, pending
+// migrations are applied first; otherwise a database that is behind the
+// binary is rejected so `todoapp migrate` can be run deliberately.
+func OpenSQLiteStore(path string, migrate bool) (*SQLiteStore, error) {
+	db, err := OpenSQLiteDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if migrate {
+		if _, err := Migrate(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if latest := LatestSchemaVersion(); version != latest {
+		db.Close()
+		return nil, fmt.Errorf("database schema is at version %d, this binary needs %d: run `todoapp migrate`", version, latest)
+	}
+	return &SQLiteStore{db: db, changes: &sqliteChanges{db: db}}, nil
+}
+
+// Users returns the UserStore view of s.
+func (s *SQLiteStore) Users() UserStore { return sqliteUsers{s.db, s.changes} }
+
+// Todos returns the TodoStore view of s.
+func (s *SQLiteStore) Todos() TodoStore { return sqliteTodos{s.db, s.changes} }
+
+// Revisions returns the RevisionStore view of s.
+func (s *SQLiteStore) Revisions() RevisionStore { return sqliteRevisions{s.db} }
+
+// Changes returns the change feed of s.
+func (s *SQLiteStore) Changes() ChangeFeed { return s.changes }
+
+// Tokens returns the TokenStore view of s.
+func (s *SQLiteStore) Tokens() TokenStore { return sqliteTokens{s.db} }
+
+// Revocations returns the RevocationStore view of s.
+func (s *SQLiteStore) Revocations() RevocationStore { return sqliteRevocations{s.db} }
+
+// Attempts returns the LoginAttemptStore view of s.
+func (s *SQLiteStore) Attempts() LoginAttemptStore { return sqliteAttempts{s.db} }
+
+// PersonalTokens returns the PersonalTokenStore view of s.
+func (s *SQLiteStore) PersonalTokens() PersonalTokenStore { return sqlitePersonalTokens{s.db} }
+
+// Stores returns every store view of s.
+func (s *SQLiteStore) Stores() Stores {
+	return Stores{Users: s.Users(), Todos: s.Todos(), Revisions: s.Revisions(), Changes: s.Changes(), Tokens: s.Tokens(), Revocations: s.Revocations(), Attempts: s.Attempts(), PersonalTokens: s.PersonalTokens(), Exporter: s}
+}
+
+// Export reads the dataset in one read-only transaction, which sees a
+// single snapshot of the database without blocking writers.
+func (s *SQLiteStore) Export() (Dataset, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Dataset{}, err
+	}
+	defer tx.Rollback()
+
+	d := newDataset()
+	var username string
+	err = queryEach(tx, `SELECT `+userColumns+` FROM users ORDER BY username`, func(rows *sql.Rows) error {
+		user, err := scanUser(rows)
+		d.Users = append(d.Users, user)
+		return err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+	err = queryEach(tx, `SELECT username, `+todoColumns+` FROM todos ORDER BY username, seq`, func(rows *sql.Rows) error {
+		todo, err := scanTodo(withUsername{rows, &username})
+		d.Todos[username] = append(d.Todos[username], todo)
+		return err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+	err = queryEach(tx, `SELECT username, `+revisionColumns+` FROM revisions ORDER BY username, todo_id, revision`, func(rows *sql.Rows) error {
+		rev, err := scanRevision(withUsername{rows, &username})
+		d.Revisions[username] = append(d.Revisions[username], rev)
+		return err
+	})
+	if err != nil {
+		return Dataset{}, err
+	}
+	return d, nil
+}
+
+// queryEach runs query in tx and calls fn for every row.
+func queryEach(tx *sql.Tx, query string, fn func(*sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// withUsername scans a leading username column, so rows from every user can
+// go through the single-user scan helpers.
+type withUsername struct {
+	row      rowScanner
+	username *string
+}
+
+func (w withUsername) Scan(dest ...any) error {
+	return w.row.Scan(append([]any{w.username}, dest...)...)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+type sqliteUsers struct {
+	db      *sql.DB
+	changes *sqliteChanges
+}
+
+const userColumns = `username, password_hash, totp_secret, totp_pending, totp_last_step, recovery_codes, role, disabled, password_reset_required`
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	err := row.Scan(&user.Username, &user.PasswordHash, &user.TOTPSecret, &user.TOTPPending, &user.TOTPLastStep, &user.RecoveryCodes, &user.Role, &user.Disabled, &user.PasswordResetRequired)
+	return user, err
+}
+
+func (u sqliteUsers) Create(user User) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO NOTHING`,
+		user.Username, user.PasswordHash, user.TOTPSecret, user.TOTPPending, user.TOTPLastStep, user.RecoveryCodes,
+		user.Role, user.Disabled, user.PasswordResetRequired)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserExists
+	}
+	if err := insertChange(tx, Change{Op: ChangeRegister, Username: user.Username}); err != nil {
+		return err
+	}
+	return u.changes.commit(tx)
+}
+
+func (u sqliteUsers) Get(username string) (User, error) {
+	user, err := scanUser(u.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (u sqliteUsers) List() ([]User, error) {
+	rows, err := u.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (u sqliteUsers) Update(username string, fn func(*User) error) (User, error) {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	updated := current
+	if err := fn(&updated); err != nil {
+		return current, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET password_hash = ?, totp_secret = ?, totp_pending = ?, totp_last_step = ?, recovery_codes = ?,
+		role = ?, disabled = ?, password_reset_required = ?
+		WHERE username = ?`,
+		updated.PasswordHash, updated.TOTPSecret, updated.TOTPPending, updated.TOTPLastStep, updated.RecoveryCodes,
+		updated.Role, updated.Disabled, updated.PasswordResetRequired, username)
+	if err != nil {
+		return current, err
+	}
+	if err := tx.Commit(); err != nil {
+		return current, err
+	}
+	return updated, nil
+}
+
+func (u sqliteUsers) Delete(username string) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM users WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	for _, table := range []string{"revisions", "changes"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE username = ?`, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type sqliteTodos struct {
+	db      *sql.DB
+	changes *sqliteChanges
+}
+
+const todoColumns = `id, title, completed, created_at, version, deleted_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTodo(row rowScanner) (Todo, error) {
+	var t Todo
+	var createdAt string
+	var deletedAt sql.NullString
+	if err := row.Scan(&t.ID, &t.Title, &t.Completed, &createdAt, &t.Version, &deletedAt); err != nil {
+		return Todo{}, err
+	}
+	var err error
+	if t.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return Todo{}, err
+	}
+	if deletedAt.Valid {
+		at, err := time.Parse(time.RFC3339Nano, deletedAt.String)
+		if err != nil {
+			return Todo{}, err
+		}
+		t.DeletedAt = &at
+	}
+	return t, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// formatNullTime stores a nil time as NULL.
+func formatNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: formatTime(*t), Valid: true}
+}
+
+func (s sqliteTodos) List(username string) ([]Todo, error) {
+	rows, err := s.db.Query(`SELECT `+todoColumns+` FROM todos WHERE username = ? ORDER BY seq`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := []Todo{}
+	for rows.Next() {
+		t, err := scanTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, t)
+	}
+	return todos, rows.Err()
+}
+
+func (s sqliteTodos) Get(username, id string) (Todo, error) {
+	return getTodo(s.db.QueryRow(`SELECT `+todoColumns+` FROM todos WHERE username = ? AND id = ?`, username, id))
+}
+
+func getTodo(row *sql.Row) (Todo, error) {
+	t, err := scanTodo(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Todo{}, ErrTodoNotFound
+	}
+	return t, err
+}
+
+func (s sqliteTodos) Create(username string, todo Todo) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO todos (username, id, title, completed, created_at, version, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		username, todo.ID, todo.Title, todo.Completed, formatTime(todo.CreatedAt), todo.Version, formatNullTime(todo.DeletedAt)); err != nil {
+		return err
+	}
+	if err := insertChange(tx, todoChange(ChangeCreate, username, todo)); err != nil {
+		return err
+	}
+	return s.changes.commit(tx)
+}
+
+func (s sqliteTodos) Update(username, id string, fn func(*Todo) error) (Todo, error) {
+	return s.update(username, id, func(t *Todo) (*Revision, error) {
+		return nil, fn(t)
+	})
+}
+
+func (s sqliteTodos) Revise(username, id string, fn func(*Todo) (Revision, error)) (Todo, error) {
+	return s.update(username, id, func(t *Todo) (*Revision, error) {
+		rev, err := fn(t)
+		return &rev, err
+	})
+}
+
+// update writes the todo fn produces and, if fn returns one, its revision
+// in one transaction.
+func (s sqliteTodos) update(username, id string, fn func(*Todo) (*Revision, error)) (Todo, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Todo{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := getTodo(tx.QueryRow(`SELECT `+todoColumns+` FROM todos WHERE username = ? AND id = ?`, username, id))
+	if err != nil {
+		return Todo{}, err
+	}
+	updated := current
+	rev, err := fn(&updated)
+	if err != nil {
+		return current, err
+	}
+
+	if _, err := tx.Exec(`UPDATE todos SET title = ?, completed = ?, created_at = ?, version = ?, deleted_at = ?
+		WHERE username = ? AND id = ?`,
+		updated.Title, updated.Completed, formatTime(updated.CreatedAt), updated.Version, formatNullTime(updated.DeletedAt),
+		username, id); err != nil {
+		return current, err
+	}
+	if rev != nil {
+		if err := insertRevision(tx, username, *rev); err != nil {
+			return current, err
+		}
+	}
+	if err := insertChange(tx, todoChange(ChangeUpdate, username, updated)); err != nil {
+		return current, err
+	}
+	if err := s.changes.commit(tx); err != nil {
+		return current, err
+	}
+	return updated, nil
+}
+
+func (s sqliteTodos) Delete(username, id string, check func(Todo) error) (Todo, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Todo{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := getTodo(tx.QueryRow(`SELECT `+todoColumns+` FROM todos WHERE username = ? AND id = ?`, username, id))
+	if err != nil {
+		return Todo{}, err
+	}
+	if check != nil {
+		if err := check(current); err != nil {
+			return current, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM todos WHERE username = ? AND id = ?`, username, id); err != nil {
+		return current, err
+	}
+	if err := insertChange(tx, todoTombstone(username, id)); err != nil {
+		return current, err
+	}
+	return current, s.changes.commit(tx)
+}
+
+func (s sqliteTodos) Owners() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT username FROM todos ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owners []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		owners = append(owners, username)
+	}
+	return owners, rows.Err()
+}
+
+type sqliteRevisions struct{ db *sql.DB }
+
+const revisionColumns = `todo_id, revision, author, at, changes`
+
+func scanRevision(row rowScanner) (Revision, error) {
+	var rev Revision
+	var at, changes string
+	if err := row.Scan(&rev.TodoID, &rev.Revision, &rev.Author, &at, &changes); err != nil {
+		return Revision{}, err
+	}
+	var err error
+	if rev.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return Revision{}, err
+	}
+	return rev, json.Unmarshal([]byte(changes), &rev.Changes)
+}
+
+func (r sqliteRevisions) Append(username string, rev Revision) error {
+	return insertRevision(r.db, username, rev)
+}
+
+// insertRevision adds rev through e, a *sql.DB or *sql.Tx.
+func insertRevision(e execer, username string, rev Revision) error {
+	changes, err := json.Marshal(rev.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec(`INSERT INTO revisions (username, todo_id, revision, author, at, changes)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		username, rev.TodoID, rev.Revision, rev.Author, formatTime(rev.At), string(changes))
+	return err
+}
+
+func (r sqliteRevisions) List(username, todoID string) ([]Revision, error) {
+	rows, err := r.db.Query(`SELECT `+revisionColumns+` FROM revisions
+		WHERE username = ? AND todo_id = ? ORDER BY revision`, username, todoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []Revision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+func (r sqliteRevisions) Get(username, todoID string, revision int64) (Revision, error) {
+	rev, err := scanRevision(r.db.QueryRow(`SELECT `+revisionColumns+` FROM revisions
+		WHERE username = ? AND todo_id = ? AND revision = ?`, username, todoID, revision))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Revision{}, ErrRevisionNotFound
+	}
+	return rev, err
+}
+
+// sqliteChanges reads the changes table. Writers add their change in the
+// same transaction as the mutation and commit through commit, which wakes
+// subscribers in this process.
+type sqliteChanges struct {
+	db       *sql.DB
+	notifier changeNotifier
+}
+
+func insertChange(tx *sql.Tx, c Change) error {
+	var todo sql.NullString
+	if c.Todo != nil {
+		data, err := json.Marshal(c.Todo)
+		if err != nil {
+			return err
+		}
+		todo = sql.NullString{String: string(data), Valid: true}
+	}
+	_, err := tx.Exec(`INSERT INTO changes (op, username, todo_id, todo, at) VALUES (?, ?, ?, ?, ?)`,
+		c.Op, c.Username, c.TodoID, todo, formatTime(time.Now()))
+	return err
+}
+
+func (f *sqliteChanges) commit(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	f.notifier.notify()
+	return nil
+}
+
+func (f *sqliteChanges) Changed() <-chan struct{} {
+	return f.notifier.Changed()
+}
+
+// Since checks the floor and reads the changes in one read-only
+// transaction, so a prune cannot slip in between.
+func (f *sqliteChanges) Since(since uint64, username string, limit int) ([]Change, error) {
+	tx, err := f.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var floor uint64
+	if err := tx.QueryRow(`SELECT seq FROM changes_floor`).Scan(&floor); err != nil {
+		return nil, err
+	}
+	if since < floor {
+		return nil, ErrChangesPruned
+	}
+	rows, err := tx.Query(`SELECT seq, op, username, todo_id, todo, at FROM changes
+		WHERE seq > ? AND (? = '' OR username = ?) ORDER BY seq LIMIT ?`,
+		since, username, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		var todo sql.NullString
+		var at string
+		if err := rows.Scan(&c.Seq, &c.Op, &c.Username, &c.TodoID, &todo, &at); err != nil {
+			return nil, err
+		}
+		if c.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			return nil, err
+		}
+		if todo.Valid {
+			c.Todo = &Todo{}
+			if err := json.Unmarshal([]byte(todo.String), c.Todo); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (f *sqliteChanges) Floor() (uint64, error) {
+	var floor uint64
+	err := f.db.QueryRow(`SELECT seq FROM changes_floor`).Scan(&floor)
+	return floor, err
+}
+
+func (f *sqliteChanges) Prune(cutoff time.Time) (int, error) {
+	tx, err := f.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newest sql.NullInt64
+	err = tx.QueryRow(`SELECT MAX(seq) FROM changes WHERE julianday(at) < julianday(?)`, formatTime(cutoff)).Scan(&newest)
+	if err != nil || !newest.Valid {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM changes WHERE seq <= ?`, newest.Int64)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE changes_floor SET seq = ? WHERE seq < ?`, newest.Int64, newest.Int64); err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), tx.Commit()
+}
+
+type sqliteTokens struct{ db *sql.DB }
+
+const tokenColumns = `hash, family, username, expires_at, used_at`
+
+func scanToken(row rowScanner) (RefreshToken, error) {
+	var token RefreshToken
+	var expiresAt string
+	var usedAt sql.NullString
+	if err := row.Scan(&token.Hash, &token.Family, &token.Username, &expiresAt, &usedAt); err != nil {
+		return RefreshToken{}, err
+	}
+	var err error
+	if token.ExpiresAt, err = time.Parse(time.RFC3339Nano, expiresAt); err != nil {
+		return RefreshToken{}, err
+	}
+	if usedAt.Valid {
+		at, err := time.Parse(time.RFC3339Nano, usedAt.String)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		token.UsedAt = &at
+	}
+	return token, nil
+}
+
+func (t sqliteTokens) Create(token RefreshToken) error {
+	_, err := t.db.Exec(`INSERT INTO refresh_tokens (`+tokenColumns+`) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO NOTHING`,
+		token.Hash, token.Family, token.Username, formatTime(token.ExpiresAt), formatNullTime(token.UsedAt))
+	return err
+}
+
+func (t sqliteTokens) Get(hash string) (RefreshToken, error) {
+	token, err := scanToken(t.db.QueryRow(`SELECT `+tokenColumns+` FROM refresh_tokens WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	return token, err
+}
+
+func (t sqliteTokens) List(username string) ([]RefreshToken, error) {
+	rows, err := t.db.Query(`SELECT `+tokenColumns+` FROM refresh_tokens WHERE username = ? ORDER BY hash`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []RefreshToken
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (t sqliteTokens) Use(hash string, at time.Time) (RefreshToken, error) {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE hash = ? AND used_at IS NULL`, formatTime(at), hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	token, err := scanToken(tx.QueryRow(`SELECT `+tokenColumns+` FROM refresh_tokens WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return token, ErrTokenReused
+	}
+	return token, tx.Commit()
+}
+
+func (t sqliteTokens) RevokeFamily(family string) error {
+	_, err := t.db.Exec(`DELETE FROM refresh_tokens WHERE family = ?`, family)
+	return err
+}
+
+// Prune compares through julianday because RFC 3339 times with trimmed
+// fractions do not sort as text.
+func (t sqliteTokens) Prune(now time.Time) (int, error) {
+	res, err := t.db.Exec(`DELETE FROM refresh_tokens WHERE julianday(expires_at) < julianday(?)`, formatTime(now))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+type sqliteRevocations struct{ db *sql.DB }
+
+func (r sqliteRevocations) Revoke(rev Revocation) error {
+	_, err := r.db.Exec(`INSERT INTO revocations (id, username, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at
+		WHERE julianday(excluded.expires_at) > julianday(revocations.expires_at)`,
+		rev.ID, rev.Username, formatTime(rev.ExpiresAt))
+	return err
+}
+
+func (r sqliteRevocations) IsRevoked(id string) (bool, error) {
+	var n int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM revocations WHERE id = ?`, id).Scan(&n)
+	return n > 0, err
+}
+
+func (r sqliteRevocations) Prune(now time.Time) (int, error) {
+	res, err := r.db.Exec(`DELETE FROM revocations WHERE julianday(expires_at) < julianday(?)`, formatTime(now))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+type sqliteAttempts struct{ db *sql.DB }
+
+const attemptColumns = `key, failures, last_failure, locked_until, expires_at`
+
+func scanAttempts(row rowScanner) (LoginAttempts, error) {
+	var a LoginAttempts
+	var lastFailure, lockedUntil, expiresAt string
+	if err := row.Scan(&a.Key, &a.Failures, &lastFailure, &lockedUntil, &expiresAt); err != nil {
+		return LoginAttempts{}, err
+	}
+	for _, f := range []struct {
+		dst *time.Time
+		src string
+	}{{&a.LastFailure, lastFailure}, {&a.LockedUntil, lockedUntil}, {&a.ExpiresAt, expiresAt}} {
+		t, err := time.Parse(time.RFC3339Nano, f.src)
+		if err != nil {
+			return LoginAttempts{}, err
+		}
+		*f.dst = t
+	}
+	return a, nil
+}
+
+// queryRower is satisfied by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// getAttempts reads the record for key, a zero one if there is none.
+func getAttempts(q queryRower, key string) (LoginAttempts, error) {
+	a, err := scanAttempts(q.QueryRow(`SELECT `+attemptColumns+` FROM login_attempts WHERE key = ?`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempts{Key: key}, nil
+	}
+	return a, err
+}
+
+func (s sqliteAttempts) Get(key string) (LoginAttempts, error) {
+	return getAttempts(s.db, key)
+}
+
+func (s sqliteAttempts) Update(key string, fn func(*LoginAttempts) error) (LoginAttempts, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := getAttempts(tx, key)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	updated := current
+	if err := fn(&updated); err != nil {
+		return current, err
+	}
+	updated.Key = key
+
+	_, err = tx.Exec(`INSERT INTO login_attempts (`+attemptColumns+`) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure,
+			locked_until = excluded.locked_until, expires_at = excluded.expires_at`,
+		key, updated.Failures, formatTime(updated.LastFailure), formatTime(updated.LockedUntil), formatTime(updated.ExpiresAt))
+	if err != nil {
+		return current, err
+	}
+	if err := tx.Commit(); err != nil {
+		return current, err
+	}
+	return updated, nil
+}
+
+func (s sqliteAttempts) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = ?`, key)
+	return err
+}
+
+func (s sqliteAttempts) Prune(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM login_attempts WHERE julianday(expires_at) < julianday(?)`, formatTime(now))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+type sqlitePersonalTokens struct{ db *sql.DB }
+
+const personalTokenColumns = `hash, id, username, name, scopes, created_at, expires_at, last_used_at`
+
+func scanPersonalToken(row rowScanner) (PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	var scopes, createdAt string
+	var expiresAt, lastUsedAt sql.NullString
+	if err := row.Scan(&token.Hash, &token.ID, &token.Username, &token.Name, &scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+		return PersonalAccessToken{}, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	var err error
+	if token.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return PersonalAccessToken{}, err
+	}
+	for _, f := range []struct {
+		dst **time.Time
+		src sql.NullString
+	}{{&token.ExpiresAt, expiresAt}, {&token.LastUsedAt, lastUsedAt}} {
+		if !f.src.Valid {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, f.src.String)
+		if err != nil {
+			return PersonalAccessToken{}, err
+		}
+		*f.dst = &t
+	}
+	return token, nil
+}
+
+func (p sqlitePersonalTokens) Create(token PersonalAccessToken) error {
+	_, err := p.db.Exec(`INSERT INTO personal_tokens (`+personalTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO NOTHING`,
+		token.Hash, token.ID, token.Username, token.Name, strings.Join(token.Scopes, " "),
+		formatTime(token.CreatedAt), formatNullTime(token.ExpiresAt), formatNullTime(token.LastUsedAt))
+	return err
+}
+
+func (p sqlitePersonalTokens) Get(hash string) (PersonalAccessToken, error) {
+	token, err := scanPersonalToken(p.db.QueryRow(`SELECT `+personalTokenColumns+` FROM personal_tokens WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PersonalAccessToken{}, ErrPersonalTokenNotFound
+	}
+	return token, err
+}
+
+func (p sqlitePersonalTokens) List(username string) ([]PersonalAccessToken, error) {
+	rows, err := p.db.Query(`SELECT `+personalTokenColumns+` FROM personal_tokens WHERE username = ?
+		ORDER BY julianday(created_at), id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []PersonalAccessToken
+	for rows.Next() {
+		token, err := scanPersonalToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (p sqlitePersonalTokens) Touch(hash string, at time.Time) error {
+	_, err := p.db.Exec(`UPDATE personal_tokens SET last_used_at = ?
+		WHERE hash = ? AND (last_used_at IS NULL OR julianday(last_used_at) < julianday(?))`,
+		formatTime(at), hash, formatTime(at))
+	return err
+}
+
+func (p sqlitePersonalTokens) Delete(username, id string) error {
+	res, err := p.db.Exec(`DELETE FROM personal_tokens WHERE username = ? AND id = ?`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPersonalTokenNotFound
+	}
+	return nil
+}
+
+func (p sqlitePersonalTokens) Prune(now time.Time) (int, error) {
+	res, err := p.db.Exec(`DELETE FROM personal_tokens WHERE expires_at IS NOT NULL AND julianday(expires_at) < julianday(?)`, formatTime(now))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
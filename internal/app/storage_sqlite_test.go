@@ -0,0 +1,100 @@
+package app
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateRunsEachMigrationOnce(t *testing.T) {
+	db, err := OpenSQLiteDB(filepath.Join(t.TempDir(), "todoapp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	applied, err := Migrate(db)
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if len(applied) != LatestSchemaVersion() {
+		t.Fatalf("Expected %d migrations on a fresh database got %d", LatestSchemaVersion(), len(applied))
+	}
+
+	applied, err = Migrate(db)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Expected no pending migrations on second run, got %d (err=%v)", len(applied), err)
+	}
+
+	version, _ := SchemaVersion(db)
+	if version != LatestSchemaVersion() {
+		t.Fatalf("Expected schema version %d got %d", LatestSchemaVersion(), version)
+	}
+}
+
+func TestOpenSQLiteStoreRejectsOutdatedSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "todoapp.db")
+
+	_, err := OpenSQLiteStore(path, false)
+	if err == nil || !strings.Contains(err.Error(), "todoapp migrate") {
+		t.Fatalf("Expected an outdated schema error pointing at the migrate command, got %v", err)
+	}
+
+	s, err := OpenSQLiteStore(path, true)
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore with migrate: %v", err)
+	}
+	s.Close()
+
+	s, err = OpenSQLiteStore(path, false)
+	if err != nil {
+		t.Fatalf("Expected migrated database to open without migrating: %v", err)
+	}
+	s.Close()
+}
+
+func TestSQLiteStoreKeepsDataAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "todoapp.db")
+	s, err := OpenSQLiteStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Users().Create(User{Username: "alice", PasswordHash: "hash"}); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if err := s.Users().Create(User{Username: "alice", PasswordHash: "other"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Expected ErrUserExists got %v", err)
+	}
+
+	first, second := newTestTodo("first"), newTestTodo("second")
+	s.Todos().Create("alice", first)
+	s.Todos().Create("alice", second)
+	s.Todos().Update("alice", first.ID, func(t *Todo) error {
+		t.Completed = true
+		t.Version++
+		return nil
+	})
+	s.Close()
+
+	s, err = OpenSQLiteStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	list, err := s.Todos().List("alice")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+		t.Fatalf("Expected both todos in creation order got %+v", list)
+	}
+	if !list[0].Completed || list[0].Version != 2 || !list[0].CreatedAt.Equal(first.CreatedAt) {
+		t.Fatalf("Update not persisted: %+v", list[0])
+	}
+	if _, err := s.Todos().Get("bob", first.ID); !errors.Is(err, ErrTodoNotFound) {
+		t.Fatalf("Expected another user's lookup to miss, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package app
+
+import "errors"
+
+// errStaleWrite is returned when a record's Expect no longer matches the
+// stored todo: the writer read an old copy and must re-read and retry.
+var errStaleWrite = errors.New("todo changed since it was read")
+
+// memoryState is the in-memory image behind the log-based stores. The
+// FileStore rebuilds it from its write-ahead log and the RaftStore from the
+// Raft log; both feed it the same walRecords.
+type memoryState struct {
+	users       *MemoryUserStore
+	todos       *MemoryTodoStore
+	revisions   *MemoryRevisionStore
+	changes     *MemoryChangeLog
+	tokens      *MemoryTokenStore
+	revocations *MemoryRevocationList
+	attempts    *MemoryLoginAttempts
+	personal    *MemoryPersonalTokens
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		users:       NewMemoryUserStore(),
+		todos:       NewMemoryTodoStore(),
+		revisions:   NewMemoryRevisionStore(),
+		changes:     NewMemoryChangeLog(),
+		tokens:      NewMemoryTokenStore(),
+		revocations: NewMemoryRevocationList(),
+		attempts:    NewMemoryLoginAttempts(),
+		personal:    NewMemoryPersonalTokens(),
+	}
+}
+
+// apply updates the state and the change feed. Records whose preconditions
+// fail change nothing and return an error: an update or delete with Expect
+// set returns errStaleWrite unless the stored todo still equals Expect, a
+// user update likewise against ExpectUser and a login attempts update
+// against ExpectAttempts, using a refresh token fails unless it exists and
+// is unused, and deleting a user or a personal access token fails unless it
+// exists. Registering the same user twice and creating the same todo
+// twice are no-ops, so a client retrying a write that already landed is
+// harmless.
+func (m *memoryState) apply(rec walRecord) error {
+	switch rec.Op {
+	case opRegister:
+		if existing, err := m.users.Get(rec.User.Username); err == nil {
+			if existing == *rec.User {
+				return nil
+			}
+			return ErrUserExists
+		}
+		m.users.Create(*rec.User)
+		m.recordChange(rec, Change{Op: ChangeRegister, Username: rec.Username})
+	case opUserUpdate:
+		_, err := m.users.Update(rec.Username, func(u *User) error {
+			if rec.ExpectUser != nil && *u != *rec.ExpectUser {
+				return errStaleWrite
+			}
+			*u = *rec.User
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case opUserDelete:
+		if err := m.users.Delete(rec.Username); err != nil {
+			return err
+		}
+		m.changes.purge(rec.Username)
+		m.revisions.purge(rec.Username)
+	case opCreate:
+		if _, err := m.todos.Get(rec.Username, rec.Todo.ID); err == nil {
+			return nil
+		}
+		m.todos.Create(rec.Username, *rec.Todo)
+		m.recordChange(rec, todoChange(ChangeCreate, rec.Username, *rec.Todo))
+	case opUpdate:
+		_, err := m.todos.Update(rec.Username, rec.Todo.ID, func(t *Todo) error {
+			if rec.Expect != nil && !sameTodo(*t, *rec.Expect) {
+				return errStaleWrite
+			}
+			*t = *rec.Todo
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if rec.Revision != nil {
+			m.revisions.Append(rec.Username, *rec.Revision)
+		}
+		m.recordChange(rec, todoChange(ChangeUpdate, rec.Username, *rec.Todo))
+	case opDelete:
+		_, err := m.todos.Delete(rec.Username, rec.TodoID, func(t Todo) error {
+			if rec.Expect != nil && !sameTodo(t, *rec.Expect) {
+				return errStaleWrite
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		m.recordChange(rec, todoTombstone(rec.Username, rec.TodoID))
+	case opRevision:
+		m.revisions.Append(rec.Username, *rec.Revision)
+	case opTokenCreate:
+		m.tokens.Create(*rec.Token)
+	case opTokenUse:
+		if _, err := m.tokens.Use(rec.Token.Hash, *rec.Token.UsedAt); err != nil {
+			return err
+		}
+	case opTokenRevoke:
+		m.tokens.RevokeFamily(rec.Token.Family)
+	case opTokenPrune:
+		m.tokens.Prune(rec.Token.ExpiresAt)
+	case opRevoke:
+		m.revocations.Revoke(*rec.Revocation)
+	case opRevokePrune:
+		m.revocations.Prune(rec.Revocation.ExpiresAt)
+	case opAttempts:
+		_, err := m.attempts.Update(rec.Attempts.Key, func(a *LoginAttempts) error {
+			if rec.ExpectAttempts != nil && !sameAttempts(*a, *rec.ExpectAttempts) {
+				return errStaleWrite
+			}
+			*a = *rec.Attempts
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case opAttemptsDelete:
+		m.attempts.Delete(rec.Attempts.Key)
+	case opAttemptsPrune:
+		m.attempts.Prune(rec.Attempts.ExpiresAt)
+	case opPersonalTokenCreate:
+		m.personal.Create(*rec.PersonalToken)
+	case opPersonalTokenTouch:
+		m.personal.Touch(rec.PersonalToken.Hash, *rec.PersonalToken.LastUsedAt)
+	case opPersonalTokenDelete:
+		if err := m.personal.Delete(rec.Username, rec.PersonalToken.ID); err != nil {
+			return err
+		}
+	case opPersonalTokenPrune:
+		m.personal.Prune(*rec.PersonalToken.ExpiresAt)
+	case opChangesPrune:
+		m.changes.Prune(rec.Change.At)
+	}
+	return nil
+}
+
+// recordChange stamps c with rec's sequence number and time and adds it to
+// the change feed.
+func (m *memoryState) recordChange(rec walRecord, c Change) {
+	c.Seq, c.At = rec.Seq, rec.At
+	m.changes.record(c)
+}
+
+// export captures the whole state as a snapshot taken at seq.
+func (m *memoryState) export(seq uint64) fileSnapshot {
+	floor, _ := m.changes.Floor()
+	return fileSnapshot{Seq: seq, Dataset: m.dataset(), Changes: m.changes.all(), ChangesFloor: floor, Tokens: m.tokens.list(), Revocations: m.revocations.list(), LoginAttempts: m.attempts.list(), PersonalTokens: m.personal.list()}
+}
+
+// dataset copies the users, todos and revisions. Callers must keep writers
+// out while it runs for the copy to be consistent.
+func (m *memoryState) dataset() Dataset {
+	d := newDataset()
+	d.Users, _ = m.users.List()
+	m.todos.forEach(func(username string, todos []Todo) {
+		if len(todos) > 0 {
+			d.Todos[username] = todos
+		}
+	})
+	m.revisions.forEach(func(username string, revs []Revision) {
+		d.Revisions[username] = revs
+	})
+	return d
+}
+
+// restore loads snap into an empty state.
+func (m *memoryState) restore(snap fileSnapshot) {
+	for _, u := range snap.Users {
+		m.users.Create(u)
+	}
+	for username, todos := range snap.Todos {
+		for _, t := range todos {
+			m.todos.Create(username, t)
+		}
+	}
+	for username, revs := range snap.Revisions {
+		for _, rev := range revs {
+			m.revisions.Append(username, rev)
+		}
+	}
+	for _, c := range snap.Changes {
+		m.changes.record(c)
+	}
+	m.changes.floor = snap.ChangesFloor
+	for _, token := range snap.Tokens {
+		m.tokens.Create(token)
+	}
+	for _, r := range snap.Revocations {
+		m.revocations.Revoke(r)
+	}
+	for _, a := range snap.LoginAttempts {
+		m.attempts.Update(a.Key, func(stored *LoginAttempts) error { *stored = a; return nil })
+	}
+	for _, token := range snap.PersonalTokens {
+		m.personal.Create(token)
+	}
+}
+
+// sameTodo reports whether a and b are the same version of a todo.
+func sameTodo(a, b Todo) bool {
+	if (a.DeletedAt == nil) != (b.DeletedAt == nil) {
+		return false
+	}
+	if a.DeletedAt != nil && !a.DeletedAt.Equal(*b.DeletedAt) {
+		return false
+	}
+	return a.ID == b.ID && a.Title == b.Title && a.Completed == b.Completed &&
+		a.CreatedAt.Equal(b.CreatedAt) && a.Version == b.Version
+}
+
+// sameAttempts reports whether a and b are the same version of a record.
+// Times are compared as instants, since a record read back from JSON loses
+// its monotonic clock reading.
+func sameAttempts(a, b LoginAttempts) bool {
+	return a.Key == b.Key && a.Failures == b.Failures && a.LastFailure.Equal(b.LastFailure) &&
+		a.LockedUntil.Equal(b.LockedUntil) && a.ExpiresAt.Equal(b.ExpiresAt)
+}
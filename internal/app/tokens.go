@@ -0,0 +1,242 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// refreshTokenBytes is the amount of randomness in a refresh token.
+const refreshTokenBytes = 32
+
+// newRefreshToken returns a random opaque refresh token.
+func newRefreshToken() string {
+	b := make([]byte, refreshTokenBytes)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken is the key a refresh token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// respondTokens signs an access token for user, stores a new refresh
+// token in family and sends both. The family is a fresh ID at login and
+// carries over on every refresh, where previous is the hash of the token
+// being exchanged. It doubles as the session ID, the access token's sid
+// claim, so revoking a session reaches every access token it issued. The
+// access token's scope claim holds every scope the user has.
+func (a *App) respondTokens(c *gin.Context, user User, family, previous string, now time.Time) {
+	username := user.Username
+	// JWT times are whole seconds; round up so no token lives shorter than
+	// the configured lifetime.
+	expiresAt := now.Add(a.Config.AccessTokenTTL + time.Second - 1).Truncate(time.Second)
+	accessString, err := a.Keys.Sign(jwt.MapClaims{
+		"iss":   a.Config.JWTIssuer,
+		"aud":   a.Config.JWTAudience,
+		"user":  username,
+		"jti":   GenerateID(),
+		"sid":   family,
+		"scope": strings.Join(a.scopesFor(user), " "),
+		"iat":   now.Unix(),
+		"exp":   expiresAt.Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+		return
+	}
+
+	refresh := newRefreshToken()
+	err = a.Tokens.Create(RefreshToken{
+		Hash:      hashToken(refresh),
+		Family:    family,
+		Username:  username,
+		ExpiresAt: now.Add(a.Config.RefreshTokenTTL),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	// A replay of the previous token may have revoked the family before
+	// the new token was stored. It took the previous token with it, so
+	// check that it is still there and otherwise revoke again.
+	if previous != "" {
+		if _, err := a.Tokens.Get(previous); errors.Is(err, ErrTokenNotFound) {
+			if err := a.revokeSession(username, family, now); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reused"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         accessString,
+		"expires_at":    expiresAt.Format(time.RFC3339),
+		"refresh_token": refresh,
+	})
+}
+
+// RefreshHandler exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once: presenting one that was
+// already exchanged means it leaked or the client is replaying it, so the
+// whole session is revoked and the user has to log in again.
+func (a *App) RefreshHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token required"})
+		return
+	}
+
+	now := a.now()
+	hash := hashToken(req.RefreshToken)
+	token, err := a.Tokens.Use(hash, now)
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	case errors.Is(err, ErrTokenReused):
+		if err := a.revokeSession(token.Username, token.Family, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reused"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	if now.After(token.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token expired"})
+		return
+	}
+
+	// Disabling or deleting an account revokes its sessions, but a refresh
+	// may have raced with that
+	user, err := a.Users.Get(token.Username)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	if accountBlocked(c, user) {
+		return
+	}
+	a.respondTokens(c, user, token.Family, hash, now)
+}
+
+// revokeSession rejects every access token issued in session sid and
+// deletes its refresh tokens. The revocation lasts as long as an access
+// token issued by the session's last refresh could be accepted.
+func (a *App) revokeSession(username, sid string, now time.Time) error {
+	err := a.Revocations.Revoke(Revocation{
+		ID:        sid,
+		Username:  username,
+		ExpiresAt: now.Add(a.Config.AccessTokenTTL + a.Config.JWTLeeway + time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	return a.Tokens.RevokeFamily(sid)
+}
+
+// revokeSessions revokes every session of username that still has a refresh
+// token, as when an admin disables the account or resets its password.
+func (a *App) revokeSessions(username string, now time.Time) error {
+	tokens, err := a.Tokens.List(username)
+	if err != nil {
+		return err
+	}
+	sessions := map[string]bool{}
+	for _, token := range tokens {
+		if !sessions[token.Family] {
+			sessions[token.Family] = true
+			if err := a.revokeSession(username, token.Family, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tokenRevoked reports whether the access token jti or its session sid has
+// been revoked.
+func (a *App) tokenRevoked(jti, sid string) (bool, error) {
+	for _, id := range []string{jti, sid} {
+		if id == "" {
+			continue
+		}
+		if revoked, err := a.Revocations.IsRevoked(id); err != nil || revoked {
+			return revoked, err
+		}
+	}
+	return false, nil
+}
+
+// LogoutHandler ends the caller's session: the presented access token and
+// every other one issued from the same login stop working, and the login's
+// refresh tokens are deleted.
+func (a *App) LogoutHandler(c *gin.Context) {
+	username, sid := c.GetString("username"), c.GetString("sid")
+	err := a.Revocations.Revoke(Revocation{ID: c.GetString("jti"), Username: username, ExpiresAt: c.GetTime("token_expires_at")})
+	if err == nil && sid != "" {
+		err = a.revokeSession(username, sid, a.now())
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// LogoutAllHandler revokes every session of the caller, this one included.
+func (a *App) LogoutAllHandler(c *gin.Context) {
+	username := c.GetString("username")
+	now := a.now()
+	tokens, err := a.Tokens.List(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+
+	sessions := map[string]bool{}
+	if sid := c.GetString("sid"); sid != "" {
+		sessions[sid] = true
+	}
+	for _, token := range tokens {
+		sessions[token.Family] = true
+	}
+	err = a.Revocations.Revoke(Revocation{ID: c.GetString("jti"), Username: username, ExpiresAt: c.GetTime("token_expires_at")})
+	for sid := range sessions {
+		if err != nil {
+			break
+		}
+		err = a.revokeSession(username, sid, now)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "All sessions revoked", "sessions": len(sessions)})
+}
@@ -0,0 +1,239 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	ExpiresAt    string `json:"expires_at"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func loginPair(t *testing.T, r *gin.Engine, username, password string) tokenPair {
+	t.Helper()
+	w := performRequest(r, "POST", "/login", Credentials{Username: username, Password: password}, "")
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	if w.Code != http.StatusOK || pair.RefreshToken == "" {
+		t.Fatalf("Login failed: %d body=%s", w.Code, w.Body.String())
+	}
+	return pair
+}
+
+func refresh(r *gin.Engine, refreshToken string) (tokenPair, *httptest.ResponseRecorder) {
+	w := performRequest(r, "POST", "/token/refresh", RefreshRequest{RefreshToken: refreshToken}, "")
+	var pair tokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	return pair, w
+}
+
+func TestRefreshRotatesAndDetectsReuse(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_refresh", ConcurrencyMode: SafeMode}))
+	registerAndLogin(t, r, "alice", "pass")
+	first := loginPair(t, r, "alice", "pass")
+
+	second, w := refresh(r, first.RefreshToken)
+	if w.Code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("Expected a rotated refresh token, got %d body=%s", w.Code, w.Body.String())
+	}
+	if w := performRequest(r, "GET", "/todos", nil, second.Token); w.Code != http.StatusOK {
+		t.Fatalf("Expected the refreshed access token accepted, got %d", w.Code)
+	}
+
+	// Replaying the exchanged token ends the whole login
+	if _, w := refresh(r, first.RefreshToken); w.Code != http.StatusUnauthorized || !bodyHasError(w, "Refresh token reused") {
+		t.Fatalf("Expected reuse detected, got %d body=%s", w.Code, w.Body.String())
+	}
+	if _, w := refresh(r, second.RefreshToken); w.Code != http.StatusUnauthorized || !bodyHasError(w, "Invalid refresh token") {
+		t.Fatalf("Expected the family revoked, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// Other logins are unaffected
+	other := loginPair(t, r, "alice", "pass")
+	if _, w := refresh(r, other.RefreshToken); w.Code != http.StatusOK {
+		t.Fatalf("Expected a separate login to keep working, got %d", w.Code)
+	}
+}
+
+func TestConcurrentRefreshRevokesFamily(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_refresh", ConcurrencyMode: SafeMode}))
+	registerAndLogin(t, r, "alice", "pass")
+	pair := loginPair(t, r, "alice", "pass")
+
+	const clients = 8
+	var wg sync.WaitGroup
+	issued := make([]tokenPair, clients)
+	codes := make([]int, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var w *httptest.ResponseRecorder
+			issued[i], w = refresh(r, pair.RefreshToken)
+			codes[i] = w.Code
+		}()
+	}
+	wg.Wait()
+
+	ok := 0
+	for i, code := range codes {
+		if code == http.StatusOK {
+			ok++
+			// The replays revoked the family, whichever order things ran in
+			if _, w := refresh(r, issued[i].RefreshToken); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected the winner's token revoked, got %d", w.Code)
+			}
+		}
+	}
+	if ok > 1 {
+		t.Fatalf("Expected at most one exchange to succeed, got %d", ok)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_refresh", ConcurrencyMode: SafeMode})
+	a.Config.RefreshTokenTTL = time.Millisecond
+	r := SetupRouter(a)
+	registerAndLogin(t, r, "alice", "pass")
+	pair := loginPair(t, r, "alice", "pass")
+	time.Sleep(5 * time.Millisecond)
+
+	if _, w := refresh(r, pair.RefreshToken); w.Code != http.StatusUnauthorized || !bodyHasError(w, "Refresh token expired") {
+		t.Fatalf("Expected an expired refresh token, got %d body=%s", w.Code, w.Body.String())
+	}
+	if n, err := a.Tokens.Prune(time.Now()); err != nil || n != 2 {
+		t.Fatalf("Expected both logins' tokens pruned, got %d (err=%v)", n, err)
+	}
+	if _, w := refresh(r, pair.RefreshToken); !bodyHasError(w, "Invalid refresh token") {
+		t.Fatalf("Expected the pruned token unknown, got %d body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestFileStoreKeepsRefreshTokensAcrossReopen(t *testing.T) {
+	for _, every := range []int{1000, 1} { // replayed from the log, then from snapshots
+		dir := t.TempDir()
+		fs, err := OpenFileStore(dir, FileOptions{SnapshotEvery: every})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens := fs.Tokens()
+		tokens.Create(RefreshToken{Hash: "a", Family: "f", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		tokens.Create(RefreshToken{Hash: "b", Family: "g", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		tokens.Use("a", time.Now())
+		tokens.RevokeFamily("g")
+		fs.Close()
+
+		fs, err = OpenFileStore(dir, FileOptions{SnapshotEvery: every})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Tokens().Use("a", time.Now()); err != ErrTokenReused {
+			t.Fatalf("Expected token a still used after reopen, got %v", err)
+		}
+		if _, err := fs.Tokens().Get("b"); err != ErrTokenNotFound {
+			t.Fatalf("Expected token b still revoked after reopen, got %v", err)
+		}
+		fs.Close()
+	}
+}
+
+func bodyHasError(w *httptest.ResponseRecorder, message string) bool {
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body["error"] == message
+}
+
+func TestLogoutRevokesOnlyThatSession(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_logout", ConcurrencyMode: SafeMode}))
+	registerAndLogin(t, r, "alice", "pass")
+	phone := loginPair(t, r, "alice", "pass")
+	laptop := loginPair(t, r, "alice", "pass")
+	rotated, _ := refresh(r, phone.RefreshToken)
+
+	if w := performRequest(r, "POST", "/logout", nil, rotated.Token); w.Code != http.StatusOK {
+		t.Fatalf("Logout failed: %d body=%s", w.Code, w.Body.String())
+	}
+	// Both access tokens of the session are dead, not just the one presented
+	for _, token := range []string{phone.Token, rotated.Token} {
+		if w := performRequest(r, "GET", "/todos", nil, token); w.Code != http.StatusUnauthorized || !bodyHasError(w, "Token revoked") {
+			t.Fatalf("Expected a revoked token, got %d body=%s", w.Code, w.Body.String())
+		}
+	}
+	if _, w := refresh(r, rotated.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the session's refresh token gone, got %d", w.Code)
+	}
+	if w := performRequest(r, "GET", "/todos", nil, laptop.Token); w.Code != http.StatusOK {
+		t.Fatalf("Expected the other session to keep working, got %d", w.Code)
+	}
+}
+
+func TestLogoutAllRevokesEverySession(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_logout", ConcurrencyMode: SafeMode}))
+	registerAndLogin(t, r, "alice", "pass")
+	bob := registerAndLogin(t, r, "bob", "pass")
+	sessions := []tokenPair{loginPair(t, r, "alice", "pass"), loginPair(t, r, "alice", "pass"), loginPair(t, r, "alice", "pass")}
+
+	if w := performRequest(r, "POST", "/logout/all", nil, sessions[0].Token); w.Code != http.StatusOK {
+		t.Fatalf("Logout all failed: %d body=%s", w.Code, w.Body.String())
+	}
+	for _, session := range sessions {
+		if w := performRequest(r, "GET", "/todos", nil, session.Token); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected every session revoked, got %d", w.Code)
+		}
+		if _, w := refresh(r, session.RefreshToken); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected every refresh token gone, got %d", w.Code)
+		}
+	}
+	if w := performRequest(r, "GET", "/todos", nil, bob); w.Code != http.StatusOK {
+		t.Fatalf("Expected other users unaffected, got %d", w.Code)
+	}
+	fresh := loginPair(t, r, "alice", "pass")
+	if w := performRequest(r, "GET", "/todos", nil, fresh.Token); w.Code != http.StatusOK {
+		t.Fatalf("Expected a new login to work, got %d", w.Code)
+	}
+}
+
+func TestRevocationsSurviveRestart(t *testing.T) {
+	for _, storage := range []string{StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{
+				JWTSecret:       "testsecret_logout",
+				ConcurrencyMode: SafeMode,
+				Storage:         storage,
+				DataDir:         dir,
+				SQLitePath:      filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:  true,
+			}
+			a, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := SetupRouter(a)
+			token := registerAndLogin(t, r, "alice", "pass")
+			performRequest(r, "POST", "/logout", nil, token)
+			a.Close()
+
+			if a, err = Open(cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if w := performRequest(SetupRouter(a), "GET", "/todos", nil, token); w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected the token still revoked after a restart, got %d", w.Code)
+			}
+			// Revocations are dropped once the token could no longer be used anyway
+			if n, err := a.Revocations.Prune(time.Now().Add(DefaultAccessTokenTTL + time.Minute)); err != nil || n != 2 {
+				t.Fatalf("Expected the token and session revocations pruned, got %d (err=%v)", n, err)
+			}
+		})
+	}
+}
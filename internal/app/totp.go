@@ -0,0 +1,317 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TOTP parameters (RFC 6238): six-digit HMAC-SHA1 codes over 30 second
+// steps, the defaults every authenticator app supports.
+const (
+	totpDigits      = 6
+	totpModulus     = 1_000_000 // 10^totpDigits
+	totpPeriod      = 30        // seconds
+	totpSecretBytes = 20
+	// totpSkew is how many steps a code may be off either way, for clocks
+	// that drift and users who type slowly.
+	totpSkew = 1
+)
+
+// recoveryCodeCount is how many recovery codes enrolling hands out.
+const recoveryCodeCount = 10
+
+// Defaults of the two-factor settings: the service name authenticator apps
+// show, and how long a login has to complete its second factor.
+const (
+	DefaultTwoFactorIssuer       = "todoapp"
+	DefaultTwoFactorChallengeTTL = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Errors of the second factor, mapped to responses by the handlers.
+var (
+	errInvalidCode      = errors.New("invalid two-factor code")
+	errNoPendingTOTP    = errors.New("no two-factor setup in progress")
+	errTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+)
+
+// NewTOTPSecret returns a random secret in the unpadded base32 form
+// authenticator apps read.
+func NewTOTPSecret() string {
+	b := make([]byte, totpSecretBytes)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// TOTPCode returns the code for secret at t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	return totpCodeAt(key, totpStep(t)), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCodeAt is the HOTP value (RFC 4226) of key for counter step.
+func totpCodeAt(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// verifyTOTP checks code against secret at now and returns the step it
+// matched. Steps up to lastStep were used already and never match again.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCodeAt(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps enroll from, usually
+// shown as a QR code.
+func totpURI(issuer, username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns fresh recovery codes, formatted xxxxx-xxxxx, and
+// their hashes as stored in User.RecoveryCodes.
+func newRecoveryCodes() ([]string, string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		rand.Read(b)
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, strings.Join(hashes, " ")
+}
+
+// useRecoveryCode looks code up in hashes and returns the hashes left
+// without it. Case, spaces and dashes in code are ignored.
+func useRecoveryCode(hashes, code string) (string, bool) {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	want := hashToken(code)
+	remaining := strings.Fields(hashes)
+	for i, h := range remaining {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(want)) == 1 {
+			return strings.Join(append(remaining[:i], remaining[i+1:]...), " "), true
+		}
+	}
+	return hashes, false
+}
+
+// challengeAudience is the aud of challenge tokens. It differs from the
+// access token audience, so a challenge never passes AuthMiddleware.
+func (a *App) challengeAudience() string {
+	return a.Config.JWTAudience + "/login/2fa"
+}
+
+// respondChallenge answers a correct password of a user with two-factor
+// authentication on: instead of tokens, the client gets a challenge token
+// to exchange at /login/2fa together with a code.
+func (a *App) respondChallenge(c *gin.Context, username string, now time.Time) {
+	expiresAt := now.Add(a.Config.TwoFactorChallengeTTL + time.Second - 1).Truncate(time.Second)
+	challenge, err := a.Keys.Sign(jwt.MapClaims{
+		"iss": a.Config.JWTIssuer,
+		"aud": a.challengeAudience(),
+		"sub": username,
+		"jti": GenerateID(),
+		"iat": now.Unix(),
+		"exp": expiresAt.Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"challenge_token": challenge,
+		"expires_at":      expiresAt.Format(time.RFC3339),
+	})
+}
+
+// verifyChallenge returns the username a challenge token was issued to.
+func (a *App) verifyChallenge(challenge string) (string, error) {
+	parser := jwt.NewParser(
+		jwt.WithLeeway(a.Config.JWTLeeway),
+		jwt.WithTimeFunc(a.Clock),
+		jwt.WithIssuer(a.Config.JWTIssuer),
+		jwt.WithAudience(a.challengeAudience()),
+		jwt.WithExpirationRequired(),
+	)
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(challenge, claims, a.accessTokenKey); err != nil {
+		return "", err
+	}
+	username, err := claims.GetSubject()
+	if err != nil || username == "" {
+		return "", errors.New("challenge without a subject")
+	}
+	return username, nil
+}
+
+// TwoFactorSetupHandler starts enrolling an authenticator: it stores a new
+// pending secret and returns it with its otpauth URI. Starting over
+// replaces a pending secret but never an enabled one.
+func (a *App) TwoFactorSetupHandler(c *gin.Context) {
+	username := c.GetString("username")
+	secret := NewTOTPSecret()
+	_, err := a.Users.Update(username, func(u *User) error {
+		if u.TOTPSecret != "" {
+			return errTwoFactorEnabled
+		}
+		u.TOTPPending = secret
+		return nil
+	})
+	switch {
+	case errors.Is(err, errTwoFactorEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication already enabled"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totpURI(a.Config.TwoFactorIssuer, username, secret),
+	})
+}
+
+// TwoFactorVerifyHandler confirms the pending secret with a code from the
+// authenticator, which turns two-factor login on, and hands out the
+// recovery codes. They are shown this once; only their hashes are kept.
+func (a *App) TwoFactorVerifyHandler(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code required"})
+		return
+	}
+	now := a.now()
+	codes, hashes := newRecoveryCodes()
+	_, err := a.Users.Update(c.GetString("username"), func(u *User) error {
+		if u.TOTPPending == "" {
+			return errNoPendingTOTP
+		}
+		step, ok := verifyTOTP(u.TOTPPending, req.Code, now, 0)
+		if !ok {
+			return errInvalidCode
+		}
+		u.TOTPSecret, u.TOTPPending, u.TOTPLastStep = u.TOTPPending, "", step
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	switch {
+	case errors.Is(err, errNoPendingTOTP):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup not started"})
+		return
+	case errors.Is(err, errInvalidCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// LoginTwoFactorHandler completes a login: it exchanges a challenge token
+// and a TOTP or recovery code for an access and a refresh token. Wrong
+// codes count as failed logins, so the lockout limits guessing.
+func (a *App) LoginTwoFactorHandler(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.ChallengeToken == "" || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge token and code required"})
+		return
+	}
+	username, err := a.verifyChallenge(req.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	now := a.now()
+	attempt, lock, err := a.reserveLogin(username, c.ClientIP(), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	if lock != nil {
+		lock.respond(c, now)
+		return
+	}
+	defer attempt.release()
+
+	user, err := a.Users.Update(username, func(u *User) error {
+		if u.TOTPSecret == "" {
+			return errInvalidCode
+		}
+		if step, ok := verifyTOTP(u.TOTPSecret, req.Code, now, u.TOTPLastStep); ok {
+			u.TOTPLastStep = step
+			return nil
+		}
+		if remaining, ok := useRecoveryCode(u.RecoveryCodes, req.Code); ok {
+			u.RecoveryCodes = remaining
+			return nil
+		}
+		return errInvalidCode
+	})
+	switch {
+	case errors.Is(err, errInvalidCode), errors.Is(err, ErrUserNotFound):
+		attempt.fail()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+
+	attempt.succeed()
+	// The account may have been disabled since the challenge was issued
+	if accountBlocked(c, user) {
+		return
+	}
+	a.respondTokens(c, user, GenerateID(), "", now)
+}
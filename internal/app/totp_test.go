@@ -0,0 +1,149 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTOTPCodes(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		if got, err := TOTPCode(secret, time.Unix(unix, 0)); err != nil || got != want {
+			t.Errorf("T=%d: expected %s, got %s (err=%v)", unix, want, got, err)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(secret, now)
+	step := totpStep(now)
+	for name, tc := range map[string]struct {
+		at       time.Time
+		code     string
+		lastStep int64
+		ok       bool
+	}{
+		"current step":   {now, code, 0, true},
+		"one step late":  {now.Add(totpPeriod * time.Second), code, 0, true},
+		"two steps late": {now.Add(2 * totpPeriod * time.Second), code, 0, false},
+		"already used":   {now, code, step, false},
+		"wrong code":     {now, "000000", 0, false},
+		"short code":     {now, code[:5], 0, false},
+	} {
+		if got, ok := verifyTOTP(secret, tc.code, tc.at, tc.lastStep); ok != tc.ok || (ok && got != step) {
+			t.Errorf("%s: expected %v, got %v at step %d", name, tc.ok, ok, got)
+		}
+	}
+
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodeCount || len(strings.Fields(hashes)) != recoveryCodeCount || strings.Contains(hashes, codes[0]) {
+		t.Fatalf("Expected %d codes stored as hashes, got %v", recoveryCodeCount, codes)
+	}
+	remaining, ok := useRecoveryCode(hashes, " "+strings.ToUpper(codes[3])+" ")
+	if !ok || len(strings.Fields(remaining)) != recoveryCodeCount-1 {
+		t.Fatal("Expected a recovery code accepted whatever its case and spacing")
+	}
+	if _, ok := useRecoveryCode(remaining, codes[3]); ok {
+		t.Fatal("Expected a recovery code to work once")
+	}
+}
+
+// testClock is a settable App.Clock.
+type testClock struct{ t time.Time }
+
+func (c *testClock) Now() time.Time          { return c.t }
+func (c *testClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func postJSON(t *testing.T, r *gin.Engine, path string, body any, token string, wantCode int) map[string]any {
+	t.Helper()
+	w := performRequest(r, "POST", path, body, token)
+	if w.Code != wantCode {
+		t.Fatalf("POST %s: expected %d got %d body=%s", path, wantCode, w.Code, w.Body.String())
+	}
+	var resp map[string]any
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	clock := &testClock{time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+	a := newTestApp(t, Config{JWTSecret: "testsecret_2fa", ConcurrencyMode: SafeMode, LoginMaxFailures: 3, LoginLockout: time.Hour})
+	a.Clock = clock.Now
+	r := SetupRouter(a)
+	token := registerAndLogin(t, r, "alice", "pass")
+
+	postJSON(t, r, "/me/2fa/verify", TwoFactorCodeRequest{Code: "123456"}, token, http.StatusBadRequest)
+	setup := postJSON(t, r, "/me/2fa/setup", nil, token, http.StatusOK)
+	secret := setup["secret"].(string)
+	if uri := setup["otpauth_uri"].(string); uri != "otpauth://totp/todoapp:alice?algorithm=SHA1&digits=6&issuer=todoapp&period=30&secret="+secret {
+		t.Fatalf("Unexpected otpauth URI %s", uri)
+	}
+	// Until the code is confirmed, logins still take the password alone
+	login(t, r, "alice", "pass")
+
+	code := func() string {
+		code, err := TOTPCode(secret, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	postJSON(t, r, "/me/2fa/verify", TwoFactorCodeRequest{Code: "000000"}, token, http.StatusBadRequest)
+	verified := postJSON(t, r, "/me/2fa/verify", TwoFactorCodeRequest{Code: code()}, token, http.StatusOK)
+	recovery := verified["recovery_codes"].([]any)
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %v", recoveryCodeCount, recovery)
+	}
+	postJSON(t, r, "/me/2fa/setup", nil, token, http.StatusConflict)
+
+	challenge := func() string {
+		resp := postJSON(t, r, "/login", Credentials{Username: "alice", Password: "pass"}, "", http.StatusOK)
+		if resp["token"] != nil || resp["challenge_token"] == nil {
+			t.Fatalf("Expected a challenge instead of tokens, got %v", resp)
+		}
+		return resp["challenge_token"].(string)
+	}
+	ch := challenge()
+	if code, claim := rejectionCode(t, performRequest(r, "GET", "/todos", nil, ch)); code != CodeMissingClaim || claim != "user" {
+		t.Fatalf("Expected a challenge refused as an access token, got %s %q", code, claim)
+	}
+
+	// The code that confirmed the authenticator is spent
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: ch, Code: code()}, "", http.StatusUnauthorized)
+	clock.Advance(totpPeriod * time.Second)
+	next := code()
+	tokens := postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: ch, Code: next}, "", http.StatusOK)
+	if w := performRequest(r, "GET", "/todos", nil, tokens["token"].(string)); w.Code != http.StatusOK {
+		t.Fatalf("Expected the second factor to log in, got %d", w.Code)
+	}
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: challenge(), Code: next}, "", http.StatusUnauthorized)
+
+	rc := recovery[0].(string)
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: challenge(), Code: rc}, "", http.StatusOK)
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: challenge(), Code: rc}, "", http.StatusUnauthorized)
+
+	// Challenges expire, and wrong codes count towards the lockout
+	ch = challenge()
+	clock.Advance(DefaultTwoFactorChallengeTTL + time.Minute)
+	if resp := postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: ch, Code: code()}, "", http.StatusUnauthorized); resp["error"] != "Invalid challenge" {
+		t.Fatalf("Expected an expired challenge refused, got %v", resp)
+	}
+	ch = challenge()
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: ch, Code: "999999"}, "", http.StatusUnauthorized)
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: ch, Code: "999998"}, "", http.StatusUnauthorized)
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: ch, Code: code()}, "", http.StatusTooManyRequests)
+	clock.Advance(2 * time.Hour)
+	postJSON(t, r, "/login/2fa", TwoFactorLoginRequest{ChallengeToken: challenge(), Code: code()}, "", http.StatusOK)
+}
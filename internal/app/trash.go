@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// errNotExpired makes the purger's delete check skip todos that are not yet
+// due.
+var errNotExpired = errors.New("trash retention not expired")
+
+// PurgeTrash permanently removes every todo that has been in the trash for at
+// least Config.TrashRetention as of now, and returns how many it removed.
+func (a *App) PurgeTrash(now time.Time) (int, error) {
+	users, err := a.Users.List()
+	if err != nil {
+		return 0, err
+	}
+
+	scan := a.Todos
+	if cache, ok := a.Todos.(*CachedTodoStore); ok {
+		scan = cache.Backing()
+	}
+	purged := 0
+	for _, user := range users {
+		todos, err := scan.List(user.Username)
+		if err != nil {
+			return purged, err
+		}
+		for _, t := range todos {
+			if !t.Trashed() {
+				continue
+			}
+			// Re-check under the store's lock: the todo may have been
+			// restored since it was listed.
+			_, err := a.Todos.Delete(user.Username, t.ID, func(current Todo) error {
+				if !current.Trashed() || now.Sub(*current.DeletedAt) < a.Config.TrashRetention {
+					return errNotExpired
+				}
+				return nil
+			})
+			switch {
+			case err == nil:
+				purged++
+			case errors.Is(err, errNotExpired), errors.Is(err, ErrTodoNotFound):
+			default:
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+// RunPurger calls PurgeTrash and prunes expired refresh tokens,
+// revocations, failed login counters and, with a ChangeRetention, old
+// changes every interval until ctx is cancelled.
+func (a *App) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := a.PurgeTrash(now)
+			if err != nil {
+				log.Printf("trash purger: %v", err)
+			}
+			if n > 0 {
+				log.Printf("trash purger: removed %d todos", n)
+			}
+			if _, err := a.Tokens.Prune(now); err != nil {
+				log.Printf("token pruner: %v", err)
+			}
+			if _, err := a.Revocations.Prune(now); err != nil {
+				log.Printf("revocation pruner: %v", err)
+			}
+			if _, err := a.Attempts.Prune(now); err != nil {
+				log.Printf("login attempts pruner: %v", err)
+			}
+			if _, err := a.PersonalTokens.Prune(now); err != nil {
+				log.Printf("personal token pruner: %v", err)
+			}
+			if a.Config.ChangeRetention > 0 {
+				if _, err := a.Changes.Prune(now.Add(-a.Config.ChangeRetention)); err != nil {
+					log.Printf("change feed pruner: %v", err)
+				}
+			}
+		}
+	}
+}
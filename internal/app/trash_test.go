@@ -0,0 +1,99 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTrashRestoreAndPermanentDelete(t *testing.T) {
+	r := SetupRouter(newTestApp(t, Config{JWTSecret: "testsecret_trash", ConcurrencyMode: SafeMode}))
+	token := registerAndLogin(t, r, "alice", "pass")
+
+	var first, second Todo
+	w := performRequest(r, "POST", "/todos", map[string]string{"title": "first"}, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &first)
+	w = performRequest(r, "POST", "/todos", map[string]string{"title": "second"}, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &second)
+
+	if w := performRequest(r, "DELETE", "/todos/"+first.ID, nil, token); w.Code != http.StatusOK {
+		t.Fatalf("Delete failed: %d", w.Code)
+	}
+
+	var todos []Todo
+	w = performRequest(r, "GET", "/todos", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &todos)
+	if len(todos) != 1 || todos[0].ID != second.ID {
+		t.Fatalf("Expected the trashed todo to be hidden from the list, got %+v", todos)
+	}
+	if w := performRequest(r, "GET", "/todos/"+first.ID, nil, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a trashed todo got %d", w.Code)
+	}
+	title := "edited"
+	if w := performRequest(r, "PUT", "/todos/"+first.ID, UpdateTodoRequest{Title: &title}, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 when editing a trashed todo got %d", w.Code)
+	}
+
+	var trash []Todo
+	w = performRequest(r, "GET", "/trash", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &trash)
+	if len(trash) != 1 || trash[0].ID != first.ID || trash[0].DeletedAt == nil {
+		t.Fatalf("Expected the deleted todo in the trash, got %s", w.Body.String())
+	}
+
+	w = performRequest(r, "POST", "/trash/"+first.ID+"/restore", nil, token)
+	var restored Todo
+	_ = json.Unmarshal(w.Body.Bytes(), &restored)
+	if w.Code != http.StatusOK || restored.DeletedAt != nil || restored.Version != 3 {
+		t.Fatalf("Restore failed: %d %s", w.Code, w.Body.String())
+	}
+	w = performRequest(r, "GET", "/todos", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &todos)
+	if len(todos) != 2 || todos[0].ID != first.ID {
+		t.Fatalf("Expected the restored todo back in its place, got %+v", todos)
+	}
+	if w := performRequest(r, "POST", "/trash/"+first.ID+"/restore", nil, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 restoring a todo that is not in the trash got %d", w.Code)
+	}
+
+	// Only trashed todos can be deleted permanently.
+	if w := performRequest(r, "DELETE", "/trash/"+second.ID, nil, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 purging a live todo got %d", w.Code)
+	}
+	performRequest(r, "DELETE", "/todos/"+second.ID, nil, token)
+	if w := performRequest(r, "DELETE", "/trash/"+second.ID, nil, token); w.Code != http.StatusOK {
+		t.Fatalf("Permanent delete failed: %d", w.Code)
+	}
+	if w := performRequest(r, "POST", "/trash/"+second.ID+"/restore", nil, token); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected a permanently deleted todo to be gone, got %d", w.Code)
+	}
+}
+
+func TestPurgeTrashRemovesExpiredTodos(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_purge", ConcurrencyMode: SafeMode, TrashRetention: time.Hour})
+	r := SetupRouter(a)
+	token := registerAndLogin(t, r, "alice", "pass")
+
+	ids := make([]string, 3)
+	for i := range ids {
+		var todo Todo
+		w := performRequest(r, "POST", "/todos", map[string]string{"title": "todo"}, token)
+		_ = json.Unmarshal(w.Body.Bytes(), &todo)
+		ids[i] = todo.ID
+	}
+	performRequest(r, "DELETE", "/todos/"+ids[0], nil, token)
+	performRequest(r, "DELETE", "/todos/"+ids[1], nil, token)
+
+	if n, err := a.PurgeTrash(time.Now()); err != nil || n != 0 {
+		t.Fatalf("Expected nothing purged before the retention period, got %d (err=%v)", n, err)
+	}
+	if n, err := a.PurgeTrash(time.Now().Add(2 * time.Hour)); err != nil || n != 2 {
+		t.Fatalf("Expected 2 todos purged, got %d (err=%v)", n, err)
+	}
+
+	todos, _ := a.Todos.List("alice")
+	if len(todos) != 1 || todos[0].ID != ids[2] {
+		t.Fatalf("Expected only the live todo to remain, got %+v", todos)
+	}
+}
@@ -0,0 +1,356 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// temporaryPasswordBytes is the amount of randomness in the password an
+// admin reset gives an account.
+const temporaryPasswordBytes = 18
+
+// newTemporaryPassword returns a random password for an admin reset.
+func newTemporaryPassword() string {
+	b := make([]byte, temporaryPasswordBytes)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// userView is how the admin API shows a user: never their password hash or
+// two-factor secrets.
+func userView(u User) gin.H {
+	role := u.Role
+	if role == "" {
+		role = RoleUser
+	}
+	return gin.H{
+		"username":                u.Username,
+		"role":                    role,
+		"disabled":                u.Disabled,
+		"two_factor":              u.TOTPSecret != "",
+		"password_reset_required": u.PasswordResetRequired,
+	}
+}
+
+// BootstrapAdmin makes sure of the admin account named in
+// Config.BootstrapAdminUsername, so a fresh deployment has someone who
+// can manage the others. An existing account keeps its password but is
+// made an admin and enabled again, which also recovers from an admin
+// locking everyone out. Only serve calls it: restore needs an empty store
+// and fsck must not write to the one it checks.
+func (a *App) BootstrapAdmin() error {
+	username := a.Config.BootstrapAdminUsername
+	if username == "" {
+		return nil
+	}
+	_, err := a.Users.Get(username)
+	if errors.Is(err, ErrUserNotFound) {
+		err = a.createBootstrapAdmin(username)
+		if err == nil || !errors.Is(err, ErrUserExists) {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	_, err = a.Users.Update(username, func(u *User) error {
+		u.Role, u.Disabled = RoleAdmin, false
+		return nil
+	})
+	return err
+}
+
+func (a *App) createBootstrapAdmin(username string) error {
+	password := a.Config.BootstrapAdminPassword
+	if password == "" {
+		return fmt.Errorf("bootstrap admin %s does not exist and no password is set", username)
+	}
+	if err := checkPassword(a.Config, password); err != nil {
+		return fmt.Errorf("bootstrap admin password: %w", err)
+	}
+	hashed, err := a.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := a.Users.Create(User{Username: username, PasswordHash: hashed, Role: RoleAdmin}); err != nil {
+		return err
+	}
+	log.Printf("created bootstrap admin %s", username)
+	return nil
+}
+
+// respondUserError answers for a failed lookup or update of the user an
+// admin endpoint addresses.
+func respondUserError(c *gin.Context, err error) {
+	if errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+}
+
+// notOwnAccount refuses an admin action on the caller's own account, which
+// would lock them out of the admin API, and reports whether it may go on.
+func notOwnAccount(c *gin.Context, action string) bool {
+	if c.Param("username") == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot " + action + " your own account"})
+		return false
+	}
+	return true
+}
+
+// ListUsersHandler lists every user, ordered by username.
+func (a *App) ListUsersHandler(c *gin.Context) {
+	users, err := a.Users.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	views := make([]gin.H, 0, len(users))
+	for _, u := range users {
+		views = append(views, userView(u))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// SetUserRoleHandler makes a user an admin or an ordinary user.
+func (a *App) SetUserRoleHandler(c *gin.Context) {
+	var req SetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Role != RoleUser && req.Role != RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role " + req.Role})
+		return
+	}
+	if !notOwnAccount(c, "change the role of") {
+		return
+	}
+	user, err := a.Users.Update(c.Param("username"), func(u *User) error {
+		u.Role = req.Role
+		return nil
+	})
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, userView(user))
+}
+
+// DisableUserHandler disables an account. Its tokens stop working at once
+// and its sessions are revoked, so enabling it again needs a new login.
+func (a *App) DisableUserHandler(c *gin.Context) {
+	if !notOwnAccount(c, "disable") {
+		return
+	}
+	username := c.Param("username")
+	_, err := a.Users.Update(username, func(u *User) error {
+		u.Disabled = true
+		return nil
+	})
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if err := a.revokeSessions(username, a.now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account disabled"})
+}
+
+// EnableUserHandler enables a disabled account again.
+func (a *App) EnableUserHandler(c *gin.Context) {
+	_, err := a.Users.Update(c.Param("username"), func(u *User) error {
+		u.Disabled = false
+		return nil
+	})
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account enabled"})
+}
+
+// ResetUserPasswordHandler replaces a user's password with a temporary one,
+// sent in this response only. Until the user trades it for a password of
+// their own at POST /password/reset they cannot log in, and their tokens
+// are refused. Their sessions are revoked and failed logins forgotten.
+func (a *App) ResetUserPasswordHandler(c *gin.Context) {
+	if !notOwnAccount(c, "reset the password of") {
+		return
+	}
+	username := c.Param("username")
+	password := newTemporaryPassword()
+	hashed, err := a.Passwords.Hash(password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Encryption error"})
+		return
+	}
+	_, err = a.Users.Update(username, func(u *User) error {
+		u.PasswordHash, u.PasswordResetRequired = hashed, true
+		return nil
+	})
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if err := a.revokeSessions(username, a.now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	a.clearLoginFailures(username)
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset", "temporary_password": password})
+}
+
+// DeleteUserHandler deletes a user with their todos, revisions, change feed
+// entries, sessions and personal access tokens. The account is disabled
+// first, so it stays locked if the deletion is interrupted and can be
+// deleted again.
+func (a *App) DeleteUserHandler(c *gin.Context) {
+	if !notOwnAccount(c, "delete") {
+		return
+	}
+	username := c.Param("username")
+	_, err := a.Users.Update(username, func(u *User) error {
+		u.Disabled = true
+		return nil
+	})
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	todos, err := a.deleteUserData(username)
+	if err == nil {
+		err = a.Users.Delete(username)
+	}
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted", "todos": todos})
+}
+
+// deleteUserData removes everything username owns but the user record and
+// returns how many todos were deleted. Revisions and change feed entries go
+// with the user record.
+func (a *App) deleteUserData(username string) (int, error) {
+	if err := a.revokeSessions(username, a.now()); err != nil {
+		return 0, err
+	}
+	tokens, err := a.PersonalTokens.List(username)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tokens {
+		if err := a.PersonalTokens.Delete(username, t.ID); err != nil && !errors.Is(err, ErrPersonalTokenNotFound) {
+			return 0, err
+		}
+	}
+	todos, err := a.Todos.List(username)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, t := range todos {
+		_, err := a.Todos.Delete(username, t.ID, nil)
+		switch {
+		case err == nil:
+			deleted++
+		case !errors.Is(err, ErrTodoNotFound):
+			return deleted, err
+		}
+	}
+	if err := a.Attempts.Delete(accountKey(username)); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// PasswordResetHandler lets a user whose password an admin reset choose a
+// new one, signing in with the temporary password. Wrong passwords count
+// as failed logins. The user then logs in as usual, second factor
+// included.
+func (a *App) PasswordResetHandler(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Username == "" || req.Password == "" || req.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username, password and new password required"})
+		return
+	}
+
+	now := a.now()
+	attempt, lock, err := a.reserveLogin(req.Username, c.ClientIP(), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	if lock != nil {
+		lock.respond(c, now)
+		return
+	}
+	defer attempt.release()
+
+	user, err := a.Users.Get(req.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	valid, err := a.checkPassword(user, err == nil, req.Password)
+	if err != nil {
+		log.Printf("password reset %s: %v", user.Username, err)
+	}
+	if !valid {
+		attempt.fail()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if user.Disabled {
+		accountBlocked(c, user)
+		return
+	}
+	if !user.PasswordResetRequired {
+		c.JSON(http.StatusConflict, gin.H{"error": "No password reset pending"})
+		return
+	}
+	if req.NewPassword == req.Password {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New password must differ from the temporary one"})
+		return
+	}
+	if a.rejectWeakPassword(c, req.NewPassword) {
+		return
+	}
+
+	hashed, err := a.Passwords.Hash(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Encryption error"})
+		return
+	}
+	_, err = a.Users.Update(user.Username, func(u *User) error {
+		// Another reset, or a concurrent one, got there first
+		if u.PasswordHash != user.PasswordHash {
+			return errPasswordChanged
+		}
+		u.PasswordHash, u.PasswordResetRequired = hashed, false
+		return nil
+	})
+	switch {
+	case errors.Is(err, errPasswordChanged):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage error"})
+		return
+	}
+	attempt.succeed()
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
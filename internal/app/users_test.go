@@ -0,0 +1,240 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	a := newTestApp(t, Config{
+		JWTSecret:              "testsecret_users",
+		ConcurrencyMode:        SafeMode,
+		BootstrapAdminUsername: "root",
+		BootstrapAdminPassword: "rootpass",
+	})
+	r := SetupRouter(a)
+	root := login(t, r, "root", "rootpass")
+	if w := performRequest(r, "GET", "/admin/users", nil, root); w.Code != http.StatusOK {
+		t.Fatalf("Expected the bootstrap admin let in, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// An existing account is promoted and enabled again, password kept
+	registerAndLogin(t, r, "alice", "pass")
+	a.Users.Update("alice", func(u *User) error { u.Disabled = true; return nil })
+	a.Config.BootstrapAdminUsername, a.Config.BootstrapAdminPassword = "alice", ""
+	if err := a.BootstrapAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := a.Users.Get("alice"); !user.IsAdmin() || user.Disabled {
+		t.Fatalf("Expected alice promoted and enabled, got %+v", user)
+	}
+	login(t, r, "alice", "pass")
+
+	a.Config.BootstrapAdminUsername = "nobody"
+	if err := a.BootstrapAdmin(); err == nil {
+		t.Fatal("Expected a missing bootstrap admin without a password refused")
+	}
+	a.Config.BootstrapAdminPassword, a.Config.PasswordMinLength = "short", 12
+	if err := a.BootstrapAdmin(); err == nil {
+		t.Fatal("Expected a weak bootstrap admin password refused")
+	}
+}
+
+func TestAdminUserManagement(t *testing.T) {
+	a := newTestApp(t, Config{JWTSecret: "testsecret_users", ConcurrencyMode: SafeMode, BootstrapAdminUsername: "root", BootstrapAdminPassword: "rootpass"})
+	r := SetupRouter(a)
+	root := login(t, r, "root", "rootpass")
+	alice := registerAndLogin(t, r, "alice", "pass")
+	pair := loginPair(t, r, "alice", "pass")
+	pat := postJSON(t, r, "/me/tokens", CreatePersonalTokenRequest{Name: "ci", Scopes: []string{ScopeTodosRead}}, alice, http.StatusCreated)["token"].(string)
+	mine := postJSON(t, r, "/todos", Todo{Title: "Mine"}, alice, http.StatusCreated)
+	title := "Mine, edited"
+	performRequest(r, "PUT", "/todos/"+mine["id"].(string), UpdateTodoRequest{Title: &title}, alice)
+
+	w := performRequest(r, "GET", "/admin/users", nil, root)
+	var users []map[string]any
+	json.Unmarshal(w.Body.Bytes(), &users)
+	if len(users) != 2 || users[0]["username"] != "alice" || users[0]["role"] != RoleUser || users[1]["role"] != RoleAdmin {
+		t.Fatalf("Expected both users listed with their roles, got %s", w.Body.String())
+	}
+	if _, leaked := users[0]["password_hash"]; leaked {
+		t.Fatalf("Expected the hash left out, got %v", users[0])
+	}
+	if w := performRequest(r, "GET", "/admin/users", nil, alice); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected a user refused, got %d", w.Code)
+	}
+
+	// Roles take effect on the next request
+	if w := performRequest(r, "PUT", "/admin/users/alice/role", SetRoleRequest{Role: "owner"}, root); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown role refused, got %d", w.Code)
+	}
+	if w := performRequest(r, "PUT", "/admin/users/root/role", SetRoleRequest{Role: RoleUser}, root); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an admin kept from demoting themselves, got %d", w.Code)
+	}
+	if w := performRequest(r, "PUT", "/admin/users/alice/role", SetRoleRequest{Role: RoleAdmin}, root); w.Code != http.StatusOK {
+		t.Fatalf("Expected alice promoted, got %d", w.Code)
+	}
+	if w := performRequest(r, "GET", "/admin/users", nil, login(t, r, "alice", "pass")); w.Code != http.StatusOK {
+		t.Fatalf("Expected a promoted user let in, got %d", w.Code)
+	}
+	performRequest(r, "PUT", "/admin/users/alice/role", SetRoleRequest{Role: RoleUser}, root)
+
+	// Disabling refuses every token at once, and logins
+	for _, path := range []string{"/admin/users/ghost/disable", "/admin/users/ghost/enable", "/admin/users/ghost/reset-password"} {
+		if w := performRequest(r, "POST", path, nil, root); w.Code != http.StatusNotFound {
+			t.Fatalf("POST %s: expected 404 got %d", path, w.Code)
+		}
+	}
+	if w := performRequest(r, "POST", "/admin/users/root/disable", nil, root); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an admin kept from disabling themselves, got %d", w.Code)
+	}
+	postJSON(t, r, "/admin/users/alice/disable", nil, root, http.StatusOK)
+	for _, token := range []string{alice, pat} {
+		if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, token)); code != CodeAccountDisabled {
+			t.Fatalf("Expected the token of a disabled user refused, got %s", code)
+		}
+	}
+	postJSON(t, r, "/login", Credentials{Username: "alice", Password: "pass"}, "", http.StatusForbidden)
+	postJSON(t, r, "/token/refresh", RefreshRequest{RefreshToken: pair.RefreshToken}, "", http.StatusUnauthorized)
+	postJSON(t, r, "/admin/users/alice/enable", nil, root, http.StatusOK)
+	alice = login(t, r, "alice", "pass")
+
+	// A reset password only lets the user choose a new one
+	temporary := postJSON(t, r, "/admin/users/alice/reset-password", nil, root, http.StatusOK)["temporary_password"].(string)
+	if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, alice)); code != CodePasswordResetRequired {
+		t.Fatalf("Expected tokens refused until the reset, got %s", code)
+	}
+	postJSON(t, r, "/login", Credentials{Username: "alice", Password: "pass"}, "", http.StatusUnauthorized)
+	postJSON(t, r, "/login", Credentials{Username: "alice", Password: temporary}, "", http.StatusForbidden)
+	postJSON(t, r, "/password/reset", PasswordResetRequest{Username: "alice", Password: "pass", NewPassword: "newpass"}, "", http.StatusUnauthorized)
+	postJSON(t, r, "/password/reset", PasswordResetRequest{Username: "alice", Password: temporary, NewPassword: temporary}, "", http.StatusBadRequest)
+	postJSON(t, r, "/password/reset", PasswordResetRequest{Username: "alice", Password: temporary, NewPassword: "newpass"}, "", http.StatusOK)
+	postJSON(t, r, "/password/reset", PasswordResetRequest{Username: "alice", Password: "newpass", NewPassword: "other"}, "", http.StatusConflict)
+	alice = login(t, r, "alice", "newpass")
+
+	// Deleting takes the user's todos and tokens along
+	if w := performRequest(r, "DELETE", "/admin/users/root", nil, root); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an admin kept from deleting themselves, got %d", w.Code)
+	}
+	w = performRequest(r, "DELETE", "/admin/users/alice", nil, root)
+	if w.Code != http.StatusOK || w.Body.String() != `{"message":"User deleted","todos":1}` {
+		t.Fatalf("Expected alice deleted with her todo, got %d %s", w.Code, w.Body.String())
+	}
+	if code, _ := rejectionCode(t, performRequest(r, "GET", "/todos", nil, alice)); code != CodeUnknownUser {
+		t.Fatalf("Expected the token of a deleted user refused, got %s", code)
+	}
+	if owners, _ := a.Todos.Owners(); len(owners) != 0 {
+		t.Fatalf("Expected no todos left, got owners %v", owners)
+	}
+	if tokens, _ := a.PersonalTokens.List("alice"); len(tokens) != 0 {
+		t.Fatalf("Expected no personal access tokens left, got %d", len(tokens))
+	}
+	if w := performRequest(r, "DELETE", "/admin/users/alice", nil, root); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected a deleted user not found, got %d", w.Code)
+	}
+
+	// Whoever takes the name next starts without the old account's history
+	alice = registerAndLogin(t, r, "alice", "pass")
+	w = performRequest(r, "GET", "/changes?since=0", nil, alice)
+	var feed changesResponse
+	json.Unmarshal(w.Body.Bytes(), &feed)
+	if w.Code != http.StatusOK || len(feed.Changes) != 1 || feed.Changes[0].Op != ChangeRegister {
+		t.Fatalf("Expected only the new registration in the feed, got %d %s", w.Code, w.Body.String())
+	}
+	if revs, _ := a.Revisions.List("alice", mine["id"].(string)); len(revs) != 0 {
+		t.Fatalf("Expected the old revisions gone, got %d", len(revs))
+	}
+}
+
+func TestRestoreWithBootstrapAdminConfigured(t *testing.T) {
+	d := newDataset()
+	d.Users = []User{{Username: "alice", PasswordHash: "hash", Role: RoleUser}}
+	d.Todos["alice"] = []Todo{newTestTodo("a")}
+	var archive bytes.Buffer
+	if _, err := WriteBackup(&archive, d, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range []string{StorageMemory, StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			a, err := Open(Config{
+				JWTSecret:              "testsecret_users",
+				Storage:                storage,
+				DataDir:                dir,
+				SQLitePath:             filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:         true,
+				BootstrapAdminUsername: "root",
+				BootstrapAdminPassword: "rootpass",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if users, _ := a.Users.List(); len(users) != 0 {
+				t.Fatalf("Expected Open to leave the store empty, got %+v", users)
+			}
+			d, err := ReadBackup(bytes.NewReader(archive.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RestoreBackup(a.Stores, d); err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+
+			// Serving afterwards still brings in the admin
+			if err := a.BootstrapAdmin(); err != nil {
+				t.Fatal(err)
+			}
+			users, err := a.Users.List()
+			if err != nil || len(users) != 2 || users[0].Username != "alice" || !users[1].IsAdmin() {
+				t.Fatalf("Expected alice restored and root bootstrapped, got %+v (err=%v)", users, err)
+			}
+		})
+	}
+}
+
+func TestUserRolesSurviveRestart(t *testing.T) {
+	for _, storage := range []string{StorageFile, StorageSQLite} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{
+				JWTSecret:              "testsecret_users",
+				ConcurrencyMode:        SafeMode,
+				Storage:                storage,
+				DataDir:                dir,
+				SQLitePath:             filepath.Join(dir, "todoapp.db"),
+				MigrateOnStart:         true,
+				BootstrapAdminUsername: "root",
+				BootstrapAdminPassword: "rootpass",
+			}
+			a, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.BootstrapAdmin(); err != nil {
+				t.Fatal(err)
+			}
+			r := SetupRouter(a)
+			root := login(t, r, "root", "rootpass")
+			registerAndLogin(t, r, "alice", "pass")
+			registerAndLogin(t, r, "bob", "pass")
+			postJSON(t, r, "/admin/users/alice/disable", nil, root, http.StatusOK)
+			performRequest(r, "DELETE", "/admin/users/bob", nil, root)
+			a.Close()
+
+			if a, err = Open(cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			users, err := a.Users.List()
+			if err != nil || len(users) != 2 || !users[0].Disabled || !users[1].IsAdmin() {
+				t.Fatalf("Expected alice disabled, bob gone and root an admin, got %+v (err=%v)", users, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+Feature: User Administration
+  In order to keep control of who uses the service
+  As an admin
+  I want to list, disable, reset and delete user accounts
+
+  Background:
+    Given the secret key "test-secret" is set up
+    And a user named "root" with password "password123" is registered
+    And user "root" is an admin
+    And user "root" logs in with password "password123" successfully
+    And a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+
+  Scenario: An admin lists the users with their roles
+    When user "root" lists the users
+    Then the user list should show "alice" with role "user"
+    And the user list should show "root" with role "admin"
+
+  Scenario: Ordinary users cannot manage accounts
+    When user "alice" lists the users
+    Then I should receive an error message "Admin access required"
+    And the response status should be 403
+
+  Scenario: A disabled account's tokens stop working at once
+    When user "root" disables the account of "alice"
+    Then the response status should be 200
+    When user "alice" gets all todos
+    Then the response status should be 401
+    And the error code should be "account_disabled"
+    When I login with username "alice" and password "password123"
+    Then I should receive an error message "Account disabled"
+    And the response status should be 403
+    When user "root" enables the account of "alice"
+    Then user "alice" logs in with password "password123" successfully
+
+  Scenario: Admins cannot lock themselves out
+    When user "root" disables the account of "root"
+    Then I should receive an error message "Cannot disable your own account"
+    And the response status should be 400
+
+  Scenario: A forced password reset makes the user choose a new password
+    When user "root" resets the password of "alice"
+    Then the response status should be 200
+    When user "alice" gets all todos
+    Then the error code should be "password_reset_required"
+    When I login with username "alice" and password "password123"
+    Then the response status should be 401
+    When user "alice" logs in with the temporary password
+    Then I should receive an error message "Password reset required"
+    And the response status should be 403
+    When user "alice" replaces the temporary password with "newpassword456"
+    Then the response status should be 200
+    And user "alice" logs in with password "newpassword456" successfully
+
+  Scenario: Deleting a user removes their todos and refuses their tokens
+    Given user "alice" has created a todo with title "Secret plans"
+    When user "root" deletes the account of "alice"
+    Then the response status should be 200
+    When user "alice" gets all todos
+    Then the response status should be 401
+    And the error code should be "unknown_user"
+    When user "root" deletes the account of "alice"
+    Then I should receive an error message "User not found"
+    And the response status should be 404
+    Given a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    When user "alice" gets all todos
+    Then user "alice" should see 0 todos
+
+  Scenario: A promotion takes effect at the next login, a demotion at once
+    When user "root" gives "alice" the role "admin"
+    Then the response status should be 200
+    Given user "alice" logs in with password "password123" successfully
+    When user "alice" lists the users
+    Then the response status should be 200
+    When user "root" gives "alice" the role "user"
+    And user "alice" lists the users
+    Then I should receive an error message "Admin access required"
+    And the response status should be 403
@@ -26,6 +26,24 @@ Feature: User Authentication
     Then I should receive an error message "Invalid request"
     And the response status should be 400
 
+  Scenario Outline: Registration enforces the password policy
+    Given passwords must be at least 8 characters and not common
+    When I register with username "alice" and password "<password>"
+    Then I should receive an error message "<error>"
+    And the response status should be 400
+
+    Examples:
+      | password    | error                                  |
+      | short       | Password must be at least 8 characters |
+      | password123 | Password is too common, choose another |
+      | Qwerty123   | Password is too common, choose another |
+
+  Scenario: Registration with a password that meets the policy
+    Given passwords must be at least 8 characters and not common
+    When I register with username "alice" and password "plum-orbit-lantern"
+    Then I should receive a success message
+    And the response status should be 201
+
   Scenario: Duplicate user registration
     Given a user named "alice" with password "password123" is already registered
     When I register with username "alice" and password "password123"
@@ -58,4 +76,155 @@ Feature: User Authentication
   Scenario: Login with invalid JSON
     When I send invalid JSON to the login endpoint
     Then I should receive an error message "Invalid request"
-    And the response status should be 400
\ No newline at end of file
+    And the response status should be 400
+
+  Scenario: Repeated failed logins lock the account
+    Given accounts lock for 15 minutes after 3 failed logins
+    And a user named "alice" with password "password123" is registered
+    When I fail to login as "alice" 3 times
+    And I login with username "alice" and password "password123"
+    Then I should receive an error message "Account locked after too many failed logins"
+    And the error code should be "account_locked"
+    And the response status should be 429
+    And the response should ask to retry after 900 seconds
+
+  Scenario: Failed logins for unknown accounts lock the same way
+    Given accounts lock for 15 minutes after 3 failed logins
+    When I fail to login as "nobody" 3 times
+    And I login with username "nobody" and password "password123"
+    Then the error code should be "account_locked"
+    And the response status should be 429
+
+  Scenario: Each failed login doubles the wait before the next attempt
+    Given failed logins delay the next attempt by 200 milliseconds
+    And a user named "alice" with password "password123" is registered
+    When I fail to login as "alice" 1 times
+    And I login with username "alice" and password "password123"
+    Then the error code should be "login_throttled"
+    And the response status should be 429
+    And the response should ask to retry after 1 second
+    When 300 milliseconds pass
+    And I fail to login as "alice" 1 times
+    And 300 milliseconds pass
+    And I login with username "alice" and password "password123"
+    Then the response status should be 429
+    When 200 milliseconds pass
+    And I login with username "alice" and password "password123"
+    Then I should receive a valid JWT token
+
+  Scenario: Repeated failed logins from one address lock it for every account
+    Given addresses lock for 15 minutes after 3 failed logins
+    And a user named "alice" with password "password123" is registered
+    When I fail to login as "bob" 1 times
+    And I fail to login as "carol" 1 times
+    And I fail to login as "dave" 1 times
+    And I login with username "alice" and password "password123"
+    Then I should receive an error message "Too many failed logins from this address"
+    And the error code should be "address_locked"
+    And the response status should be 429
+
+  Scenario: An admin unlocks a locked account
+    Given accounts lock for 15 minutes after 3 failed logins
+    And a user named "alice" with password "password123" is registered
+    And a user named "root" with password "password123" is registered
+    And user "root" is an admin
+    And user "root" logs in with password "password123" successfully
+    And I fail to login as "alice" 3 times
+    When user "root" unlocks the account of "alice"
+    Then the response status should be 200
+    When I login with username "alice" and password "password123"
+    Then I should receive a valid JWT token
+    And the response status should be 200
+
+  Scenario: Only admins can unlock accounts
+    Given accounts lock for 15 minutes after 3 failed logins
+    And a user named "alice" with password "password123" is registered
+    And a user named "bob" with password "password123" is registered
+    And user "bob" logs in with password "password123" successfully
+    And I fail to login as "alice" 3 times
+    When user "bob" unlocks the account of "alice"
+    Then I should receive an error message "Admin access required"
+    And the response status should be 403
+    When I login with username "alice" and password "password123"
+    Then the response status should be 429
+
+  Scenario: Login returns an access token and a refresh token
+    Given a user named "alice" with password "password123" is registered
+    When I login with username "alice" and password "password123"
+    Then I should receive a valid JWT token
+    And I should receive a refresh token
+    And the response status should be 200
+
+  Scenario: Refreshing rotates the refresh token
+    Given a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    When user "alice" refreshes their token
+    Then the response status should be 200
+    And I should receive a refresh token
+    And user "alice" should be able to access their todos
+
+  Scenario: An expired access token is renewed with the refresh token
+    Given access tokens expire after 1000 milliseconds
+    And a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    When user "alice"'s access token expires
+    And user "alice" requests all todos
+    Then the response status should be 401
+    And I should receive an error message "Invalid token"
+    When user "alice" refreshes their token
+    Then the response status should be 200
+    And user "alice" should be able to access their todos
+
+  Scenario: An expired refresh token is rejected
+    Given refresh tokens expire after 100 milliseconds
+    And a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    When 200 milliseconds pass
+    And user "alice" refreshes their token
+    Then I should receive an error message "Refresh token expired"
+    And the response status should be 401
+
+  Scenario: Replaying a used refresh token revokes the whole login
+    Given a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    And user "alice" refreshes their token
+    When user "alice" replays their previous refresh token
+    Then I should receive an error message "Refresh token reused"
+    And the response status should be 401
+    When user "alice" refreshes their token
+    Then I should receive an error message "Invalid refresh token"
+    And the response status should be 401
+
+  Scenario: Refreshing with an unknown token
+    When I refresh with the token "not-a-real-token"
+    Then I should receive an error message "Invalid refresh token"
+    And the response status should be 401
+
+  Scenario: Refreshing without a token
+    When I refresh with the token ""
+    Then I should receive an error message "Refresh token required"
+    And the response status should be 400
+
+  Scenario: Logging out revokes the session
+    Given a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    When user "alice" logs out
+    Then the response status should be 200
+    When user "alice" requests all todos
+    Then I should receive an error message "Token revoked"
+    And the response status should be 401
+    When user "alice" refreshes their token
+    Then I should receive an error message "Invalid refresh token"
+    And the response status should be 401
+
+  Scenario: Logging out of all sessions
+    Given a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+    And user "alice" refreshes their token
+    When user "alice" logs out of all sessions
+    Then the response status should be 200
+    When user "alice" requests all todos
+    Then I should receive an error message "Token revoked"
+    And the response status should be 401
+    When user "alice" logs in with password "password123" successfully
+    Then user "alice" should be able to access their todos
@@ -41,18 +41,80 @@ Feature: User Authorization and Data Isolation
     When I try to access todos with an invalid token
     Then I should receive an error message "Invalid token"
     And the response status should be 401
+    And the error code should be "invalid_signature"
 
   Scenario: Expired token access
     When I try to access todos with an expired token
     Then I should receive an error message "Invalid token"
     And the response status should be 401
+    And the error code should be "token_expired"
 
   Scenario: Missing authorization header
     When I try to access todos without an authorization header
     Then I should receive an error message "Authorization header required"
     And the response status should be 401
+    And the error code should be "missing_authorization"
 
   Scenario: Malformed authorization header
     When I try to access todos with malformed authorization header
     Then I should receive an error message "Invalid token"
-    And the response status should be 401
\ No newline at end of file
+    And the response status should be 401
+    And the error code should be "invalid_authorization_scheme"
+
+  Scenario Outline: Tokens signed with an algorithm the server does not accept
+    When I try to access todos with a token signed with the "<algorithm>" algorithm
+    Then I should receive an error message "Invalid token"
+    And the response status should be 401
+    And the error code should be "unsupported_algorithm"
+
+    Examples:
+      | algorithm |
+      | none      |
+      | HS384     |
+      | HS512     |
+
+  Scenario: Token without a user claim
+    When I try to access todos with a token without the "user" claim
+    Then I should receive an error message "Invalid token"
+    And the response status should be 401
+    And the error code should be "missing_claim"
+
+  Scenario: Token issued for another audience
+    When I try to access todos with a token for audience "billing-service"
+    Then I should receive an error message "Invalid token"
+    And the response status should be 401
+    And the error code should be "invalid_audience"
+
+  Scenario: A read-only token can list todos but not change them
+    Given user "alice" creates a personal access token "dashboard" with scopes "todos:read"
+    When the personal access token "dashboard" is used to GET "/todos"
+    Then the response status should be 200
+    When the personal access token "dashboard" is used to create a todo with title "Not allowed"
+    Then I should receive an error message "Missing scope todos:write"
+    And the response status should be 403
+    And the error code should be "insufficient_scope"
+
+  Scenario: A write-only token cannot read todos
+    Given user "alice" creates a personal access token "importer" with scopes "todos:write"
+    When the personal access token "importer" is used to create a todo with title "Imported"
+    Then the response status should be 201
+    When the personal access token "importer" is used to GET "/changes"
+    Then I should receive an error message "Missing scope todos:read"
+    And the response status should be 403
+
+  Scenario: Only admins can grant the admin scope
+    When user "alice" creates a personal access token "ops" with scopes "admin"
+    Then I should receive an error message "Cannot grant scope admin"
+    And the response status should be 403
+
+  Scenario: Admin endpoints need the admin scope
+    Given a user named "root" with password "password123" is registered
+    And user "root" is an admin
+    And user "root" logs in with password "password123" successfully
+    And user "root" creates a personal access token "backups" with scopes "admin"
+    And user "root" creates a personal access token "reader" with scopes "todos:read"
+    When the personal access token "backups" is used to POST "/admin/backup"
+    Then the response status should be 200
+    When the personal access token "reader" is used to POST "/admin/backup"
+    Then I should receive an error message "Missing scope admin"
+    And the response status should be 403
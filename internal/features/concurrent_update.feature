@@ -3,6 +3,11 @@ Feature: Confusion and Data Loss from Simultaneous Updates
   As a software developer
   I want to demonstrate that when two people edit the same ToDo at once,
   the system can't decide who wins, leading to unpredictable results.
+  The scenario tagged @racy runs the server with the unsynchronised store
+  to show the problem. Scenarios tagged @safe run it in safe concurrency
+  mode and show that atomic per-user updates lose no creates and never mix
+  two edits.
+  With If-Match, a stale edit is rejected instead of silently overwriting.
 
   Background:
     Given the secret key "test-secret" is set up
@@ -10,8 +15,25 @@ Feature: Confusion and Data Loss from Simultaneous Updates
     And user "Alice" logs in with password "pass" successfully
     And a new task titled "Concurrent Task" is created
 
+  @racy
   Scenario: Two People Edit the Same Task at the Same Time
     When the first person tries to change the task's title to "A" many times
     And the second person tries to change the task's title to "B" many times
     Then both people should receive confirmation that their changes were saved
-    And the final title of the task will be a random mix of the two versions
\ No newline at end of file
+    And the final title of the task will be a random mix of the two versions
+
+  @safe
+  Scenario: Many Tasks Created at the Same Time Are All Kept
+    When 4 people each create 25 tasks at the same time
+    Then the task list should contain 101 tasks
+
+  @safe
+  Scenario: Competing Edits Never Produce a Mixed Task
+    When two people repeatedly save competing versions of the task at the same time
+    Then every saved version should be one person's complete version
+    And the final task should be one person's complete version
+
+  @safe
+  Scenario: Conditional Edits Keep Every Change
+    When both people append to the task's title many times using If-Match
+    Then every append should be kept in the final title
@@ -0,0 +1,62 @@
+Feature: Personal Access Tokens
+  In order to let scripts and integrations use my todos without my password
+  As a user
+  I want named, scoped and revocable personal access tokens
+
+  Background:
+    Given the secret key "test-secret" is set up
+    And a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+
+  Scenario: Creating a token and using it in place of a login
+    When user "alice" creates a personal access token "ci" with scopes "todos:write,todos:read"
+    Then the response status should be 201
+    When the personal access token "ci" is used to create a todo with title "From CI"
+    Then the response status should be 201
+    And user "alice" should see the personal access token "ci" with scopes "todos:read,todos:write"
+    And user "alice" should see the personal access token "ci" as used
+
+  Scenario: Tokens need a name and known scopes
+    When user "alice" creates a personal access token "ci" with scopes "todos:delete"
+    Then I should receive an error message "Unknown scope todos:delete"
+    And the response status should be 400
+    When user "alice" creates a personal access token "" with scopes "todos:read"
+    Then I should receive an error message "Token name required"
+    And the response status should be 400
+
+  Scenario: A token cannot manage tokens or sessions
+    Given user "alice" creates a personal access token "ci" with scopes "todos:read"
+    When the personal access token "ci" is used to POST "/me/tokens"
+    Then I should receive an error message "Not allowed with a personal access token"
+    And the response status should be 403
+    When the personal access token "ci" is used to POST "/logout"
+    Then the response status should be 403
+
+  Scenario: A revoked token stops working at once
+    Given user "alice" creates a personal access token "ci" with scopes "todos:read"
+    When user "alice" revokes the personal access token "ci"
+    Then the response status should be 200
+    And user "alice" should not see the personal access token "ci"
+    When the personal access token "ci" is used to GET "/todos"
+    Then the response status should be 401
+    And the error code should be "unknown_token"
+
+  Scenario: An expired token is refused
+    Given the clock is set to "2026-10-16T12:00:00Z"
+    And user "alice" logs in with password "password123" successfully
+    And user "alice" creates a personal access token "ci" with scopes "todos:read" expiring in 3600 seconds
+    When the personal access token "ci" is used to GET "/todos"
+    Then the response status should be 200
+    When 3601 seconds pass on the clock
+    And the personal access token "ci" is used to GET "/todos"
+    Then the response status should be 401
+    And the error code should be "token_expired"
+
+  Scenario: Users see and revoke only their own tokens
+    Given a user named "bob" with password "password123" is registered
+    And user "bob" logs in with password "password123" successfully
+    And user "alice" creates a personal access token "ci" with scopes "todos:read"
+    Then user "bob" should not see the personal access token "ci"
+    When user "bob" revokes the personal access token "ci"
+    Then I should receive an error message "Token not found"
+    And the response status should be 404
@@ -0,0 +1,151 @@
+package steps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"todoapp/internal/app"
+)
+
+// adminRequest sends an admin API request as username and keeps the
+// response.
+func adminRequest(ctx context.Context, username, method, path string, body interface{}) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.SetCurrentUser(username)
+	resp, err := tc.MakeRequest(method, path, body)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to %s %s: %w", method, path, err)
+	}
+	tc.SetLastResponse(resp)
+	return ctx, nil
+}
+
+func userListsTheUsers(ctx context.Context, username string) (context.Context, error) {
+	return adminRequest(ctx, username, "GET", "/admin/users", nil)
+}
+
+func userDisablesTheAccountOf(ctx context.Context, username, target string) (context.Context, error) {
+	return adminRequest(ctx, username, "POST", "/admin/users/"+target+"/disable", nil)
+}
+
+func userEnablesTheAccountOf(ctx context.Context, username, target string) (context.Context, error) {
+	return adminRequest(ctx, username, "POST", "/admin/users/"+target+"/enable", nil)
+}
+
+func userDeletesTheAccountOf(ctx context.Context, username, target string) (context.Context, error) {
+	return adminRequest(ctx, username, "DELETE", "/admin/users/"+target, nil)
+}
+
+func userGivesTheRole(ctx context.Context, username, target, role string) (context.Context, error) {
+	return adminRequest(ctx, username, "PUT", "/admin/users/"+target+"/role", app.SetRoleRequest{Role: role})
+}
+
+func userResetsThePasswordOf(ctx context.Context, username, target string) (context.Context, error) {
+	ctx, err := adminRequest(ctx, username, "POST", "/admin/users/"+target+"/reset-password", nil)
+	if err != nil {
+		return ctx, err
+	}
+	tc := GetTestContextFromContext(ctx)
+	resp := tc.GetLastResponse()
+	if resp.StatusCode != http.StatusOK {
+		return ctx, nil
+	}
+
+	bodyBytes, err := readBody(resp)
+	if err != nil {
+		return ctx, err
+	}
+	var reset struct {
+		TemporaryPassword string `json:"temporary_password"`
+	}
+	if err := json.Unmarshal(bodyBytes, &reset); err != nil || reset.TemporaryPassword == "" {
+		return ctx, fmt.Errorf("expected a temporary password, got: %s", string(bodyBytes))
+	}
+	tc.mutex.Lock()
+	tc.TemporaryPasswords[target] = reset.TemporaryPassword
+	tc.mutex.Unlock()
+	return ctx, nil
+}
+
+// temporaryPassword returns the password an admin reset username to.
+func temporaryPassword(tc *TestContext, username string) (string, error) {
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+	password, ok := tc.TemporaryPasswords[username]
+	if !ok {
+		return "", fmt.Errorf("no temporary password for %s", username)
+	}
+	return password, nil
+}
+
+func userLogsInWithTheTemporaryPassword(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	password, err := temporaryPassword(tc, username)
+	if err != nil {
+		return ctx, err
+	}
+	resp, err := tc.MakeRequest("POST", "/login", app.Credentials{Username: username, Password: password})
+	if err != nil {
+		return ctx, fmt.Errorf("failed to login: %w", err)
+	}
+	tc.SetLastResponse(resp)
+	return ctx, nil
+}
+
+func userReplacesTheTemporaryPasswordWith(ctx context.Context, username, newPassword string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	password, err := temporaryPassword(tc, username)
+	if err != nil {
+		return ctx, err
+	}
+	req := app.PasswordResetRequest{Username: username, Password: password, NewPassword: newPassword}
+	resp, err := tc.MakeRequest("POST", "/password/reset", req)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to reset password: %w", err)
+	}
+	tc.SetLastResponse(resp)
+	return ctx, nil
+}
+
+func theUserListShouldShowWithRole(ctx context.Context, username, role string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	resp := tc.GetLastResponse()
+	bodyBytes, err := readBody(resp)
+	if err != nil {
+		return ctx, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ctx, fmt.Errorf("expected status 200 listing users, got %d (body: %s)", resp.StatusCode, string(bodyBytes))
+	}
+	var users []map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &users); err != nil {
+		return ctx, fmt.Errorf("failed to decode user list: %w (body: %s)", err, string(bodyBytes))
+	}
+	for _, user := range users {
+		if user["username"] != username {
+			continue
+		}
+		if _, leaked := user["password_hash"]; leaked {
+			return ctx, fmt.Errorf("expected the user list to leave out password hashes")
+		}
+		if user["role"] != role {
+			return ctx, fmt.Errorf("expected %s to have role %s, got %v", username, role, user["role"])
+		}
+		return ctx, nil
+	}
+	return ctx, fmt.Errorf("expected %s in the user list, got: %s", username, string(bodyBytes))
+}
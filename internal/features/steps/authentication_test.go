@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
+
 	"todoapp/internal/app"
 )
 
@@ -53,10 +55,15 @@ func iLoginWithUsernameAndPassword(ctx context.Context, username, password strin
 		resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
 		if err := json.Unmarshal(bodyBytes, &loginResponse); err == nil {
-			if token, exists := loginResponse["token"]; exists {
-				tc.StoreUserToken(username, token)
+			if _, exists := loginResponse["token"]; exists {
+				tc.StoreTokenPair(username, loginResponse)
 				tc.SetCurrentUser(username)
 			}
+			if challenge, exists := loginResponse["challenge_token"]; exists {
+				tc.mutex.Lock()
+				tc.Challenges[username] = challenge
+				tc.mutex.Unlock()
+			}
 		}
 	}
 	return ctx, nil
@@ -91,3 +98,228 @@ func iSendInvalidJSONToTheLoginEndpoint(ctx context.Context) (context.Context, e
 	tc.SetLastResponse(resp)
 	return ctx, nil
 }
+
+// readBody returns the body of resp and puts it back for later steps.
+func readBody(resp *http.Response) ([]byte, error) {
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	return bodyBytes, nil
+}
+
+func iShouldReceiveARefreshToken(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	bodyBytes, err := readBody(tc.GetLastResponse())
+	if err != nil {
+		return ctx, err
+	}
+	var loginResponse map[string]string
+	if err := json.Unmarshal(bodyBytes, &loginResponse); err != nil {
+		return ctx, fmt.Errorf("failed to decode login response: %w (body: %s)", err, string(bodyBytes))
+	}
+	if loginResponse["refresh_token"] == "" || loginResponse["expires_at"] == "" {
+		return ctx, fmt.Errorf("expected a refresh token and an expiry, got: %s", string(bodyBytes))
+	}
+	return ctx, nil
+}
+
+func passwordsMustBeAtLeastCharactersAndNotCommon(ctx context.Context, length int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.App.Config.PasswordMinLength = length
+	tc.App.Config.PasswordRejectCommon = true
+	return ctx, nil
+}
+
+func accessTokensExpireAfterMilliseconds(ctx context.Context, ms int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.App.Config.AccessTokenTTL = time.Duration(ms) * time.Millisecond
+	return ctx, nil
+}
+
+func refreshTokensExpireAfterMilliseconds(ctx context.Context, ms int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.App.Config.RefreshTokenTTL = time.Duration(ms) * time.Millisecond
+	return ctx, nil
+}
+
+func millisecondsPass(ctx context.Context, ms int) (context.Context, error) {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return ctx, nil
+}
+
+func usersAccessTokenExpires(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	expiresAt, ok := tc.AccessExpiry[username]
+	tc.mutex.RUnlock()
+	if !ok {
+		return ctx, fmt.Errorf("no access token expiry stored for %s", username)
+	}
+	time.Sleep(time.Until(expiresAt) + 50*time.Millisecond)
+	return ctx, nil
+}
+
+func sendRefresh(ctx context.Context, username, refreshToken string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	resp, err := tc.MakeRequest("POST", "/token/refresh", app.RefreshRequest{RefreshToken: refreshToken})
+	if err != nil {
+		return ctx, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	tc.SetLastResponse(resp)
+
+	if resp.StatusCode == http.StatusOK {
+		bodyBytes, err := readBody(resp)
+		if err != nil {
+			return ctx, err
+		}
+		var pair map[string]string
+		if err := json.Unmarshal(bodyBytes, &pair); err != nil {
+			return ctx, fmt.Errorf("failed to decode refresh response: %w (body: %s)", err, string(bodyBytes))
+		}
+		tc.StoreTokenPair(username, pair)
+	}
+	return ctx, nil
+}
+
+func userRefreshesTheirToken(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	refreshToken := tc.RefreshTokens[username]
+	tc.mutex.RUnlock()
+	return sendRefresh(ctx, username, refreshToken)
+}
+
+func userReplaysTheirPreviousRefreshToken(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	previous, ok := tc.PreviousRefreshTokens[username]
+	tc.mutex.RUnlock()
+	if !ok {
+		return ctx, fmt.Errorf("%s has not refreshed yet", username)
+	}
+	return sendRefresh(ctx, username, previous)
+}
+
+func iRefreshWithTheToken(ctx context.Context, refreshToken string) (context.Context, error) {
+	if GetTestContextFromContext(ctx) == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	return sendRefresh(ctx, "", refreshToken)
+}
+
+func userLogsOut(ctx context.Context, username string) (context.Context, error) {
+	return userPosts(ctx, username, "/logout")
+}
+
+func userLogsOutOfAllSessions(ctx context.Context, username string) (context.Context, error) {
+	return userPosts(ctx, username, "/logout/all")
+}
+
+func userPosts(ctx context.Context, username, path string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	tc.SetCurrentUser(username)
+	resp, err := tc.MakeRequest("POST", path, nil)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to post to %s: %w", path, err)
+	}
+	tc.SetLastResponse(resp)
+	return ctx, nil
+}
+
+func accountsLockAfterFailedLogins(ctx context.Context, minutes, failures int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.App.Config.LoginMaxFailures = failures
+	tc.App.Config.LoginLockout = time.Duration(minutes) * time.Minute
+	return ctx, nil
+}
+
+func addressesLockAfterFailedLogins(ctx context.Context, minutes, failures int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.App.Config.LoginIPMaxFailures = failures
+	tc.App.Config.LoginLockout = time.Duration(minutes) * time.Minute
+	return ctx, nil
+}
+
+func failedLoginsDelayTheNextByMilliseconds(ctx context.Context, ms int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.App.Config.LoginDelay = time.Duration(ms) * time.Millisecond
+	return ctx, nil
+}
+
+func iFailToLoginAsTimes(ctx context.Context, username string, times int) (context.Context, error) {
+	for i := 0; i < times; i++ {
+		ctx, err := iLoginWithUsernameAndPassword(ctx, username, "not-the-password")
+		if err != nil {
+			return ctx, err
+		}
+		if status := GetTestContextFromContext(ctx).GetLastResponse().StatusCode; status != http.StatusUnauthorized {
+			return ctx, fmt.Errorf("failed login %d as %s: expected status 401, got %d", i+1, username, status)
+		}
+	}
+	return ctx, nil
+}
+
+func theResponseShouldAskToRetryAfterSeconds(ctx context.Context, seconds string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	if got := tc.GetLastResponse().Header.Get("Retry-After"); got != seconds {
+		return ctx, fmt.Errorf("expected Retry-After %s, got %q", seconds, got)
+	}
+	return ctx, nil
+}
+
+func userIsAnAdmin(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	_, err := tc.App.Users.Update(username, func(u *app.User) error {
+		u.Role = app.RoleAdmin
+		return nil
+	})
+	return ctx, err
+}
+
+func userUnlocksTheAccountOf(ctx context.Context, username, target string) (context.Context, error) {
+	return userPosts(ctx, username, "/admin/users/"+target+"/unlock")
+}
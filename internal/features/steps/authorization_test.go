@@ -223,3 +223,74 @@ func iTryToAccessTodosWithoutAnAuthorizationHeader(ctx context.Context) (context
 func iTryToAccessTodosWithMalformedAuthorizationHeader(ctx context.Context) (context.Context, error) {
 	return makeRequestWithToken(ctx, "MALFORMED")
 }
+
+// validTokenClaims returns claims the server accepts from a token signed
+// with the test secret.
+func validTokenClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":  app.DefaultJWTIssuer,
+		"aud":  app.DefaultJWTAudience,
+		"user": "alice",
+		"jti":  app.GenerateID(),
+		"iat":  now.Unix(),
+		"exp":  now.Add(time.Minute).Unix(),
+	}
+}
+
+func requestWithSignedToken(ctx context.Context, method jwt.SigningMethod, claims jwt.MapClaims) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	var key interface{} = []byte(tc.Config.JWTSecret)
+	if method == jwt.SigningMethodNone {
+		key = jwt.UnsafeAllowNoneSignatureType
+	}
+	tokenString, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return makeRequestWithToken(ctx, tokenString)
+}
+
+func iTryToAccessTodosWithATokenSignedWithTheAlgorithm(ctx context.Context, alg string) (context.Context, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return ctx, fmt.Errorf("unknown algorithm %q", alg)
+	}
+	return requestWithSignedToken(ctx, method, validTokenClaims())
+}
+
+func iTryToAccessTodosWithATokenWithoutTheClaim(ctx context.Context, claim string) (context.Context, error) {
+	claims := validTokenClaims()
+	delete(claims, claim)
+	return requestWithSignedToken(ctx, jwt.SigningMethodHS256, claims)
+}
+
+func iTryToAccessTodosWithATokenForAudience(ctx context.Context, audience string) (context.Context, error) {
+	claims := validTokenClaims()
+	claims["aud"] = audience
+	return requestWithSignedToken(ctx, jwt.SigningMethodHS256, claims)
+}
+
+func theErrorCodeShouldBe(ctx context.Context, expected string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	bodyBytes, err := readBody(tc.GetLastResponse())
+	if err != nil {
+		return ctx, err
+	}
+	var body map[string]string
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return ctx, fmt.Errorf("failed to decode error response: %w (body: %s)", err, string(bodyBytes))
+	}
+	if body["code"] != expected {
+		return ctx, fmt.Errorf("expected error code '%s', got '%s'", expected, body["code"])
+	}
+	return ctx, nil
+}
@@ -77,12 +77,11 @@ func userLogsInWithPasswordSuccessfully(ctx context.Context, username, password
 		return ctx, fmt.Errorf("failed to decode login response: %w (body: %s)", err, string(bodyBytes))
 	}
 
-	token, exists := loginResponse["token"]
-	if !exists {
+	if _, exists := loginResponse["token"]; !exists {
 		return ctx, fmt.Errorf("no token in login response")
 	}
 
-	tc.StoreUserToken(username, token)
+	tc.StoreTokenPair(username, loginResponse)
 	tc.SetCurrentUser(username)
 	tc.SetLastResponse(resp)
 
@@ -195,3 +195,246 @@ func runConcurrentAppends(ctx context.Context, charToAppend string, updates int)
 		putResp.Body.Close()
 	}
 }
+
+func peopleEachCreateTasksAtTheSameTime(ctx context.Context, people, tasks int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(people)
+	for p := 0; p < people; p++ {
+		go func(person int) {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				title := fmt.Sprintf("Person %d task %d", person, i)
+				resp, err := tc.MakeRequest("POST", "/todos", map[string]string{"title": title})
+				tc.concMutex.Lock()
+				if err != nil {
+					tc.errs = append(tc.errs, fmt.Errorf("POST request error: %w", err))
+				} else if resp.StatusCode != http.StatusCreated {
+					tc.errs = append(tc.errs, fmt.Errorf("POST failed with status %d", resp.StatusCode))
+				}
+				tc.concMutex.Unlock()
+				if resp != nil {
+					resp.Body.Close()
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if len(tc.errs) > 0 {
+		return ctx, fmt.Errorf("%d creates failed, first error: %v", len(tc.errs), tc.errs[0])
+	}
+	return ctx, nil
+}
+
+func theTaskListShouldContainTasks(ctx context.Context, expected int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	resp, err := tc.MakeRequest("GET", "/todos", nil)
+	if err != nil {
+		return ctx, err
+	}
+	defer resp.Body.Close()
+
+	var todos []app.Todo
+	if err := json.NewDecoder(resp.Body).Decode(&todos); err != nil {
+		return ctx, err
+	}
+	if len(todos) != expected {
+		return ctx, fmt.Errorf("expected %d tasks, got %d: %d creates were lost", expected, len(todos), expected-len(todos))
+	}
+	return ctx, nil
+}
+
+// competingVersion is one person's complete edit: title and completed are
+// always sent together, so any mix of the two means a torn write.
+func competingVersion(todo app.Todo) bool {
+	return (todo.Title == "A" && todo.Completed) || (todo.Title == "B" && !todo.Completed)
+}
+
+func twoPeopleRepeatedlySaveCompetingVersions(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	const loops = 200
+	save := func(title string, completed bool) {
+		defer concurrentWG.Done()
+		for i := 0; i < loops; i++ {
+			req := app.UpdateTodoRequest{Title: &title, Completed: &completed}
+			resp, err := tc.MakeRequest("PUT", "/todos/"+tc.CurrentTodoID, req)
+			if err != nil {
+				tc.concMutex.Lock()
+				tc.errs = append(tc.errs, fmt.Errorf("PUT request error: %w", err))
+				tc.concMutex.Unlock()
+				continue
+			}
+
+			var saved app.Todo
+			decodeErr := json.NewDecoder(resp.Body).Decode(&saved)
+			resp.Body.Close()
+
+			tc.concMutex.Lock()
+			switch {
+			case resp.StatusCode != http.StatusOK:
+				tc.errs = append(tc.errs, fmt.Errorf("PUT update failed with status %d", resp.StatusCode))
+			case decodeErr != nil:
+				tc.errs = append(tc.errs, fmt.Errorf("PUT decode error: %w", decodeErr))
+			case !competingVersion(saved):
+				tc.torn++
+			default:
+				tc.success++
+			}
+			tc.concMutex.Unlock()
+		}
+	}
+
+	concurrentWG.Add(2)
+	go save("A", true)
+	go save("B", false)
+	concurrentWG.Wait()
+	return ctx, nil
+}
+
+func everySavedVersionShouldBeComplete(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	tc.concMutex.Lock()
+	defer tc.concMutex.Unlock()
+
+	if len(tc.errs) > 0 {
+		return ctx, fmt.Errorf("expected 0 errors, got %d, first error: %v", len(tc.errs), tc.errs[0])
+	}
+	if tc.torn > 0 {
+		return ctx, fmt.Errorf("%d of %d responses mixed both people's edits", tc.torn, tc.torn+tc.success)
+	}
+	return ctx, nil
+}
+
+func theFinalTaskShouldBeComplete(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	resp, err := tc.MakeRequest("GET", "/todos/"+tc.CurrentTodoID, nil)
+	if err != nil {
+		return ctx, err
+	}
+	defer resp.Body.Close()
+
+	var todo app.Todo
+	if err := json.NewDecoder(resp.Body).Decode(&todo); err != nil {
+		return ctx, err
+	}
+	if !competingVersion(todo) {
+		return ctx, fmt.Errorf("final task mixes both edits: title=%q completed=%v", todo.Title, todo.Completed)
+	}
+	return ctx, nil
+}
+
+const conditionalAppends = 100
+
+func bothPeopleAppendUsingIfMatch(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	concurrentWG.Add(2)
+	go runConditionalAppends(tc, "A", conditionalAppends)
+	go runConditionalAppends(tc, "B", conditionalAppends)
+	concurrentWG.Wait()
+
+	if len(tc.errs) > 0 {
+		return ctx, fmt.Errorf("%d appends failed, first error: %v", len(tc.errs), tc.errs[0])
+	}
+	return ctx, nil
+}
+
+func everyAppendShouldBeKept(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+
+	resp, err := tc.MakeRequest("GET", "/todos/"+tc.CurrentTodoID, nil)
+	if err != nil {
+		return ctx, err
+	}
+	defer resp.Body.Close()
+
+	var todo app.Todo
+	if err := json.NewDecoder(resp.Body).Decode(&todo); err != nil {
+		return ctx, err
+	}
+
+	countA := strings.Count(todo.Title, "A")
+	countB := strings.Count(todo.Title, "B")
+	if countA != conditionalAppends || countB != conditionalAppends {
+		return ctx, fmt.Errorf("expected %d A's and %d B's, got %d and %d", conditionalAppends, conditionalAppends, countA, countB)
+	}
+	if !strings.HasPrefix(todo.Title, tc.OriginalTitle) {
+		return ctx, fmt.Errorf("original title was lost: %q", todo.Title)
+	}
+	return ctx, nil
+}
+
+// runConditionalAppends is runConcurrentAppends with optimistic concurrency:
+// each PUT carries the ETag from the GET it was based on, and a 412 means
+// someone else got there first, so the append is retried on fresh data.
+func runConditionalAppends(tc *TestContext, charToAppend string, appends int) {
+	defer concurrentWG.Done()
+
+	fail := func(err error) {
+		tc.concMutex.Lock()
+		tc.errs = append(tc.errs, err)
+		tc.concMutex.Unlock()
+	}
+
+	for i := 0; i < appends; {
+		getResp, err := tc.MakeRequest("GET", "/todos/"+tc.CurrentTodoID, nil)
+		if err != nil {
+			fail(fmt.Errorf("GET request error: %w", err))
+			return
+		}
+		var currentTodo app.Todo
+		err = json.NewDecoder(getResp.Body).Decode(&currentTodo)
+		getResp.Body.Close()
+		if err != nil {
+			fail(fmt.Errorf("GET decode error: %w", err))
+			return
+		}
+
+		newTitle := currentTodo.Title + charToAppend
+		req := app.UpdateTodoRequest{Title: &newTitle}
+		putResp, err := tc.MakeRequestWithHeaders("PUT", "/todos/"+tc.CurrentTodoID, req,
+			map[string]string{"If-Match": getResp.Header.Get("ETag")})
+		if err != nil {
+			fail(fmt.Errorf("PUT request error: %w", err))
+			return
+		}
+		putResp.Body.Close()
+
+		switch putResp.StatusCode {
+		case http.StatusOK:
+			i++
+		case http.StatusPreconditionFailed:
+			// Lost the race for this version, retry with fresh data
+		default:
+			fail(fmt.Errorf("PUT update failed with status %d", putResp.StatusCode))
+			return
+		}
+	}
+}
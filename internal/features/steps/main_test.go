@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"github.com/cucumber/godog"
+
+	"todoapp/internal/app"
 )
 
 func TestFeatures(t *testing.T) {
@@ -26,6 +28,14 @@ func TestFeatures(t *testing.T) {
 func InitializeScenarios(ctx *godog.ScenarioContext) {
 	ctx.Before(func(ctx context.Context, sc *godog.Scenario) (context.Context, error) {
 		tc := NewTestContext()
+		for _, tag := range sc.Tags {
+			switch tag.Name {
+			case "@safe":
+				tc.Config.ConcurrencyMode = app.SafeMode
+			case "@racy":
+				tc.Config.ConcurrencyMode = app.RacyMode
+			}
+		}
 		if err := tc.SetupServer(); err != nil {
 			return ctx, fmt.Errorf("failed to setup test server: %w", err)
 		}
@@ -56,6 +66,54 @@ func InitializeScenarios(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I login with username "([^"]*)" and password "([^"]*)"$`, iLoginWithUsernameAndPassword)
 	ctx.Step(`^I send invalid JSON to the register endpoint$`, iSendInvalidJSONToTheRegisterEndpoint)
 	ctx.Step(`^I send invalid JSON to the login endpoint$`, iSendInvalidJSONToTheLoginEndpoint)
+	ctx.Step(`^I should receive a refresh token$`, iShouldReceiveARefreshToken)
+	ctx.Step(`^passwords must be at least (\d+) characters and not common$`, passwordsMustBeAtLeastCharactersAndNotCommon)
+	ctx.Step(`^access tokens expire after (\d+) milliseconds$`, accessTokensExpireAfterMilliseconds)
+	ctx.Step(`^refresh tokens expire after (\d+) milliseconds$`, refreshTokensExpireAfterMilliseconds)
+	ctx.Step(`^(\d+) milliseconds pass$`, millisecondsPass)
+	ctx.Step(`^user "([^"]*)"'s access token expires$`, usersAccessTokenExpires)
+	ctx.Step(`^user "([^"]*)" refreshes their token$`, userRefreshesTheirToken)
+	ctx.Step(`^user "([^"]*)" replays their previous refresh token$`, userReplaysTheirPreviousRefreshToken)
+	ctx.Step(`^I refresh with the token "([^"]*)"$`, iRefreshWithTheToken)
+	ctx.Step(`^user "([^"]*)" logs out$`, userLogsOut)
+	ctx.Step(`^user "([^"]*)" logs out of all sessions$`, userLogsOutOfAllSessions)
+	ctx.Step(`^accounts lock for (\d+) minutes after (\d+) failed logins$`, accountsLockAfterFailedLogins)
+	ctx.Step(`^addresses lock for (\d+) minutes after (\d+) failed logins$`, addressesLockAfterFailedLogins)
+	ctx.Step(`^failed logins delay the next attempt by (\d+) milliseconds$`, failedLoginsDelayTheNextByMilliseconds)
+	ctx.Step(`^I fail to login as "([^"]*)" (\d+) times$`, iFailToLoginAsTimes)
+	ctx.Step(`^the response should ask to retry after (\d+) seconds?$`, theResponseShouldAskToRetryAfterSeconds)
+	ctx.Step(`^user "([^"]*)" is an admin$`, userIsAnAdmin)
+	ctx.Step(`^user "([^"]*)" unlocks the account of "([^"]*)"$`, userUnlocksTheAccountOf)
+
+	ctx.Step(`^the clock is set to "([^"]*)"$`, theClockIsSetTo)
+	ctx.Step(`^(\d+) seconds pass on the clock$`, secondsPassOnTheClock)
+	ctx.Step(`^user "([^"]*)" sets up two-factor authentication$`, userSetsUpTwoFactorAuthentication)
+	ctx.Step(`^user "([^"]*)" confirms two-factor authentication with a valid code$`, userConfirmsTwoFactorAuthenticationWithAValidCode)
+	ctx.Step(`^user "([^"]*)" confirms two-factor authentication with the code "([^"]*)"$`, userConfirmsTwoFactorAuthenticationWithTheCode)
+	ctx.Step(`^user "([^"]*)" should have (\d+) recovery codes$`, userShouldHaveRecoveryCodes)
+	ctx.Step(`^I should receive a two-factor challenge instead of a token$`, iShouldReceiveATwoFactorChallengeInsteadOfAToken)
+	ctx.Step(`^I complete the login of "([^"]*)" with a valid code$`, iCompleteTheLoginOfWithAValidCode)
+	ctx.Step(`^I complete the login of "([^"]*)" with the code "([^"]*)"$`, iCompleteTheLoginOfWithTheCode)
+	ctx.Step(`^I complete the login of "([^"]*)" with recovery code (\d+)$`, iCompleteTheLoginOfWithRecoveryCode)
+
+	ctx.Step(`^user "([^"]*)" creates a personal access token "([^"]*)" with scopes "([^"]*)"$`, userCreatesAPersonalAccessTokenWithScopes)
+	ctx.Step(`^user "([^"]*)" creates a personal access token "([^"]*)" with scopes "([^"]*)" expiring in (\d+) seconds$`, userCreatesAPersonalAccessTokenWithScopesExpiringIn)
+	ctx.Step(`^the personal access token "([^"]*)" is used to (GET|POST|DELETE) "([^"]*)"$`, thePersonalAccessTokenIsUsedTo)
+	ctx.Step(`^the personal access token "([^"]*)" is used to create a todo with title "([^"]*)"$`, thePersonalAccessTokenIsUsedToCreateATodoWithTitle)
+	ctx.Step(`^user "([^"]*)" revokes the personal access token "([^"]*)"$`, userRevokesThePersonalAccessToken)
+	ctx.Step(`^user "([^"]*)" should see the personal access token "([^"]*)" with scopes "([^"]*)"$`, userShouldSeeThePersonalAccessTokenWithScopes)
+	ctx.Step(`^user "([^"]*)" should see the personal access token "([^"]*)" as used$`, userShouldSeeThePersonalAccessTokenAsUsed)
+	ctx.Step(`^user "([^"]*)" should not see the personal access token "([^"]*)"$`, userShouldNotSeeThePersonalAccessToken)
+
+	ctx.Step(`^user "([^"]*)" lists the users$`, userListsTheUsers)
+	ctx.Step(`^the user list should show "([^"]*)" with role "([^"]*)"$`, theUserListShouldShowWithRole)
+	ctx.Step(`^user "([^"]*)" disables the account of "([^"]*)"$`, userDisablesTheAccountOf)
+	ctx.Step(`^user "([^"]*)" enables the account of "([^"]*)"$`, userEnablesTheAccountOf)
+	ctx.Step(`^user "([^"]*)" deletes the account of "([^"]*)"$`, userDeletesTheAccountOf)
+	ctx.Step(`^user "([^"]*)" gives "([^"]*)" the role "([^"]*)"$`, userGivesTheRole)
+	ctx.Step(`^user "([^"]*)" resets the password of "([^"]*)"$`, userResetsThePasswordOf)
+	ctx.Step(`^user "([^"]*)" logs in with the temporary password$`, userLogsInWithTheTemporaryPassword)
+	ctx.Step(`^user "([^"]*)" replaces the temporary password with "([^"]*)"$`, userReplacesTheTemporaryPasswordWith)
 
 	ctx.Step(`^user "([^"]*)" gets all todos$`, userGetsAllTodos)
 	ctx.Step(`^user "([^"]*)" should only see "([^"]*)"$`, userShouldOnlySee)
@@ -67,6 +125,10 @@ func InitializeScenarios(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I try to access todos with an expired token$`, iTryToAccessTodosWithAnExpiredToken)
 	ctx.Step(`^I try to access todos without an authorization header$`, iTryToAccessTodosWithoutAnAuthorizationHeader)
 	ctx.Step(`^I try to access todos with malformed authorization header$`, iTryToAccessTodosWithMalformedAuthorizationHeader)
+	ctx.Step(`^I try to access todos with a token signed with the "([^"]*)" algorithm$`, iTryToAccessTodosWithATokenSignedWithTheAlgorithm)
+	ctx.Step(`^I try to access todos with a token without the "([^"]*)" claim$`, iTryToAccessTodosWithATokenWithoutTheClaim)
+	ctx.Step(`^I try to access todos with a token for audience "([^"]*)"$`, iTryToAccessTodosWithATokenForAudience)
+	ctx.Step(`^the error code should be "([^"]*)"$`, theErrorCodeShouldBe)
 
 	ctx.Step(`^user "([^"]*)" creates a todo with title "([^"]*)"$`, userCreatesATodoWithTitle)
 	ctx.Step(`^user "([^"]*)" has created a todo with title "([^"]*)"$`, userHasCreatedATodoWithTitle)
@@ -100,6 +162,13 @@ func InitializeScenarios(ctx *godog.ScenarioContext) {
 	ctx.Step(`^the second person tries to change the task's title to "([^"]*)" many times$`, theSecondPersonTriesToChangeTheTask)
 	ctx.Step(`^both people should receive confirmation that their changes were saved$`, bothPeopleShouldReceiveConfirmationThatTheirChangesWereSaved)
 	ctx.Step(`^the final title of the task will be a random mix of the two versions$`, theFinalTitleOfTheTaskWillBeARandomMixOfTheTwoVersions)
+	ctx.Step(`^(\d+) people each create (\d+) tasks at the same time$`, peopleEachCreateTasksAtTheSameTime)
+	ctx.Step(`^the task list should contain (\d+) tasks$`, theTaskListShouldContainTasks)
+	ctx.Step(`^two people repeatedly save competing versions of the task at the same time$`, twoPeopleRepeatedlySaveCompetingVersions)
+	ctx.Step(`^every saved version should be one person's complete version$`, everySavedVersionShouldBeComplete)
+	ctx.Step(`^the final task should be one person's complete version$`, theFinalTaskShouldBeComplete)
+	ctx.Step(`^both people append to the task's title many times using If-Match$`, bothPeopleAppendUsingIfMatch)
+	ctx.Step(`^every append should be kept in the final title$`, everyAppendShouldBeKept)
 
 	ctx.Step(`^all changes should be reflected correctly$`, allChangesShouldBeReflectedCorrectly)
 	ctx.Step(`^all operations should succeed$`, allOperationsShouldSucceed)
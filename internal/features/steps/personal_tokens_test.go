@@ -0,0 +1,189 @@
+package steps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"todoapp/internal/app"
+)
+
+func createPersonalToken(ctx context.Context, username, name string, req app.CreatePersonalTokenRequest) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	tc.SetCurrentUser(username)
+	resp, err := tc.MakeRequest("POST", "/me/tokens", req)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to create personal access token: %w", err)
+	}
+	tc.SetLastResponse(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return ctx, nil
+	}
+
+	bodyBytes, err := readBody(resp)
+	if err != nil {
+		return ctx, err
+	}
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(bodyBytes, &created); err != nil {
+		return ctx, fmt.Errorf("failed to decode token response: %w (body: %s)", err, string(bodyBytes))
+	}
+	if !strings.HasPrefix(created.Token, app.PersonalTokenPrefix) {
+		return ctx, fmt.Errorf("expected a personal access token, got: %s", string(bodyBytes))
+	}
+	tc.mutex.Lock()
+	tc.PersonalTokens[name] = created.Token
+	tc.PersonalTokenIDs[name] = created.ID
+	tc.mutex.Unlock()
+	return ctx, nil
+}
+
+func userCreatesAPersonalAccessTokenWithScopes(ctx context.Context, username, name, scopes string) (context.Context, error) {
+	if GetTestContextFromContext(ctx) == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	return createPersonalToken(ctx, username, name, app.CreatePersonalTokenRequest{Name: name, Scopes: strings.Split(scopes, ",")})
+}
+
+func userCreatesAPersonalAccessTokenWithScopesExpiringIn(ctx context.Context, username, name, scopes string, seconds int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	expiresAt := tc.App.Clock().Add(time.Duration(seconds) * time.Second)
+	return createPersonalToken(ctx, username, name, app.CreatePersonalTokenRequest{Name: name, Scopes: strings.Split(scopes, ","), ExpiresAt: &expiresAt})
+}
+
+// usePersonalToken sends a request authenticated by the named token.
+func usePersonalToken(ctx context.Context, name, method, path string, body interface{}) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	token, ok := tc.PersonalTokens[name]
+	tc.mutex.RUnlock()
+	if !ok {
+		return ctx, fmt.Errorf("no personal access token named %s", name)
+	}
+
+	resp, err := tc.MakeRequestWithHeaders(method, path, body, map[string]string{"Authorization": "Bearer " + token})
+	if err != nil {
+		return ctx, fmt.Errorf("failed to %s %s: %w", method, path, err)
+	}
+	tc.SetLastResponse(resp)
+	return ctx, nil
+}
+
+func thePersonalAccessTokenIsUsedTo(ctx context.Context, name, method, path string) (context.Context, error) {
+	return usePersonalToken(ctx, name, method, path, nil)
+}
+
+func thePersonalAccessTokenIsUsedToCreateATodoWithTitle(ctx context.Context, name, title string) (context.Context, error) {
+	return usePersonalToken(ctx, name, "POST", "/todos", app.Todo{Title: title})
+}
+
+func userRevokesThePersonalAccessToken(ctx context.Context, username, name string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	id, ok := tc.PersonalTokenIDs[name]
+	tc.mutex.RUnlock()
+	if !ok {
+		return ctx, fmt.Errorf("no personal access token named %s", name)
+	}
+
+	tc.SetCurrentUser(username)
+	resp, err := tc.MakeRequest("DELETE", "/me/tokens/"+id, nil)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to revoke personal access token: %w", err)
+	}
+	tc.SetLastResponse(resp)
+	return ctx, nil
+}
+
+// listedPersonalToken finds the named token in username's token list.
+func listedPersonalToken(tc *TestContext, username, name string) (map[string]interface{}, error) {
+	tc.SetCurrentUser(username)
+	resp, err := tc.MakeRequest("GET", "/me/tokens", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list personal access tokens: %w", err)
+	}
+	tc.SetLastResponse(resp)
+	bodyBytes, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status 200 listing tokens, got %d (body: %s)", resp.StatusCode, string(bodyBytes))
+	}
+	var tokens []map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode token list: %w (body: %s)", err, string(bodyBytes))
+	}
+	for _, token := range tokens {
+		if token["name"] == name {
+			return token, nil
+		}
+	}
+	return nil, nil
+}
+
+func userShouldSeeThePersonalAccessTokenWithScopes(ctx context.Context, username, name, scopes string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	token, err := listedPersonalToken(tc, username, name)
+	if err != nil {
+		return ctx, err
+	}
+	if token == nil {
+		return ctx, fmt.Errorf("expected %s to see the token %s", username, name)
+	}
+	if _, leaked := token["token"]; leaked {
+		return ctx, fmt.Errorf("expected the token list to leave out the secret")
+	}
+	if got := fmt.Sprint(token["scopes"]); got != "["+strings.ReplaceAll(scopes, ",", " ")+"]" {
+		return ctx, fmt.Errorf("expected scopes %s, got %s", scopes, got)
+	}
+	return ctx, nil
+}
+
+func userShouldSeeThePersonalAccessTokenAsUsed(ctx context.Context, username, name string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	token, err := listedPersonalToken(tc, username, name)
+	if err != nil {
+		return ctx, err
+	}
+	if token == nil || token["last_used_at"] == nil {
+		return ctx, fmt.Errorf("expected the token %s listed with a last use, got %v", name, token)
+	}
+	return ctx, nil
+}
+
+func userShouldNotSeeThePersonalAccessToken(ctx context.Context, username, name string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	token, err := listedPersonalToken(tc, username, name)
+	if err != nil {
+		return ctx, err
+	}
+	if token != nil {
+		return ctx, fmt.Errorf("expected %s not to see the token %s, got %v", username, name, token)
+	}
+	return ctx, nil
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -18,69 +19,124 @@ import (
 
 // TestContext holds the state for ALL BDD tests
 type TestContext struct {
-	Server        *httptest.Server
-	Client        *http.Client
-	BaseURL       string
-	Config        *TestConfig
-	UserTokens    map[string]string
-	UserTodoIDs   map[string]string
-	CurrentUser   string
-	LastResponse  *http.Response
-	LastError     string
-	TodoIDByTitle map[string]string
-	mutex         sync.RWMutex
+	App        *app.App
+	DataDir    string
+	Server     *httptest.Server
+	Client     *http.Client
+	BaseURL    string
+	Config     *TestConfig
+	UserTokens map[string]string
+	// RefreshTokens holds each user's latest refresh token and
+	// PreviousRefreshTokens the one it replaced.
+	RefreshTokens         map[string]string
+	PreviousRefreshTokens map[string]string
+	AccessExpiry          map[string]time.Time
+	UserTodoIDs           map[string]string
+	CurrentUser           string
+	LastResponse          *http.Response
+	LastError             string
+	TodoIDByTitle         map[string]string
+	// Now is the server's clock once a scenario fixes it. TOTPSecrets,
+	// RecoveryCodes and Challenges hold each user's two-factor state.
+	Now           time.Time
+	TOTPSecrets   map[string]string
+	RecoveryCodes map[string][]string
+	Challenges    map[string]string
+	// PersonalTokens and PersonalTokenIDs map each personal access token's
+	// name to its secret and its ID.
+	PersonalTokens   map[string]string
+	PersonalTokenIDs map[string]string
+	// TemporaryPasswords holds the password an admin reset each user to.
+	TemporaryPasswords map[string]string
+	mutex              sync.RWMutex
 
 	// --- Fields for concurrent_update_test ---
 	CurrentTodoID string
 	OriginalTitle string
 	success       int
+	torn          int
 	errs          []error
 	concMutex     sync.Mutex
 	// -----------------------------------------
 }
 
 type TestConfig struct {
-	JWTSecret     string
-	BaseURL       string
-	Timeout       time.Duration
-	RetryCount    int
-	LogLevel      string
-	TestDataDir   string
-	CleanupAfter  bool
-	ParallelTests bool
+	JWTSecret       string
+	ConcurrencyMode string
+	Storage         string
+	BaseURL         string
+	Timeout         time.Duration
+	RetryCount      int
+	LogLevel        string
+	TestDataDir     string
+	CleanupAfter    bool
+	ParallelTests   bool
 }
 
 // NewTestContext creates a new test context
 func NewTestContext() *TestContext {
 	config := LoadTestConfig()
 	return &TestContext{
-		UserTokens:    make(map[string]string),
-		UserTodoIDs:   make(map[string]string),
-		TodoIDByTitle: make(map[string]string),
-		Config:        config,
-		errs:          make([]error, 0),
+		UserTokens:            make(map[string]string),
+		RefreshTokens:         make(map[string]string),
+		PreviousRefreshTokens: make(map[string]string),
+		AccessExpiry:          make(map[string]time.Time),
+		UserTodoIDs:           make(map[string]string),
+		TodoIDByTitle:         make(map[string]string),
+		TOTPSecrets:           make(map[string]string),
+		RecoveryCodes:         make(map[string][]string),
+		Challenges:            make(map[string]string),
+		PersonalTokens:        make(map[string]string),
+		PersonalTokenIDs:      make(map[string]string),
+		TemporaryPasswords:    make(map[string]string),
+		Config:                config,
+		errs:                  make([]error, 0),
 	}
 }
 
 func LoadTestConfig() *TestConfig {
 	return &TestConfig{
-		JWTSecret:     getEnv("JWT_SECRET", "test-secret"),
-		BaseURL:       getEnv("TEST_BASE_URL", ""),
-		Timeout:       getDurationEnv("TEST_TIMEOUT", 30*time.Second),
-		RetryCount:    getIntEnv("TEST_RETRY_COUNT", 3),
-		LogLevel:      getEnv("TEST_LOG_LEVEL", "info"),
-		TestDataDir:   getEnv("TEST_DATA_DIR", "./testdata"),
-		CleanupAfter:  getBoolEnv("TEST_CLEANUP_AFTER", true),
-		ParallelTests: getBoolEnv("TEST_PARALLEL", false),
+		JWTSecret:       getEnv("JWT_SECRET", "test-secret"),
+		ConcurrencyMode: getEnv("TODO_CONCURRENCY", app.SafeMode),
+		Storage:         getEnv("STORAGE", app.StorageMemory),
+		BaseURL:         getEnv("TEST_BASE_URL", ""),
+		Timeout:         getDurationEnv("TEST_TIMEOUT", 30*time.Second),
+		RetryCount:      getIntEnv("TEST_RETRY_COUNT", 3),
+		LogLevel:        getEnv("TEST_LOG_LEVEL", "info"),
+		TestDataDir:     getEnv("TEST_DATA_DIR", "./testdata"),
+		CleanupAfter:    getBoolEnv("TEST_CLEANUP_AFTER", true),
+		ParallelTests:   getBoolEnv("TEST_PARALLEL", false),
 	}
 }
 
+// SetupServer starts the API on a fresh store. Set STORAGE=file or
+// STORAGE=sqlite to run the scenarios against a durable backend; its files
+// live in a temporary directory removed by CloseServer.
 func (tc *TestContext) SetupServer() error {
-	app.Init(tc.Config.JWTSecret)
-	app.Users = sync.Map{}
-	app.Todos = sync.Map{}
+	dataDir, err := os.MkdirTemp("", "todoapp-bdd-")
+	if err != nil {
+		return err
+	}
+	tc.DataDir = dataDir
+
+	tc.App, err = app.Open(app.Config{
+		JWTSecret:       tc.Config.JWTSecret,
+		ConcurrencyMode: tc.Config.ConcurrencyMode,
+		Storage:         tc.Config.Storage,
+		DataDir:         dataDir,
+		SQLitePath:      filepath.Join(dataDir, "todoapp.db"),
+		MigrateOnStart:  true,
+		RaftNodeID:      "node1",
+		RaftAddr:        "127.0.0.1:0",
+		// Cheap password hashes keep the scenarios fast
+		Argon2Memory:     1024,
+		Argon2Iterations: 1,
+	})
+	if err != nil {
+		return err
+	}
 
-	router := app.SetupRouter()
+	router := app.SetupRouter(tc.App)
 	tc.Server = httptest.NewServer(router)
 	tc.BaseURL = tc.Server.URL
 	tc.Client = &http.Client{Timeout: tc.Config.Timeout}
@@ -91,9 +147,19 @@ func (tc *TestContext) CloseServer() {
 	if tc.Server != nil {
 		tc.Server.Close()
 	}
+	if tc.App != nil {
+		tc.App.Close()
+	}
+	if tc.DataDir != "" {
+		os.RemoveAll(tc.DataDir)
+	}
 }
 
 func (tc *TestContext) MakeRequest(method, path string, body interface{}) (*http.Response, error) {
+	return tc.MakeRequestWithHeaders(method, path, body, nil)
+}
+
+func (tc *TestContext) MakeRequestWithHeaders(method, path string, body interface{}, headers map[string]string) (*http.Response, error) {
 	var buf io.Reader
 	if body != nil {
 		if strBody, ok := body.(string); ok {
@@ -118,6 +184,9 @@ func (tc *TestContext) MakeRequest(method, path string, body interface{}) (*http
 			req.Header.Set("Authorization", "Bearer "+token)
 		}
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	return tc.Client.Do(req)
 }
@@ -134,6 +203,20 @@ func (tc *TestContext) StoreUserToken(username, token string) {
 	tc.UserTokens[username] = token
 }
 
+// StoreTokenPair keeps the tokens from a login or refresh response.
+func (tc *TestContext) StoreTokenPair(username string, pair map[string]string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.UserTokens[username] = pair["token"]
+	if previous, ok := tc.RefreshTokens[username]; ok {
+		tc.PreviousRefreshTokens[username] = previous
+	}
+	tc.RefreshTokens[username] = pair["refresh_token"]
+	if expiresAt, err := time.Parse(time.RFC3339, pair["expires_at"]); err == nil {
+		tc.AccessExpiry[username] = expiresAt
+	}
+}
+
 func (tc *TestContext) GetUserToken(username string) (string, bool) {
 	tc.mutex.RLock()
 	defer tc.mutex.RUnlock()
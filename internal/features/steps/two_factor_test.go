@@ -0,0 +1,226 @@
+package steps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"todoapp/internal/app"
+)
+
+func theClockIsSetTo(ctx context.Context, value string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	now, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return ctx, err
+	}
+	tc.mutex.Lock()
+	tc.Now = now
+	tc.mutex.Unlock()
+	tc.App.Clock = func() time.Time {
+		tc.mutex.RLock()
+		defer tc.mutex.RUnlock()
+		return tc.Now
+	}
+	return ctx, nil
+}
+
+func secondsPassOnTheClock(ctx context.Context, seconds int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if tc.Now.IsZero() {
+		return ctx, fmt.Errorf("the clock has not been set")
+	}
+	tc.Now = tc.Now.Add(time.Duration(seconds) * time.Second)
+	return ctx, nil
+}
+
+// currentCode is the TOTP code of username's authenticator at the test
+// clock's time.
+func currentCode(tc *TestContext, username string) (string, error) {
+	tc.mutex.RLock()
+	secret, now := tc.TOTPSecrets[username], tc.Now
+	tc.mutex.RUnlock()
+	if secret == "" {
+		return "", fmt.Errorf("%s has not set up two-factor authentication", username)
+	}
+	return app.TOTPCode(secret, now)
+}
+
+func userSetsUpTwoFactorAuthentication(ctx context.Context, username string) (context.Context, error) {
+	ctx, err := userPosts(ctx, username, "/me/2fa/setup")
+	if err != nil {
+		return ctx, err
+	}
+	tc := GetTestContextFromContext(ctx)
+	resp := tc.GetLastResponse()
+	if resp.StatusCode != http.StatusOK {
+		return ctx, nil
+	}
+	bodyBytes, err := readBody(resp)
+	if err != nil {
+		return ctx, err
+	}
+	var setup map[string]string
+	if err := json.Unmarshal(bodyBytes, &setup); err != nil {
+		return ctx, fmt.Errorf("failed to decode setup response: %w (body: %s)", err, string(bodyBytes))
+	}
+	if setup["secret"] == "" || setup["otpauth_uri"] == "" {
+		return ctx, fmt.Errorf("expected a secret and an otpauth URI, got: %s", string(bodyBytes))
+	}
+	tc.mutex.Lock()
+	tc.TOTPSecrets[username] = setup["secret"]
+	tc.mutex.Unlock()
+	return ctx, nil
+}
+
+func confirmTwoFactor(ctx context.Context, username, code string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	tc.SetCurrentUser(username)
+	resp, err := tc.MakeRequest("POST", "/me/2fa/verify", app.TwoFactorCodeRequest{Code: code})
+	if err != nil {
+		return ctx, fmt.Errorf("failed to confirm two-factor authentication: %w", err)
+	}
+	tc.SetLastResponse(resp)
+
+	if resp.StatusCode == http.StatusOK {
+		bodyBytes, err := readBody(resp)
+		if err != nil {
+			return ctx, err
+		}
+		var verified struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}
+		if err := json.Unmarshal(bodyBytes, &verified); err != nil {
+			return ctx, fmt.Errorf("failed to decode verify response: %w (body: %s)", err, string(bodyBytes))
+		}
+		tc.mutex.Lock()
+		tc.RecoveryCodes[username] = verified.RecoveryCodes
+		tc.mutex.Unlock()
+	}
+	return ctx, nil
+}
+
+func userConfirmsTwoFactorAuthenticationWithAValidCode(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	code, err := currentCode(tc, username)
+	if err != nil {
+		return ctx, err
+	}
+	return confirmTwoFactor(ctx, username, code)
+}
+
+func userConfirmsTwoFactorAuthenticationWithTheCode(ctx context.Context, username, code string) (context.Context, error) {
+	if GetTestContextFromContext(ctx) == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	return confirmTwoFactor(ctx, username, code)
+}
+
+func userShouldHaveRecoveryCodes(ctx context.Context, username string, count int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	codes := tc.RecoveryCodes[username]
+	tc.mutex.RUnlock()
+	if len(codes) != count {
+		return ctx, fmt.Errorf("expected %d recovery codes, got %d", count, len(codes))
+	}
+	return ctx, nil
+}
+
+func iShouldReceiveATwoFactorChallengeInsteadOfAToken(ctx context.Context) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	bodyBytes, err := readBody(tc.GetLastResponse())
+	if err != nil {
+		return ctx, err
+	}
+	var body map[string]string
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return ctx, fmt.Errorf("failed to decode login response: %w (body: %s)", err, string(bodyBytes))
+	}
+	if body["challenge_token"] == "" || body["token"] != "" {
+		return ctx, fmt.Errorf("expected a challenge token and no access token, got: %s", string(bodyBytes))
+	}
+	return ctx, nil
+}
+
+func completeLogin(ctx context.Context, username, code string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	tc.mutex.RLock()
+	challenge := tc.Challenges[username]
+	tc.mutex.RUnlock()
+	if challenge == "" {
+		return ctx, fmt.Errorf("%s has no pending two-factor challenge", username)
+	}
+
+	resp, err := tc.MakeRequest("POST", "/login/2fa", app.TwoFactorLoginRequest{ChallengeToken: challenge, Code: code})
+	if err != nil {
+		return ctx, fmt.Errorf("failed to complete login: %w", err)
+	}
+	tc.SetLastResponse(resp)
+
+	if resp.StatusCode == http.StatusOK {
+		bodyBytes, err := readBody(resp)
+		if err != nil {
+			return ctx, err
+		}
+		var pair map[string]string
+		if err := json.Unmarshal(bodyBytes, &pair); err != nil {
+			return ctx, fmt.Errorf("failed to decode login response: %w (body: %s)", err, string(bodyBytes))
+		}
+		tc.StoreTokenPair(username, pair)
+		tc.SetCurrentUser(username)
+	}
+	return ctx, nil
+}
+
+func iCompleteTheLoginOfWithAValidCode(ctx context.Context, username string) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	code, err := currentCode(tc, username)
+	if err != nil {
+		return ctx, err
+	}
+	return completeLogin(ctx, username, code)
+}
+
+func iCompleteTheLoginOfWithTheCode(ctx context.Context, username, code string) (context.Context, error) {
+	if GetTestContextFromContext(ctx) == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	return completeLogin(ctx, username, code)
+}
+
+func iCompleteTheLoginOfWithRecoveryCode(ctx context.Context, username string, n int) (context.Context, error) {
+	tc := GetTestContextFromContext(ctx)
+	if tc == nil {
+		return ctx, fmt.Errorf("test context not found")
+	}
+	tc.mutex.RLock()
+	codes := tc.RecoveryCodes[username]
+	tc.mutex.RUnlock()
+	if n < 1 || n > len(codes) {
+		return ctx, fmt.Errorf("%s has no recovery code %d", username, n)
+	}
+	return completeLogin(ctx, username, codes[n-1])
+}
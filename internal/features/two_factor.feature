@@ -0,0 +1,79 @@
+Feature: Two-Factor Authentication
+  In order to keep my account safe even if my password leaks
+  As a user
+  I want to confirm my logins with a code from an authenticator app
+
+  Background:
+    Given the secret key "test-secret" is set up
+    And the clock is set to "2026-10-16T12:00:00Z"
+    And a user named "alice" with password "password123" is registered
+    And user "alice" logs in with password "password123" successfully
+
+  Scenario: Enabling two-factor authentication
+    When user "alice" sets up two-factor authentication
+    Then the response status should be 200
+    When user "alice" confirms two-factor authentication with a valid code
+    Then the response status should be 200
+    And user "alice" should have 10 recovery codes
+
+  Scenario: Confirming with a wrong code leaves two-factor authentication off
+    Given user "alice" sets up two-factor authentication
+    When user "alice" confirms two-factor authentication with the code "000000"
+    Then I should receive an error message "Invalid code"
+    And the response status should be 400
+    When I login with username "alice" and password "password123"
+    Then I should receive a valid JWT token
+
+  Scenario: Enabling twice is refused
+    Given user "alice" sets up two-factor authentication
+    And user "alice" confirms two-factor authentication with a valid code
+    When user "alice" sets up two-factor authentication
+    Then I should receive an error message "Two-factor authentication already enabled"
+    And the response status should be 409
+
+  Scenario: Logging in takes a code once two-factor authentication is on
+    Given user "alice" sets up two-factor authentication
+    And user "alice" confirms two-factor authentication with a valid code
+    When I login with username "alice" and password "password123"
+    Then I should receive a two-factor challenge instead of a token
+    And the response status should be 200
+    When 30 seconds pass on the clock
+    And I complete the login of "alice" with a valid code
+    Then I should receive a valid JWT token
+    And user "alice" should be able to access their todos
+
+  Scenario: A code works only once
+    Given user "alice" sets up two-factor authentication
+    And user "alice" confirms two-factor authentication with a valid code
+    When I login with username "alice" and password "password123"
+    And I complete the login of "alice" with a valid code
+    Then I should receive an error message "Invalid code"
+    And the response status should be 401
+
+  Scenario: A wrong code is rejected
+    Given user "alice" sets up two-factor authentication
+    And user "alice" confirms two-factor authentication with a valid code
+    When I login with username "alice" and password "password123"
+    And I complete the login of "alice" with the code "123456"
+    Then I should receive an error message "Invalid code"
+    And the response status should be 401
+
+  Scenario: A recovery code stands in for a lost authenticator, once
+    Given user "alice" sets up two-factor authentication
+    And user "alice" confirms two-factor authentication with a valid code
+    When I login with username "alice" and password "password123"
+    And I complete the login of "alice" with recovery code 1
+    Then I should receive a valid JWT token
+    When I login with username "alice" and password "password123"
+    And I complete the login of "alice" with recovery code 1
+    Then I should receive an error message "Invalid code"
+    And the response status should be 401
+
+  Scenario: An expired challenge is rejected
+    Given user "alice" sets up two-factor authentication
+    And user "alice" confirms two-factor authentication with a valid code
+    When I login with username "alice" and password "password123"
+    And 600 seconds pass on the clock
+    And I complete the login of "alice" with a valid code
+    Then I should receive an error message "Invalid challenge"
+    And the response status should be 401
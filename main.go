@@ -1,21 +1,168 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"todoapp/internal/app"
 )
 
 func main() {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Fatal("JWT_SECRET environment variable required")
+	cfg := app.LoadConfig()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrate(cfg)
+		case "restore":
+			if len(os.Args) != 3 {
+				log.Fatal("usage: todoapp restore <file>")
+			}
+			restore(cfg, os.Args[2])
+		case "fsck":
+			fsck(cfg, os.Args[2:])
+		default:
+			log.Fatalf("unknown command %q (commands: migrate, restore, fsck)", os.Args[1])
+		}
+		return
+	}
+
+	serve(cfg)
+}
+
+// serve runs the HTTP API until SIGINT or SIGTERM.
+func serve(cfg app.Config) {
+	if cfg.JWTSecret == "" && len(cfg.JWTKeys) == 0 {
+		log.Fatal("JWT_SECRET or JWT_KEYS environment variable required")
+	}
+
+	a, err := app.Open(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := a.BootstrapAdmin(); err != nil {
+		a.Close()
+		log.Fatal(err)
+	}
+
+	// The purger permanently removes todos that outlived TRASH_RETENTION
+	purgeCtx, stopPurger := context.WithCancel(context.Background())
+	purgerDone := make(chan struct{})
+	go func() {
+		defer close(purgerDone)
+		if cfg.PurgeInterval > 0 {
+			a.RunPurger(purgeCtx, cfg.PurgeInterval)
+		}
+	}()
+
+	srv := &http.Server{Addr: ":8080", Handler: app.SetupRouter(a)}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a shutdown signal so durable stores are closed cleanly
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	stopPurger()
+	<-purgerDone
+	if err := a.Close(); err != nil {
+		log.Printf("close storage: %v", err)
+	}
+}
+
+// migrate applies pending SQLite schema migrations to SQLITE_PATH.
+func migrate(cfg app.Config) {
+	db, err := app.OpenSQLiteDB(cfg.SQLitePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	applied, err := app.Migrate(db)
+	for _, m := range applied {
+		fmt.Printf("applied %s\n", m.Name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := app.SchemaVersion(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s is at schema version %d\n", cfg.SQLitePath, version)
+}
+
+// restore loads a backup archive into the configured storage backend, which
+// must not hold any users yet.
+func restore(cfg app.Config, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	d, err := app.ReadBackup(f)
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
 	}
-	app.Init(secret)
 
-	r := app.SetupRouter()
-	if err := r.Run(":8080"); err != nil {
+	a, err := app.Open(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sum, err := app.RestoreBackup(a.Stores, d)
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
+	fmt.Printf("restored %d users, %d todos and %d revisions into %s storage\n", sum.Users, sum.Todos, sum.Revisions, cfg.Storage)
+}
+
+// fsck checks the configured storage backend for broken invariants and,
+// with --repair, fixes them. It exits non-zero while problems remain.
+func fsck(cfg app.Config, args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems found")
+	flags.Parse(args)
+
+	a, err := app.Open(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := app.Fsck(a.Stores, time.Now().UTC(), *repair)
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	remaining := report.Unrepaired()
+	fmt.Printf("checked %d users and %d todos: %d problems, %d repaired\n",
+		report.Users, report.Todos, len(report.Problems), len(report.Problems)-remaining)
+	if remaining > 0 {
+		os.Exit(1)
+	}
 }